@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/binary"
+	"errors"
 	"log"
 	"math/rand"
 	"netsim/protocol"
@@ -10,7 +11,8 @@ import (
 
 // L3 constants
 var (
-	AF_INET = 0
+	AF_INET  = 0
+	AF_INET6 = 1
 )
 
 // L4 constants
@@ -25,6 +27,27 @@ const (
 	TCP = 1
 )
 
+// Socket options
+var (
+	IP_MULTICAST_TTL   = 0
+	IP_ADD_MEMBERSHIP  = 1
+	IP_DROP_MEMBERSHIP = 2
+	IP_TOS             = 3
+)
+
+const (
+	defaultMulticastTTL = 1
+)
+
+/*
+Errors returned when setting a socket option
+*/
+var (
+	ErrInvalidArgument    = errors.New("invalid argument")
+	ErrOptionNotSupported = errors.New("protocol not available")
+	ErrNotBound           = errors.New("socket not bound")
+)
+
 /*
 Socket is a high level API that abstracts the protocol being used and offers a uniform interface for applications to
 talk to the network. Though it is a (very) leaky abstraction, but still very useful.
@@ -37,12 +60,15 @@ type Socket struct {
 	tcpBinding    *l4.TcpBinding
 	tcpConnection *l4.TcpConnection
 	data          []byte
+	multicastTTL  byte
+	tos           byte
 }
 
 func NewSocket(host Host, domain int, channelType int, protocol int) *Socket {
 	s := &Socket{
-		host:        host,
-		networkType: domain,
+		host:         host,
+		networkType:  domain,
+		multicastTTL: defaultMulticastTTL,
 	}
 
 	if channelType == SOCK_DGRAM && protocol == 0 {
@@ -63,6 +89,8 @@ func newClientSocket(listeningSocket *Socket, tcpConnection *l4.TcpConnection) *
 		networkType:   listeningSocket.networkType,
 		tcpBinding:    listeningSocket.tcpBinding,
 		tcpConnection: tcpConnection,
+		multicastTTL:  defaultMulticastTTL,
+		tos:           listeningSocket.tos,
 	}
 
 	return s
@@ -72,16 +100,16 @@ func newClientSocket(listeningSocket *Socket, tcpConnection *l4.TcpConnection) *
 The Socket API
 */
 func (s *Socket) Bind(ipAddr []byte, port uint16) {
-	var networkProtocolIdentifier []byte
-	if s.networkType == AF_INET {
-		networkProtocolIdentifier = protocol.IP
-	}
+	networkProtocolIdentifier := s.getNetworkProtocol()
 
 	if s.sockType == UDP {
 		s.udpBinding = s.host.GetUDP().Bind(ipAddr, port, networkProtocolIdentifier)
 	}
 	if s.sockType == TCP {
 		s.tcpBinding = s.host.GetTCP().Bind(ipAddr, port, networkProtocolIdentifier)
+		if s.tcpBinding != nil {
+			s.tcpBinding.SetTos(s.tos)
+		}
 	}
 }
 
@@ -105,7 +133,7 @@ func (s *Socket) Connect(destAddr []byte, destPort uint16) {
 	if s.sockType == TCP {
 		if s.tcpBinding == nil {
 			randomPort := s.getRandomPort()
-			s.Bind([]byte{0, 0, 0, 0}, randomPort)
+			s.Bind(s.getUnspecifiedAddress(), randomPort)
 		}
 		s.tcpConnection = s.tcpBinding.Connect(destAddr, destPort)
 	}
@@ -125,9 +153,14 @@ func (s *Socket) SendTo(destAddr []byte, destPort uint16, srcPort *uint16, data
 		binary.BigEndian.PutUint16(metadata[2:4], *srcPort)
 
 		//Populate the network protocol
-		if s.networkType == AF_INET {
-			metadata = append(metadata, protocol.IP...)
+		metadata = append(metadata, s.getNetworkProtocol()...)
+
+		//Multicasts do not go beyond the link unless asked to
+		ttl := byte(l4.DefaultTTL)
+		if isMulticastAddress(destAddr) {
+			ttl = s.multicastTTL
 		}
+		metadata = append(metadata, l4.AnyInterface, ttl, s.tos)
 
 		//Send the packet
 		s.host.GetUDP().SendDown(data, destAddr, metadata, nil)
@@ -140,6 +173,11 @@ func (s *Socket) SendTo(destAddr []byte, destPort uint16, srcPort *uint16, data
 
 func (s *Socket) Send(data []byte) {
 	if s.sockType == TCP {
+		if s.tcpConnection == nil {
+			log.Printf("Socket: Not connected")
+			return
+		}
+
 		for _, b := range data {
 			s.tcpConnection.Send(b)
 		}
@@ -195,6 +233,11 @@ func (s *Socket) Recv(maxBytes int) []byte {
 	}
 
 	if s.sockType == TCP {
+		if s.tcpConnection == nil {
+			log.Printf("Socket: Not connected")
+			return nil
+		}
+
 		data := make([]byte, 0, maxBytes)
 		for len(data) < maxBytes {
 			b := s.tcpConnection.Recv()
@@ -209,6 +252,91 @@ func (s *Socket) Recv(maxBytes int) []byte {
 	return nil
 }
 
+/*
+Returns the pending error on the socket, like the packets sent being reported as undeliverable, or the connection attempt
+failing. Connect leaves the socket unconnected if it fails.
+*/
+func (s *Socket) GetError() error {
+	if s.sockType == UDP && s.udpBinding != nil {
+		return s.udpBinding.GetError()
+	}
+
+	if s.sockType == TCP {
+		if s.tcpConnection != nil {
+			return s.tcpConnection.GetError()
+		}
+		if s.tcpBinding != nil {
+			return s.tcpBinding.GetError()
+		}
+	}
+
+	return nil
+}
+
+/*
+Options for multicast on UDP sockets. The TTL of the packets sent to groups is set with IP_MULTICAST_TTL and a 1 byte
+value. Groups are joined with IP_ADD_MEMBERSHIP and left with IP_DROP_MEMBERSHIP, whose value is the address of the group
+optionally followed by the address of the interface to use. The socket has to be bound to join a group.
+The TOS of the packets sent is set with IP_TOS and a 1 byte value, with the DSCP in its upper 6 bits. It works on TCP
+sockets too, where it applies to the connection of the socket, or on a listening socket to the connections it accepts
+later, which start with its TOS.
+Returns ErrInvalidArgument if the value does not have the length the option expects, and ErrOptionNotSupported for
+unknown options or options the socket type does not have.
+*/
+func (s *Socket) SetSockOpt(option int, value []byte) error {
+	if option == IP_TOS {
+		if len(value) < 1 {
+			return ErrInvalidArgument
+		}
+		s.tos = value[0]
+		if s.tcpConnection != nil {
+			s.tcpConnection.SetTos(s.tos)
+		} else if s.tcpBinding != nil {
+			s.tcpBinding.SetTos(s.tos)
+		}
+		return nil
+	}
+
+	if s.sockType != UDP {
+		log.Printf("Socket: Option %d is only supported on UDP sockets", option)
+		return ErrOptionNotSupported
+	}
+
+	switch option {
+	case IP_MULTICAST_TTL:
+		if len(value) < 1 {
+			return ErrInvalidArgument
+		}
+		s.multicastTTL = value[0]
+	case IP_ADD_MEMBERSHIP, IP_DROP_MEMBERSHIP:
+		//The value is the group address, optionally followed by the address of the interface
+		n := len(s.getUnspecifiedAddress())
+		if len(value) != n && len(value) != 2*n {
+			return ErrInvalidArgument
+		}
+		if s.udpBinding == nil {
+			log.Printf("Socket: Not bound to any address")
+			return ErrNotBound
+		}
+
+		group := value[:n]
+		var intfAddr []byte
+		if len(value) == 2*n {
+			intfAddr = value[n:]
+		}
+
+		if option == IP_ADD_MEMBERSHIP {
+			s.udpBinding.JoinGroup(group, intfAddr)
+		} else {
+			s.udpBinding.LeaveGroup(group, intfAddr)
+		}
+	default:
+		log.Printf("Socket: Unknown option %d", option)
+		return ErrOptionNotSupported
+	}
+	return nil
+}
+
 func (s *Socket) Close() {
 	if s.sockType == UDP {
 		s.udpBinding.Close()
@@ -222,16 +350,37 @@ func (s *Socket) Close() {
 /*
 Internal methods
 */
+func (s *Socket) getNetworkProtocol() []byte {
+	if s.networkType == AF_INET6 {
+		return protocol.IPv6
+	}
+	return protocol.IP
+}
+
+func (s *Socket) getUnspecifiedAddress() []byte {
+	if s.networkType == AF_INET6 {
+		return make([]byte, 16)
+	}
+	return []byte{0, 0, 0, 0}
+}
+
+func isMulticastAddress(addr []byte) bool {
+	if len(addr) == 16 {
+		return addr[0] == 0xFF
+	}
+	return addr[0]&0xF0 == 0xE0
+}
+
 func (s *Socket) getRandomPort() uint16 {
 	for {
 		port := uint16(rand.Intn(65536))
 		if s.sockType == UDP {
-			if !s.host.GetUDP().IsPortInUse(port) {
+			if !s.host.GetUDP().IsPortInUseForProtocol(port, s.getNetworkProtocol()) {
 				return port
 			}
 		}
 		if s.sockType == TCP {
-			if !s.host.GetTCP().IsPortInUse(port) {
+			if !s.host.GetTCP().IsPortInUseForProtocol(port, s.getNetworkProtocol()) {
 				return port
 			}
 		}
@@ -161,3 +161,45 @@ func TestTCP(t *testing.T) {
 
 	time.Sleep(10 * time.Second)
 }
+
+func TestSetSockOpt(t *testing.T) {
+	udpSocket := NewSocket(nil, AF_INET, SOCK_DGRAM, 0)
+	tcpSocket := NewSocket(nil, AF_INET, SOCK_STREAM, 0)
+
+	//Values too short or too long are rejected instead of being read past their end
+	for _, option := range []int{IP_TOS, IP_MULTICAST_TTL, IP_ADD_MEMBERSHIP, IP_DROP_MEMBERSHIP} {
+		if err := udpSocket.SetSockOpt(option, nil); err != ErrInvalidArgument {
+			t.Errorf("Expected option %d with an empty value to be rejected but got %v", option, err)
+		}
+	}
+	if err := udpSocket.SetSockOpt(IP_ADD_MEMBERSHIP, []byte{224, 0, 0}); err != ErrInvalidArgument {
+		t.Errorf("Expected a truncated group address to be rejected but got %v", err)
+	}
+	if err := udpSocket.SetSockOpt(IP_ADD_MEMBERSHIP, []byte{224, 0, 0, 1, 10, 0}); err != ErrInvalidArgument {
+		t.Errorf("Expected a truncated interface address to be rejected but got %v", err)
+	}
+
+	if err := udpSocket.SetSockOpt(IP_ADD_MEMBERSHIP, []byte{224, 0, 0, 1}); err != ErrNotBound {
+		t.Errorf("Expected joining a group on an unbound socket to fail but got %v", err)
+	}
+	if err := udpSocket.SetSockOpt(IP_MULTICAST_TTL, []byte{0}); err != nil || udpSocket.multicastTTL != 0 {
+		t.Errorf("Expected the multicast TTL to be set but got %v", err)
+	}
+	if err := tcpSocket.SetSockOpt(IP_TOS, []byte{0xB8}); err != nil || tcpSocket.tos != 0xB8 {
+		t.Errorf("Expected the TOS to be set but got %v", err)
+	}
+	//Accepted sockets start with the TOS of the listening socket and change their connection only
+	clientSocket := newClientSocket(tcpSocket, &l4.TcpConnection{})
+	if clientSocket.tos != 0xB8 || clientSocket.multicastTTL != defaultMulticastTTL {
+		t.Errorf("Expected the accepted socket to inherit the TOS but got %#x", clientSocket.tos)
+	}
+	if err := clientSocket.SetSockOpt(IP_TOS, []byte{0x10}); err != nil || tcpSocket.tos != 0xB8 {
+		t.Errorf("Expected the TOS of the listening socket to be kept but got %#x", tcpSocket.tos)
+	}
+	if err := tcpSocket.SetSockOpt(IP_MULTICAST_TTL, []byte{1}); err != ErrOptionNotSupported {
+		t.Errorf("Expected multicast options to be refused on TCP sockets but got %v", err)
+	}
+	if err := udpSocket.SetSockOpt(42, []byte{1}); err != ErrOptionNotSupported {
+		t.Errorf("Expected unknown options to be refused but got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package apps
+
+import (
+	"bytes"
+	"netsim/devices"
+	"netsim/hardware"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"testing"
+	"time"
+)
+
+/*
+Testcase
+*/
+func TestPingAndTraceroute(t *testing.T) {
+	computer1 := devices.NewComputer([]byte("appsc1"), []byte{10, 0, 1, 2})
+	computer1.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 1, 1})
+	computer2 := devices.NewComputer([]byte("appsc2"), []byte{10, 0, 2, 2})
+	computer2.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 2, 1})
+
+	routeProvider1 := l3.NewStaticRouteProvider()
+	routeProvider1.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 2}, Mask: 32}, []byte{10, 0, 1, 2}, 0)
+	routeProvider1.Add(protocol.DefaultRouteCidr, []byte{10, 0, 12, 2}, 1)
+	router1 := devices.NewRouter([][]byte{[]byte("appsr1"), []byte("appsr2")}, [][]byte{{10, 0, 1, 1}, {10, 0, 12, 1}}, routeProvider1, l3.NewARP())
+
+	routeProvider2 := l3.NewStaticRouteProvider()
+	routeProvider2.Add(&protocol.CIDR{Address: []byte{10, 0, 2, 2}, Mask: 32}, []byte{10, 0, 2, 2}, 1)
+	routeProvider2.Add(protocol.DefaultRouteCidr, []byte{10, 0, 12, 1}, 0)
+	router2 := devices.NewRouter([][]byte{[]byte("appsr3"), []byte("appsr4")}, [][]byte{{10, 0, 12, 2}, {10, 0, 2, 1}}, routeProvider2, l3.NewARP())
+
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, computer1.GetAdapter(), router1.GetL3Protocol().GetL2ProtocolForInterface(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, router1.GetL3Protocol().GetL2ProtocolForInterface(1).GetAdapter(), router2.GetL3Protocol().GetL2ProtocolForInterface(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, router2.GetL3Protocol().GetL2ProtocolForInterface(1).GetAdapter(), computer2.GetAdapter())
+
+	go hardware.Clk.Start()
+	computer1.TurnOn()
+	computer2.TurnOn()
+	router1.TurnOn()
+	router2.TurnOn()
+
+	pingDone := make(chan *PingStatistics)
+	computer1.Run(func(computer *devices.Computer) {
+		pingDone <- Ping(computer, []byte{10, 0, 2, 2}, 3, time.Second, 56)
+	})
+
+	stats := <-pingDone
+	if stats.Sent != 3 || stats.Received != 3 || stats.Loss != 0 {
+		t.Errorf("Expected all pings to be answered but got %d of %d", stats.Received, stats.Sent)
+	}
+	if stats.MinRtt <= 0 || stats.MinRtt > stats.AvgRtt || stats.AvgRtt > stats.MaxRtt {
+		t.Errorf("Got inconsistent round trip times %v/%v/%v", stats.MinRtt, stats.AvgRtt, stats.MaxRtt)
+	}
+
+	tracerouteDone := make(chan []*TracerouteHop)
+	computer1.Run(func(computer *devices.Computer) {
+		tracerouteDone <- Traceroute(computer, []byte{10, 0, 2, 2})
+	})
+
+	hops := <-tracerouteDone
+	expected := [][]byte{{10, 0, 1, 1}, {10, 0, 12, 2}, {10, 0, 2, 2}}
+	if len(hops) != len(expected) {
+		t.Fatalf("Expected %d hops but got %d", len(expected), len(hops))
+	}
+	for i, hop := range hops {
+		if !bytes.Equal(hop.Address, expected[i]) || len(hop.Rtts) != probesPerHop {
+			t.Errorf("Hop %d: Expected %v but got %v with %d answers", hop.Ttl, expected[i], hop.Address, len(hop.Rtts))
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package apps
+
+import (
+	"log"
+	"math/rand"
+	"netsim/protocol/l3"
+	"time"
+)
+
+/*
+Ping checks if a host is reachable by sending it ICMP echo requests and waiting for the replies. The time taken by each
+reply to arrive is the round trip time to the host. Requests which do not get a reply before the next one is sent, or
+within the timeout after the last one, are counted as lost.
+Ping and the other tools here can run on any device which has ICMP, normally using Computer.Run.
+*/
+const (
+	defaultTTL   = 64
+	replyTimeout = 2 * time.Second
+)
+
+type IcmpHost interface {
+	GetICMP() *l3.ICMP
+}
+
+type PingStatistics struct {
+	Sent     int
+	Received int
+	Loss     float64
+	MinRtt   time.Duration
+	AvgRtt   time.Duration
+	MaxRtt   time.Duration
+	Rtts     []time.Duration
+	Errors   []error
+}
+
+func Ping(host IcmpHost, dst []byte, count int, interval time.Duration, size int) *PingStatistics {
+	binding := bind(host.GetICMP())
+	defer binding.Close()
+
+	stats := &PingStatistics{}
+	sentAt := map[uint16]time.Time{}
+	payload := make([]byte, size)
+
+	for seq := 1; seq <= count; seq++ {
+		sentAt[uint16(seq)] = time.Now()
+		binding.SendEcho(dst, uint16(seq), payload, defaultTTL, 0)
+		stats.Sent++
+
+		//Wait for the replies until the next request is due, or for the timeout after the last request
+		wait := interval
+		if seq == count {
+			wait = replyTimeout
+		}
+		deadline := time.Now().Add(wait)
+		for {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				break
+			}
+
+			m := binding.Recv(remaining)
+			if m == nil {
+				break
+			}
+
+			start, ok := sentAt[m.Seq]
+			if !ok {
+				continue
+			}
+			delete(sentAt, m.Seq)
+
+			if m.Err != nil {
+				log.Printf("Ping: From %v seq=%d: %v", m.Source, m.Seq, m.Err)
+				stats.Errors = append(stats.Errors, m.Err)
+				continue
+			}
+
+			rtt := m.ReceivedAt.Sub(start)
+			log.Printf("Ping: %d bytes from %v: seq=%d time=%v", len(m.Data), m.Source, m.Seq, rtt)
+			stats.Rtts = append(stats.Rtts, rtt)
+		}
+	}
+
+	stats.compute()
+	return stats
+}
+
+/*
+Internal methods
+*/
+func (s *PingStatistics) compute() {
+	s.Received = len(s.Rtts)
+	if s.Sent > 0 {
+		s.Loss = float64(s.Sent-s.Received) * 100 / float64(s.Sent)
+	}
+
+	var total time.Duration
+	for i, rtt := range s.Rtts {
+		if i == 0 || rtt < s.MinRtt {
+			s.MinRtt = rtt
+		}
+		if rtt > s.MaxRtt {
+			s.MaxRtt = rtt
+		}
+		total += rtt
+	}
+	if s.Received > 0 {
+		s.AvgRtt = total / time.Duration(s.Received)
+	}
+}
+
+/*
+Bind to a random unused identifier, so that multiple tools can run on the same host together
+*/
+func bind(icmp *l3.ICMP) *l3.IcmpBinding {
+	for {
+		id := uint16(rand.Intn(65536))
+		if !icmp.IsIdInUse(id) {
+			return icmp.Bind(id)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package apps
+
+import (
+	"log"
+	"netsim/protocol"
+	"time"
+)
+
+/*
+Traceroute finds the routers on the path to a host. It sends ICMP echo requests with increasing TTLs, starting at 1.
+The router at which the TTL of a request runs out reports back with a time exceeded message, which tells us its address.
+This goes on until the host itself replies, the host is reported unreachable, or the maximum number of hops is reached.
+A few requests are sent for each TTL, hops which do not answer any of them are returned without an address.
+*/
+const (
+	maxHops        = 30
+	probesPerHop   = 3
+	tracerouteSize = 32
+)
+
+type TracerouteHop struct {
+	Ttl     int
+	Address []byte
+	Rtts    []time.Duration
+	Err     error
+}
+
+func Traceroute(host IcmpHost, dst []byte) []*TracerouteHop {
+	binding := bind(host.GetICMP())
+	defer binding.Close()
+
+	var hops []*TracerouteHop
+	payload := make([]byte, tracerouteSize)
+	seq := uint16(0)
+
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		hop := &TracerouteHop{Ttl: ttl}
+		done := false
+
+		for probe := 0; probe < probesPerHop; probe++ {
+			seq++
+			sentAt := time.Now()
+			binding.SendEcho(dst, seq, payload, byte(ttl), 0)
+
+			//Wait for the answer to this probe, skipping late answers to the earlier ones
+			deadline := sentAt.Add(replyTimeout)
+			for {
+				remaining := time.Until(deadline)
+				if remaining <= 0 {
+					break
+				}
+
+				m := binding.Recv(remaining)
+				if m == nil {
+					break
+				}
+				if m.Seq != seq {
+					continue
+				}
+
+				hop.Address = m.Source
+				hop.Rtts = append(hop.Rtts, m.ReceivedAt.Sub(sentAt))
+				if m.Err != protocol.ErrTTLExceeded {
+					//Either the host replied, or it cannot be reached. Nothing beyond this.
+					hop.Err = m.Err
+					done = true
+				}
+				break
+			}
+		}
+
+		log.Printf("Traceroute: %d %v %v", hop.Ttl, hop.Address, hop.Rtts)
+		hops = append(hops, hop)
+		if done {
+			break
+		}
+	}
+
+	return hops
+}
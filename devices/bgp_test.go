@@ -0,0 +1,149 @@
+package devices
+
+import (
+	"bytes"
+	"log"
+	"netsim/hardware"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"netsim/protocol/routing"
+	"testing"
+	"time"
+)
+
+/*
+Testcase
+*/
+func TestBgp(t *testing.T) {
+	//Three ASes, each with one router, all connected to each other. AS 100 and AS 300 have a computer each.
+	computer1 := NewComputer([]byte("bgpc01"), []byte{10, 1, 0, 2})
+	computer1.AddRoute(protocol.DefaultRouteCidr, []byte{10, 1, 0, 1})
+	computer3 := NewComputer([]byte("bgpc03"), []byte{10, 3, 0, 2})
+	computer3.AddRoute(protocol.DefaultRouteCidr, []byte{10, 3, 0, 1})
+
+	newRouter := func(name string, addrs [][]byte, masks []int) (*Router, *l3.RoutingTable) {
+		table := l3.NewRoutingTable()
+		var macs [][]byte
+		for i, addr := range addrs {
+			macs = append(macs, []byte{name[0], name[1], name[2], name[3], name[4], byte('0' + i)})
+			table.Add(&protocol.CIDR{Address: addr, Mask: masks[i]}, nil, i)
+		}
+		return NewRouter(macs, addrs, table, l3.NewARP()), table
+	}
+	router1, table1 := newRouter("bgpr1", [][]byte{{10, 1, 0, 1}, {10, 12, 0, 1}, {10, 13, 0, 1}}, []int{16, 24, 24})
+	router2, _ := newRouter("bgpr2", [][]byte{{10, 12, 0, 2}, {10, 23, 0, 2}}, []int{24, 24})
+	router3, _ := newRouter("bgpr3", [][]byte{{10, 13, 0, 3}, {10, 23, 0, 3}, {10, 3, 0, 1}}, []int{24, 24, 16})
+
+	adapter := func(r *Router, intfNum int) hardware.Adapter {
+		return r.GetL3Protocol().GetL2ProtocolForInterface(intfNum).GetAdapter()
+	}
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, computer1.GetAdapter(), adapter(router1, 0))
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, adapter(router1, 1), adapter(router2, 0))
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, adapter(router1, 2), adapter(router3, 0))
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, adapter(router2, 1), adapter(router3, 1))
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, adapter(router3, 2), computer3.GetAdapter())
+
+	go hardware.Clk.Start()
+	computer1.TurnOn()
+	computer3.TurnOn()
+	router1.TurnOn()
+	router2.TurnOn()
+	router3.TurnOn()
+
+	//AS 100 prefers to go through AS 200, and AS 300 does not take anything more specific than a /16 from AS 200
+	bgp1 := router1.EnableBgp(100, []byte{1, 1, 1, 1})
+	bgp2 := router2.EnableBgp(200, []byte{2, 2, 2, 2})
+	bgp3 := router3.EnableBgp(300, []byte{3, 3, 3, 3})
+	for _, bgp := range []*routing.BGP{bgp1, bgp2, bgp3} {
+		bgp.SetTimers(6*time.Second, time.Second)
+	}
+	bgp1.AddNetwork(&protocol.CIDR{Address: []byte{10, 1, 0, 0}, Mask: 16})
+	bgp1.AddNeighbor(&routing.BgpNeighbor{Address: []byte{10, 12, 0, 2}, As: 200, Import: func(path *routing.BgpPath) bool {
+		path.LocalPref = 200
+		return true
+	}})
+	bgp1.AddNeighbor(&routing.BgpNeighbor{Address: []byte{10, 13, 0, 3}, As: 300})
+	bgp2.AddNeighbor(&routing.BgpNeighbor{Address: []byte{10, 12, 0, 1}, As: 100})
+	bgp2.AddNeighbor(&routing.BgpNeighbor{Address: []byte{10, 23, 0, 3}, As: 300})
+	bgp3.AddNetwork(&protocol.CIDR{Address: []byte{10, 3, 0, 0}, Mask: 16})
+	bgp3.AddNeighbor(&routing.BgpNeighbor{Address: []byte{10, 13, 0, 1}, As: 100})
+	bgp3.AddNeighbor(&routing.BgpNeighbor{Address: []byte{10, 23, 0, 2}, As: 200, Import: func(path *routing.BgpPath) bool {
+		return path.Prefix.Mask <= 16
+	}})
+
+	bestPath := func(bgp *routing.BGP, prefix []byte) *routing.BgpPath {
+		for _, path := range bgp.GetBestPaths() {
+			if bytes.Equal(path.Prefix.Address, prefix) {
+				return path
+			}
+		}
+		return nil
+	}
+	//Waits until the best path to the prefix is through the AS
+	waitForPath := func(bgp *routing.BGP, prefix []byte, as uint16) {
+		for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			if path := bestPath(bgp, prefix); path != nil && len(path.AsPath) > 0 && path.AsPath[0] == as {
+				return
+			}
+		}
+	}
+
+	log.Printf("Testcase: Converging")
+	waitForPath(bgp1, []byte{10, 3, 0, 0}, 200)
+	waitForPath(bgp3, []byte{10, 1, 0, 0}, 100)
+
+	//Local preference wins over the shorter path
+	if path := bestPath(bgp1, []byte{10, 3, 0, 0}); path == nil || len(path.AsPath) != 2 || path.AsPath[0] != 200 || path.AsPath[1] != 300 {
+		t.Fatalf("Expected path through AS 200 to be preferred but got %v", path)
+	}
+	if path := bestPath(bgp2, []byte{10, 1, 0, 0}); path == nil || len(path.AsPath) != 1 || path.AsPath[0] != 100 {
+		t.Errorf("Expected shortest path to AS 100 but got %v", path)
+	}
+
+	//Paths for its own prefix come back to AS 100 through the other ASes, and are dropped
+	if paths := bgp1.GetPaths(&protocol.CIDR{Address: []byte{10, 1, 0, 0}, Mask: 16}); len(paths) != 1 || paths[0].From != nil {
+		t.Errorf("Expected only the local path for own prefix but got %d paths", len(paths))
+	}
+
+	log.Printf("Testcase: Ping across the ASes")
+	binding := computer1.GetICMP().Bind(1)
+	var reply *l3.IcmpMessage
+	for seq := uint16(1); seq <= 3 && reply == nil; seq++ {
+		binding.SendEcho([]byte{10, 3, 0, 2}, seq, []byte("ping"), 64, 0)
+		reply = binding.Recv(5 * time.Second)
+	}
+	if reply == nil || reply.Type != l3.IcmpEchoReply {
+		t.Errorf("Expected a reply from the far computer")
+	}
+
+	//AS 200 hijacks a part of the prefix of AS 300. AS 100 believes it, AS 300 filters it.
+	log.Printf("Testcase: Hijack")
+	hijacked := &protocol.CIDR{Address: []byte{10, 3, 5, 0}, Mask: 24}
+	bgp2.AddNetwork(hijacked)
+	waitForPath(bgp1, []byte{10, 3, 5, 0}, 200)
+	if path := bestPath(bgp1, []byte{10, 3, 5, 0}); path == nil || len(path.AsPath) != 1 || path.AsPath[0] != 200 {
+		t.Errorf("Expected hijacked prefix to be learnt from AS 200 but got %v", path)
+	}
+	if len(bgp3.GetPaths(hijacked)) != 0 {
+		t.Errorf("Expected import policy to drop the hijacked prefix")
+	}
+
+	//The link to AS 200 goes down, so AS 100 has to use the direct path once the hold time expires
+	log.Printf("Testcase: Session failure")
+	adapter(router1, 1).TurnOff()
+	adapter(router2, 0).TurnOff()
+	waitForPath(bgp1, []byte{10, 3, 0, 0}, 300)
+	if route, err := table1.Lookup([]byte{10, 3, 0, 2}); err != nil || !bytes.Equal(route.Gateway, []byte{10, 13, 0, 3}) {
+		t.Errorf("Expected route through AS 300 after failure but got %v %v", route, err)
+	}
+	if path := bestPath(bgp1, []byte{10, 3, 0, 0}); path == nil || len(path.AsPath) != 1 || path.AsPath[0] != 300 {
+		t.Errorf("Expected direct path to AS 300 after failure but got %v", path)
+	}
+	if route, err := table1.Lookup([]byte{10, 3, 5, 1}); err != nil || route.Cidr.Mask != 16 {
+		t.Errorf("Expected hijacked prefix to be withdrawn with the session")
+	}
+
+	for _, bgp := range []*routing.BGP{bgp1, bgp2, bgp3} {
+		bgp.Stop()
+	}
+}
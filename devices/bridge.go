@@ -1,46 +1,137 @@
 package devices
 
 import (
-	"encoding/binary"
+	"log"
 	"netsim/hardware"
 	"netsim/protocol"
 	"netsim/protocol/l2"
-	"netsim/utils"
 	"sync"
+	"time"
 )
 
 /*
 A bridge is an ethernet switch.
-Ideally, each entry in the forwardingTable should have an expiry but since it would not be useful in simulations, hence
-not implementing it.
-Also, not adding any buffers
+The forwarding table is learnt per VLAN and its dynamic entries expire after the aging time, so that a host which moves
+to another port is re-learnt there. Entries for a port are also flushed when the port is turned off.
+Not adding any buffers
+
+Each port is either an access port or a trunk port. An access port belongs to a single VLAN and frames are sent out of it
+untagged. A trunk port carries a list of allowed VLANs, frames of which are sent out tagged, except for the native VLAN
+whose frames are sent untagged. Untagged frames received on a trunk port belong to the native VLAN.
+VLAN 0 is the default VLAN to which all ports belong initially. Since a tag with VLAN 0 only carries a priority, and is
+taken for the native VLAN by the other end, VLAN 0 can only be carried untagged on a trunk, as its native VLAN.
 */
+const (
+	PortModeAccess = iota
+	PortModeTrunk
+)
+
+const (
+	defaultVlan = uint16(0)
+)
+
 type Bridge struct {
-	ports           []*l2.Ethernet
-	portMapping     map[protocol.FrameConsumer]int
-	forwardingTable map[string]int
-	vlanTable       map[int][]uint16
-	lock            sync.Mutex
+	ports          []*l2.Ethernet
+	portMapping    map[protocol.FrameConsumer]int
+	macTable       *macTable
+	stickyPorts    map[int]bool
+	vlanTable      map[int]*portVlanConfig
+	mirrorSessions map[int]*mirrorSession
+	nextMirrorId   int
+	stormControl   map[int]*stormControl
+	portSecurity   map[int]*portSecurity
+	aggregations   map[int]*l2.LinkAggregation
+	aggregatedTo   map[int]int
+	igmpSnooping   *igmpSnooping
+	lock           sync.Mutex
 }
 
 func NewBridge(macs [][]byte) *Bridge {
 	bridge := &Bridge{
-		portMapping:     make(map[protocol.FrameConsumer]int),
-		forwardingTable: make(map[string]int),
-		vlanTable:       make(map[int][]uint16),
+		portMapping:    make(map[protocol.FrameConsumer]int),
+		macTable:       newMacTable(),
+		stickyPorts:    make(map[int]bool),
+		vlanTable:      make(map[int]*portVlanConfig),
+		mirrorSessions: make(map[int]*mirrorSession),
+		stormControl:   make(map[int]*stormControl),
+		portSecurity:   make(map[int]*portSecurity),
+		aggregations:   make(map[int]*l2.LinkAggregation),
+		aggregatedTo:   make(map[int]int),
 	}
 	for i, m := range macs {
 		ethernet := l2.NewEthernet(hardware.NewEthernetAdapter(m, true), bridge)
 		bridge.ports = append(bridge.ports, ethernet)
-		bridge.vlanTable[i] = []uint16{0}
+		bridge.vlanTable[i] = newAccessPortConfig(defaultVlan)
 		bridge.portMapping[ethernet] = i
 	}
 
 	return bridge
 }
 
+/*
+VLAN configuration
+*/
+func (b *Bridge) SetAccessPort(portNum int, vlanId uint16) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	priority := b.vlanTable[portNum].priority
+	b.vlanTable[portNum] = newAccessPortConfig(vlanId)
+	b.vlanTable[portNum].priority = priority
+}
+
+/*
+VLAN 0 is left out of the allowed VLANs unless it is the native one
+*/
+func (b *Bridge) SetTrunkPort(portNum int, allowedVlans []uint16, nativeVlan uint16) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	priority := b.vlanTable[portNum].priority
+	b.vlanTable[portNum] = newTrunkPortConfig(portNum, allowedVlans, nativeVlan)
+	b.vlanTable[portNum].priority = priority
+}
+
+/*
+Priority (PCP) given to frames which arrive on the port without one
+*/
+func (b *Bridge) SetPortPriority(portNum int, priority uint8) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.vlanTable[portNum].priority = priority & 0x07
+}
+
+/*
+Adds a VLAN to a port. An access port in the default VLAN is moved to the VLAN, an access port in any other VLAN is
+turned into a trunk carrying both VLANs and the default VLAN as the native one. A trunk port is allowed one more VLAN,
+as long as it is not VLAN 0 while another VLAN is native.
+*/
 func (b *Bridge) AddPortToVlan(portNum int, vlanId uint16) {
-	b.vlanTable[portNum] = append(b.vlanTable[portNum], vlanId)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	config := b.vlanTable[portNum]
+	if config.mode == PortModeTrunk {
+		config.allow(portNum, vlanId)
+		return
+	}
+
+	if config.accessVlan == defaultVlan || config.accessVlan == vlanId {
+		config.accessVlan = vlanId
+		return
+	}
+
+	trunk := newTrunkPortConfig(portNum, []uint16{defaultVlan, config.accessVlan, vlanId}, defaultVlan)
+	trunk.priority = config.priority
+	b.vlanTable[portNum] = trunk
+}
+
+func (b *Bridge) GetPortMode(portNum int) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.vlanTable[portNum].mode
 }
 
 func (b *Bridge) TurnOn() {
@@ -53,6 +144,76 @@ func (b *Bridge) TurnOff() {
 	for _, a := range b.ports {
 		a.GetAdapter().TurnOff()
 	}
+	b.macTable.flush()
+}
+
+func (b *Bridge) TurnOnPort(portNum int) {
+	b.ports[portNum].GetAdapter().TurnOn()
+}
+
+/*
+Turning off a port brings its link down, hence the addresses learnt on it are flushed
+*/
+func (b *Bridge) TurnOffPort(portNum int) {
+	b.ports[portNum].GetAdapter().TurnOff()
+	b.macTable.flushPort(portNum)
+}
+
+/*
+MAC address table configuration
+*/
+func (b *Bridge) SetMacAgingTime(agingTime time.Duration) {
+	b.macTable.setAgingTime(agingTime)
+}
+
+func (b *Bridge) SetMacTableSize(size int) {
+	b.macTable.setMaxSize(size)
+}
+
+func (b *Bridge) AddStaticMacEntry(vlanId uint16, mac []byte, portNum int) {
+	b.macTable.addStatic(vlanId, mac, portNum)
+}
+
+func (b *Bridge) RemoveMacEntry(vlanId uint16, mac []byte) {
+	b.macTable.remove(vlanId, mac)
+}
+
+/*
+Addresses learnt on a sticky port never expire and are not moved to other ports
+*/
+func (b *Bridge) SetPortSticky(portNum int, sticky bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.stickyPorts[portNum] = sticky
+}
+
+func (b *Bridge) FlushMacTable() {
+	b.macTable.flush()
+}
+
+func (b *Bridge) MacTable() []MacTableEntry {
+	return b.macTable.snapshot()
+}
+
+/*
+Bundles the ports into one logical port which takes the number of the first of them. All configuration of the bundle,
+like VLANs, is done on the logical port.
+*/
+func (b *Bridge) AddLinkAggregation(portNums []int, key uint16) *l2.LinkAggregation {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var members []*l2.Ethernet
+	for _, p := range portNums {
+		members = append(members, b.ports[p])
+		b.aggregatedTo[p] = portNums[0]
+	}
+
+	systemId := b.ports[0].GetAdapter().(*hardware.EthernetAdapter).GetMacAddress()
+	agg := l2.NewLinkAggregation(systemId, key, members)
+	b.aggregations[portNums[0]] = agg
+	return agg
 }
 
 func (b *Bridge) GetPort(portNum int) *l2.Ethernet {
@@ -69,64 +230,203 @@ func (b *Bridge) SendUp(frame []byte, metadata []byte, sender protocol.Protocol)
 	sourceAddr := frame[14:20]
 	destAddr := frame[8:14]
 
+	//Link control frames are never forwarded
+	if l2.IsSlowProtocolsAddress(destAddr) {
+		return
+	}
+
+	//Members of a bundle are seen as the logical port of the bundle
 	portNum := b.portMapping[sender]
+	if logicalPortNum, ok := b.aggregatedTo[portNum]; ok {
+		if !b.aggregations[logicalPortNum].IsActive(sender) {
+			return
+		}
+		portNum = logicalPortNum
+	}
 
-	//Find the VLAN Id for the incoming frame
-	isSourceTrunk := b.isTrunk(portNum)
-	var vlanId uint16
-	if isSourceTrunk {
-		vlanId = binary.BigEndian.Uint16(frame[20:22])
-	} else {
-		vlanId = b.getVlanId(portNum)
+	//Monitor ports do not take part in forwarding
+	if b.isMonitorPort(portNum) {
+		return
 	}
 
-	//Tag the frame
-	if !isSourceTrunk {
-		vlanTag := make([]byte, 2)
-		binary.BigEndian.PutUint16(vlanTag, vlanId)
-		frame[20] = vlanTag[0]
-		frame[21] = vlanTag[1]
+	//Find the VLAN and priority of the incoming frame
+	vlanId, priority, ok := b.classifyIngress(portNum, frame)
+	if !ok {
+		return
+	}
+
+	//Copy the frame to monitor ports if required
+	mirrored := map[int]bool{}
+	b.mirror(portNum, vlanId, MirrorIngress, frame, mirrored)
 
-		checksum := utils.CalculateChecksum(frame[:len(frame)-1])
-		frame[len(frame)-1] = checksum[0]
+	//Check if the source is allowed on the port
+	if !b.admitSource(portNum, vlanId, sourceAddr) {
+		return
 	}
 
 	//Make an entry in the forwarding table for the source address
-	b.forwardingTable[string(sourceAddr)] = portNum
+	entryType := MacEntryDynamic
+	if b.stickyPorts[portNum] {
+		entryType = MacEntrySticky
+	}
+	b.macTable.learn(vlanId, sourceAddr, portNum, entryType)
 
 	//If an entry for the destination exists in the forwarding table then forward the frame there, else everywhere
-	destPortNum, ok := b.forwardingTable[string(destAddr)]
+	destPortNum, ok := b.macTable.lookup(vlanId, destAddr)
+
+	//Police the traffic which would be flooded
+	if !b.admitFlood(portNum, destAddr, ok) {
+		return
+	}
+
+	//Multicast only goes to the ports which want it, if the bridge snoops on IGMP
+	if ports, snooped := b.snoopMulticast(portNum, vlanId, frame); snooped {
+		for _, i := range ports {
+			if i != portNum && b.isLogicalPort(i) && b.vlanTable[i].isMember(vlanId) && !b.isMonitorPort(i) {
+				b.sendOnPort(i, frame, vlanId, priority, mirrored)
+			}
+		}
+		return
+	}
+
 	if ok {
-		if b.isPartOfVlan(destPortNum, vlanId) {
-			b.ports[destPortNum].GetAdapter().PutInBuffer(frame)
+		//Destination is on the same segment as the source, hence nothing to do
+		if destPortNum == portNum {
+			return
+		}
+		if b.vlanTable[destPortNum].isMember(vlanId) && !b.isMonitorPort(destPortNum) {
+			b.sendOnPort(destPortNum, frame, vlanId, priority, mirrored)
 		}
 	} else {
-		for i, port := range b.ports {
-			if i != portNum && b.isPartOfVlan(i, vlanId) {
-				port.GetAdapter().PutInBuffer(frame)
+		for i := range b.ports {
+			if i != portNum && b.isLogicalPort(i) && b.vlanTable[i].isMember(vlanId) && !b.isMonitorPort(i) {
+				b.sendOnPort(i, frame, vlanId, priority, mirrored)
 			}
 		}
 	}
 }
 
-func (b *Bridge) isTrunk(portNum int) bool {
-	return len(b.vlanTable[portNum]) > 2
+/*
+Find the VLAN a frame belongs to based on the configuration of the port it came in on. Returns false if the frame is not
+allowed on the port.
+*/
+func (b *Bridge) classifyIngress(portNum int, frame []byte) (uint16, uint8, bool) {
+	config := b.vlanTable[portNum]
+	tagVlanId, tagPriority := l2.GetVlanTag(frame)
+
+	priority := config.priority
+	if tagPriority != 0 {
+		priority = tagPriority
+	}
+
+	if config.mode == PortModeAccess {
+		//Only untagged or priority tagged frames are accepted on access ports
+		if tagVlanId != 0 {
+			log.Printf("Bridge: Got tagged frame on access port %d. Dropping.", portNum)
+			return 0, 0, false
+		}
+		return config.accessVlan, priority, true
+	}
+
+	vlanId := tagVlanId
+	if vlanId == 0 {
+		vlanId = config.nativeVlan
+	}
+
+	if !config.isMember(vlanId) {
+		log.Printf("Bridge: Got frame for VLAN %d not allowed on trunk port %d. Dropping.", vlanId, portNum)
+		return 0, 0, false
+	}
+
+	return vlanId, priority, true
 }
 
-func (b *Bridge) getVlanId(portNum int) uint16 {
-	if len(b.vlanTable[portNum]) == 1 {
-		return 0
+/*
+Push or pop the VLAN tag as required by the outgoing port and send the frame. Each port gets its own copy since the tag
+differs across ports.
+*/
+func (b *Bridge) sendOnPort(portNum int, frame []byte, vlanId uint16, priority uint8, mirrored map[int]bool) {
+	config := b.vlanTable[portNum]
+
+	outFrame := make([]byte, len(frame))
+	copy(outFrame, frame)
+
+	if config.mode == PortModeTrunk && vlanId != config.nativeVlan {
+		l2.SetVlanTag(outFrame, vlanId, priority)
 	} else {
-		return b.vlanTable[portNum][1]
+		l2.SetVlanTag(outFrame, 0, 0)
 	}
-}
 
-func (b *Bridge) isPartOfVlan(portNum int, vlanId uint16) bool {
-	for _, i := range b.vlanTable[portNum] {
-		if vlanId == i {
-			return true
+	b.mirror(portNum, vlanId, MirrorEgress, outFrame, mirrored)
+
+	//Frames for a bundle are distributed across its members
+	if agg, ok := b.aggregations[portNum]; ok {
+		member := agg.SelectMemberForFrame(outFrame)
+		if member != nil {
+			member.GetAdapter().PutInBuffer(outFrame)
 		}
+		return
+	}
+
+	b.ports[portNum].GetAdapter().PutInBuffer(outFrame)
+}
+
+/*
+Returns false for the members of a bundle other than the one representing the bundle
+*/
+func (b *Bridge) isLogicalPort(portNum int) bool {
+	logicalPortNum, ok := b.aggregatedTo[portNum]
+	return !ok || logicalPortNum == portNum
+}
+
+/*
+Per-port VLAN configuration
+*/
+type portVlanConfig struct {
+	mode         int
+	accessVlan   uint16
+	allowedVlans map[uint16]bool
+	nativeVlan   uint16
+	priority     uint8
+}
+
+func newAccessPortConfig(vlanId uint16) *portVlanConfig {
+	return &portVlanConfig{
+		mode:       PortModeAccess,
+		accessVlan: vlanId,
+	}
+}
+
+func newTrunkPortConfig(portNum int, allowedVlans []uint16, nativeVlan uint16) *portVlanConfig {
+	config := &portVlanConfig{
+		mode:         PortModeTrunk,
+		allowedVlans: map[uint16]bool{nativeVlan: true},
+		nativeVlan:   nativeVlan,
+	}
+	for _, v := range allowedVlans {
+		config.allow(portNum, v)
+	}
+
+	return config
+}
+
+/*
+Frames of VLAN 0 would go out tagged with VLAN 0, which the other end puts in its native VLAN, so VLAN 0 is only allowed
+as the native VLAN
+*/
+func (c *portVlanConfig) allow(portNum int, vlanId uint16) {
+	if vlanId == 0 && c.nativeVlan != 0 {
+		log.Printf("Bridge: VLAN 0 can only be the native VLAN of trunk port %d. Ignoring.", portNum)
+		return
+	}
+
+	c.allowedVlans[vlanId] = true
+}
+
+func (c *portVlanConfig) isMember(vlanId uint16) bool {
+	if c.mode == PortModeAccess {
+		return c.accessVlan == vlanId
 	}
 
-	return false
+	return c.allowedVlans[vlanId]
 }
@@ -7,6 +7,8 @@ import (
 	"netsim/hardware"
 	"netsim/protocol"
 	"netsim/protocol/l2"
+	"netsim/utils"
+	"sync"
 	"testing"
 	"time"
 )
@@ -17,6 +19,8 @@ Dummy L3 Protocol implementation for testing
 type l3Node struct {
 	nodeNum    int
 	l2Protocol protocol.L2Protocol
+	received   []string
+	lock       sync.Mutex
 }
 
 func NewL3Node(mac []byte, nodeNum int) *l3Node {
@@ -60,6 +64,52 @@ func (d *l3Node) SendDown(data []byte, destAddr []byte, metadata []byte, sender
 
 func (d *l3Node) SendUp(b []byte, metadata []byte, sender protocol.Protocol) {
 	log.Printf("l4Node %d: Got packet: %s", d.nodeNum, b)
+	d.lock.Lock()
+	d.received = append(d.received, string(b))
+	d.lock.Unlock()
+}
+
+func (d *l3Node) hasReceived(data string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, r := range d.received {
+		if r == data {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Captures every frame seen by a promiscuous adapter
+*/
+type frameCapture struct {
+	adapter *hardware.EthernetAdapter
+	frames  [][]byte
+	lock    sync.Mutex
+}
+
+func newFrameCapture(mac []byte) *frameCapture {
+	c := &frameCapture{
+		adapter: hardware.NewEthernetAdapter(mac, true),
+	}
+	l2.NewEthernet(c.adapter, c)
+	return c
+}
+
+func (c *frameCapture) SendUp(frame []byte, metadata []byte, sender protocol.Protocol) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.frames = append(c.frames, append([]byte{}, frame...))
+}
+
+func (c *frameCapture) getFrames() [][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.frames
 }
 
 /*
@@ -115,3 +165,383 @@ func TestBridge(t *testing.T) {
 
 	time.Sleep(2 * time.Second)
 }
+
+/*
+MAC address table aging, static entries, capacity and flushing
+*/
+func TestBridgeMacTable(t *testing.T) {
+	// Create the nodes
+	nodes := []*l3Node{}
+	for i := 0; i < 3; i++ {
+		mac := fmt.Sprintf("macta%d", i)
+		n := NewL3Node([]byte(mac), i)
+		nodes = append(nodes, n)
+		n.TurnOn()
+	}
+
+	// Create the bridge
+	var macs [][]byte
+	for i := 0; i < 3; i++ {
+		mac := fmt.Sprintf("macbr%d", i)
+		macs = append(macs, []byte(mac))
+	}
+	bridge := NewBridge(macs)
+	bridge.SetMacAgingTime(3 * time.Second)
+	bridge.AddStaticMacEntry(0, []byte("static"), 2)
+	bridge.TurnOn()
+
+	for i := 0; i < 3; i++ {
+		hardware.NewDuplexLink(100, 1e8, 0.000, nodes[i].l2Protocol.GetAdapter(), bridge.GetPort(i).GetAdapter())
+	}
+
+	go hardware.Clk.Start()
+
+	// Both senders should get learnt
+	nodes[0].SendDown([]byte("Learn me"), []byte("macta1"), nil, nil)
+	nodes[1].SendDown([]byte("Learn me too"), []byte("macta0"), nil, nil)
+	time.Sleep(2 * time.Second)
+
+	table := bridge.MacTable()
+	for _, e := range table {
+		log.Printf("Vlan %d Mac %s Port %d Type %d Age %v", e.VlanId, e.Address, e.Port, e.Type, e.Age)
+	}
+	if len(table) != 3 {
+		t.Fatalf("Expected 3 entries in MAC table, got %d", len(table))
+	}
+
+	// Link down on port 1 flushes the entry learnt there
+	bridge.TurnOffPort(1)
+	if len(bridge.MacTable()) != 2 {
+		t.Fatalf("Expected entry on port 1 to be flushed")
+	}
+	bridge.TurnOnPort(1)
+
+	// Dynamic entries age out, static entry stays
+	time.Sleep(3 * time.Second)
+	table = bridge.MacTable()
+	if len(table) != 1 || table[0].Type != MacEntryStatic {
+		t.Fatalf("Expected only the static entry to remain, got %d entries", len(table))
+	}
+
+	// A full table evicts the oldest dynamic entry
+	bridge.SetMacTableSize(2)
+	nodes[0].SendDown([]byte("Learn me"), []byte("macta1"), nil, nil)
+	time.Sleep(1 * time.Second)
+	nodes[1].SendDown([]byte("Learn me too"), []byte("macta0"), nil, nil)
+	time.Sleep(2 * time.Second)
+	table = bridge.MacTable()
+	if len(table) != 2 || string(table[0].Address) != "macta1" {
+		t.Fatalf("Expected oldest dynamic entry to be evicted")
+	}
+}
+
+/*
+Two bridges connected by a trunk, each having an access port in VLAN 10 and VLAN 20
+*/
+func TestBridgeTrunk(t *testing.T) {
+	nodes := []*l3Node{}
+	for i := 0; i < 4; i++ {
+		mac := fmt.Sprintf("vlann%d", i)
+		n := NewL3Node([]byte(mac), i)
+		nodes = append(nodes, n)
+		n.TurnOn()
+	}
+
+	bridges := []*Bridge{}
+	for i := 0; i < 2; i++ {
+		var macs [][]byte
+		for j := 0; j < 4; j++ {
+			macs = append(macs, []byte(fmt.Sprintf("vlb%dp%d", i, j)))
+		}
+		bridge := NewBridge(macs)
+		bridge.SetAccessPort(0, 10)
+		bridge.SetAccessPort(1, 20)
+		bridge.SetTrunkPort(2, []uint16{10, 20}, 20)
+		bridge.SetPortPriority(0, 5)
+		bridge.TurnOn()
+		bridges = append(bridges, bridge)
+	}
+
+	// Port 3 of bridge 0 is the trunk from the other bridge as well, a capture sits there to look at the tags
+	bridges[0].SetTrunkPort(3, []uint16{10, 20}, 20)
+	capture := newFrameCapture([]byte("vlcapt"))
+	capture.adapter.TurnOn()
+
+	hardware.NewDuplexLink(100, 1e8, 0.000, nodes[0].l2Protocol.GetAdapter(), bridges[0].GetPort(0).GetAdapter())
+	hardware.NewDuplexLink(100, 1e8, 0.000, nodes[1].l2Protocol.GetAdapter(), bridges[0].GetPort(1).GetAdapter())
+	hardware.NewDuplexLink(100, 1e8, 0.000, nodes[2].l2Protocol.GetAdapter(), bridges[1].GetPort(0).GetAdapter())
+	hardware.NewDuplexLink(100, 1e8, 0.000, nodes[3].l2Protocol.GetAdapter(), bridges[1].GetPort(1).GetAdapter())
+	hardware.NewDuplexLink(100, 1e8, 0.000, bridges[0].GetPort(2).GetAdapter(), bridges[1].GetPort(2).GetAdapter())
+	hardware.NewDuplexLink(100, 1e8, 0.000, bridges[0].GetPort(3).GetAdapter(), capture.adapter)
+
+	go hardware.Clk.Start()
+
+	// VLAN 10 crosses the trunk tagged
+	nodes[0].SendDown([]byte("Hello vlan 10"), []byte("vlann2"), nil, nil)
+	// VLAN 20 is native on the trunk, hence untagged
+	nodes[1].SendDown([]byte("Hello vlan 20"), []byte("vlann3"), nil, nil)
+	// Different VLAN must not be reached
+	nodes[0].SendDown([]byte("Should not cross vlans"), []byte("vlann3"), nil, nil)
+	time.Sleep(4 * time.Second)
+
+	if !nodes[2].hasReceived("Hello vlan 10") {
+		t.Errorf("Frame in VLAN 10 did not cross the trunk")
+	}
+	if !nodes[3].hasReceived("Hello vlan 20") {
+		t.Errorf("Frame in native VLAN did not cross the trunk")
+	}
+	if nodes[3].hasReceived("Should not cross vlans") {
+		t.Errorf("Frame leaked from VLAN 10 to VLAN 20")
+	}
+
+	tagged, untagged := 0, 0
+	for _, frame := range capture.getFrames() {
+		vlanId, priority := l2.GetVlanTag(frame)
+		if vlanId == 10 && priority == 5 {
+			tagged++
+		}
+		if vlanId == 0 {
+			untagged++
+		}
+	}
+	if tagged == 0 || untagged == 0 {
+		t.Errorf("Expected tagged VLAN 10 and untagged native VLAN frames on trunk, got %d and %d", tagged, untagged)
+	}
+}
+
+/*
+VLAN 0 is not carried tagged on trunks whose native VLAN is another one, since the tag would put its frames in the native
+VLAN of the other end
+*/
+func TestBridgeTrunkVlanZero(t *testing.T) {
+	nodes := []*l3Node{}
+	for i := 0; i < 3; i++ {
+		n := NewL3Node([]byte(fmt.Sprintf("vlzer%d", i)), i)
+		nodes = append(nodes, n)
+		n.TurnOn()
+	}
+
+	bridges := []*Bridge{}
+	for i := 0; i < 2; i++ {
+		var macs [][]byte
+		for j := 0; j < 3; j++ {
+			macs = append(macs, []byte(fmt.Sprintf("vzb%dp%d", i, j)))
+		}
+		bridge := NewBridge(macs)
+		bridge.SetTrunkPort(2, []uint16{0, 10}, 10)
+		bridge.TurnOn()
+		bridges = append(bridges, bridge)
+	}
+	// Port 0 of both bridges stays in the default VLAN, port 1 of bridge 1 is in VLAN 10
+	bridges[1].SetAccessPort(1, 10)
+
+	hardware.NewDuplexLink(100, 1e8, 0.000, nodes[0].l2Protocol.GetAdapter(), bridges[0].GetPort(0).GetAdapter())
+	hardware.NewDuplexLink(100, 1e8, 0.000, nodes[1].l2Protocol.GetAdapter(), bridges[1].GetPort(0).GetAdapter())
+	hardware.NewDuplexLink(100, 1e8, 0.000, nodes[2].l2Protocol.GetAdapter(), bridges[1].GetPort(1).GetAdapter())
+	hardware.NewDuplexLink(100, 1e8, 0.000, bridges[0].GetPort(2).GetAdapter(), bridges[1].GetPort(2).GetAdapter())
+
+	go hardware.Clk.Start()
+
+	nodes[0].SendDown([]byte("Should stay in vlan 0"), []byte("vlzer2"), nil, nil)
+	time.Sleep(4 * time.Second)
+
+	if nodes[2].hasReceived("Should stay in vlan 0") {
+		t.Errorf("Frame leaked from VLAN 0 to the native VLAN of the trunk")
+	}
+	if nodes[1].hasReceived("Should stay in vlan 0") {
+		t.Errorf("Expected VLAN 0 not to be carried on the trunk")
+	}
+}
+
+/*
+Traffic between two hosts is mirrored to a capturing computer on the monitor port
+*/
+func TestBridgeMirror(t *testing.T) {
+	nodes := []*l3Node{}
+	for i := 0; i < 3; i++ {
+		mac := fmt.Sprintf("spann%d", i)
+		n := NewL3Node([]byte(mac), i)
+		nodes = append(nodes, n)
+		n.TurnOn()
+	}
+
+	var macs [][]byte
+	for i := 0; i < 4; i++ {
+		macs = append(macs, []byte(fmt.Sprintf("spanb%d", i)))
+	}
+	bridge := NewBridge(macs)
+	bridge.SetAccessPort(2, 30)
+	bridge.AddMirrorSession(3, []int{0}, nil, MirrorBoth)
+	bridge.TurnOn()
+
+	monitor := NewComputer([]byte("spanmo"), []byte{10, 0, 0, 100})
+	capture := &frameCapture{}
+	monitor.StartCapture(capture)
+	monitor.TurnOn()
+
+	for i := 0; i < 3; i++ {
+		hardware.NewDuplexLink(100, 1e8, 0.000, nodes[i].l2Protocol.GetAdapter(), bridge.GetPort(i).GetAdapter())
+	}
+	hardware.NewDuplexLink(100, 1e8, 0.000, monitor.GetAdapter(), bridge.GetPort(3).GetAdapter())
+
+	go hardware.Clk.Start()
+
+	// Port 0 ingress and egress are mirrored, traffic between other ports is not
+	nodes[0].SendDown([]byte("Mirror ingress"), []byte("spann1"), nil, nil)
+	time.Sleep(1 * time.Second)
+	nodes[1].SendDown([]byte("Mirror egress"), []byte("spann0"), nil, nil)
+	time.Sleep(1 * time.Second)
+	nodes[1].SendDown([]byte("Do not mirror"), []byte("spann1"), nil, nil)
+	time.Sleep(2 * time.Second)
+
+	seen := map[string]bool{}
+	for _, frame := range capture.getFrames() {
+		seen[string(frame[24:len(frame)-1])] = true
+	}
+	if !seen["Mirror ingress"] || !seen["Mirror egress"] {
+		t.Errorf("Expected both directions of port 0 to be mirrored")
+	}
+	if seen["Do not mirror"] {
+		t.Errorf("Frame not involving port 0 was mirrored")
+	}
+	if nodes[2].hasReceived("Mirror ingress") {
+		t.Errorf("Frame leaked to another VLAN")
+	}
+}
+
+/*
+Builds a frame with an arbitrary source address, as an attacker flooding MAC addresses would
+*/
+func craftFrame(destAddr []byte, sourceAddr []byte, data []byte) []byte {
+	b := []byte("01020304")
+	b = append(b, destAddr...)
+	b = append(b, sourceAddr...)
+	b = append(b, 0, 0)
+	b = append(b, []byte("no")...)
+	b = append(b, data...)
+	b = append(b, utils.CalculateChecksum(b)...)
+	return b
+}
+
+func TestBridgeStormControlAndPortSecurity(t *testing.T) {
+	nodes := []*l3Node{}
+	for i := 0; i < 2; i++ {
+		n := NewL3Node([]byte(fmt.Sprintf("strmn%d", i)), i)
+		nodes = append(nodes, n)
+		n.TurnOn()
+	}
+	attacker := hardware.NewEthernetAdapter([]byte("attack"), false)
+	attacker.TurnOn()
+
+	var macs [][]byte
+	for i := 0; i < 4; i++ {
+		macs = append(macs, []byte(fmt.Sprintf("strmb%d", i)))
+	}
+	bridge := NewBridge(macs)
+	bridge.SetStormControl(0, TrafficBroadcast, 1)
+	bridge.SetPortSecurity(2, 2, ViolationRestrict)
+	bridge.SetPortSecurity(3, 1, ViolationShutdown)
+	bridge.TurnOn()
+
+	for i := 0; i < 2; i++ {
+		hardware.NewDuplexLink(100, 1e9, 0.000, nodes[i].l2Protocol.GetAdapter(), bridge.GetPort(i).GetAdapter())
+	}
+	hardware.NewDuplexLink(100, 1e9, 0.000, attacker, bridge.GetPort(2).GetAdapter())
+	shutdownAttacker := hardware.NewEthernetAdapter([]byte("attac2"), false)
+	shutdownAttacker.TurnOn()
+	hardware.NewDuplexLink(100, 1e9, 0.000, shutdownAttacker, bridge.GetPort(3).GetAdapter())
+
+	go hardware.Clk.Start()
+
+	// Broadcast storm from port 0, only about one frame per second gets through
+	for i := 0; i < 5; i++ {
+		nodes[0].SendDown([]byte(fmt.Sprintf("Broadcast %d", i)), []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, nil, nil)
+	}
+
+	// MAC flooding from ports 2 and 3
+	for i := 0; i < 5; i++ {
+		attacker.PutInBuffer(craftFrame([]byte("strmn1"), []byte(fmt.Sprintf("fake%02d", i)), []byte("flood")))
+		shutdownAttacker.PutInBuffer(craftFrame([]byte("strmn1"), []byte(fmt.Sprintf("fakf%02d", i)), []byte("flood")))
+	}
+	time.Sleep(3 * time.Second)
+
+	if bridge.GetStormControlDrops(0, TrafficBroadcast) < 3 {
+		t.Errorf("Expected broadcast storm to be policed, got %d drops", bridge.GetStormControlDrops(0, TrafficBroadcast))
+	}
+	if bridge.GetPortSecurityViolations(2) != 3 {
+		t.Errorf("Expected 3 violations on restricted port, got %d", bridge.GetPortSecurityViolations(2))
+	}
+	if !bridge.IsPortErrDisabled(3) {
+		t.Errorf("Expected port 3 to be shut down")
+	}
+
+	learnt := 0
+	for _, e := range bridge.MacTable() {
+		if e.Port == 2 {
+			learnt++
+		}
+	}
+	if learnt != 2 {
+		t.Errorf("Expected 2 addresses learnt on restricted port, got %d", learnt)
+	}
+}
+
+/*
+Two bridges connected by a bundle of two links. Traffic keeps flowing when one of the links goes down.
+*/
+func TestBridgeLinkAggregation(t *testing.T) {
+	nodes := []*l3Node{}
+	for i := 0; i < 2; i++ {
+		n := NewL3Node([]byte(fmt.Sprintf("lagnd%d", i)), i)
+		nodes = append(nodes, n)
+		n.TurnOn()
+	}
+
+	bridges := []*Bridge{}
+	aggs := []*l2.LinkAggregation{}
+	for i := 0; i < 2; i++ {
+		var macs [][]byte
+		for j := 0; j < 3; j++ {
+			macs = append(macs, []byte(fmt.Sprintf("lgb%dp%d", i, j)))
+		}
+		bridge := NewBridge(macs)
+		aggs = append(aggs, bridge.AddLinkAggregation([]int{1, 2}, 1))
+		bridge.TurnOn()
+		bridges = append(bridges, bridge)
+	}
+
+	hardware.NewDuplexLink(1, 1e9, 0.000, nodes[0].l2Protocol.GetAdapter(), bridges[0].GetPort(0).GetAdapter())
+	hardware.NewDuplexLink(1, 1e9, 0.000, nodes[1].l2Protocol.GetAdapter(), bridges[1].GetPort(0).GetAdapter())
+	hardware.NewDuplexLink(1, 1e9, 0.000, bridges[0].GetPort(1).GetAdapter(), bridges[1].GetPort(1).GetAdapter())
+	hardware.NewDuplexLink(1, 1e9, 0.000, bridges[0].GetPort(2).GetAdapter(), bridges[1].GetPort(2).GetAdapter())
+
+	go hardware.Clk.Start()
+
+	// Wait for LACP to bring up the bundle
+	time.Sleep(3 * time.Second)
+	for i := 0; i < 2; i++ {
+		if len(aggs[i].GetActiveMembers()) != 2 {
+			t.Fatalf("Expected both members of bundle %d to be active", i)
+		}
+	}
+
+	nodes[0].SendDown([]byte("Over the bundle"), []byte("lagnd1"), nil, nil)
+	time.Sleep(1 * time.Second)
+	if !nodes[1].hasReceived("Over the bundle") {
+		t.Errorf("Frame did not cross the bundle")
+	}
+
+	// Take one member down, the other end detects it once LACPDUs stop arriving
+	bridges[0].TurnOffPort(1)
+	time.Sleep(4 * time.Second)
+	if len(aggs[1].GetActiveMembers()) != 1 {
+		t.Fatalf("Expected failed member to be removed from the bundle")
+	}
+
+	nodes[0].SendDown([]byte("After failover"), []byte("lagnd1"), nil, nil)
+	nodes[1].SendDown([]byte("Back after failover"), []byte("lagnd0"), nil, nil)
+	time.Sleep(1 * time.Second)
+	if !nodes[1].hasReceived("After failover") || !nodes[0].hasReceived("Back after failover") {
+		t.Errorf("Frames did not cross the bundle after failover")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"netsim/api"
 	"netsim/hardware"
 	"netsim/protocol"
+	"netsim/protocol/dhcp"
 	"netsim/protocol/l2"
 	"netsim/protocol/l3"
 	"netsim/protocol/l4"
@@ -13,53 +14,148 @@ type Computer struct {
 	adapter         *hardware.EthernetAdapter
 	l2Protocol      *l2.Ethernet
 	ip              *l3.IP
+	ipv6            *l3.IPv6
+	icmp            *l3.ICMP
+	igmp            *l3.IGMP
 	udp             *l4.UDP
 	tcp             *l4.TCP
-	routeProvider   *l3.StaticRouteProvider
-	addressResolver *l3.StaticAddressResolver
+	routeProvider   *l3.RoutingTable
+	addressResolver *l3.ARP
+	dhcpClient      *dhcp.Client
+	firewall        *PacketFilter
 }
 
 func NewComputer(mac []byte, ipAddr []byte) *Computer {
-	routeProvider := l3.NewStaticRouteProvider()
-	addressResolver := l3.NewStaticAddressResolver()
+	routeProvider := l3.NewRoutingTable()
+	addressResolver := l3.NewARP()
 	//Create the stack
 	computer := &Computer{routeProvider: routeProvider, addressResolver: addressResolver}
 	computer.adapter = hardware.NewEthernetAdapter(mac, false)
 	ethernet := l2.NewEthernet(computer.adapter, nil)
 	ip := l3.NewIP([][]byte{ipAddr}, false, nil, routeProvider, addressResolver)
+	icmp := l3.NewICMP()
+	igmp := l3.NewIGMP()
 	udp := l4.NewUDP()
 	tcp := l4.NewTCP()
 
 	//Set references
 	ip.SetL2ProtocolForInterface(0, ethernet)
+	addressResolver.Attach(ip)
 
 	//Arrange the stack
 	ethernet.AddL3Protocol(ip)
+	ip.AddL4Protocol(icmp)
+	ip.AddL4Protocol(igmp)
 	ip.AddL4Protocol(tcp)
 	ip.AddL4Protocol(udp)
+	icmp.AddL3Protocol(ip)
+	igmp.AddL3Protocol(ip)
 	tcp.AddL3Protocol(ip)
+	udp.AddL3Protocol(ip)
 
+	computer.l2Protocol = ethernet
+	computer.ip = ip
+	computer.icmp = icmp
+	computer.igmp = igmp
 	computer.tcp = tcp
 	computer.udp = udp
 	return computer
 }
 
+/*
+Creates a computer without an address, which gets one using DHCP once turned on
+*/
+func NewDhcpComputer(mac []byte) *Computer {
+	computer := NewComputer(mac, []byte{0, 0, 0, 0})
+	computer.dhcpClient = dhcp.NewClient(computer.ip, computer.udp, computer.routeProvider, 0)
+	return computer
+}
+
+/*
+Makes the computer dual-stack. The address can be nil, in which case one is configured from the router advertisements.
+IPv6 routes go in the same routing table as the IP ones.
+*/
+func (c *Computer) EnableIPv6(ipAddr []byte) *l3.IPv6 {
+	c.ipv6 = l3.NewIPv6([][]byte{ipAddr}, false, nil, c.routeProvider)
+	c.ipv6.SetL2ProtocolForInterface(0, c.l2Protocol)
+	c.l2Protocol.AddL3Protocol(c.ipv6)
+
+	c.ipv6.AddL4Protocol(c.tcp)
+	c.ipv6.AddL4Protocol(c.udp)
+	c.tcp.AddL3Protocol(c.ipv6)
+	c.udp.AddL3Protocol(c.ipv6)
+	return c.ipv6
+}
+
+func (c *Computer) GetIPv6() *l3.IPv6 {
+	return c.ipv6
+}
+
+/*
+Filters the packets the computer receives and sends. Does nothing until rules or policies are added.
+*/
+func (c *Computer) EnableFirewall() *PacketFilter {
+	if c.firewall == nil {
+		c.firewall = NewPacketFilter(c.ip)
+	}
+	return c.firewall
+}
+
+func (c *Computer) GetFirewall() *PacketFilter {
+	return c.firewall
+}
+
+/*
+Adds a static entry to the ARP cache. Not needed normally, since addresses are resolved using ARP.
+*/
 func (c *Computer) AddAddress(ipAddr []byte, mac []byte) {
 	c.addressResolver.Add(ipAddr, mac)
 }
 
+func (c *Computer) GetARP() *l3.ARP {
+	return c.addressResolver
+}
+
 func (c *Computer) AddRoute(cidr *protocol.CIDR, gateway []byte) {
 	c.routeProvider.Add(cidr, gateway, 0)
 }
 
+func (c *Computer) GetRoutingTable() *l3.RoutingTable {
+	return c.routeProvider
+}
+
 func (c *Computer) TurnOn() {
 	c.adapter.TurnOn()
+	if c.dhcpClient != nil {
+		c.dhcpClient.Start()
+	}
 }
 
 func (c *Computer) TurnOff() {
+	if c.dhcpClient != nil {
+		c.dhcpClient.Stop()
+	}
 	c.adapter.TurnOff()
 }
 
+func (c *Computer) GetDhcpClient() *dhcp.Client {
+	return c.dhcpClient
+}
+
+/*
+Capturing puts the adapter in promiscuous mode and hands every frame seen, including those destined to other hosts, to
+the consumer. Useful on a computer attached to the monitor port of a bridge.
+*/
+func (c *Computer) StartCapture(consumer protocol.FrameConsumer) {
+	c.l2Protocol.SetRawConsumer(consumer)
+	c.adapter.SetPromiscuous(true)
+}
+
+func (c *Computer) StopCapture() {
+	c.adapter.SetPromiscuous(false)
+	c.l2Protocol.SetRawConsumer(nil)
+}
+
 func (c *Computer) Run(runFunc func(computer *Computer)) {
 	go runFunc(c)
 }
@@ -68,10 +164,22 @@ func (c *Computer) NewSocket(domain int, channelType int, protocol int) *api.Soc
 	return api.NewSocket(c, domain, channelType, protocol)
 }
 
+func (c *Computer) GetL3Protocol() protocol.L3Protocol {
+	return c.ip
+}
+
 func (c *Computer) GetAdapter() hardware.Adapter {
 	return c.adapter
 }
 
+func (c *Computer) GetICMP() *l3.ICMP {
+	return c.icmp
+}
+
+func (c *Computer) GetIGMP() *l3.IGMP {
+	return c.igmp
+}
+
 func (c *Computer) GetUDP() *l4.UDP {
 	return c.udp
 }
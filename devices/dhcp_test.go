@@ -0,0 +1,113 @@
+package devices
+
+import (
+	"bytes"
+	"log"
+	"netsim/hardware"
+	"netsim/protocol"
+	"netsim/protocol/dhcp"
+	"netsim/protocol/l3"
+	"testing"
+	"time"
+)
+
+/*
+Testcase
+*/
+func TestDhcp(t *testing.T) {
+	//The server and a client share a LAN with the router, another client is on the other side of the router
+	server := NewComputer([]byte("dhcpsv"), []byte{10, 0, 1, 10})
+	server.AddRoute(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, nil)
+	server.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 1, 1})
+	client1 := NewDhcpComputer([]byte("dhcpc1"))
+	client2 := NewDhcpComputer([]byte("dhcpc2"))
+
+	routeProvider := l3.NewStaticRouteProvider()
+	routeProvider.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, nil, 0)
+	routeProvider.Add(&protocol.CIDR{Address: []byte{10, 0, 2, 0}, Mask: 24}, nil, 1)
+	router := NewRouter([][]byte{[]byte("dhcpr1"), []byte("dhcpr2")}, [][]byte{{10, 0, 1, 1}, {10, 0, 2, 1}}, routeProvider, l3.NewARP())
+
+	bridge := NewBridge([][]byte{[]byte("dhcpb0"), []byte("dhcpb1"), []byte("dhcpb2")})
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, server.GetAdapter(), bridge.GetPort(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, client1.GetAdapter(), bridge.GetPort(1).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, router.GetL3Protocol().GetL2ProtocolForInterface(0).GetAdapter(), bridge.GetPort(2).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, router.GetL3Protocol().GetL2ProtocolForInterface(1).GetAdapter(), client2.GetAdapter())
+
+	dhcpServer := dhcp.NewServer(server, []*dhcp.Pool{
+		{
+			Network:   &protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24},
+			Start:     []byte{10, 0, 1, 100},
+			End:       []byte{10, 0, 1, 110},
+			Gateway:   []byte{10, 0, 1, 1},
+			Dns:       [][]byte{{10, 0, 1, 53}},
+			LeaseTime: 6 * time.Second,
+		},
+		{
+			Network:   &protocol.CIDR{Address: []byte{10, 0, 2, 0}, Mask: 24},
+			Start:     []byte{10, 0, 2, 100},
+			End:       []byte{10, 0, 2, 110},
+			Gateway:   []byte{10, 0, 2, 1},
+			LeaseTime: 6 * time.Second,
+		},
+	})
+
+	go hardware.Clk.Start()
+	bridge.TurnOn()
+	router.TurnOn()
+	router.EnableDhcpRelay([][]byte{{10, 0, 1, 10}})
+	server.TurnOn()
+	dhcpServer.Start()
+	client1.TurnOn()
+	client2.TurnOn()
+
+	log.Printf("Testcase: Waiting for leases")
+	time.Sleep(3 * time.Second)
+
+	lease1 := client1.GetDhcpClient().GetLease()
+	lease2 := client2.GetDhcpClient().GetLease()
+	if lease1 == nil || lease2 == nil {
+		t.Fatalf("Expected both clients to get a lease")
+	}
+	if !bytes.Equal(lease1.Address, []byte{10, 0, 1, 100}) || lease1.Mask != 24 || !bytes.Equal(lease1.Gateway, []byte{10, 0, 1, 1}) || len(lease1.Dns) != 1 {
+		t.Errorf("Got unexpected lease %v/%d via %v", lease1.Address, lease1.Mask, lease1.Gateway)
+	}
+	if !bytes.Equal(lease2.Address, []byte{10, 0, 2, 100}) || !bytes.Equal(lease2.Gateway, []byte{10, 0, 2, 1}) {
+		t.Errorf("Got unexpected relayed lease %v/%d via %v", lease2.Address, lease2.Mask, lease2.Gateway)
+	}
+	if !bytes.Equal(client2.GetL3Protocol().GetAddressForInterface(0), []byte{10, 0, 2, 100}) {
+		t.Errorf("Expected address to be set on the interface")
+	}
+
+	//The clients can talk to each other using the configured addresses and routes
+	log.Printf("Testcase: Ping between clients")
+	binding := client1.GetICMP().Bind(1)
+	binding.SendEcho(lease2.Address, 1, []byte("ping"), 64, 0)
+	if m := binding.Recv(5 * time.Second); m == nil || m.Err != nil {
+		t.Errorf("Expected a reply from the other client")
+	}
+
+	//Leases are renewed before they expire
+	log.Printf("Testcase: Renewing")
+	time.Sleep(5 * time.Second)
+	renewed := client1.GetDhcpClient().GetLease()
+	if renewed == nil || !renewed.ObtainedAt.After(lease1.ObtainedAt) {
+		t.Errorf("Expected lease to be renewed")
+	}
+	if len(dhcpServer.GetLeases()) != 2 {
+		t.Errorf("Expected server to have 2 leases but got %d", len(dhcpServer.GetLeases()))
+	}
+
+	//Leases are released when the client stops, only the routes the client installed go away with them
+	log.Printf("Testcase: Releasing")
+	backup := &l3.Route{Cidr: protocol.DefaultRouteCidr, Gateway: []byte{10, 0, 1, 2}, Interface: 0, Distance: 5}
+	client1.GetRoutingTable().AddRoute(backup)
+	client1.GetDhcpClient().Stop()
+	time.Sleep(2 * time.Second)
+	if len(dhcpServer.GetLeases()) != 1 || client1.GetDhcpClient().GetLease() != nil {
+		t.Errorf("Expected lease to be released")
+	}
+	routes := client1.GetRoutingTable().GetRoutes()
+	if len(routes) != 1 || !bytes.Equal(routes[0].Gateway, backup.Gateway) {
+		t.Errorf("Expected only the backup default route to be left but got %d routes", len(routes))
+	}
+}
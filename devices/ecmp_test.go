@@ -0,0 +1,125 @@
+package devices
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"netsim/api"
+	"netsim/hardware"
+	"netsim/protocol"
+	"netsim/protocol/l2"
+	"netsim/protocol/l3"
+	"testing"
+	"time"
+)
+
+/*
+Testcase
+*/
+func TestEqualCostMultipath(t *testing.T) {
+	//A router with two equal-cost routes to a remote network
+	host := NewComputer([]byte("ecmph1"), []byte{10, 0, 1, 2})
+	host.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 1, 1})
+	hop1 := NewComputer([]byte("ecmpn1"), []byte{10, 1, 0, 2})
+	hop2 := NewComputer([]byte("ecmpn2"), []byte{10, 2, 0, 2})
+	capture1, capture2 := &frameCapture{}, &frameCapture{}
+	hop1.StartCapture(capture1)
+	hop2.StartCapture(capture2)
+
+	remote := &protocol.CIDR{Address: []byte{10, 9, 0, 0}, Mask: 16}
+	table := l3.NewRoutingTable()
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, nil, 0)
+	table.Add(&protocol.CIDR{Address: []byte{10, 1, 0, 0}, Mask: 24}, nil, 1)
+	table.Add(&protocol.CIDR{Address: []byte{10, 2, 0, 0}, Mask: 24}, nil, 2)
+	table.Add(remote, []byte{10, 2, 0, 2}, 2)
+	table.Add(remote, []byte{10, 1, 0, 2}, 1)
+	router := NewRouter([][]byte{[]byte("ecmpr0"), []byte("ecmpr1"), []byte("ecmpr2")}, [][]byte{{10, 0, 1, 1}, {10, 1, 0, 1}, {10, 2, 0, 1}}, table, l3.NewARP())
+
+	if routes, _ := table.LookupAll([]byte{10, 9, 0, 1}); len(routes) != 2 || routes[0].Interface != 1 || routes[1].Interface != 2 {
+		t.Errorf("Expected both routes ordered by interface but got %v", routes)
+	}
+
+	adapter := func(intfNum int) hardware.Adapter {
+		return router.GetL3Protocol().GetL2ProtocolForInterface(intfNum).GetAdapter()
+	}
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, host.GetAdapter(), adapter(0))
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, hop1.GetAdapter(), adapter(1))
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, hop2.GetAdapter(), adapter(2))
+
+	go hardware.Clk.Start()
+	host.TurnOn()
+	hop1.TurnOn()
+	hop2.TurnOn()
+	router.TurnOn()
+
+	//Returns the source ports of the packets to the remote network seen by a next hop
+	seen := func(capture *frameCapture) []uint16 {
+		var ports []uint16
+		for _, frame := range capture.getFrames() {
+			frameType, packet := l2.GetPayload(frame)
+			if bytes.Equal(frameType, protocol.IP) && len(packet) >= 24 && bytes.Equal(packet[16:18], []byte{10, 9}) {
+				ports = append(ports, binary.BigEndian.Uint16(packet[20:22]))
+			}
+		}
+		return ports
+	}
+	send := func(port uint16, count int) {
+		s := host.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+		for i := 0; i < count; i++ {
+			s.SendTo([]byte{10, 9, 0, 5}, 9000, &port, []byte("multipath"))
+		}
+	}
+
+	//The packets of a flow all take the same path, and the flows are spread over both. The datagrams are small, since
+	//fragmented ones are hashed without their ports and may take another path than the rest of their flow.
+	log.Printf("Testcase: Per flow")
+	for port := uint16(20000); port < 20032; port++ {
+		send(port, 3)
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(3 * time.Second)
+
+	paths := map[uint16]int{}
+	for i, capture := range []*frameCapture{capture1, capture2} {
+		for _, port := range seen(capture) {
+			if path, found := paths[port]; found && path != i {
+				t.Errorf("Expected the flow from port %d to take a single path", port)
+			}
+			paths[port] = i
+		}
+	}
+	used := map[int]int{}
+	for _, path := range paths {
+		used[path]++
+	}
+	if len(paths) != 32 || used[0] == 0 || used[1] == 0 {
+		t.Errorf("Expected the 32 flows to be spread over both paths but got %v", used)
+	}
+
+	stats := router.GetNextHopStats()
+	if len(stats) != 2 || !bytes.Equal(stats[0].Gateway, []byte{10, 1, 0, 2}) || !bytes.Equal(stats[1].Gateway, []byte{10, 2, 0, 2}) {
+		t.Fatalf("Expected counters for both next hops but got %v", stats)
+	}
+	if stats[0].Packets+stats[1].Packets != 96 || stats[0].Packets != uint64(3*used[0]) {
+		t.Errorf("Expected the counters to match the flows but got %d and %d packets", stats[0].Packets, stats[1].Packets)
+	}
+
+	//Per packet, a single flow is spread evenly
+	log.Printf("Testcase: Per packet")
+	router.SetMultipathMode(l3.MultipathPerPacket)
+	send(30000, 10)
+	time.Sleep(3 * time.Second)
+
+	count := func(capture *frameCapture) int {
+		n := 0
+		for _, port := range seen(capture) {
+			if port == 30000 {
+				n++
+			}
+		}
+		return n
+	}
+	if count(capture1) != 5 || count(capture2) != 5 {
+		t.Errorf("Expected the packets of the flow to alternate between the paths but got %d and %d", count(capture1), count(capture2))
+	}
+}
@@ -0,0 +1,70 @@
+package devices
+
+import (
+	"netsim/hardware"
+	"netsim/protocol"
+	"netsim/protocol/l2"
+	"netsim/protocol/l3"
+)
+
+/*
+A firewall is a router which only forwards the packets its packet filter allows. Separating networks with firewalls lets
+them be split into zones, like a DMZ which the outside world can reach only some services in, and an inside network
+which only its own hosts can open connections from.
+*/
+type Firewall struct {
+	ip       *l3.IP
+	icmp     *l3.ICMP
+	filter   *PacketFilter
+	numPorts int
+}
+
+func NewFirewall(macs [][]byte, ipAddrs [][]byte, routingTable protocol.RouteProvider, addrResolutionTable protocol.AddressResolver) *Firewall {
+	firewall := &Firewall{
+		ip:       l3.NewIP(ipAddrs, true, nil, routingTable, addrResolutionTable),
+		icmp:     l3.NewICMP(),
+		numPorts: len(ipAddrs),
+	}
+	firewall.filter = NewPacketFilter(firewall.ip)
+
+	//ICMP answers pings and tells the senders of rejected packets about them
+	firewall.ip.AddL4Protocol(firewall.icmp)
+	firewall.icmp.AddL3Protocol(firewall.ip)
+
+	for i, m := range macs {
+		eth := l2.NewEthernet(hardware.NewEthernetAdapter(m, false), nil)
+		eth.AddL3Protocol(firewall.ip)
+		firewall.ip.SetL2ProtocolForInterface(i, eth)
+	}
+
+	//Dynamic address resolution has to listen on the interfaces
+	if arp, ok := addrResolutionTable.(*l3.ARP); ok {
+		arp.Attach(firewall.ip)
+	}
+
+	return firewall
+}
+
+func (f *Firewall) GetL3Protocol() protocol.L3Protocol {
+	return f.ip
+}
+
+func (f *Firewall) GetICMP() *l3.ICMP {
+	return f.icmp
+}
+
+func (f *Firewall) GetPacketFilter() *PacketFilter {
+	return f.filter
+}
+
+func (f *Firewall) TurnOn() {
+	for i := 0; i < f.numPorts; i++ {
+		f.ip.GetL2ProtocolForInterface(i).GetAdapter().TurnOn()
+	}
+}
+
+func (f *Firewall) TurnOff() {
+	for i := 0; i < f.numPorts; i++ {
+		f.ip.GetL2ProtocolForInterface(i).GetAdapter().TurnOff()
+	}
+}
@@ -0,0 +1,149 @@
+package devices
+
+import (
+	"bytes"
+	"log"
+	"netsim/api"
+	"netsim/hardware"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"testing"
+	"time"
+)
+
+/*
+Testcase
+*/
+func TestFirewall(t *testing.T) {
+	//An inside network which can open connections to the outside, but not the other way round
+	inside := NewComputer([]byte("fwcin1"), []byte{10, 0, 1, 2})
+	inside.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 1, 1})
+	outside := NewComputer([]byte("fwcout"), []byte{10, 0, 2, 2})
+	outside.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 2, 1})
+
+	table := l3.NewRoutingTable()
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, nil, 0)
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 2, 0}, Mask: 24}, nil, 1)
+	firewall := NewFirewall([][]byte{[]byte("fwall0"), []byte("fwall1")}, [][]byte{{10, 0, 1, 1}, {10, 0, 2, 1}}, table, l3.NewARP())
+
+	filter := firewall.GetPacketFilter()
+	filter.SetPolicy(l3.HookForward, ActionDrop)
+	filter.AppendRule(l3.HookForward, FilterRule{States: StateEstablished | StateRelated, Action: ActionAccept})
+	filter.AppendRule(l3.HookForward, FilterRule{InInterfaces: []int{0}, States: StateNew, Action: ActionAccept, Log: true})
+	filter.AppendRule(l3.HookForward, FilterRule{InInterfaces: []int{1}, Protocol: protocol.UDP, DestPorts: &PortRange{From: 23, To: 23}, Action: ActionReject})
+
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, inside.GetAdapter(), firewall.GetL3Protocol().GetL2ProtocolForInterface(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, outside.GetAdapter(), firewall.GetL3Protocol().GetL2ProtocolForInterface(1).GetAdapter())
+
+	go hardware.Clk.Start()
+	inside.TurnOn()
+	outside.TurnOn()
+	firewall.TurnOn()
+
+	bind := func(c *Computer, port uint16) *api.Socket {
+		s := c.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+		s.Bind([]byte{0, 0, 0, 0}, port)
+		return s
+	}
+
+	//The inside opens a flow, and the answers are let back in
+	log.Printf("Testcase: Flow from the inside")
+	client := bind(inside, 7000)
+	server := bind(outside, 7000)
+	port := uint16(7000)
+	data := []byte("Hello outside")
+	client.SendTo([]byte{10, 0, 2, 2}, 7000, &port, data)
+	if received := waitForData(server, len(data), 5*time.Second); !bytes.Equal(received, data) {
+		t.Fatalf("Expected the outside to receive %s but got %s", data, received)
+	}
+	reply := []byte("Hello inside")
+	server.SendTo([]byte{10, 0, 1, 2}, 7000, &port, reply)
+	if received := waitForData(client, len(reply), 5*time.Second); !bytes.Equal(received, reply) {
+		t.Errorf("Expected the answer to be let in but got %s", received)
+	}
+
+	//The outside cannot open flows
+	log.Printf("Testcase: Flow from the outside")
+	target := bind(inside, 7001)
+	outsider := bind(outside, 7001)
+	port = 7001
+	outsider.SendTo([]byte{10, 0, 1, 2}, 7001, &port, data)
+	if received := waitForData(target, len(data), 2*time.Second); len(received) != 0 {
+		t.Errorf("Expected packets from the outside to be dropped but got %s", received)
+	}
+
+	//Rejected packets are reported to the sender
+	log.Printf("Testcase: Rejecting")
+	rejected := bind(outside, 7002)
+	port = 7002
+	rejected.SendTo([]byte{10, 0, 1, 2}, 23, &port, data)
+	if err := waitForError(rejected, 5*time.Second); err != protocol.ErrProhibited {
+		t.Errorf("Expected the sender to be told the packet is prohibited but got %v", err)
+	}
+
+	rules := filter.GetRules(l3.HookForward)
+	if rules[0].Hits != 1 || rules[1].Hits != 1 || rules[2].Hits != 1 {
+		t.Errorf("Expected every rule to have matched one packet but got %d, %d and %d", rules[0].Hits, rules[1].Hits, rules[2].Hits)
+	}
+
+	//A host firewall can stop what the network firewall lets through, and its own packets
+	log.Printf("Testcase: Host firewall")
+	hostFilter := outside.EnableFirewall()
+	hostFilter.AppendRule(l3.HookInput, FilterRule{Protocol: protocol.UDP, DestPorts: &PortRange{From: 7003, To: 7004}, Action: ActionDrop})
+	hostFilter.AppendRule(l3.HookOutput, FilterRule{Destination: &protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, Protocol: protocol.UDP, Action: ActionReject})
+
+	blocked := bind(outside, 7003)
+	port = 7000
+	client.SendTo([]byte{10, 0, 2, 2}, 7003, &port, data)
+	if received := waitForData(blocked, len(data), 2*time.Second); len(received) != 0 {
+		t.Errorf("Expected the host firewall to drop the packet but got %s", received)
+	}
+
+	port = 7000
+	server.SendTo([]byte{10, 0, 1, 2}, 7000, &port, reply)
+	if err := waitForError(server, 2*time.Second); err != protocol.ErrProhibited {
+		t.Errorf("Expected the host to be stopped from sending but got %v", err)
+	}
+}
+
+func TestFilterRuleFragments(t *testing.T) {
+	//A UDP packet to port 23, and a later fragment whose data happens to look the same
+	first := make([]byte, 40)
+	first[0], first[6], first[10] = 0x04, 0x00, protocol.UDP[0]
+	first[20], first[21], first[22], first[23] = 0x1B, 0x58, 0x00, 23
+	later := append([]byte{}, first...)
+	later[6], later[8] = 0x01, 24
+
+	ports := FilterRule{Protocol: protocol.UDP, DestPorts: &PortRange{From: 23, To: 23}}
+	if !ports.matches(&l3.HookPacket{Packet: first}, 0) {
+		t.Errorf("Expected the first fragment to match the ports")
+	}
+	if ports.matches(&l3.HookPacket{Packet: later}, 0) {
+		t.Errorf("Expected a later fragment never to match the ports")
+	}
+
+	first[10], later[10] = protocol.TCP[0], protocol.TCP[0]
+	first[32], later[32] = 0x01, 0x01
+	flags := FilterRule{TcpFlags: 0x01, TcpFlagsMask: 0x01}
+	if !flags.matches(&l3.HookPacket{Packet: first}, 0) || flags.matches(&l3.HookPacket{Packet: later}, 0) {
+		t.Errorf("Expected only the first fragment to match the TCP flags")
+	}
+
+	//Rules without ports match every fragment
+	proto := FilterRule{Protocol: protocol.TCP}
+	if !proto.matches(&l3.HookPacket{Packet: later}, 0) {
+		t.Errorf("Expected a later fragment to match a rule without ports")
+	}
+}
+
+/*
+Reading the error of a socket clears it, hence it is polled for here
+*/
+func waitForError(socket *api.Socket, timeout time.Duration) error {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if err := socket.GetError(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package devices
+
+import (
+	"bytes"
+	"log"
+	"netsim/protocol"
+	"netsim/protocol/l2"
+	"netsim/protocol/l3"
+	"sort"
+	"time"
+)
+
+/*
+IGMP snooping keeps multicast from being flooded to every port like broadcast. The bridge looks into the IGMP messages
+passing through it: reports tell it which ports have listeners for a group, leaves that a port does not want the group
+anymore, and queries which ports lead to multicast routers. Frames for a group are sent to the ports which have listeners
+for it, and to the router ports since routers want all multicast. Frames for groups without listeners only go to the
+router ports. Reports and leaves are only sent to the router ports too, hence every listener reports, since it never
+hears the reports of the others.
+Groups in 224.0.0.0/24 are used by protocols which expect everyone on the link to hear them, hence they are always
+flooded, and so is everything which is not IP multicast.
+Groups are learnt per VLAN and forgotten if not reported again within the timeout. A port leaves a group as soon as a
+leave arrives on it, since each port is expected to have a single host behind it.
+*/
+const (
+	defaultIgmpSnoopingTimeout = 260 * time.Second
+)
+
+/*
+A group which has listeners on the ports
+*/
+type IgmpSnoopingEntry struct {
+	VlanId uint16
+	Group  []byte
+	Ports  []int
+}
+
+type igmpSnoopingKey struct {
+	vlanId uint16
+	group  string
+}
+
+type igmpSnooping struct {
+	members     map[igmpSnoopingKey]map[int]time.Time
+	routerPorts map[uint16]map[int]time.Time
+	timeout     time.Duration
+}
+
+func newIgmpSnooping() *igmpSnooping {
+	return &igmpSnooping{
+		members:     map[igmpSnoopingKey]map[int]time.Time{},
+		routerPorts: map[uint16]map[int]time.Time{},
+		timeout:     defaultIgmpSnoopingTimeout,
+	}
+}
+
+func (b *Bridge) SetIgmpSnooping(enabled bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !enabled {
+		b.igmpSnooping = nil
+	} else if b.igmpSnooping == nil {
+		b.igmpSnooping = newIgmpSnooping()
+	}
+}
+
+/*
+Sets how long a group or router port is remembered without hearing from it. Should be longer than the query interval of
+the routers.
+*/
+func (b *Bridge) SetIgmpSnoopingTimeout(timeout time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.igmpSnooping != nil {
+		b.igmpSnooping.timeout = timeout
+	}
+}
+
+func (b *Bridge) IgmpSnoopingTable() []IgmpSnoopingEntry {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.igmpSnooping == nil {
+		return nil
+	}
+
+	var entries []IgmpSnoopingEntry
+	for key, ports := range b.igmpSnooping.members {
+		entry := IgmpSnoopingEntry{VlanId: key.vlanId, Group: []byte(key.group), Ports: getLivePorts(ports)}
+		if len(entry.Ports) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+/*
+Returns the ports multicast routers have been heard on in the VLAN
+*/
+func (b *Bridge) IgmpRouterPorts(vlanId uint16) []int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.igmpSnooping == nil {
+		return nil
+	}
+	return getLivePorts(b.igmpSnooping.routerPorts[vlanId])
+}
+
+/*
+Internal methods. These expect the bridge lock to be held.
+*/
+
+/*
+Learns from the IGMP messages in the frame, and returns the ports a multicast frame has to be sent to. Returns false if
+the frame has to be flooded instead.
+*/
+func (b *Bridge) snoopMulticast(portNum int, vlanId uint16, frame []byte) ([]int, bool) {
+	snooping := b.igmpSnooping
+	if snooping == nil || !l2.IsMulticastAddress(frame[8:14]) {
+		return nil, false
+	}
+
+	frameType, packet := l2.GetPayload(frame)
+	if !bytes.Equal(frameType, protocol.IP) || len(packet) < 20 {
+		return nil, false
+	}
+
+	//The destination is at the same place in both header formats of IP
+	destAddr := packet[16:20]
+	if destAddr[0]&0xF0 != 0xE0 {
+		return nil, false
+	}
+
+	now := time.Now()
+	if msgType, group, ok := l3.ParseIgmp(packet); ok {
+		switch msgType {
+		case l3.IgmpQuery:
+			if snooping.routerPorts[vlanId] == nil {
+				snooping.routerPorts[vlanId] = map[int]time.Time{}
+			}
+			if _, ok := snooping.routerPorts[vlanId][portNum]; !ok {
+				log.Printf("Bridge: Multicast router on port %d in VLAN %d", portNum, vlanId)
+			}
+			snooping.routerPorts[vlanId][portNum] = now.Add(snooping.timeout)
+		case l3.IgmpReportV2:
+			key := igmpSnoopingKey{vlanId, string(group)}
+			if snooping.members[key] == nil {
+				snooping.members[key] = map[int]time.Time{}
+			}
+			snooping.members[key][portNum] = now.Add(snooping.timeout)
+			return getLivePorts(snooping.routerPorts[vlanId]), true
+		case l3.IgmpLeave:
+			key := igmpSnoopingKey{vlanId, string(group)}
+			delete(snooping.members[key], portNum)
+			if len(snooping.members[key]) == 0 {
+				delete(snooping.members, key)
+			}
+			return getLivePorts(snooping.routerPorts[vlanId]), true
+		}
+	}
+
+	if destAddr[0] == 224 && destAddr[1] == 0 && destAddr[2] == 0 {
+		return nil, false
+	}
+
+	ports := getLivePorts(snooping.members[igmpSnoopingKey{vlanId, string(destAddr)}])
+	isListener := map[int]bool{}
+	for _, p := range ports {
+		isListener[p] = true
+	}
+	for _, p := range getLivePorts(snooping.routerPorts[vlanId]) {
+		if !isListener[p] {
+			ports = append(ports, p)
+		}
+	}
+	return ports, true
+}
+
+/*
+Returns the ports which have not expired, in order
+*/
+func getLivePorts(ports map[int]time.Time) []int {
+	var live []int
+	now := time.Now()
+	for p, expiresAt := range ports {
+		if expiresAt.After(now) {
+			live = append(live, p)
+		}
+	}
+	sort.Ints(live)
+	return live
+}
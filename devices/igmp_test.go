@@ -0,0 +1,100 @@
+package devices
+
+import (
+	"bytes"
+	"log"
+	"netsim/api"
+	"netsim/hardware"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"testing"
+	"time"
+)
+
+/*
+Testcase
+*/
+func TestIgmpSnooping(t *testing.T) {
+	//A router querying for groups and three computers, all on a bridge snooping on IGMP
+	table := l3.NewRoutingTable()
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, nil, 0)
+	router := NewRouter([][]byte{[]byte("igmpr1")}, [][]byte{{10, 0, 1, 1}}, table, l3.NewARP())
+	router.GetIGMP().SetQueryInterval(5 * time.Second)
+	router.GetIGMP().SetQuerier(true)
+
+	sender := NewComputer([]byte("igmpc1"), []byte{10, 0, 1, 2})
+	listener := NewComputer([]byte("igmpc2"), []byte{10, 0, 1, 3})
+	other := NewComputer([]byte("igmpc3"), []byte{10, 0, 1, 4})
+	capture := &frameCapture{}
+	other.StartCapture(capture)
+
+	bridge := NewBridge([][]byte{[]byte("igmpb0"), []byte("igmpb1"), []byte("igmpb2"), []byte("igmpb3")})
+	bridge.SetIgmpSnooping(true)
+
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, router.GetL3Protocol().GetL2ProtocolForInterface(0).GetAdapter(), bridge.GetPort(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, sender.GetAdapter(), bridge.GetPort(1).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, listener.GetAdapter(), bridge.GetPort(2).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, other.GetAdapter(), bridge.GetPort(3).GetAdapter())
+
+	go hardware.Clk.Start()
+	bridge.TurnOn()
+	router.TurnOn()
+	sender.TurnOn()
+	listener.TurnOn()
+	other.TurnOn()
+
+	//The first query tells the bridge where the router is
+	time.Sleep(2 * time.Second)
+	if ports := bridge.IgmpRouterPorts(0); len(ports) != 1 || ports[0] != 0 {
+		t.Fatalf("Expected the router to be learnt on port 0 but got %v", ports)
+	}
+	if !router.GetIGMP().IsQuerier(0) {
+		t.Errorf("Expected the only router on the link to be the querier")
+	}
+
+	//The listener joins the group, which the router and the bridge learn from its report
+	log.Printf("Testcase: Joining the group")
+	group := []byte{239, 1, 1, 1}
+	server := listener.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+	server.Bind([]byte{0, 0, 0, 0}, 5000)
+	server.SetSockOpt(api.IP_ADD_MEMBERSHIP, group)
+	time.Sleep(2 * time.Second)
+
+	if groups := router.GetIGMP().GetGroups(0); len(groups) != 1 || !bytes.Equal(groups[0], group) {
+		t.Errorf("Expected the router to know about the group but got %v", groups)
+	}
+	entries := bridge.IgmpSnoopingTable()
+	if len(entries) != 1 || !bytes.Equal(entries[0].Group, group) || len(entries[0].Ports) != 1 || entries[0].Ports[0] != 2 {
+		t.Fatalf("Expected the listener to be learnt on port 2 but got %+v", entries)
+	}
+
+	//Data sent to the group reaches the listener and not the other computer
+	log.Printf("Testcase: Sending to the group")
+	client := sender.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+	data := []byte("Hello group")
+	client.SendTo(group, 5000, nil, data)
+	var received []byte
+	for i := 0; i < 50 && received == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+		received = server.Recv(len(data))
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("Expected the listener to receive %s but got %s", data, received)
+	}
+	for _, frame := range capture.getFrames() {
+		if bytes.Equal(frame[8:14], l3.GroupMacAddress(group)) {
+			t.Errorf("Expected no frames for the group on a port without listeners")
+		}
+	}
+
+	//Once the listener leaves, the group is forgotten after the router checks that no one else wants it
+	log.Printf("Testcase: Leaving the group")
+	server.SetSockOpt(api.IP_DROP_MEMBERSHIP, group)
+	time.Sleep(4 * time.Second)
+	if entries := bridge.IgmpSnoopingTable(); len(entries) != 0 {
+		t.Errorf("Expected the bridge to forget the group but got %+v", entries)
+	}
+	if groups := router.GetIGMP().GetGroups(0); len(groups) != 0 {
+		t.Errorf("Expected the router to forget the group but got %v", groups)
+	}
+}
@@ -0,0 +1,239 @@
+package devices
+
+import (
+	"bytes"
+	"log"
+	"netsim/api"
+	"netsim/hardware"
+	"netsim/protocol"
+	"netsim/protocol/l2"
+	"netsim/protocol/l3"
+	"testing"
+	"time"
+)
+
+/*
+Testcase
+*/
+func TestIPv6(t *testing.T) {
+	//A dual-stack router between a computer which configures itself and one with a static address
+	prefix1 := []byte{0x20, 0x01, 0x0D, 0xB8, 0, 1, 0, 0}
+	prefix2 := []byte{0x20, 0x01, 0x0D, 0xB8, 0, 2, 0, 0}
+	routerAddr1 := append(append([]byte{}, prefix1...), 0, 0, 0, 0, 0, 0, 0, 1)
+	routerAddr2 := append(append([]byte{}, prefix2...), 0, 0, 0, 0, 0, 0, 0, 1)
+	staticAddr := append(append([]byte{}, prefix2...), 0, 0, 0, 0, 0, 0, 0, 2)
+
+	computer1 := NewComputer([]byte("v6c001"), []byte{10, 0, 1, 2})
+	computer1.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 1, 1})
+	ipv61 := computer1.EnableIPv6(nil)
+	computer2 := NewComputer([]byte("v6c002"), []byte{10, 0, 2, 2})
+	computer2.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 2, 1})
+	computer2.EnableIPv6(staticAddr)
+
+	table := l3.NewRoutingTable()
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, nil, 0)
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 2, 0}, Mask: 24}, nil, 1)
+	router := NewRouter([][]byte{[]byte("v6r001"), []byte("v6r002")}, [][]byte{{10, 0, 1, 1}, {10, 0, 2, 1}}, table, l3.NewARP())
+	router.EnableIPv6([][]byte{routerAddr1, routerAddr2}).GetNDP().SetAdvertisementInterval(time.Second)
+
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, computer1.GetAdapter(), router.GetL3Protocol().GetL2ProtocolForInterface(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, computer2.GetAdapter(), router.GetL3Protocol().GetL2ProtocolForInterface(1).GetAdapter())
+
+	go hardware.Clk.Start()
+	computer1.TurnOn()
+	computer2.TurnOn()
+	router.TurnOn()
+
+	//The address is made of the prefix and the MAC address, with the universal/local bit flipped
+	log.Printf("Testcase: Waiting for SLAAC")
+	expectedAddr := append(append([]byte{}, prefix1...), 'v'^0x02, '6', 'c', 0xFF, 0xFE, '0', '0', '1')
+	var addresses [][]byte
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		addresses = ipv61.GetAddressesForInterface(0)
+		if len(addresses) == 2 && len(ipv61.GetNDP().GetRouters(0)) == 1 {
+			break
+		}
+	}
+	if len(addresses) != 2 || !bytes.Equal(addresses[1], expectedAddr) {
+		t.Fatalf("Expected address %v to be configured but got %v", expectedAddr, addresses)
+	}
+	if !bytes.Equal(addresses[0][0:8], []byte{0xFE, 0x80, 0, 0, 0, 0, 0, 0}) || !bytes.Equal(addresses[0][8:], expectedAddr[8:]) {
+		t.Errorf("Expected link local address with the same interface identifier but got %v", addresses[0])
+	}
+	route, err := computer1.GetRoutingTable().Lookup(staticAddr)
+	if err != nil || !bytes.Equal(route.Gateway, router.GetIPv6().GetLinkLocalAddress(0)) {
+		t.Errorf("Expected default route through the router but got %v %v", route, err)
+	}
+
+	//Datagrams across the router, with one big enough to need fragments
+	log.Printf("Testcase: Sending datagrams over IPv6")
+	server := computer2.NewSocket(api.AF_INET6, api.SOCK_DGRAM, 0)
+	server.Bind(make([]byte, 16), 80)
+	big := bytes.Repeat([]byte("0123456789"), 400)
+
+	client := computer1.NewSocket(api.AF_INET6, api.SOCK_DGRAM, 0)
+	srcPort := uint16(5000)
+	client.Bind(make([]byte, 16), srcPort)
+	client.SendTo(staticAddr, 80, &srcPort, []byte("hello_over_ipv6"))
+	client.SendTo(staticAddr, 80, &srcPort, big)
+
+	received := waitForData(server, len("hello_over_ipv6")+len(big), 10*time.Second)
+	if !bytes.Equal(received, append([]byte("hello_over_ipv6"), big...)) {
+		t.Fatalf("Expected the datagrams to arrive intact but got %d bytes", len(received))
+	}
+
+	//Streams work the same way
+	log.Printf("Testcase: Connecting over IPv6")
+	listener := computer2.NewSocket(api.AF_INET6, api.SOCK_STREAM, 0)
+	listener.Bind(make([]byte, 16), 8080)
+	listener.Listen(1)
+	accepted := make(chan *api.Socket, 1)
+	go func() {
+		accepted <- listener.Accept()
+	}()
+
+	stream := computer1.NewSocket(api.AF_INET6, api.SOCK_STREAM, 0)
+	stream.Connect(staticAddr, 8080)
+	if stream.GetError() != nil {
+		t.Fatalf("Expected to connect but got %v", stream.GetError())
+	}
+	stream.Send([]byte("stream_over_ipv6"))
+	select {
+	case conn := <-accepted:
+		if data := waitForData(conn, len("stream_over_ipv6"), 10*time.Second); string(data) != "stream_over_ipv6" {
+			t.Errorf("Expected data over the stream but got %s", data)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected the connection to be accepted")
+	}
+
+	//IP still works next to IPv6, on the same port
+	log.Printf("Testcase: Sending datagram over IP")
+	server4 := computer2.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+	server4.Bind([]byte{0, 0, 0, 0}, 80)
+	client4 := computer1.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+	client4.SendTo([]byte{10, 0, 2, 2}, 80, nil, []byte("hello_over_ip"))
+	received = waitForData(server4, len("hello_over_ip"), 10*time.Second)
+	if string(received) != "hello_over_ip" {
+		t.Errorf("Expected the datagram over IP but got %s", received)
+	}
+	client.SendTo(staticAddr, 80, &srcPort, []byte("still_over_ipv6"))
+	if received = waitForData(server, len("still_over_ipv6"), 10*time.Second); string(received) != "still_over_ipv6" {
+		t.Errorf("Expected the datagram over IPv6 to reach its own socket but got %s", received)
+	}
+
+	//Nobody listens on the port, hence the answer of the computer comes back as an error
+	log.Printf("Testcase: Sending to a closed port")
+	client.SendTo(staticAddr, 82, &srcPort, []byte("anyone_there"))
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		err = client.GetError()
+		if err != nil {
+			break
+		}
+	}
+	if err != protocol.ErrPortUnreachable {
+		t.Errorf("Expected port unreachable but got %v", err)
+	}
+}
+
+func TestIPv6PathMTU(t *testing.T) {
+	//Two routers joined by a link with the smallest MTU IPv6 allows
+	prefix1 := []byte{0x20, 0x01, 0x0D, 0xB8, 0, 0x11, 0, 0}
+	prefix2 := []byte{0x20, 0x01, 0x0D, 0xB8, 0, 0x12, 0, 0}
+	prefix3 := []byte{0x20, 0x01, 0x0D, 0xB8, 0, 0x13, 0, 0}
+	addr := func(prefix []byte, host byte) []byte {
+		return append(append([]byte{}, prefix...), 0, 0, 0, 0, 0, 0, 0, host)
+	}
+
+	computer1 := NewComputer([]byte("v6pc01"), []byte{10, 0, 1, 2})
+	ipv61 := computer1.EnableIPv6(addr(prefix1, 2))
+	computer2 := NewComputer([]byte("v6pc02"), []byte{10, 0, 3, 2})
+	computer2.EnableIPv6(addr(prefix3, 2))
+
+	table1 := l3.NewRoutingTable()
+	table1.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, nil, 0)
+	table1.Add(&protocol.CIDR{Address: []byte{10, 0, 2, 0}, Mask: 24}, nil, 1)
+	table1.Add(&protocol.CIDR{Address: addr(prefix3, 0), Mask: 64}, addr(prefix2, 2), 1)
+	router1 := NewRouter([][]byte{[]byte("v6pr01"), []byte("v6pr02")}, [][]byte{{10, 0, 1, 1}, {10, 0, 2, 1}}, table1, l3.NewARP())
+	router1.EnableIPv6([][]byte{addr(prefix1, 1), addr(prefix2, 1)}).GetNDP().SetAdvertisementInterval(time.Second)
+
+	table2 := l3.NewRoutingTable()
+	table2.Add(&protocol.CIDR{Address: []byte{10, 0, 2, 0}, Mask: 24}, nil, 0)
+	table2.Add(&protocol.CIDR{Address: []byte{10, 0, 3, 0}, Mask: 24}, nil, 1)
+	table2.Add(&protocol.CIDR{Address: addr(prefix1, 0), Mask: 64}, addr(prefix2, 1), 0)
+	router2 := NewRouter([][]byte{[]byte("v6pr03"), []byte("v6pr04")}, [][]byte{{10, 0, 2, 2}, {10, 0, 3, 1}}, table2, l3.NewARP())
+	router2.EnableIPv6([][]byte{addr(prefix2, 2), addr(prefix3, 1)}).GetNDP().SetAdvertisementInterval(time.Second)
+
+	router1.GetL3Protocol().GetL2ProtocolForInterface(1).(*l2.Ethernet).SetMTU(1280)
+	router2.GetL3Protocol().GetL2ProtocolForInterface(0).(*l2.Ethernet).SetMTU(1280)
+
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, computer1.GetAdapter(), router1.GetL3Protocol().GetL2ProtocolForInterface(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, router1.GetL3Protocol().GetL2ProtocolForInterface(1).GetAdapter(), router2.GetL3Protocol().GetL2ProtocolForInterface(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, router2.GetL3Protocol().GetL2ProtocolForInterface(1).GetAdapter(), computer2.GetAdapter())
+
+	go hardware.Clk.Start()
+	computer1.TurnOn()
+	computer2.TurnOn()
+	router1.TurnOn()
+	router2.TurnOn()
+
+	//The computers learn their default routes from the advertisements
+	destAddr := addr(prefix3, 2)
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if len(ipv61.GetNDP().GetRouters(0)) == 1 && len(computer2.GetIPv6().GetNDP().GetRouters(0)) == 1 {
+			break
+		}
+	}
+	if mtu := ipv61.GetPathMTU(destAddr); mtu != 1500 {
+		t.Errorf("Expected the MTU of the interface before anything is learnt but got %d", mtu)
+	}
+
+	listener := computer2.NewSocket(api.AF_INET6, api.SOCK_STREAM, 0)
+	listener.Bind(make([]byte, 16), 8080)
+	listener.Listen(1)
+	accepted := make(chan *api.Socket, 1)
+	go func() {
+		accepted <- listener.Accept()
+	}()
+
+	stream := computer1.NewSocket(api.AF_INET6, api.SOCK_STREAM, 0)
+	stream.Connect(destAddr, 8080)
+	if stream.GetError() != nil {
+		t.Fatalf("Expected to connect but got %v", stream.GetError())
+	}
+	var conn *api.Socket
+	select {
+	case conn = <-accepted:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected the connection to be accepted")
+	}
+
+	//The first segment is too large for the link between the routers, which sends back Packet Too Big
+	log.Printf("Testcase: Discovering the IPv6 path MTU")
+	data := bytes.Repeat([]byte("0123456789"), 300)
+	stream.Send(data)
+	if received := waitForData(conn, len(data), 30*time.Second); !bytes.Equal(received, data) {
+		t.Fatalf("Expected the data to arrive intact but got %d bytes", len(received))
+	}
+	if mtu := ipv61.GetPathMTU(destAddr); mtu != 1280 {
+		t.Errorf("Expected path MTU 1280 but got %d", mtu)
+	}
+
+	//Datagrams are fragmented by the source to fit the path
+	log.Printf("Testcase: Sending a datagram over the small link")
+	server := computer2.NewSocket(api.AF_INET6, api.SOCK_DGRAM, 0)
+	server.Bind(make([]byte, 16), 80)
+	client := computer1.NewSocket(api.AF_INET6, api.SOCK_DGRAM, 0)
+	client.SendTo(destAddr, 80, nil, data)
+	if received := waitForData(server, len(data), 10*time.Second); !bytes.Equal(received, data) {
+		t.Errorf("Expected the datagram to arrive intact but got %d bytes", len(received))
+	}
+}
+
+func waitForData(socket *api.Socket, length int, timeout time.Duration) []byte {
+	var received []byte
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline) && len(received) < length; time.Sleep(100 * time.Millisecond) {
+		received = append(received, socket.Recv(length-len(received))...)
+	}
+	return received
+}
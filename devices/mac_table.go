@@ -0,0 +1,309 @@
+package devices
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+The MAC address table of a bridge. Entries are kept per VLAN so that the same address can be learnt on different ports
+in different VLANs. Dynamic entries expire after the aging time, static entries are configured by an administrator and
+never expire, sticky entries are learnt dynamically but then behave like static entries.
+When the table is full, the least recently seen dynamic entry is evicted to make space for the new one.
+*/
+const (
+	MacEntryDynamic = iota
+	MacEntryStatic
+	MacEntrySticky
+)
+
+const (
+	defaultMacAgingTime = 300 * time.Second
+	defaultMacTableSize = 8192
+)
+
+/*
+Snapshot of a single entry, as returned by Bridge.MacTable
+*/
+type MacTableEntry struct {
+	VlanId  uint16
+	Address []byte
+	Port    int
+	Type    int
+	Age     time.Duration
+}
+
+type macTable struct {
+	entries   map[uint16]map[string]*macTableEntry
+	agingTime time.Duration
+	maxSize   int
+	size      int
+	lock      sync.Mutex
+}
+
+func newMacTable() *macTable {
+	return &macTable{
+		entries:   make(map[uint16]map[string]*macTableEntry),
+		agingTime: defaultMacAgingTime,
+		maxSize:   defaultMacTableSize,
+	}
+}
+
+func (m *macTable) setAgingTime(agingTime time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.agingTime = agingTime
+}
+
+func (m *macTable) setMaxSize(maxSize int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.maxSize = maxSize
+	for m.size > m.maxSize {
+		if !m.evictOldest() {
+			break
+		}
+	}
+}
+
+/*
+Learn the port for an address. Returns false if the address could not be learnt because the table is full of entries
+which cannot be evicted.
+*/
+func (m *macTable) learn(vlanId uint16, addr []byte, port int, entryType int) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	entry := m.get(vlanId, addr, now)
+	if entry != nil {
+		//Static and sticky entries are not moved by learning
+		if entry.entryType == MacEntryDynamic {
+			entry.port = port
+			entry.entryType = entryType
+		}
+		entry.lastSeen = now
+		return true
+	}
+
+	if m.size >= m.maxSize && !m.evictOldest() {
+		return false
+	}
+
+	m.put(&macTableEntry{
+		vlanId:    vlanId,
+		address:   append([]byte{}, addr...),
+		port:      port,
+		entryType: entryType,
+		lastSeen:  now,
+	})
+	return true
+}
+
+func (m *macTable) addStatic(vlanId uint16, addr []byte, port int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry := m.get(vlanId, addr, time.Now())
+	if entry != nil {
+		entry.port = port
+		entry.entryType = MacEntryStatic
+		return
+	}
+
+	if m.size >= m.maxSize {
+		m.evictOldest()
+	}
+
+	m.put(&macTableEntry{
+		vlanId:    vlanId,
+		address:   append([]byte{}, addr...),
+		port:      port,
+		entryType: MacEntryStatic,
+		lastSeen:  time.Now(),
+	})
+}
+
+func (m *macTable) remove(vlanId uint16, addr []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	vlanEntries, ok := m.entries[vlanId]
+	if !ok {
+		return
+	}
+	if _, ok := vlanEntries[string(addr)]; ok {
+		delete(vlanEntries, string(addr))
+		m.size--
+	}
+}
+
+func (m *macTable) lookup(vlanId uint16, addr []byte) (int, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry := m.get(vlanId, addr, time.Now())
+	if entry == nil {
+		return -1, false
+	}
+
+	return entry.port, true
+}
+
+/*
+Remove the dynamic entries pointing to a port. Used when the link on the port goes down, since the hosts behind it have
+to be re-learnt wherever they show up next.
+*/
+func (m *macTable) flushPort(port int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.removeWhere(func(e *macTableEntry) bool {
+		return e.port == port && e.entryType == MacEntryDynamic
+	})
+}
+
+func (m *macTable) flush() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.removeWhere(func(e *macTableEntry) bool {
+		return e.entryType == MacEntryDynamic
+	})
+}
+
+func (m *macTable) countForPort(port int) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, vlanEntries := range m.entries {
+		for _, e := range vlanEntries {
+			if e.port == port && !m.isExpired(e, now) {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+func (m *macTable) snapshot() []MacTableEntry {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	m.removeWhere(func(e *macTableEntry) bool {
+		return m.isExpired(e, now)
+	})
+
+	var result []MacTableEntry
+	for _, vlanEntries := range m.entries {
+		for _, e := range vlanEntries {
+			result = append(result, MacTableEntry{
+				VlanId:  e.vlanId,
+				Address: append([]byte{}, e.address...),
+				Port:    e.port,
+				Type:    e.entryType,
+				Age:     now.Sub(e.lastSeen),
+			})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].VlanId != result[j].VlanId {
+			return result[i].VlanId < result[j].VlanId
+		}
+		return bytes.Compare(result[i].Address, result[j].Address) < 0
+	})
+	return result
+}
+
+/*
+Internal methods. These expect the lock to be held.
+*/
+func (m *macTable) get(vlanId uint16, addr []byte, now time.Time) *macTableEntry {
+	vlanEntries, ok := m.entries[vlanId]
+	if !ok {
+		return nil
+	}
+
+	entry, ok := vlanEntries[string(addr)]
+	if !ok {
+		return nil
+	}
+
+	if m.isExpired(entry, now) {
+		delete(vlanEntries, string(addr))
+		m.size--
+		return nil
+	}
+
+	return entry
+}
+
+func (m *macTable) put(entry *macTableEntry) {
+	vlanEntries, ok := m.entries[entry.vlanId]
+	if !ok {
+		vlanEntries = make(map[string]*macTableEntry)
+		m.entries[entry.vlanId] = vlanEntries
+	}
+	vlanEntries[string(entry.address)] = entry
+	m.size++
+}
+
+func (m *macTable) isExpired(entry *macTableEntry, now time.Time) bool {
+	//Aging time of 0 disables aging
+	if entry.entryType != MacEntryDynamic || m.agingTime == 0 {
+		return false
+	}
+
+	return entry.lastSeen.Add(m.agingTime).Before(now)
+}
+
+func (m *macTable) evictOldest() bool {
+	var oldest *macTableEntry
+	for _, vlanEntries := range m.entries {
+		for _, e := range vlanEntries {
+			if e.entryType != MacEntryDynamic {
+				continue
+			}
+			if oldest == nil || e.lastSeen.Before(oldest.lastSeen) {
+				oldest = e
+			}
+		}
+	}
+
+	if oldest == nil {
+		return false
+	}
+
+	delete(m.entries[oldest.vlanId], string(oldest.address))
+	m.size--
+	return true
+}
+
+func (m *macTable) removeWhere(predicate func(e *macTableEntry) bool) {
+	for _, vlanEntries := range m.entries {
+		for k, e := range vlanEntries {
+			if predicate(e) {
+				delete(vlanEntries, k)
+				m.size--
+			}
+		}
+	}
+}
+
+//Internal struct
+type macTableEntry struct {
+	vlanId    uint16
+	address   []byte
+	port      int
+	entryType int
+	lastSeen  time.Time
+}
@@ -1,42 +1,44 @@
 package devices
 
 import (
-	"encoding/binary"
+	"bytes"
+	"log"
 	"netsim/hardware"
 	"netsim/protocol"
 	"netsim/protocol/l2"
 	"netsim/protocol/l3"
-	"netsim/utils"
-	"strconv"
-	"strings"
 	"sync"
 )
 
+const (
+	firstMappedPort = 1024
+)
+
 /*
 A NAT Gateway is a router which does network address translation so that devices which do not have a public IP address
-can communicate with the outside world. In an actual implementation, the mappings would have a LRU eviction policy, but
-no eviction is being implemented here since in simulations we are never going to run out of ports.
+can communicate with the outside world.
+The translation is done on the connections followed by the connection tracking of an IP in forwarding mode. The first
+packet of a connection from a private address to the outside world gets the address of the outgoing interface and a
+port no other connection uses for the same destination at postrouting, which is recorded in the reply tuple of the
+connection. The other packets of the connection are translated the same way, and the replies get the private address
+and port back at prerouting, so that they are routed to the device. Pings are translated by their identifier.
 */
 type NatGateway struct {
-	ip                  *l3.IP
-	numPorts            int
-	mapping             map[string]uint16
-	revMapping          map[uint16]string
-	routingTable        protocol.RouteProvider
-	addrResolutionTable protocol.AddressResolver
-	lock                sync.Mutex
+	ip        *l3.IP
+	conntrack *l3.Conntrack
+	numPorts  int
+	lock      sync.Mutex
 }
 
 func NewNatGateway(macs [][]byte, ipAddrs [][]byte, routingTable protocol.RouteProvider, addrResolutionTable protocol.AddressResolver) *NatGateway {
 	router := &NatGateway{
-		numPorts:            len(ipAddrs),
-		mapping:             map[string]uint16{},
-		revMapping:          map[uint16]string{},
-		routingTable:        routingTable,
-		addrResolutionTable: addrResolutionTable,
+		numPorts: len(ipAddrs),
 	}
 
-	router.ip = l3.NewIP(ipAddrs, false, router, routingTable, addrResolutionTable)
+	router.ip = l3.NewIP(ipAddrs, true, nil, routingTable, addrResolutionTable)
+	router.conntrack = router.ip.GetConntrack()
+	router.ip.RegisterHook(l3.HookPrerouting, l3.PriorityNatDst, router.translateDestination)
+	router.ip.RegisterHook(l3.HookPostrouting, l3.PriorityNatSrc, router.translateSource)
 
 	for i, m := range macs {
 		eth := l2.NewEthernet(hardware.NewEthernetAdapter(m, false), nil)
@@ -44,6 +46,11 @@ func NewNatGateway(macs [][]byte, ipAddrs [][]byte, routingTable protocol.RouteP
 		router.ip.SetL2ProtocolForInterface(i, eth)
 	}
 
+	//Dynamic address resolution has to listen on the interfaces
+	if arp, ok := addrResolutionTable.(*l3.ARP); ok {
+		arp.Attach(router.ip)
+	}
+
 	return router
 }
 
@@ -51,6 +58,13 @@ func (r *NatGateway) GetL3Protocol() protocol.L3Protocol {
 	return r.ip
 }
 
+/*
+Returns the connections being translated, along with the others passing through
+*/
+func (r *NatGateway) GetConnections() []l3.Connection {
+	return r.conntrack.GetConnections()
+}
+
 func (r *NatGateway) TurnOn() {
 	for i := 0; i < r.numPorts; i++ {
 		r.ip.GetL2ProtocolForInterface(i).GetAdapter().TurnOn()
@@ -63,127 +77,76 @@ func (r *NatGateway) TurnOff() {
 	}
 }
 
-func (r *NatGateway) SendUp(packet []byte, metadata []byte, source protocol.Protocol) {
-	//Copy the packet
-	newPacket := make([]byte, len(packet))
-	copy(newPacket, packet)
-
-	//Reduce the TTL for the packet
-	ttl := int(newPacket[9])
-	ttl -= 1
-
-	//If TTL reached 0, then drop the packet
-	if ttl == 0 {
-		return
+/*
+Maps new connections from private addresses to the outside world, and translates the sources of the packets of
+connections which have been mapped
+*/
+func (r *NatGateway) translateSource(p *l3.HookPacket) int {
+	packet := p.Packet
+	if conn, reply := r.conntrack.Lookup(packet); conn != nil && !reply && r.requiresForwardTranslation(conn.Original.Source, conn.Original.Destination) {
+		if !r.mapConnection(conn, r.ip.GetAddressForInterface(p.OutInterface), r.hasPorts(packet)) {
+			log.Printf("NAT: No free port to map connection from %v. Dropping.", conn.Original.Source)
+			return l3.VerdictDrop
+		}
 	}
 
-	//Set the new TTL in packet
-	newPacket[9] = byte(ttl)
-
-	//Get the interface through which the packet has to leave
-	destinationAddr := newPacket[16:20]
-	intf := r.routingTable.GetInterfaceForAddress(destinationAddr)
-
-	if r.requiresForwardTranslation(newPacket[12:16], newPacket[16:20]) {
-		sourceIpAddr := newPacket[12:16]
-		sourcePort := r.getSourcePort(newPacket)
-		key := r.getKey(sourceIpAddr, sourcePort)
-
-		r.lock.Lock()
-		//Check if a mapping already exists, else create one
-		mappedPort, ok := r.mapping[key]
-		if !ok {
-			//Get a free port
-			mappedPort = r.getFreePort()
+	if r.conntrack.TranslateSource(packet) {
+		return l3.VerdictModify
+	}
+	return l3.VerdictAccept
+}
 
-			//Create mapping
-			r.mapping[key] = mappedPort
-			r.revMapping[mappedPort] = key
-		}
+/*
+Gives the replies from the outside world back the private address and port of their connection
+*/
+func (r *NatGateway) translateDestination(p *l3.HookPacket) int {
+	if r.conntrack.TranslateDestination(p.Packet) {
+		return l3.VerdictModify
+	}
+	return l3.VerdictAccept
+}
 
-		//Change the source IP addr for the outgoing packet
-		for i := 0; i < 4; i++ {
-			newPacket[12+i] = r.ip.GetAddressForInterface(intf)[i]
-		}
+/*
+Picks the port the replies of the connection come back to, keeping the one used by the device if it is free. Packets of
+protocols without ports can only be told apart by their addresses, hence only one connection per destination gets
+through. Returns false if no port is free.
+*/
+func (r *NatGateway) mapConnection(conn *l3.Connection, addr []byte, hasPorts bool) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 
-		//Change the source port for the outgoing packet
-		portBytes := make([]byte, 2)
-		binary.BigEndian.PutUint16(portBytes, mappedPort)
-		for i := 0; i < 2; i++ {
-			newPacket[20+i] = portBytes[i]
-		}
+	//The connection has been mapped already
+	if !bytes.Equal(conn.Reply.Destination, conn.Original.Source) {
+		return true
+	}
 
-		//Change the TCP/UDP checksum since the packet has changed
-		if r.isTcpPacket(newPacket) {
-			newPacket[20+13] = 0
-			newPacket[20+13] = utils.CalculateChecksum(newPacket[20:])[0]
-		} else {
-			newPacket[20+6] = 0
-			newPacket[20+6] = utils.CalculateChecksum(newPacket[20:])[0]
+	reply := conn.Reply
+	reply.Destination = addr
+	mapTo := func(port uint16) bool {
+		reply.DestPort = port
+		if conn.Original.Protocol == protocol.ICMP[0] {
+			reply.SourcePort = port
 		}
-		r.lock.Unlock()
+		return r.conntrack.SetReplyTuple(conn.Original, reply)
 	}
 
-	if r.requiresReverseTranslation(newPacket[12:16], newPacket[16:20]) {
-		destinationPort := r.getDestinationPort(newPacket)
-
-		r.lock.Lock()
-		//Check if a mapping exists, else don't do anything
-		key, ok := r.revMapping[destinationPort]
-		if ok {
-			mappedIpAddr, mappedPort := r.getIpAndPort(key)
-			destinationAddr = mappedIpAddr
-			intf = r.routingTable.GetInterfaceForAddress(destinationAddr)
-
-			//Change the destination IP addr for the outgoing packet
-			for i := 0; i < 4; i++ {
-				newPacket[16+i] = mappedIpAddr[i]
-			}
-
-			//Change the destination port for the outgoing packet
-			portBytes := make([]byte, 2)
-			binary.BigEndian.PutUint16(portBytes, mappedPort)
-			for i := 0; i < 2; i++ {
-				newPacket[22+i] = portBytes[i]
-			}
-
-			//Change the TCP/UDP checksum since the packet has changed
-			if r.isTcpPacket(newPacket) {
-				newPacket[20+13] = 0
-				newPacket[20+13] = utils.CalculateChecksum(newPacket[20:])[0]
-			} else {
-				newPacket[20+6] = 0
-				newPacket[20+6] = utils.CalculateChecksum(newPacket[20:])[0]
+	if mapTo(conn.Original.SourcePort) {
+		return true
+	}
+	if hasPorts {
+		for port := firstMappedPort; port <= 65535; port++ {
+			if mapTo(uint16(port)) {
+				return true
 			}
 		}
-		r.lock.Unlock()
 	}
-
-	//Calculate the new checksum since packet has changed
-	newPacket[11] = byte(0)
-	newPacket[11] = utils.CalculateChecksum(newPacket[:20])[0]
-
-	//If incoming interface is same as outgoing interface, then drop the packet
-	if intf == r.getInterfaceNum(source) {
-		return
-	}
-
-	//Get the next hop address
-	nextHopAddr := r.routingTable.GetGatewayForAddress(destinationAddr)
-	l2Address := r.addrResolutionTable.Resolve(nextHopAddr)
-
-	//Forward the packet
-	r.ip.GetL2ProtocolForInterface(intf).SendDown(newPacket, l2Address, nil, r.ip)
+	return false
 }
 
 func (r *NatGateway) requiresForwardTranslation(sourceIpAddr []byte, destinationIpAddr []byte) bool {
 	return r.isPrivateIp(sourceIpAddr) && !r.isPrivateIp(destinationIpAddr)
 }
 
-func (r *NatGateway) requiresReverseTranslation(sourceIpAddr []byte, destinationIpAddr []byte) bool {
-	return !r.isPrivateIp(sourceIpAddr)
-}
-
 func (r *NatGateway) isPrivateIp(ipAddr []byte) bool {
 	//Class A check
 	if int(ipAddr[0]) == 10 {
@@ -203,52 +166,15 @@ func (r *NatGateway) isPrivateIp(ipAddr []byte) bool {
 	return false
 }
 
-func (r *NatGateway) getKey(ipAddr []byte, port uint16) string {
-	return string(ipAddr) + ":" + strconv.Itoa(int(port))
-}
-
-func (r *NatGateway) getIpAndPort(key string) ([]byte, uint16) {
-	parts := strings.Split(key, ":")
-	ipAddr := []byte(parts[0])
-	port, _ := strconv.Atoi(parts[1])
-
-	return ipAddr, uint16(port)
-}
-
-func (r *NatGateway) getSourcePort(packet []byte) uint16 {
-	port := packet[20:22]
-	return binary.BigEndian.Uint16(port)
-}
-
-func (r *NatGateway) getDestinationPort(packet []byte) uint16 {
-	port := packet[22:24]
-	return binary.BigEndian.Uint16(port)
-}
-
-func (r *NatGateway) getInterfaceNum(source protocol.Protocol) int {
-	for i := 0; i < r.numPorts; i++ {
-		if source == r.ip.GetL2ProtocolForInterface(i) {
-			return i
-		}
-	}
-
-	return -1
-}
-
-func (r *NatGateway) getFreePort() uint16 {
-	var i uint16
-	for i = 0; i <= uint16(65535); i++ {
-		_, ok := r.revMapping[i]
-		if !ok {
-			return i
-		}
+/*
+Pings have their identifier translated like a port
+*/
+func (r *NatGateway) hasPorts(packet []byte) bool {
+	switch packet[10] {
+	case protocol.TCP[0], protocol.UDP[0]:
+		return true
+	case protocol.ICMP[0]:
+		return packet[20] == l3.IcmpEchoRequest
 	}
-
-	//If this happens then it means we ran out of ports. Not handling this, for simplicity.
-	return 0
-}
-
-func (r *NatGateway) isTcpPacket(packet []byte) bool {
-	ident := packet[10]
-	return ident == protocol.TCP[0]
+	return false
 }
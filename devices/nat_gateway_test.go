@@ -1,11 +1,13 @@
 package devices
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"netsim/api"
 	"netsim/hardware"
 	"netsim/protocol"
+	"netsim/protocol/l2"
 	"netsim/protocol/l3"
 	"testing"
 	"time"
@@ -60,6 +62,19 @@ func TestNatDataTransfer(t *testing.T) {
 	node1.Run(client)
 
 	time.Sleep(20 * time.Second)
+
+	//The connection was seen through to its end, with the replies expected at the public address
+	connections := router.GetConnections()
+	if len(connections) != 1 {
+		t.Fatalf("Expected one connection through the gateway but got %d", len(connections))
+	}
+	conn := connections[0]
+	if !bytes.Equal(conn.Original.Source, []byte{10, 0, 0, 2}) || !bytes.Equal(conn.Reply.Destination, []byte{201, 31, 0, 1}) {
+		t.Errorf("Expected the connection to be translated to the public address but got %+v", conn)
+	}
+	if conn.TcpState != l3.TcpStateTimeWait {
+		t.Errorf("Expected the connection to be closed but it is in state %d", conn.TcpState)
+	}
 }
 
 func server(server *Computer) {
@@ -75,11 +90,13 @@ func server(server *Computer) {
 	sock := socket.Accept()
 
 	//Receive data
+	//Receive is not blocking, hence poll for the data without keeping the CPU busy
 	for {
 		data := sock.Recv(100)
 		if len(data) > 0 {
 			log.Printf("Server Received: %s", data)
 		}
+		time.Sleep(100 * time.Millisecond)
 	}
 }
 
@@ -96,3 +113,74 @@ func client(client *Computer) {
 	time.Sleep(10 * time.Second)
 	socket.Close()
 }
+
+func TestNatFragments(t *testing.T) {
+	//The inside link has a small MTU, hence the datagrams of the inside arrive at the gateway in fragments
+	inside := NewComputer([]byte("ntfin1"), []byte{10, 0, 1, 2})
+	inside.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 1, 1})
+	outside := NewComputer([]byte("ntfout"), []byte{201, 31, 0, 2})
+	outside.AddRoute(protocol.DefaultRouteCidr, []byte{201, 31, 0, 1})
+	capture := &frameCapture{}
+	outside.StartCapture(capture)
+
+	table := l3.NewRoutingTable()
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, nil, 0)
+	table.Add(&protocol.CIDR{Address: []byte{201, 31, 0, 0}, Mask: 24}, nil, 1)
+	router := NewNatGateway([][]byte{[]byte("ntfgw0"), []byte("ntfgw1")}, [][]byte{{10, 0, 1, 1}, {201, 31, 0, 1}}, table, l3.NewARP())
+	router.GetL3Protocol().GetL2ProtocolForInterface(0).(*l2.Ethernet).SetMTU(576)
+	inside.GetL3Protocol().GetL2ProtocolForInterface(0).(*l2.Ethernet).SetMTU(576)
+
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, inside.GetAdapter(), router.GetL3Protocol().GetL2ProtocolForInterface(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, router.GetL3Protocol().GetL2ProtocolForInterface(1).GetAdapter(), outside.GetAdapter())
+
+	go hardware.Clk.Start()
+	inside.TurnOn()
+	outside.TurnOn()
+	router.TurnOn()
+
+	//The gateway puts the datagram back together before translating it
+	log.Printf("Testcase: Sending a fragmented datagram through NAT")
+	server := outside.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+	server.Bind([]byte{0, 0, 0, 0}, 5000)
+	client := inside.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+	srcPort := uint16(5000)
+	client.Bind([]byte{0, 0, 0, 0}, srcPort)
+	data := bytes.Repeat([]byte("0123456789"), 120)
+	client.SendTo([]byte{201, 31, 0, 2}, 5000, &srcPort, data)
+	if received := waitForData(server, len(data), 10*time.Second); !bytes.Equal(received, data) {
+		t.Fatalf("Expected the datagram to arrive intact but got %d bytes", len(received))
+	}
+
+	var translated int
+	for _, frame := range capture.getFrames() {
+		frameType, packet := l2.GetPayload(frame)
+		if !bytes.Equal(frameType, protocol.IP) {
+			continue
+		}
+		if bytes.Equal(packet[12:16], []byte{10, 0, 1, 2}) {
+			t.Errorf("Expected no packet from the private address outside")
+		}
+		if bytes.Equal(packet[12:16], []byte{201, 31, 0, 1}) && packet[10] == protocol.UDP[0] {
+			translated++
+		}
+	}
+	if translated != 1 {
+		t.Errorf("Expected the datagram as a single translated packet but got %d", translated)
+	}
+
+	connections := router.GetConnections()
+	if len(connections) != 1 || connections[0].Original.SourcePort != srcPort || connections[0].Original.DestPort != 5000 {
+		t.Fatalf("Expected one connection with the ports of the datagram but got %+v", connections)
+	}
+
+	//The reply is translated back, and fragmented to fit the inside link
+	log.Printf("Testcase: Replying through NAT")
+	reply := bytes.Repeat([]byte("9876543210"), 120)
+	server.SendTo([]byte{201, 31, 0, 1}, connections[0].Reply.DestPort, &srcPort, reply)
+	if received := waitForData(client, len(reply), 10*time.Second); !bytes.Equal(received, reply) {
+		t.Errorf("Expected the reply to arrive intact but got %d bytes", len(received))
+	}
+	if connections = router.GetConnections(); len(connections) != 1 || !connections[0].Replied {
+		t.Errorf("Expected the connection to be replied to but got %+v", connections)
+	}
+}
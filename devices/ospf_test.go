@@ -0,0 +1,116 @@
+package devices
+
+import (
+	"bytes"
+	"log"
+	"netsim/hardware"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"netsim/protocol/routing"
+	"testing"
+	"time"
+)
+
+/*
+Testcase
+*/
+func TestOspf(t *testing.T) {
+	//Four routers in a square, with a computer on each of two opposite corners. The path through router 3 is expensive.
+	computer1 := NewComputer([]byte("ospfc1"), []byte{10, 0, 1, 2})
+	computer1.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 1, 1})
+	computer4 := NewComputer([]byte("ospfc4"), []byte{10, 0, 4, 2})
+	computer4.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 4, 1})
+
+	table1 := l3.NewRoutingTable()
+	router1 := NewRouter([][]byte{[]byte("ospr10"), []byte("ospr11"), []byte("ospr12")}, [][]byte{{10, 0, 1, 1}, {10, 1, 12, 1}, {10, 1, 13, 1}}, table1, l3.NewARP())
+	router2 := NewRouter([][]byte{[]byte("ospr20"), []byte("ospr21")}, [][]byte{{10, 1, 12, 2}, {10, 1, 24, 2}}, l3.NewRoutingTable(), l3.NewARP())
+	router3 := NewRouter([][]byte{[]byte("ospr30"), []byte("ospr31")}, [][]byte{{10, 1, 13, 3}, {10, 1, 34, 3}}, l3.NewRoutingTable(), l3.NewARP())
+	router4 := NewRouter([][]byte{[]byte("ospr40"), []byte("ospr41"), []byte("ospr42")}, [][]byte{{10, 0, 4, 1}, {10, 1, 24, 4}, {10, 1, 34, 4}}, l3.NewRoutingTable(), l3.NewARP())
+
+	adapter := func(r *Router, intfNum int) hardware.Adapter {
+		return r.GetL3Protocol().GetL2ProtocolForInterface(intfNum).GetAdapter()
+	}
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, computer1.GetAdapter(), adapter(router1, 0))
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, adapter(router1, 1), adapter(router2, 0))
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, adapter(router1, 2), adapter(router3, 0))
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, adapter(router2, 1), adapter(router4, 1))
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, adapter(router3, 1), adapter(router4, 2))
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, adapter(router4, 0), computer4.GetAdapter())
+
+	go hardware.Clk.Start()
+	computer1.TurnOn()
+	computer4.TurnOn()
+	var ospfs []*routing.OSPF
+	for i, r := range []*Router{router1, router2, router3, router4} {
+		//Every interface is on a /24 network
+		var networks []*protocol.CIDR
+		for j := 0; j < r.GetL3Protocol().(*l3.IP).NumInterfaces(); j++ {
+			addr := r.GetL3Protocol().GetAddressForInterface(j)
+			networks = append(networks, &protocol.CIDR{Address: []byte{addr[0], addr[1], addr[2], 0}, Mask: 24})
+		}
+
+		r.TurnOn()
+		ospf := r.EnableOspf([]byte{1, 1, 1, byte(i + 1)}, networks)
+		ospf.SetTimers(500*time.Millisecond, 3*time.Second, 30*time.Second, 60*time.Second)
+		ospfs = append(ospfs, ospf)
+	}
+	ospfs[0].SetCost(2, 50)
+
+	//Waits until the route to the far computer goes through the gateway
+	waitForRoute := func(gateway []byte) {
+		for deadline := time.Now().Add(15 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			if route, err := table1.Lookup([]byte{10, 0, 4, 2}); err == nil && bytes.Equal(route.Gateway, gateway) {
+				return
+			}
+		}
+	}
+
+	log.Printf("Testcase: Converging")
+	waitForRoute([]byte{10, 1, 12, 2})
+
+	if len(ospfs[0].GetNeighbors()) != 2 {
+		t.Errorf("Expected router 1 to have 2 neighbours but got %d", len(ospfs[0].GetNeighbors()))
+	}
+	if len(ospfs[0].GetDatabase()) != 4 {
+		t.Errorf("Expected 4 LSAs in the database but got %d", len(ospfs[0].GetDatabase()))
+	}
+	route, err := table1.Lookup([]byte{10, 0, 4, 2})
+	if err != nil || !bytes.Equal(route.Gateway, []byte{10, 1, 12, 2}) || route.Metric != 30 || route.Distance != routing.DistanceOspf {
+		t.Fatalf("Expected route through router 2 with metric 30 but got %v %v", route, err)
+	}
+	if ospfs[0].GetInterfaceForAddress([]byte{10, 0, 4, 2}) != 1 {
+		t.Errorf("Expected OSPF to route through interface 1")
+	}
+
+	ping := func(name string) {
+		binding := computer1.GetICMP().Bind(1)
+		defer binding.Close()
+
+		var reply *l3.IcmpMessage
+		for seq := uint16(1); seq <= 3 && reply == nil; seq++ {
+			binding.SendEcho([]byte{10, 0, 4, 2}, seq, []byte("ping"), 64, 0)
+			reply = binding.Recv(5 * time.Second)
+		}
+		if reply == nil || reply.Type != l3.IcmpEchoReply {
+			t.Errorf("%s: Expected a reply from the far computer", name)
+		}
+	}
+	log.Printf("Testcase: Ping across the routers")
+	ping("Ping")
+
+	//The link between router 2 and router 4 fails, so the traffic has to take the expensive path
+	log.Printf("Testcase: Link failure")
+	adapter(router2, 1).TurnOff()
+	adapter(router4, 1).TurnOff()
+	waitForRoute([]byte{10, 1, 13, 3})
+
+	route, err = table1.Lookup([]byte{10, 0, 4, 2})
+	if err != nil || !bytes.Equal(route.Gateway, []byte{10, 1, 13, 3}) || route.Metric != 70 {
+		t.Fatalf("Expected route through router 3 with metric 70 but got %v %v", route, err)
+	}
+	ping("Ping after failure")
+
+	for _, ospf := range ospfs {
+		ospf.Stop()
+	}
+}
@@ -0,0 +1,251 @@
+package devices
+
+import (
+	"encoding/binary"
+	"log"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"sync"
+)
+
+/*
+A packet filter decides which packets may pass through an IP, like iptables does. It has a chain of rules for each of
+the packets for the host (l3.HookInput), the packets it forwards (l3.HookForward) and the packets it sends
+(l3.HookOutput). The rules of a chain are checked in order, and the first one which matches a packet decides what
+happens to it:
+1. Accept	- The packet goes on
+2. Drop		- The packet is dropped quietly
+3. Reject	- The packet is dropped, and the sender is told that it is not allowed
+
+Packets which no rule matches get the policy of the chain, which accepts them unless changed.
+The filter is stateful: rules can match on the state of the connection a packet belongs to, as followed by the
+connection tracking of the IP, see l3.Conntrack. The first packet of a connection is new, and once the other end has
+answered, the packets either way are established. ICMP errors about a known connection are related to it, and packets
+which neither start nor belong to a connection are invalid.
+*/
+const (
+	ActionAccept = iota
+	ActionDrop
+	ActionReject
+)
+
+const (
+	StateNew         = l3.ConnStateNew
+	StateEstablished = l3.ConnStateEstablished
+	StateRelated     = l3.ConnStateRelated
+	StateInvalid     = l3.ConnStateInvalid
+)
+
+/*
+Ports from From to To, both included
+*/
+type PortRange = l3.PortRange
+
+/*
+A rule matches the packets which match all of its conditions. Conditions which are not set match every packet. Ports
+only match TCP and UDP packets. TCP flags match if the flags in TcpFlagsMask are set as in TcpFlags. Fragments other
+than the first do not carry the TCP or UDP header, hence they never match rules with ports or TCP flags, like with
+iptables. States is a combination of the states the connection may be in.
+Hits counts the packets the rule has matched, and packets matching a rule with Log set are logged.
+*/
+type FilterRule struct {
+	InInterfaces  []int
+	OutInterfaces []int
+	Source        *protocol.CIDR
+	Destination   *protocol.CIDR
+	Protocol      []byte
+	SourcePorts   *PortRange
+	DestPorts     *PortRange
+	TcpFlags      byte
+	TcpFlagsMask  byte
+	States        int
+	Action        int
+	Log           bool
+	Hits          uint64
+}
+
+type PacketFilter struct {
+	ip        *l3.IP
+	conntrack *l3.Conntrack
+	rules     map[int][]*FilterRule
+	policies  map[int]int
+	lock      sync.Mutex
+}
+
+/*
+Constructor. The filter starts checking the packets of the IP right away.
+*/
+func NewPacketFilter(ip *l3.IP) *PacketFilter {
+	filter := &PacketFilter{
+		ip:        ip,
+		conntrack: ip.GetConntrack(),
+		rules:     map[int][]*FilterRule{},
+		policies:  map[int]int{},
+	}
+
+	for _, hook := range []int{l3.HookInput, l3.HookForward, l3.HookOutput} {
+		ip.RegisterHook(hook, l3.PriorityFilter, filter.filter)
+	}
+	return filter
+}
+
+func (f *PacketFilter) AppendRule(chain int, rule FilterRule) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.rules[chain] = append(f.rules[chain], &rule)
+}
+
+/*
+Inserts the rule before the rule at the index, or at the end if the index is past it
+*/
+func (f *PacketFilter) InsertRule(chain int, index int, rule FilterRule) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	rules := f.rules[chain]
+	if index < 0 || index >= len(rules) {
+		f.rules[chain] = append(rules, &rule)
+		return
+	}
+
+	newRules := append([]*FilterRule{}, rules[:index]...)
+	newRules = append(newRules, &rule)
+	f.rules[chain] = append(newRules, rules[index:]...)
+}
+
+func (f *PacketFilter) DeleteRule(chain int, index int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	rules := f.rules[chain]
+	if index < 0 || index >= len(rules) {
+		return
+	}
+	f.rules[chain] = append(rules[:index:index], rules[index+1:]...)
+}
+
+func (f *PacketFilter) FlushRules(chain int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.rules, chain)
+}
+
+/*
+Returns copies of the rules of the chain, with their hit counters
+*/
+func (f *PacketFilter) GetRules(chain int) []FilterRule {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var rules []FilterRule
+	for _, rule := range f.rules[chain] {
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+/*
+Sets what happens to the packets no rule of the chain matches
+*/
+func (f *PacketFilter) SetPolicy(chain int, action int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.policies[chain] = action
+}
+
+/*
+Internal methods
+*/
+
+/*
+The hook checking the packets against the rules of the chain of the hook point
+*/
+func (f *PacketFilter) filter(p *l3.HookPacket) int {
+	packet := p.Packet
+	state := f.conntrack.GetState(packet)
+
+	f.lock.Lock()
+	action := f.policies[p.Hook]
+	for i, rule := range f.rules[p.Hook] {
+		if !rule.matches(p, state) {
+			continue
+		}
+
+		rule.Hits++
+		if rule.Log {
+			log.Printf("Firewall: Rule %d of chain %d matched packet from %v to %v with protocol %d", i, p.Hook, packet[12:16], packet[16:20], packet[10])
+		}
+		action = rule.Action
+		break
+	}
+	f.lock.Unlock()
+
+	switch action {
+	case ActionAccept:
+		return l3.VerdictAccept
+	case ActionReject:
+		return f.ip.Reject(p)
+	default:
+		return l3.VerdictDrop
+	}
+}
+
+func (r *FilterRule) matches(p *l3.HookPacket, state int) bool {
+	packet := p.Packet
+	if !matchesInterface(r.InInterfaces, p.InInterface) || !matchesInterface(r.OutInterfaces, p.OutInterface) {
+		return false
+	}
+	if r.Source != nil && !r.Source.Contains(packet[12:16]) {
+		return false
+	}
+	if r.Destination != nil && !r.Destination.Contains(packet[16:20]) {
+		return false
+	}
+	if r.Protocol != nil && r.Protocol[0] != packet[10] {
+		return false
+	}
+	if r.States != 0 && r.States&state == 0 {
+		return false
+	}
+
+	if r.SourcePorts != nil || r.DestPorts != nil {
+		if !hasPorts(packet) {
+			return false
+		}
+		if r.SourcePorts != nil && !r.SourcePorts.Contains(binary.BigEndian.Uint16(packet[20:22])) {
+			return false
+		}
+		if r.DestPorts != nil && !r.DestPorts.Contains(binary.BigEndian.Uint16(packet[22:24])) {
+			return false
+		}
+	}
+
+	if r.TcpFlagsMask != 0 {
+		if !hasPorts(packet) || packet[10] != protocol.TCP[0] || len(packet) < 33 || packet[32]&r.TcpFlagsMask != r.TcpFlags {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Only the first fragment of a packet has the ports, at offset 0
+*/
+func hasPorts(packet []byte) bool {
+	return len(packet) >= 24 && (packet[10] == protocol.TCP[0] || packet[10] == protocol.UDP[0]) && binary.BigEndian.Uint16(packet[7:9]) == 0
+}
+
+func matchesInterface(interfaces []int, intfNum int) bool {
+	if len(interfaces) == 0 {
+		return true
+	}
+	for _, i := range interfaces {
+		if i == intfNum {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package devices
+
+import (
+	"bytes"
+	"log"
+	"netsim/api"
+	"netsim/hardware"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"netsim/protocol/routing"
+	"testing"
+	"time"
+)
+
+/*
+Testcase
+*/
+func TestPimDenseMode(t *testing.T) {
+	//A source behind router 1, and a listener behind each of routers 2 and 3. Router 3 is reached through router 2.
+	source := NewComputer([]byte("pimcs1"), []byte{10, 0, 1, 2})
+	listener2 := NewComputer([]byte("pimcl2"), []byte{10, 0, 2, 2})
+	listener3 := NewComputer([]byte("pimcl3"), []byte{10, 0, 3, 2})
+
+	table1 := l3.NewRoutingTable()
+	table1.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, nil, 0)
+	table1.Add(&protocol.CIDR{Address: []byte{10, 1, 12, 0}, Mask: 24}, nil, 1)
+	router1 := NewRouter([][]byte{[]byte("pimr10"), []byte("pimr11")}, [][]byte{{10, 0, 1, 1}, {10, 1, 12, 1}}, table1, l3.NewARP())
+
+	table2 := l3.NewRoutingTable()
+	table2.Add(&protocol.CIDR{Address: []byte{10, 1, 12, 0}, Mask: 24}, nil, 0)
+	table2.Add(&protocol.CIDR{Address: []byte{10, 0, 2, 0}, Mask: 24}, nil, 1)
+	table2.Add(&protocol.CIDR{Address: []byte{10, 1, 23, 0}, Mask: 24}, nil, 2)
+	table2.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, []byte{10, 1, 12, 1}, 0)
+	router2 := NewRouter([][]byte{[]byte("pimr20"), []byte("pimr21"), []byte("pimr22")}, [][]byte{{10, 1, 12, 2}, {10, 0, 2, 1}, {10, 1, 23, 2}}, table2, l3.NewARP())
+
+	table3 := l3.NewRoutingTable()
+	table3.Add(&protocol.CIDR{Address: []byte{10, 1, 23, 0}, Mask: 24}, nil, 0)
+	table3.Add(&protocol.CIDR{Address: []byte{10, 0, 3, 0}, Mask: 24}, nil, 1)
+	table3.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, []byte{10, 1, 23, 2}, 0)
+	router3 := NewRouter([][]byte{[]byte("pimr30"), []byte("pimr31")}, [][]byte{{10, 1, 23, 3}, {10, 0, 3, 1}}, table3, l3.NewARP())
+
+	adapter := func(r *Router, intfNum int) hardware.Adapter {
+		return r.GetL3Protocol().GetL2ProtocolForInterface(intfNum).GetAdapter()
+	}
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, source.GetAdapter(), adapter(router1, 0))
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, adapter(router1, 1), adapter(router2, 0))
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, adapter(router2, 1), listener2.GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, adapter(router2, 2), adapter(router3, 0))
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, adapter(router3, 1), listener3.GetAdapter())
+
+	go hardware.Clk.Start()
+	source.TurnOn()
+	listener2.TurnOn()
+	listener3.TurnOn()
+	var pims []*routing.PIM
+	for _, r := range []*Router{router1, router2, router3} {
+		r.TurnOn()
+		r.GetIGMP().SetQueryInterval(5 * time.Second)
+		pim := r.EnablePim()
+		pim.SetTimers(500*time.Millisecond, 30*time.Second)
+		pims = append(pims, pim)
+	}
+
+	time.Sleep(2 * time.Second)
+	if len(pims[1].GetNeighbors(0)) != 1 || len(pims[1].GetNeighbors(2)) != 1 {
+		t.Fatalf("Expected router 2 to have a neighbour on both its router links")
+	}
+
+	group := []byte{239, 2, 2, 2}
+	join := func(c *Computer) *api.Socket {
+		s := c.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+		s.Bind([]byte{0, 0, 0, 0}, 6000)
+		s.SetSockOpt(api.IP_ADD_MEMBERSHIP, group)
+		return s
+	}
+	sender := source.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+	sender.SetSockOpt(api.IP_MULTICAST_TTL, []byte{16})
+
+	//Waits until the forwarding state of the router for the source matches
+	waitForRoute := func(pim *routing.PIM, check func(route *routing.MulticastRoute) bool) *routing.MulticastRoute {
+		var route *routing.MulticastRoute
+		for deadline := time.Now().Add(15 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			for _, r := range pim.GetForwardingTable() {
+				if bytes.Equal(r.Source, []byte{10, 0, 1, 2}) && bytes.Equal(r.Group, group) {
+					route = r
+				}
+			}
+			if route != nil && check(route) {
+				break
+			}
+		}
+		return route
+	}
+
+	//The traffic is flooded to the listener behind router 2, and router 3 prunes it since no one wants it there
+	log.Printf("Testcase: Flooding and pruning")
+	server2 := join(listener2)
+	time.Sleep(2 * time.Second)
+	data := []byte("Hello routed group")
+	sender.SendTo(group, 6000, nil, data)
+	if received := waitForData(server2, len(data), 10*time.Second); !bytes.Equal(received, data) {
+		t.Fatalf("Expected the listener behind router 2 to receive %s but got %s", data, received)
+	}
+
+	route := waitForRoute(pims[1], func(r *routing.MulticastRoute) bool {
+		return len(r.PrunedInterfaces) == 1
+	})
+	if route == nil || route.IncomingInterface != 0 || len(route.PrunedInterfaces) != 1 || route.PrunedInterfaces[0] != 2 {
+		t.Fatalf("Expected router 2 to have the link to router 3 pruned but got %+v", route)
+	}
+	if len(route.OutgoingInterfaces) != 1 || route.OutgoingInterfaces[0] != 1 {
+		t.Errorf("Expected router 2 to forward only to its listener but got %v", route.OutgoingInterfaces)
+	}
+	if route := waitForRoute(pims[2], func(r *routing.MulticastRoute) bool { return r.UpstreamPruned }); route == nil || !route.UpstreamPruned {
+		t.Errorf("Expected router 3 to have pruned the source but got %+v", route)
+	}
+
+	//A listener behind router 3 gets the traffic back with a graft
+	log.Printf("Testcase: Grafting")
+	server3 := join(listener3)
+	route = waitForRoute(pims[1], func(r *routing.MulticastRoute) bool {
+		return len(r.PrunedInterfaces) == 0
+	})
+	if route == nil || len(route.OutgoingInterfaces) != 2 {
+		t.Fatalf("Expected router 2 to forward to router 3 again but got %+v", route)
+	}
+	sender.SendTo(group, 6000, nil, data)
+	if received := waitForData(server3, len(data), 10*time.Second); !bytes.Equal(received, data) {
+		t.Errorf("Expected the listener behind router 3 to receive %s but got %s", data, received)
+	}
+
+	//Packets from the source arriving on the wrong interface fail the RPF check
+	if outgoing := pims[1].GetOutgoingInterfaces([]byte{10, 0, 1, 2}, group, 2); len(outgoing) != 0 {
+		t.Errorf("Expected packets failing the RPF check to be dropped but got %v", outgoing)
+	}
+
+	//Once everyone leaves, the whole tree is pruned back to the first router
+	log.Printf("Testcase: Leaving")
+	server2.SetSockOpt(api.IP_DROP_MEMBERSHIP, group)
+	server3.SetSockOpt(api.IP_DROP_MEMBERSHIP, group)
+	route = waitForRoute(pims[0], func(r *routing.MulticastRoute) bool {
+		return len(r.OutgoingInterfaces) == 0
+	})
+	if route == nil || len(route.OutgoingInterfaces) != 0 || len(route.PrunedInterfaces) != 1 {
+		t.Errorf("Expected router 1 to have the link to router 2 pruned but got %+v", route)
+	}
+}
@@ -0,0 +1,180 @@
+package devices
+
+import (
+	"bytes"
+	"log"
+	"netsim/api"
+	"netsim/hardware"
+	"netsim/protocol"
+	"netsim/protocol/l2"
+	"netsim/protocol/l3"
+	"testing"
+	"time"
+)
+
+/*
+Testcase
+*/
+func TestPathMTUDiscovery(t *testing.T) {
+	//Two routers joined by a link with a smaller MTU, like one carrying tunnelled packets. It is still larger than the
+	//MTU used behind black holes.
+	computer1 := NewComputer([]byte("pmtuc1"), []byte{10, 0, 1, 2})
+	computer1.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 1, 1})
+	computer2 := NewComputer([]byte("pmtuc2"), []byte{10, 0, 3, 2})
+	computer2.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 3, 1})
+
+	table1 := l3.NewRoutingTable()
+	table1.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, nil, 0)
+	table1.Add(&protocol.CIDR{Address: []byte{10, 0, 2, 0}, Mask: 24}, nil, 1)
+	table1.Add(&protocol.CIDR{Address: []byte{10, 0, 3, 0}, Mask: 24}, []byte{10, 0, 2, 2}, 1)
+	router1 := NewRouter([][]byte{[]byte("pmtur1"), []byte("pmtur2")}, [][]byte{{10, 0, 1, 1}, {10, 0, 2, 1}}, table1, l3.NewARP())
+
+	table2 := l3.NewRoutingTable()
+	table2.Add(&protocol.CIDR{Address: []byte{10, 0, 2, 0}, Mask: 24}, nil, 0)
+	table2.Add(&protocol.CIDR{Address: []byte{10, 0, 3, 0}, Mask: 24}, nil, 1)
+	table2.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, []byte{10, 0, 2, 1}, 0)
+	router2 := NewRouter([][]byte{[]byte("pmtur3"), []byte("pmtur4")}, [][]byte{{10, 0, 2, 2}, {10, 0, 3, 1}}, table2, l3.NewARP())
+
+	router1.GetL3Protocol().GetL2ProtocolForInterface(1).(*l2.Ethernet).SetMTU(1000)
+	router2.GetL3Protocol().GetL2ProtocolForInterface(0).(*l2.Ethernet).SetMTU(1000)
+
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, computer1.GetAdapter(), router1.GetL3Protocol().GetL2ProtocolForInterface(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, router1.GetL3Protocol().GetL2ProtocolForInterface(1).GetAdapter(), router2.GetL3Protocol().GetL2ProtocolForInterface(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, router2.GetL3Protocol().GetL2ProtocolForInterface(1).GetAdapter(), computer2.GetAdapter())
+
+	go hardware.Clk.Start()
+	computer1.TurnOn()
+	computer2.TurnOn()
+	router1.TurnOn()
+	router2.TurnOn()
+
+	ip := computer1.GetL3Protocol().(*l3.IP)
+	destAddr := []byte{10, 0, 3, 2}
+	if mtu := ip.GetPathMTU(destAddr); mtu != 1500 {
+		t.Errorf("Expected the MTU of the interface before anything is learnt but got %d", mtu)
+	}
+
+	listener := computer2.NewSocket(api.AF_INET, api.SOCK_STREAM, 0)
+	listener.Bind([]byte{0, 0, 0, 0}, 8080)
+	listener.Listen(1)
+	accepted := make(chan *api.Socket, 1)
+	go func() {
+		accepted <- listener.Accept()
+	}()
+
+	stream := computer1.NewSocket(api.AF_INET, api.SOCK_STREAM, 0)
+	stream.Connect(destAddr, 8080)
+	if stream.GetError() != nil {
+		t.Fatalf("Expected to connect but got %v", stream.GetError())
+	}
+	var conn *api.Socket
+	select {
+	case conn = <-accepted:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected the connection to be accepted")
+	}
+
+	//The first segment is too large for the link between the routers, which tells the sender its MTU
+	log.Printf("Testcase: Discovering the path MTU")
+	data := bytes.Repeat([]byte("0123456789"), 300)
+	stream.Send(data)
+	if received := waitForData(conn, len(data), 30*time.Second); !bytes.Equal(received, data) {
+		t.Fatalf("Expected the data to arrive intact but got %d bytes", len(received))
+	}
+	if mtu := ip.GetPathMTU(destAddr); mtu != 1000 {
+		t.Errorf("Expected path MTU 1000 but got %d", mtu)
+	}
+
+	//The learnt MTU is forgotten after a while
+	log.Printf("Testcase: Aging the path MTU")
+	ip.SetPathMTUAging(time.Second)
+	time.Sleep(2 * time.Second)
+	if mtu := ip.GetPathMTU(destAddr); mtu != 1500 {
+		t.Errorf("Expected the path MTU to age out but got %d", mtu)
+	}
+	ip.SetPathMTUAging(10 * time.Minute)
+
+	//Without errors from the router full-size segments vanish, until the sender gives up on Don't Fragment after
+	//losing them several times
+	log.Printf("Testcase: Sending through a black hole")
+	router1.GetICMP().SetSendErrors(false)
+	stream.Send(data)
+	if received := waitForData(conn, len(data), 60*time.Second); !bytes.Equal(received, data) {
+		t.Fatalf("Expected the data to arrive through the black hole but got %d bytes", len(received))
+	}
+	cache := ip.GetPathMTUCache()
+	if len(cache) != 1 || !cache[0].BlackHole || cache[0].MTU != 576 {
+		t.Errorf("Expected the destination to be marked as behind a black hole but got %+v", cache)
+	}
+
+	//Once the small MTU is forgotten, full-size segments are tried again
+	log.Printf("Testcase: Growing the path MTU again")
+	router1.GetICMP().SetSendErrors(true)
+	ip.SetPathMTUAging(time.Second)
+	time.Sleep(2 * time.Second)
+	ip.SetPathMTUAging(10 * time.Minute)
+	stream.Send(data)
+	if received := waitForData(conn, len(data), 30*time.Second); !bytes.Equal(received, data) {
+		t.Fatalf("Expected the data to arrive intact but got %d bytes", len(received))
+	}
+	if cache := ip.GetPathMTUCache(); len(cache) != 1 || cache[0].BlackHole || cache[0].MTU != 1000 {
+		t.Errorf("Expected the path MTU to be discovered again but got %+v", cache)
+	}
+}
+
+func TestRouterFragmentation(t *testing.T) {
+	//The router has a link with a small MTU towards the receiver
+	computer1 := NewComputer([]byte("frgcp1"), []byte{10, 0, 1, 2})
+	computer1.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 1, 1})
+	computer2 := NewComputer([]byte("frgcp2"), []byte{10, 0, 2, 2})
+	computer2.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 2, 1})
+	capture := &frameCapture{}
+	computer2.StartCapture(capture)
+
+	table := l3.NewRoutingTable()
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, nil, 0)
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 2, 0}, Mask: 24}, nil, 1)
+	router := NewRouter([][]byte{[]byte("frgrt1"), []byte("frgrt2")}, [][]byte{{10, 0, 1, 1}, {10, 0, 2, 1}}, table, l3.NewARP())
+	router.GetL3Protocol().GetL2ProtocolForInterface(1).(*l2.Ethernet).SetMTU(576)
+	computer2.GetL3Protocol().GetL2ProtocolForInterface(0).(*l2.Ethernet).SetMTU(576)
+
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, computer1.GetAdapter(), router.GetL3Protocol().GetL2ProtocolForInterface(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, router.GetL3Protocol().GetL2ProtocolForInterface(1).GetAdapter(), computer2.GetAdapter())
+
+	go hardware.Clk.Start()
+	computer1.TurnOn()
+	computer2.TurnOn()
+	router.TurnOn()
+
+	server := computer2.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+	server.Bind([]byte{0, 0, 0, 0}, 5000)
+
+	//The datagram fits the link of the sender, the router has to fragment it
+	log.Printf("Testcase: Sending a datagram larger than the next link")
+	client := computer1.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+	data := bytes.Repeat([]byte("0123456789"), 120)
+	client.SendTo([]byte{10, 0, 2, 2}, 5000, nil, data)
+	var received []byte
+	for i := 0; i < 100 && received == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+		received = server.Recv(len(data))
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("Expected the datagram to arrive intact but got %d bytes", len(received))
+	}
+
+	var fragments int
+	for _, frame := range capture.getFrames() {
+		frameType, packet := l2.GetPayload(frame)
+		if !bytes.Equal(frameType, protocol.IP) || !bytes.Equal(packet[12:16], []byte{10, 0, 1, 2}) {
+			continue
+		}
+		if len(packet) > 576 {
+			t.Errorf("Expected packets to fit the link but got %d bytes", len(packet))
+		}
+		fragments++
+	}
+	if fragments != 3 {
+		t.Errorf("Expected the datagram in 3 fragments but got %d", fragments)
+	}
+}
@@ -0,0 +1,120 @@
+package devices
+
+import (
+	"bytes"
+	"encoding/binary"
+	"netsim/api"
+	"netsim/hardware"
+	"netsim/protocol"
+	"netsim/protocol/l2"
+	"netsim/protocol/l3"
+	"testing"
+	"time"
+)
+
+/*
+Testcase
+*/
+func TestPolicyRouting(t *testing.T) {
+	//A site with two uplinks. The second is used by one of the hosts, and by everyone for voice.
+	host1 := NewComputer([]byte("prhst1"), []byte{10, 0, 1, 2})
+	host1.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 1, 1})
+	host2 := NewComputer([]byte("prhst2"), []byte{10, 0, 1, 3})
+	host2.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 1, 1})
+	ispA := NewComputer([]byte("prispa"), []byte{10, 1, 0, 2})
+	ispB := NewComputer([]byte("prispb"), []byte{10, 2, 0, 2})
+	captureA, captureB := &frameCapture{}, &frameCapture{}
+	ispA.StartCapture(captureA)
+	ispB.StartCapture(captureB)
+
+	table := l3.NewRoutingTable()
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, nil, 0)
+	table.Add(&protocol.CIDR{Address: []byte{10, 1, 0, 0}, Mask: 24}, nil, 1)
+	table.Add(&protocol.CIDR{Address: []byte{10, 2, 0, 0}, Mask: 24}, nil, 2)
+	table.Add(protocol.DefaultRouteCidr, []byte{10, 1, 0, 2}, 1)
+	router := NewRouter([][]byte{[]byte("prrtr0"), []byte("prrtr1"), []byte("prrtr2")}, [][]byte{{10, 0, 1, 1}, {10, 1, 0, 1}, {10, 2, 0, 1}}, table, l3.NewARP())
+
+	uplinkB := l3.NewRoutingTable()
+	uplinkB.Add(protocol.DefaultRouteCidr, []byte{10, 2, 0, 2}, 2)
+	router.AddRoutingTable(100, uplinkB)
+	router.AddRoutingRule(l3.RoutingRule{Priority: 100, Source: &protocol.CIDR{Address: []byte{10, 0, 1, 3}, Mask: 32}, Table: 100})
+	router.AddRoutingRule(l3.RoutingRule{Priority: 200, Protocol: protocol.UDP, DestPorts: &l3.PortRange{From: 5060, To: 5061}, Table: 100})
+
+	//A rule whose table has no route for the destination leaves it to the next ones
+	router.AddRoutingTable(101, l3.NewRoutingTable())
+	router.AddRoutingRule(l3.RoutingRule{Priority: 50, Table: 101})
+
+	adapter := func(intfNum int) hardware.Adapter {
+		return router.GetL3Protocol().GetL2ProtocolForInterface(intfNum).GetAdapter()
+	}
+	bridge := NewBridge([][]byte{[]byte("prbrg0"), []byte("prbrg1"), []byte("prbrg2")})
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, adapter(0), bridge.GetPort(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, host1.GetAdapter(), bridge.GetPort(1).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, host2.GetAdapter(), bridge.GetPort(2).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, adapter(1), ispA.GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, adapter(2), ispB.GetAdapter())
+
+	go hardware.Clk.Start()
+	for _, c := range []*Computer{host1, host2, ispA, ispB} {
+		c.TurnOn()
+	}
+	bridge.TurnOn()
+	router.TurnOn()
+
+	if rules := router.GetRoutingRules(); len(rules) != 4 || rules[0].Priority != 50 || rules[3].Priority != l3.DefaultRulePriority {
+		t.Errorf("Expected the rules in order of priority, followed by the default one, but got %+v", rules)
+	}
+
+	remote := []byte{8, 8, 8, 8}
+	send := func(c *Computer, port uint16) {
+		s := c.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+		s.SendTo(remote, port, nil, []byte("policy"))
+	}
+	send(host1, 7000)
+	send(host2, 7000)
+	send(host1, 5060)
+	time.Sleep(2 * time.Second)
+
+	//Returns the destination ports of the packets from the host seen on an uplink
+	seen := func(capture *frameCapture, srcAddr []byte) []uint16 {
+		var ports []uint16
+		for _, frame := range capture.getFrames() {
+			frameType, packet := l2.GetPayload(frame)
+			if bytes.Equal(frameType, protocol.IP) && len(packet) >= 24 && bytes.Equal(packet[12:16], srcAddr) && bytes.Equal(packet[16:20], remote) {
+				ports = append(ports, binary.BigEndian.Uint16(packet[22:24]))
+			}
+		}
+		return ports
+	}
+	if ports := seen(captureA, []byte{10, 0, 1, 2}); len(ports) != 1 || ports[0] != 7000 {
+		t.Errorf("Expected only the ordinary traffic of host 1 on the first uplink but got %v", ports)
+	}
+	if ports := seen(captureB, []byte{10, 0, 1, 2}); len(ports) != 1 || ports[0] != 5060 {
+		t.Errorf("Expected the voice traffic of host 1 on the second uplink but got %v", ports)
+	}
+	if ports := seen(captureB, []byte{10, 0, 1, 3}); len(ports) != 1 || ports[0] != 7000 {
+		t.Errorf("Expected the traffic of host 2 on the second uplink but got %v", ports)
+	}
+	if ports := seen(captureA, []byte{10, 0, 1, 3}); len(ports) != 0 {
+		t.Errorf("Expected no traffic of host 2 on the first uplink but got %v", ports)
+	}
+
+	//The fragments of a voice datagram all take the same uplink, although only the first has the ports
+	s := host1.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+	s.SendTo(remote, 5061, nil, bytes.Repeat([]byte("0123456789"), 300))
+	fragments := func(capture *frameCapture) int {
+		count := 0
+		for _, frame := range capture.getFrames() {
+			frameType, packet := l2.GetPayload(frame)
+			if bytes.Equal(frameType, protocol.IP) && bytes.Equal(packet[12:16], []byte{10, 0, 1, 2}) && (packet[6]&0x01 == 0 || packet[7] != 0 || packet[8] != 0) {
+				count++
+			}
+		}
+		return count
+	}
+	for deadline := time.Now().Add(20 * time.Second); time.Now().Before(deadline) && fragments(captureA)+fragments(captureB) < 3; time.Sleep(100 * time.Millisecond) {
+	}
+	if a, b := fragments(captureA), fragments(captureB); a+b != 3 || (a != 0 && b != 0) {
+		t.Errorf("Expected the 3 fragments on a single uplink but got %d and %d", a, b)
+	}
+}
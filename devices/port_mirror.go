@@ -0,0 +1,84 @@
+package devices
+
+/*
+Port mirroring (SPAN) copies the frames seen on a set of source ports, or belonging to a set of source VLANs, to a monitor
+port where a capturing device can be attached. Frames received on a port are mirrored in the ingress direction, exactly
+as they arrived. Frames sent out of a port are mirrored in the egress direction, as they leave the port i.e. after the
+VLAN tag has been pushed or popped.
+A monitor port does not take part in forwarding. Frames received on it are dropped and nothing is learnt from them.
+Each session sends at most one copy of a frame to its monitor port, even if the frame matches the session multiple times.
+*/
+const (
+	MirrorIngress = 1 << iota
+	MirrorEgress
+	MirrorBoth = MirrorIngress | MirrorEgress
+)
+
+type mirrorSession struct {
+	monitorPort int
+	sourcePorts map[int]bool
+	sourceVlans map[uint16]bool
+	direction   int
+}
+
+/*
+Creates a mirroring session and returns its id. Source ports and source VLANs can both be given, a frame is mirrored if
+it matches either of them.
+*/
+func (b *Bridge) AddMirrorSession(monitorPort int, sourcePorts []int, sourceVlans []uint16, direction int) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	session := &mirrorSession{
+		monitorPort: monitorPort,
+		sourcePorts: map[int]bool{},
+		sourceVlans: map[uint16]bool{},
+		direction:   direction,
+	}
+	for _, p := range sourcePorts {
+		session.sourcePorts[p] = true
+	}
+	for _, v := range sourceVlans {
+		session.sourceVlans[v] = true
+	}
+
+	b.nextMirrorId++
+	b.mirrorSessions[b.nextMirrorId] = session
+	return b.nextMirrorId
+}
+
+func (b *Bridge) RemoveMirrorSession(sessionId int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.mirrorSessions, sessionId)
+}
+
+/*
+Internal methods. These expect the bridge lock to be held.
+*/
+func (b *Bridge) isMonitorPort(portNum int) bool {
+	for _, session := range b.mirrorSessions {
+		if session.monitorPort == portNum {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *Bridge) mirror(portNum int, vlanId uint16, direction int, frame []byte, mirrored map[int]bool) {
+	for id, session := range b.mirrorSessions {
+		if mirrored[id] || session.direction&direction == 0 || session.monitorPort == portNum {
+			continue
+		}
+
+		if session.sourcePorts[portNum] || session.sourceVlans[vlanId] {
+			mirrored[id] = true
+
+			copied := make([]byte, len(frame))
+			copy(copied, frame)
+			b.ports[session.monitorPort].GetAdapter().PutInBuffer(copied)
+		}
+	}
+}
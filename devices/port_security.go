@@ -0,0 +1,114 @@
+package devices
+
+import (
+	"log"
+)
+
+/*
+Port security limits the number of addresses that can be learnt on a port. A frame from a new source address beyond the
+limit is a violation, which is handled as per the configured action:
+1. Protect  - The frame is dropped silently
+2. Restrict - The frame is dropped and the violation is counted
+3. Shutdown - The port is error-disabled i.e. turned off until recovered by an administrator, and the violation is counted
+Combined with sticky learning, this pins the hosts allowed on a port to the first ones seen there.
+*/
+const (
+	ViolationProtect = iota
+	ViolationRestrict
+	ViolationShutdown
+)
+
+type portSecurity struct {
+	maxAddresses int
+	action       int
+	violations   uint64
+	errDisabled  bool
+}
+
+func (b *Bridge) SetPortSecurity(portNum int, maxAddresses int, action int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.portSecurity[portNum] = &portSecurity{
+		maxAddresses: maxAddresses,
+		action:       action,
+	}
+}
+
+func (b *Bridge) RemovePortSecurity(portNum int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.portSecurity, portNum)
+}
+
+func (b *Bridge) GetPortSecurityViolations(portNum int) uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	security, ok := b.portSecurity[portNum]
+	if !ok {
+		return 0
+	}
+	return security.violations
+}
+
+func (b *Bridge) IsPortErrDisabled(portNum int) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	security, ok := b.portSecurity[portNum]
+	return ok && security.errDisabled
+}
+
+/*
+Bring an error-disabled port back up
+*/
+func (b *Bridge) RecoverPort(portNum int) {
+	b.lock.Lock()
+	security, ok := b.portSecurity[portNum]
+	if ok {
+		security.errDisabled = false
+	}
+	b.lock.Unlock()
+
+	b.TurnOnPort(portNum)
+}
+
+/*
+Internal methods. These expect the bridge lock to be held.
+Returns false if the frame has to be dropped
+*/
+func (b *Bridge) admitSource(portNum int, vlanId uint16, sourceAddr []byte) bool {
+	security, ok := b.portSecurity[portNum]
+	if !ok {
+		return true
+	}
+
+	if security.errDisabled {
+		return false
+	}
+
+	//Address already learnt on this port
+	learntPort, found := b.macTable.lookup(vlanId, sourceAddr)
+	if found && learntPort == portNum {
+		return true
+	}
+
+	if b.macTable.countForPort(portNum) < security.maxAddresses {
+		return true
+	}
+
+	switch security.action {
+	case ViolationRestrict:
+		security.violations++
+		log.Printf("Bridge: Port security violation on port %d by %s. Dropping.", portNum, string(sourceAddr))
+	case ViolationShutdown:
+		security.violations++
+		security.errDisabled = true
+		log.Printf("Bridge: Port security violation on port %d by %s. Shutting down port.", portNum, string(sourceAddr))
+		b.TurnOffPort(portNum)
+	}
+
+	return false
+}
@@ -0,0 +1,503 @@
+package devices
+
+import (
+	"encoding/binary"
+	"log"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"netsim/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Quality of service lets a router treat the packets leaving it differently by their DiffServ class, so that voice keeps
+flowing when a link is congested. Packets are put in a class by rules, like ACLs: the first rule which matches a packet
+decides its class, and packets no rule matches are in DefaultClass. Rules can match on the DSCP in the TOS byte, so the
+routers in the core of a network can trust the classes picked by the routers at its edge. A class can:
+1. Mark		- Set the DSCP of its packets, for the routers further on
+2. Police	- Drop its packets above a rate, measured with a token bucket
+3. Queue	- Wait in a queue of its own on the interfaces whose egress rate is limited
+
+On an interface with a limited rate, see SetEgressRate, the queue to send from next is picked by priority first: a class
+is only sent from when no class with a higher priority has packets waiting. Classes with the same priority share the
+rate by their weights, using deficit round robin. A class with a high priority can starve the others, hence it should
+be policed. Packets arriving at a full queue are dropped.
+Packets leaving other interfaces are still marked and policed, but are sent right away.
+*/
+const (
+	DscpDefault = 0
+	DscpCs1     = 8
+	DscpAf11    = 10
+	DscpAf21    = 18
+	DscpAf31    = 26
+	DscpAf41    = 34
+	DscpEf      = 46
+	DscpCs6     = 48
+)
+
+const (
+	DefaultClass      = 0
+	defaultQueueLimit = 64
+	qosQuantum        = 1500 //bytes a class of weight 1 may send per round
+	minBurst          = 1500
+)
+
+/*
+Rates are in bytes per second and bursts in bytes. A class is not policed if PoliceRate is 0, and a PoliceBurst of 0
+allows 100ms worth of bytes, but at least a full packet. Weights less than 1 count as 1, and a QueueLimit of 0 means the
+default of 64 packets.
+*/
+type QosClass struct {
+	Priority    int
+	Weight      int
+	QueueLimit  int
+	Mark        bool
+	Dscp        byte
+	PoliceRate  float64
+	PoliceBurst float64
+}
+
+/*
+A rule matches the packets which match all of its conditions. Conditions which are not set match every packet. Ports
+only match TCP and UDP packets, and never match fragments other than the first, which do not carry them. Dscps matches
+the packets with any of the DSCPs in it. Packets sent by the router itself have no incoming interface.
+Hits counts the packets the rule has matched.
+*/
+type QosRule struct {
+	InInterfaces  []int
+	OutInterfaces []int
+	Source        *protocol.CIDR
+	Destination   *protocol.CIDR
+	Protocol      []byte
+	SourcePorts   *PortRange
+	DestPorts     *PortRange
+	Dscps         []byte
+	Class         int
+	Hits          uint64
+}
+
+/*
+Counters of a class over all interfaces. Packets and Bytes count what has been sent.
+*/
+type QosClassStats struct {
+	Class       int
+	Packets     uint64
+	Bytes       uint64
+	PoliceDrops uint64
+	QueueDrops  uint64
+}
+
+type Qos struct {
+	ip      *l3.IP
+	classes map[int]*qosClass
+	rules   []*QosRule
+	ports   map[int]*egressPort
+	lock    sync.Mutex
+}
+
+type qosClass struct {
+	QosClass
+	policer *utils.TokenBucket
+	stats   QosClassStats
+}
+
+type egressPort struct {
+	shaper  *utils.TokenBucket
+	queues  map[int]*classQueue
+	current int
+	wake    chan bool
+	stop    chan bool
+}
+
+type classQueue struct {
+	class   int
+	packets []*l3.HookPacket
+	deficit int
+}
+
+/*
+Constructor. Until classes and rules are added, every packet is in the default class and is sent right away.
+*/
+func NewQos(ip *l3.IP) *Qos {
+	q := &Qos{
+		ip:      ip,
+		classes: map[int]*qosClass{},
+		ports:   map[int]*egressPort{},
+	}
+	q.SetClass(DefaultClass, QosClass{})
+
+	ip.RegisterHook(l3.HookPostrouting, l3.PriorityQos, q.classify)
+	return q
+}
+
+/*
+Adds the class, or replaces the one with the same identifier. Its counters are kept.
+*/
+func (q *Qos) SetClass(id int, class QosClass) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	c := &qosClass{QosClass: class, stats: QosClassStats{Class: id}}
+	if existing, ok := q.classes[id]; ok {
+		c.stats = existing.stats
+	}
+	if c.Weight < 1 {
+		c.Weight = 1
+	}
+	if c.QueueLimit <= 0 {
+		c.QueueLimit = defaultQueueLimit
+	}
+	if c.PoliceRate > 0 {
+		burst := c.PoliceBurst
+		if burst <= 0 {
+			burst = c.PoliceRate / 10
+			if burst < minBurst {
+				burst = minBurst
+			}
+		}
+		c.policer = utils.NewTokenBucket(c.PoliceRate, burst)
+	}
+	q.classes[id] = c
+}
+
+func (q *Qos) AppendRule(rule QosRule) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.rules = append(q.rules, &rule)
+}
+
+/*
+Inserts the rule before the rule at the index, or at the end if the index is past it
+*/
+func (q *Qos) InsertRule(index int, rule QosRule) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if index < 0 || index >= len(q.rules) {
+		q.rules = append(q.rules, &rule)
+		return
+	}
+
+	newRules := append([]*QosRule{}, q.rules[:index]...)
+	newRules = append(newRules, &rule)
+	q.rules = append(newRules, q.rules[index:]...)
+}
+
+func (q *Qos) DeleteRule(index int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if index < 0 || index >= len(q.rules) {
+		return
+	}
+	q.rules = append(q.rules[:index:index], q.rules[index+1:]...)
+}
+
+func (q *Qos) FlushRules() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.rules = nil
+}
+
+/*
+Returns copies of the rules, with their hit counters
+*/
+func (q *Qos) GetRules() []QosRule {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var rules []QosRule
+	for _, rule := range q.rules {
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+/*
+Limits the rate of the packets sent on the interface, in bytes per second, so that they wait in the queues of their
+classes instead of in the adapter. The rate should be a bit below the one of the link. A rate of 0 or less removes the
+limit, and the packets waiting are sent right away.
+*/
+func (q *Qos) SetEgressRate(intfNum int, bytesPerSecond float64) {
+	q.lock.Lock()
+	port, ok := q.ports[intfNum]
+
+	if bytesPerSecond > 0 {
+		//Allow a burst of 10ms worth of bytes, but at least a full packet
+		burst := bytesPerSecond / 100
+		if burst < minBurst {
+			burst = minBurst
+		}
+		shaper := utils.NewTokenBucket(bytesPerSecond, burst)
+
+		if ok {
+			port.shaper = shaper
+		} else {
+			port = &egressPort{
+				shaper:  shaper,
+				queues:  map[int]*classQueue{},
+				current: -1,
+				wake:    make(chan bool, 1),
+				stop:    make(chan bool),
+			}
+			q.ports[intfNum] = port
+			go q.serve(port)
+		}
+		q.lock.Unlock()
+		return
+	}
+
+	if !ok {
+		q.lock.Unlock()
+		return
+	}
+	delete(q.ports, intfNum)
+	close(port.stop)
+	var waiting []*l3.HookPacket
+	for _, queue := range port.queues {
+		for _, p := range queue.packets {
+			q.countSent(queue.class, p.Packet)
+			waiting = append(waiting, p)
+		}
+	}
+	q.lock.Unlock()
+
+	for _, p := range waiting {
+		q.ip.Reinject(p, l3.VerdictModify)
+	}
+}
+
+/*
+Returns the counters of every class, ordered by class
+*/
+func (q *Qos) GetStats() []QosClassStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var stats []QosClassStats
+	for _, class := range q.classes {
+		stats = append(stats, class.stats)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Class < stats[j].Class
+	})
+	return stats
+}
+
+/*
+Internal methods
+*/
+
+/*
+The hook putting the packets leaving in their class. Queued packets are handed back as modified, since they may have
+been marked.
+*/
+func (q *Qos) classify(p *l3.HookPacket) int {
+	packet := p.Packet
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	classId := DefaultClass
+	for _, rule := range q.rules {
+		if rule.matches(p) {
+			rule.Hits++
+			classId = rule.Class
+			break
+		}
+	}
+	class, ok := q.classes[classId]
+	if !ok {
+		log.Printf("QoS: No class %d. Using the default class.", classId)
+		classId = DefaultClass
+		class = q.classes[DefaultClass]
+	}
+
+	verdict := l3.VerdictAccept
+	if class.Mark && packet[1]>>2 != class.Dscp {
+		packet[1] = class.Dscp<<2 | packet[1]&0x03
+		verdict = l3.VerdictModify
+	}
+
+	if class.policer != nil && !class.policer.Take(float64(len(packet))) {
+		class.stats.PoliceDrops++
+		return l3.VerdictDrop
+	}
+
+	port, ok := q.ports[p.OutInterface]
+	if !ok {
+		q.countSent(classId, packet)
+		return verdict
+	}
+
+	queue, ok := port.queues[classId]
+	if !ok {
+		queue = &classQueue{class: classId}
+		port.queues[classId] = queue
+	}
+	if len(queue.packets) >= class.QueueLimit {
+		class.stats.QueueDrops++
+		return l3.VerdictDrop
+	}
+	queue.packets = append(queue.packets, p)
+
+	select {
+	case port.wake <- true:
+	default:
+	}
+	return l3.VerdictQueue
+}
+
+/*
+Sends the packets waiting on an interface, as fast as its rate allows
+*/
+func (q *Qos) serve(port *egressPort) {
+	for {
+		q.lock.Lock()
+		queue := q.nextQueue(port)
+		if queue == nil {
+			q.lock.Unlock()
+			select {
+			case <-port.wake:
+				continue
+			case <-port.stop:
+				return
+			}
+		}
+		p := queue.packets[0]
+		shaper := port.shaper
+		q.lock.Unlock()
+
+		if !shaper.Take(float64(len(p.Packet))) {
+			select {
+			case <-time.After(time.Millisecond):
+				continue
+			case <-port.stop:
+				return
+			}
+		}
+
+		//Only this goroutine takes packets out of the queues, hence the packet is still the first one, unless they have
+		//all been sent because the rate was removed
+		q.lock.Lock()
+		select {
+		case <-port.stop:
+			q.lock.Unlock()
+			return
+		default:
+		}
+		queue.packets = queue.packets[1:]
+		queue.deficit -= len(p.Packet)
+		if len(queue.packets) == 0 {
+			queue.deficit = 0
+		}
+		q.countSent(queue.class, p.Packet)
+		q.lock.Unlock()
+
+		q.ip.Reinject(p, l3.VerdictModify)
+	}
+}
+
+/*
+Returns the queue to send from next, or nil if no packets are waiting. Expects the lock to be held.
+*/
+func (q *Qos) nextQueue(port *egressPort) *classQueue {
+	//Only the classes with the highest priority among those with packets waiting are sent from
+	var ids []int
+	priority := 0
+	for id, queue := range port.queues {
+		if len(queue.packets) == 0 {
+			continue
+		}
+		classPriority := q.getClass(id).Priority
+		if len(ids) == 0 || classPriority > priority {
+			ids = []int{id}
+			priority = classPriority
+		} else if classPriority == priority {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	sort.Ints(ids)
+
+	//Deficit round robin: a class gets a quantum by its weight each time its turn comes, and is sent from while it has
+	//enough left for its next packet
+	start := 0
+	for start < len(ids) && ids[start] < port.current {
+		start++
+	}
+	for i := 0; ; i++ {
+		id := ids[(start+i)%len(ids)]
+		queue := port.queues[id]
+		if id != port.current {
+			port.current = id
+			queue.deficit += qosQuantum * q.getClass(id).Weight
+		}
+		if queue.deficit >= len(queue.packets[0].Packet) {
+			return queue
+		}
+		port.current = -1
+	}
+}
+
+/*
+Classes removed while their packets wait are served like the default one. Expects the lock to be held.
+*/
+func (q *Qos) getClass(id int) *qosClass {
+	if class, ok := q.classes[id]; ok {
+		return class
+	}
+	return q.classes[DefaultClass]
+}
+
+/*
+Expects the lock to be held
+*/
+func (q *Qos) countSent(classId int, packet []byte) {
+	stats := &q.getClass(classId).stats
+	stats.Packets++
+	stats.Bytes += uint64(len(packet))
+}
+
+func (r *QosRule) matches(p *l3.HookPacket) bool {
+	packet := p.Packet
+	if !matchesInterface(r.InInterfaces, p.InInterface) || !matchesInterface(r.OutInterfaces, p.OutInterface) {
+		return false
+	}
+	if r.Source != nil && !r.Source.Contains(packet[12:16]) {
+		return false
+	}
+	if r.Destination != nil && !r.Destination.Contains(packet[16:20]) {
+		return false
+	}
+	if r.Protocol != nil && r.Protocol[0] != packet[10] {
+		return false
+	}
+
+	if r.SourcePorts != nil || r.DestPorts != nil {
+		if !hasPorts(packet) {
+			return false
+		}
+		if r.SourcePorts != nil && !r.SourcePorts.Contains(binary.BigEndian.Uint16(packet[20:22])) {
+			return false
+		}
+		if r.DestPorts != nil && !r.DestPorts.Contains(binary.BigEndian.Uint16(packet[22:24])) {
+			return false
+		}
+	}
+
+	if len(r.Dscps) > 0 {
+		found := false
+		for _, dscp := range r.Dscps {
+			found = found || dscp == packet[1]>>2
+		}
+		return found
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package devices
+
+import (
+	"bytes"
+	"log"
+	"netsim/api"
+	"netsim/hardware"
+	"netsim/protocol"
+	"netsim/protocol/l2"
+	"netsim/protocol/l3"
+	"testing"
+	"time"
+)
+
+/*
+Testcase
+*/
+func TestQos(t *testing.T) {
+	//Voice and bulk traffic from two hosts meet on a slow uplink
+	phone := NewComputer([]byte("qosph1"), []byte{10, 0, 1, 2})
+	phone.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 1, 1})
+	server := NewComputer([]byte("qossv1"), []byte{10, 0, 2, 2})
+	server.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 2, 1})
+	remote := NewComputer([]byte("qosrm1"), []byte{10, 0, 3, 2})
+	remote.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 3, 1})
+	capture := &frameCapture{}
+	remote.StartCapture(capture)
+
+	table := l3.NewRoutingTable()
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, nil, 0)
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 2, 0}, Mask: 24}, nil, 1)
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 3, 0}, Mask: 24}, nil, 2)
+	router := NewRouter([][]byte{[]byte("qosrt0"), []byte("qosrt1"), []byte("qosrt2")}, [][]byte{{10, 0, 1, 1}, {10, 0, 2, 1}, {10, 0, 3, 1}}, table, l3.NewARP())
+
+	//Voice is trusted by its DSCP and goes first, but is policed. Bulk traffic is marked down.
+	const voiceClass, bulkClass = 1, 2
+	qos := router.EnableQos()
+	qos.SetClass(voiceClass, QosClass{Priority: 1, PoliceRate: 80})
+	qos.SetClass(bulkClass, QosClass{QueueLimit: 4, Mark: true, Dscp: DscpCs1})
+	qos.AppendRule(QosRule{Dscps: []byte{DscpEf}, Class: voiceClass})
+	qos.AppendRule(QosRule{Source: &protocol.CIDR{Address: []byte{10, 0, 2, 0}, Mask: 24}, Protocol: protocol.UDP, Class: bulkClass})
+	qos.SetEgressRate(2, 100)
+
+	adapter := func(intfNum int) hardware.Adapter {
+		return router.GetL3Protocol().GetL2ProtocolForInterface(intfNum).GetAdapter()
+	}
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, phone.GetAdapter(), adapter(0))
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, server.GetAdapter(), adapter(1))
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, remote.GetAdapter(), adapter(2))
+
+	go hardware.Clk.Start()
+	phone.TurnOn()
+	server.TurnOn()
+	remote.TurnOn()
+	router.TurnOn()
+
+	voice := phone.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+	voice.SetSockOpt(api.IP_TOS, []byte{DscpEf << 2})
+	bulk := server.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+	voicePort, bulkPort := uint16(5004), uint16(6000)
+
+	//Addresses are resolved before the congestion starts
+	voice.SendTo([]byte{10, 0, 3, 2}, 5004, &voicePort, make([]byte, 20))
+	bulk.SendTo([]byte{10, 0, 3, 2}, 6000, &bulkPort, make([]byte, 100))
+	time.Sleep(2 * time.Second)
+
+	log.Printf("Testcase: Congestion")
+	for i := 0; i < 30; i++ {
+		bulk.SendTo([]byte{10, 0, 3, 2}, 6000, &bulkPort, make([]byte, 100))
+	}
+	for i := 0; i < 5; i++ {
+		voice.SendTo([]byte{10, 0, 3, 2}, 5004, &voicePort, make([]byte, 20))
+		time.Sleep(time.Second)
+	}
+	time.Sleep(6 * time.Second)
+
+	//Returns the TOS of the packets from the host which arrived
+	received := func(srcAddr []byte) []byte {
+		var tos []byte
+		for _, frame := range capture.getFrames() {
+			frameType, packet := l2.GetPayload(frame)
+			if bytes.Equal(frameType, protocol.IP) && len(packet) >= 20 && bytes.Equal(packet[12:16], srcAddr) {
+				tos = append(tos, packet[1])
+			}
+		}
+		return tos
+	}
+	voiceTos := received([]byte{10, 0, 1, 2})
+	bulkTos := received([]byte{10, 0, 2, 2})
+
+	if len(voiceTos) != 6 {
+		t.Errorf("Expected all 6 voice packets to survive the congestion but got %d", len(voiceTos))
+	}
+	for _, tos := range voiceTos {
+		if tos != DscpEf<<2 {
+			t.Errorf("Expected voice to keep the TOS set on the socket but got %d", tos)
+		}
+	}
+	for _, tos := range bulkTos {
+		if tos != DscpCs1<<2 {
+			t.Errorf("Expected bulk traffic to be marked down but got TOS %d", tos)
+		}
+	}
+
+	stats := qos.GetStats()
+	if len(stats) != 3 {
+		t.Fatalf("Expected counters for 3 classes but got %v", stats)
+	}
+	if stats[voiceClass].Packets != 6 || stats[voiceClass].PoliceDrops != 0 || stats[voiceClass].QueueDrops != 0 {
+		t.Errorf("Expected no voice packet to be dropped but got %+v", stats[voiceClass])
+	}
+	if stats[bulkClass].QueueDrops == 0 || stats[bulkClass].Packets != uint64(len(bulkTos)) || stats[bulkClass].Packets+stats[bulkClass].QueueDrops != 31 {
+		t.Errorf("Expected the bulk queue to overflow, and the rest to be sent, but got %+v and %d received", stats[bulkClass], len(bulkTos))
+	}
+	if rules := qos.GetRules(); rules[0].Hits != 6 || rules[1].Hits != 31 {
+		t.Errorf("Expected the rules to match 6 and 31 packets but got %d and %d", rules[0].Hits, rules[1].Hits)
+	}
+}
+
+func TestQosRuleFragments(t *testing.T) {
+	//A UDP packet to port 5060, and a later fragment whose data happens to look the same
+	first := make([]byte, 40)
+	first[0], first[10] = 0x04, protocol.UDP[0]
+	first[20], first[21], first[22], first[23] = 0x13, 0xC4, 0x13, 0xC4
+	later := append([]byte{}, first...)
+	later[6], later[8] = 0x01, 24
+
+	rule := QosRule{Protocol: protocol.UDP, DestPorts: &PortRange{From: 5060, To: 5060}}
+	if !rule.matches(&l3.HookPacket{Packet: first}) {
+		t.Errorf("Expected the first fragment to match the ports")
+	}
+	if rule.matches(&l3.HookPacket{Packet: later}) {
+		t.Errorf("Expected a later fragment never to match the ports")
+	}
+}
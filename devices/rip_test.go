@@ -0,0 +1,89 @@
+package devices
+
+import (
+	"bytes"
+	"log"
+	"netsim/hardware"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"testing"
+	"time"
+)
+
+/*
+Testcase
+*/
+func TestRip(t *testing.T) {
+	//Three routers in a chain, with a computer at each end
+	computer1 := NewComputer([]byte("ripc01"), []byte{10, 0, 1, 2})
+	computer1.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 1, 1})
+	computer3 := NewComputer([]byte("ripc03"), []byte{10, 0, 3, 2})
+	computer3.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 3, 1})
+
+	table1 := l3.NewRoutingTable()
+	table2 := l3.NewRoutingTable()
+	table3 := l3.NewRoutingTable()
+	router1 := NewRouter([][]byte{[]byte("ripr11"), []byte("ripr12")}, [][]byte{{10, 0, 1, 1}, {10, 1, 12, 1}}, table1, l3.NewARP())
+	router2 := NewRouter([][]byte{[]byte("ripr21"), []byte("ripr22")}, [][]byte{{10, 1, 12, 2}, {10, 1, 23, 2}}, table2, l3.NewARP())
+	router3 := NewRouter([][]byte{[]byte("ripr31"), []byte("ripr32")}, [][]byte{{10, 1, 23, 3}, {10, 0, 3, 1}}, table3, l3.NewARP())
+
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, computer1.GetAdapter(), router1.GetL3Protocol().GetL2ProtocolForInterface(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, router1.GetL3Protocol().GetL2ProtocolForInterface(1).GetAdapter(), router2.GetL3Protocol().GetL2ProtocolForInterface(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, router2.GetL3Protocol().GetL2ProtocolForInterface(1).GetAdapter(), router3.GetL3Protocol().GetL2ProtocolForInterface(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, router3.GetL3Protocol().GetL2ProtocolForInterface(1).GetAdapter(), computer3.GetAdapter())
+
+	go hardware.Clk.Start()
+	computer1.TurnOn()
+	computer3.TurnOn()
+	router1.TurnOn()
+	router2.TurnOn()
+	router3.TurnOn()
+
+	rip1 := router1.EnableRip([]*protocol.CIDR{{Address: []byte{10, 0, 1, 0}, Mask: 24}, {Address: []byte{10, 1, 12, 0}, Mask: 24}})
+	rip2 := router2.EnableRip([]*protocol.CIDR{{Address: []byte{10, 1, 12, 0}, Mask: 24}, {Address: []byte{10, 1, 23, 0}, Mask: 24}})
+	rip3 := router3.EnableRip([]*protocol.CIDR{{Address: []byte{10, 1, 23, 0}, Mask: 24}, {Address: []byte{10, 0, 3, 0}, Mask: 24}})
+	rip1.SetTimers(time.Second, 3*time.Second, 2*time.Second)
+	rip2.SetTimers(time.Second, 3*time.Second, 2*time.Second)
+	rip3.SetTimers(time.Second, 3*time.Second, 2*time.Second)
+
+	log.Printf("Testcase: Learning routes")
+	time.Sleep(3 * time.Second)
+
+	route, err := table1.Lookup([]byte{10, 0, 3, 2})
+	if err != nil || !bytes.Equal(route.Gateway, []byte{10, 1, 12, 2}) || route.Metric != 3 || route.Distance != 120 {
+		t.Fatalf("Expected route to far network via router 2 with metric 3 but got %v %v", route, err)
+	}
+	if len(rip1.GetRoutes()) != 4 {
+		t.Errorf("Expected router 1 to know 4 networks but got %d", len(rip1.GetRoutes()))
+	}
+
+	log.Printf("Testcase: Ping across the routers")
+	binding := computer1.GetICMP().Bind(1)
+	var reply *l3.IcmpMessage
+	for seq := uint16(1); seq <= 3 && reply == nil; seq++ {
+		binding.SendEcho([]byte{10, 0, 3, 2}, seq, []byte("ping"), 64, 0)
+		reply = binding.Recv(5 * time.Second)
+	}
+	if reply == nil || reply.Type != l3.IcmpEchoReply {
+		t.Errorf("Expected a reply from the far computer")
+	}
+
+	//Router 2 stops hearing from router 3, times out the route and tells router 1
+	log.Printf("Testcase: Route timeout")
+	router2.GetL3Protocol().GetL2ProtocolForInterface(1).GetAdapter().TurnOff()
+	time.Sleep(6 * time.Second)
+	if _, err := table1.Lookup([]byte{10, 0, 3, 2}); err != protocol.ErrNoRoute {
+		t.Errorf("Expected route to far network to be gone but got %v", err)
+	}
+	if _, err := table2.Lookup([]byte{10, 0, 3, 2}); err != protocol.ErrNoRoute {
+		t.Errorf("Expected route on router 2 to time out but got %v", err)
+	}
+
+	//Stopping takes the routes out of the table
+	rip1.Stop()
+	rip2.Stop()
+	rip3.Stop()
+	if len(table1.GetRoutes()) != 0 {
+		t.Errorf("Expected routes to be removed but got %d", len(table1.GetRoutes()))
+	}
+}
@@ -1,35 +1,72 @@
 package devices
 
 import (
+	"log"
 	"netsim/hardware"
 	"netsim/protocol"
+	"netsim/protocol/dhcp"
 	"netsim/protocol/l2"
 	"netsim/protocol/l3"
+	"netsim/protocol/l4"
+	"netsim/protocol/routing"
 )
 
 /*
 A router is a device which connects multiple networks together
 Based on the destination IP address in the packet, it forwards packet out of one of the interfaces after consulting the routing table.
 A router generally implements routing algorithms to learn the routing table. In this implementation, the RouteProvider implements any routing algorithms.
-We will be providing a StaticRouteProvider which is configured by a network administrator. If we want to implement a routing protocol then we can pass a RouteProvider as l4Protocols so it gets the packets and hence learn the routes.
+We will be providing a RoutingTable which can be configured by a network administrator. If we want to implement a routing protocol then we can pass a RouteProvider as l4Protocols so it gets the packets and hence learn the routes.
 */
 type Router struct {
-	ip       *l3.IP
-	numPorts int
+	ip           *l3.IP
+	ipv6         *l3.IPv6
+	routingTable protocol.RouteProvider
+	icmp         *l3.ICMP
+	igmp         *l3.IGMP
+	udp          *l4.UDP
+	tcp          *l4.TCP
+	arp          *l3.ARP
+	qos          *Qos
+	numPorts     int
 }
 
 func NewRouter(macs [][]byte, ipAddrs [][]byte, routingTable protocol.RouteProvider, addrResolutionTable protocol.AddressResolver) *Router {
 	router := &Router{
-		ip:       l3.NewIP(ipAddrs, true, nil, routingTable, addrResolutionTable),
-		numPorts: len(ipAddrs),
+		ip:           l3.NewIP(ipAddrs, true, nil, routingTable, addrResolutionTable),
+		routingTable: routingTable,
+		icmp:         l3.NewICMP(),
+		igmp:         l3.NewIGMP(),
+		udp:          l4.NewUDP(),
+		tcp:          l4.NewTCP(),
+		numPorts:     len(ipAddrs),
 	}
 
+	//ICMP answers pings and reports the packets which could not be forwarded
+	router.ip.AddL4Protocol(router.icmp)
+	router.icmp.AddL3Protocol(router.ip)
+
+	//IGMP learns the multicast groups which have listeners on the networks of the router, once made a querier
+	router.ip.AddL4Protocol(router.igmp)
+	router.igmp.AddL3Protocol(router.ip)
+
+	//UDP and TCP are used by services running on the router, like DHCP and BGP
+	router.ip.AddL4Protocol(router.udp)
+	router.udp.AddL3Protocol(router.ip)
+	router.ip.AddL4Protocol(router.tcp)
+	router.tcp.AddL3Protocol(router.ip)
+
 	for i, m := range macs {
 		eth := l2.NewEthernet(hardware.NewEthernetAdapter(m, false), nil)
 		eth.AddL3Protocol(router.ip)
 		router.ip.SetL2ProtocolForInterface(i, eth)
 	}
 
+	//Dynamic address resolution has to listen on the interfaces
+	if arp, ok := addrResolutionTable.(*l3.ARP); ok {
+		arp.Attach(router.ip)
+		router.arp = arp
+	}
+
 	return router
 }
 
@@ -37,6 +74,204 @@ func (r *Router) GetL3Protocol() protocol.L3Protocol {
 	return r.ip
 }
 
+func (r *Router) GetICMP() *l3.ICMP {
+	return r.icmp
+}
+
+func (r *Router) GetIGMP() *l3.IGMP {
+	return r.igmp
+}
+
+func (r *Router) GetUDP() *l4.UDP {
+	return r.udp
+}
+
+func (r *Router) GetTCP() *l4.TCP {
+	return r.tcp
+}
+
+/*
+Relays DHCP messages between the hosts on the networks of the router and the servers, which are on other networks
+*/
+func (r *Router) EnableDhcpRelay(servers [][]byte) *dhcp.Relay {
+	relay := dhcp.NewRelay(r, servers)
+	relay.Start()
+	return relay
+}
+
+/*
+Runs RIP on the interfaces having an address in one of the networks. The routing table of the router has to be a
+RoutingTable so that the learnt routes can be added to it.
+*/
+func (r *Router) EnableRip(networks []*protocol.CIDR) *routing.RIP {
+	table := r.getRoutingTable()
+	if table == nil {
+		return nil
+	}
+
+	rip := routing.NewRIP(r, table, networks)
+	rip.Start()
+	return rip
+}
+
+/*
+Runs OSPF on the interfaces having an address in one of the networks. Like for RIP, the routing table of the router has
+to be a RoutingTable.
+*/
+func (r *Router) EnableOspf(routerId []byte, networks []*protocol.CIDR) *routing.OSPF {
+	table := r.getRoutingTable()
+	if table == nil {
+		return nil
+	}
+
+	ospf := routing.NewOSPF(r.ip, table, routerId, networks)
+	r.ip.AddL4Protocol(ospf)
+	ospf.Start()
+	return ospf
+}
+
+/*
+Runs BGP for the AS the router is in. The neighbours and the networks to announce are added to the returned BGP.
+*/
+func (r *Router) EnableBgp(as uint16, routerId []byte) *routing.BGP {
+	table := r.getRoutingTable()
+	if table == nil {
+		return nil
+	}
+
+	bgp := routing.NewBGP(r.ip, r.tcp, table, as, routerId)
+	bgp.Start()
+	return bgp
+}
+
+/*
+Runs PIM dense mode on all interfaces, so that multicast is routed to the networks which want it. The sources are checked
+against the routing table of the router, and the networks with listeners are learnt with IGMP.
+*/
+func (r *Router) EnablePim() *routing.PIM {
+	pim := routing.NewPIM(r.ip, r.igmp, r.routingTable)
+	r.ip.AddL4Protocol(pim)
+	r.ip.SetMulticastRouter(pim)
+	pim.Start()
+	return pim
+}
+
+/*
+Makes the router dual-stack, with one IPv6 address per interface. The router advertises the prefixes of the addresses on
+their links, so that hosts can configure themselves. Routes for IPv6 networks go in the same routing table, which has to
+be a RoutingTable.
+*/
+func (r *Router) EnableIPv6(ipAddrs [][]byte) *l3.IPv6 {
+	table := r.getRoutingTable()
+	if table == nil {
+		return nil
+	}
+
+	r.ipv6 = l3.NewIPv6(ipAddrs, true, nil, table)
+	for i := 0; i < r.numPorts; i++ {
+		eth := r.ip.GetL2ProtocolForInterface(i)
+		eth.AddL3Protocol(r.ipv6)
+		r.ipv6.SetL2ProtocolForInterface(i, eth)
+	}
+
+	r.ipv6.AddL4Protocol(r.udp)
+	r.udp.AddL3Protocol(r.ipv6)
+	r.ipv6.AddL4Protocol(r.tcp)
+	r.tcp.AddL3Protocol(r.ipv6)
+	return r.ipv6
+}
+
+func (r *Router) GetIPv6() *l3.IPv6 {
+	return r.ipv6
+}
+
+/*
+Adds a routing table for the rules to pick, besides the one the router was created with
+*/
+func (r *Router) AddRoutingTable(id int, table protocol.RouteProvider) {
+	r.ip.AddRoutingTable(id, table)
+}
+
+/*
+Routes the packets the rule matches with the table it names, see l3.RoutingRule
+*/
+func (r *Router) AddRoutingRule(rule l3.RoutingRule) {
+	r.ip.AddRoutingRule(rule)
+}
+
+func (r *Router) DeleteRoutingRule(priority int) {
+	r.ip.DeleteRoutingRule(priority)
+}
+
+func (r *Router) GetRoutingRules() []l3.RoutingRule {
+	return r.ip.GetRoutingRules()
+}
+
+/*
+Picks how forwarded packets are spread over equal-cost routes, either l3.MultipathPerFlow or l3.MultipathPerPacket
+*/
+func (r *Router) SetMultipathMode(mode int) {
+	r.ip.SetMultipathMode(mode)
+}
+
+/*
+Returns how many packets have been forwarded to each next hop
+*/
+func (r *Router) GetNextHopStats() []l3.NextHopStats {
+	return r.ip.GetNextHopStats()
+}
+
+/*
+Classifies, marks and polices the packets leaving the router, and queues them by class on the interfaces whose egress
+rate is limited. Does nothing until classes and rules are added.
+*/
+func (r *Router) EnableQos() *Qos {
+	if r.qos == nil {
+		r.qos = NewQos(r.ip)
+	}
+	return r.qos
+}
+
+func (r *Router) GetQos() *Qos {
+	return r.qos
+}
+
+/*
+Turns the interface into a bundle of links. The existing port becomes the first member and the other members are created
+with the same MAC address.
+*/
+func (r *Router) BundleInterface(intfNum int, numMembers int, key uint16) *l2.LinkAggregation {
+	first := r.ip.GetL2ProtocolForInterface(intfNum).(*l2.Ethernet)
+	first.RemoveL3Protocol(r.ip)
+	mac := first.GetAdapter().(*hardware.EthernetAdapter).GetMacAddress()
+
+	members := []*l2.Ethernet{first}
+	for i := 1; i < numMembers; i++ {
+		members = append(members, l2.NewEthernet(hardware.NewEthernetAdapter(mac, false), nil))
+	}
+
+	agg := l2.NewLinkAggregation(mac, key, members)
+	agg.AddL3Protocol(r.ip)
+	if r.arp != nil {
+		first.RemoveL3Protocol(r.arp)
+		agg.AddL3Protocol(r.arp)
+	}
+	r.ip.SetL2ProtocolForInterface(intfNum, agg)
+	return agg
+}
+
+func (r *Router) getRoutingTable() *l3.RoutingTable {
+	switch table := r.routingTable.(type) {
+	case *l3.RoutingTable:
+		return table
+	case *l3.StaticRouteProvider:
+		return table.RoutingTable
+	default:
+		log.Printf("Router: Routing protocols need a RoutingTable")
+		return nil
+	}
+}
+
 func (r *Router) TurnOn() {
 	for i := 0; i < r.numPorts; i++ {
 		r.ip.GetL2ProtocolForInterface(i).GetAdapter().TurnOn()
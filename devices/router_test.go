@@ -1,8 +1,10 @@
 package devices
 
 import (
+	"bytes"
 	"fmt"
 	"log"
+	"netsim/api"
 	"netsim/hardware"
 	"netsim/protocol"
 	"netsim/protocol/l2"
@@ -123,3 +125,73 @@ func TestSimpleDataTransfer(t *testing.T) {
 	time.Sleep(10 * time.Second)
 
 }
+
+/*
+Testcase
+*/
+func TestRouterICMP(t *testing.T) {
+	computer1 := NewComputer([]byte("icmpc1"), []byte{10, 0, 1, 2})
+	computer1.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 1, 1})
+	computer2 := NewComputer([]byte("icmpc2"), []byte{10, 0, 2, 2})
+	computer2.AddRoute(protocol.DefaultRouteCidr, []byte{10, 0, 2, 1})
+
+	//There is no default route, and the route to 10.0.2.3 leads to a host which does not exist
+	routeProvider := l3.NewStaticRouteProvider()
+	routeProvider.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 2}, Mask: 32}, []byte{10, 0, 1, 2}, 0)
+	routeProvider.Add(&protocol.CIDR{Address: []byte{10, 0, 2, 2}, Mask: 32}, []byte{10, 0, 2, 2}, 1)
+	routeProvider.Add(&protocol.CIDR{Address: []byte{10, 0, 2, 3}, Mask: 32}, []byte{10, 0, 2, 3}, 1)
+	router := NewRouter([][]byte{[]byte("icmpr1"), []byte("icmpr2")}, [][]byte{{10, 0, 1, 1}, {10, 0, 2, 1}}, routeProvider, l3.NewARP())
+
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, computer1.GetAdapter(), router.GetL3Protocol().GetL2ProtocolForInterface(0).GetAdapter())
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, computer2.GetAdapter(), router.GetL3Protocol().GetL2ProtocolForInterface(1).GetAdapter())
+
+	go hardware.Clk.Start()
+	computer1.TurnOn()
+	computer2.TurnOn()
+	router.TurnOn()
+
+	binding := computer1.GetICMP().Bind(1)
+	expect := func(name string, msgType int, source []byte, err error, timeout time.Duration) {
+		m := binding.Recv(timeout)
+		if m == nil {
+			t.Errorf("%s: Expected a message", name)
+			return
+		}
+		if m.Type != msgType || !bytes.Equal(m.Source, source) || m.Err != err {
+			t.Errorf("%s: Got unexpected message type %d from %v with error %v", name, m.Type, m.Source, m.Err)
+		}
+	}
+
+	log.Printf("Testcase: Echo")
+	binding.SendEcho([]byte{10, 0, 2, 2}, 1, []byte("ping"), 64, 0)
+	expect("Echo", l3.IcmpEchoReply, []byte{10, 0, 2, 2}, nil, 5*time.Second)
+
+	binding.SendEcho([]byte{10, 0, 1, 1}, 2, []byte("ping"), 64, 0)
+	expect("Echo router", l3.IcmpEchoReply, []byte{10, 0, 1, 1}, nil, 5*time.Second)
+
+	log.Printf("Testcase: Time exceeded")
+	binding.SendEcho([]byte{10, 0, 2, 2}, 3, []byte("ping"), 1, 0)
+	expect("Time exceeded", l3.IcmpTimeExceeded, []byte{10, 0, 1, 1}, protocol.ErrTTLExceeded, 5*time.Second)
+
+	log.Printf("Testcase: Net unreachable")
+	binding.SendEcho([]byte{10, 9, 9, 9}, 4, []byte("ping"), 64, 0)
+	expect("Net unreachable", l3.IcmpDestinationUnreachable, []byte{10, 0, 1, 1}, protocol.ErrNetUnreachable, 5*time.Second)
+
+	log.Printf("Testcase: Host unreachable")
+	binding.SendEcho([]byte{10, 0, 2, 3}, 5, []byte("ping"), 64, 0)
+	expect("Host unreachable", l3.IcmpDestinationUnreachable, []byte{10, 0, 1, 1}, protocol.ErrHostUnreachable, 10*time.Second)
+
+	log.Printf("Testcase: Fragmentation needed")
+	binding.SendEcho([]byte{10, 0, 2, 2}, 6, make([]byte, 2000), 64, l3.DontFragment)
+	expect("Fragmentation needed", 0, []byte{10, 0, 1, 2}, protocol.ErrFragmentationNeeded, 5*time.Second)
+
+	log.Printf("Testcase: Port unreachable")
+	srcPort := uint16(5000)
+	socket := computer1.NewSocket(api.AF_INET, api.SOCK_DGRAM, 0)
+	socket.Bind([]byte{0, 0, 0, 0}, srcPort)
+	socket.SendTo([]byte{10, 0, 2, 2}, 7777, &srcPort, []byte("anyone_there"))
+	time.Sleep(2 * time.Second)
+	if err := socket.GetError(); err != protocol.ErrPortUnreachable {
+		t.Errorf("Expected port unreachable on socket but got %v", err)
+	}
+}
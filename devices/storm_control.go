@@ -0,0 +1,101 @@
+package devices
+
+import (
+	"log"
+	"netsim/protocol/l2"
+	"netsim/utils"
+)
+
+/*
+Storm control polices the flooded traffic received on a port. Broadcast, multicast and unknown unicast frames are each
+limited to a configured number of frames per second, and the frames above the limit are dropped and counted. This keeps
+a broadcast storm or a MAC flooding attack on one port from overwhelming the rest of the network.
+*/
+const (
+	TrafficBroadcast = iota
+	TrafficMulticast
+	TrafficUnknownUnicast
+)
+
+type stormControl struct {
+	limiters map[int]*utils.TokenBucket
+	drops    map[int]uint64
+}
+
+func newStormControl() *stormControl {
+	return &stormControl{
+		limiters: map[int]*utils.TokenBucket{},
+		drops:    map[int]uint64{},
+	}
+}
+
+/*
+Limit the traffic of a type received on the port to the given rate. A rate less than 0 removes the limit.
+*/
+func (b *Bridge) SetStormControl(portNum int, trafficType int, framesPerSecond float64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	control := b.getStormControl(portNum)
+	if framesPerSecond < 0 {
+		delete(control.limiters, trafficType)
+		return
+	}
+
+	//Allow a burst of one second worth of frames
+	burst := framesPerSecond
+	if burst < 1 {
+		burst = 1
+	}
+	control.limiters[trafficType] = utils.NewTokenBucket(framesPerSecond, burst)
+}
+
+func (b *Bridge) GetStormControlDrops(portNum int, trafficType int) uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.getStormControl(portNum).drops[trafficType]
+}
+
+/*
+Internal methods. These expect the bridge lock to be held.
+*/
+func (b *Bridge) getStormControl(portNum int) *stormControl {
+	control, ok := b.stormControl[portNum]
+	if !ok {
+		control = newStormControl()
+		b.stormControl[portNum] = control
+	}
+
+	return control
+}
+
+/*
+Returns false if the frame has to be dropped
+*/
+func (b *Bridge) admitFlood(portNum int, destAddr []byte, isKnown bool) bool {
+	var trafficType int
+	if l2.IsBroadcastAddress(destAddr) {
+		trafficType = TrafficBroadcast
+	} else if l2.IsMulticastAddress(destAddr) {
+		trafficType = TrafficMulticast
+	} else if !isKnown {
+		trafficType = TrafficUnknownUnicast
+	} else {
+		return true
+	}
+
+	control, ok := b.stormControl[portNum]
+	if !ok {
+		return true
+	}
+
+	limiter, ok := control.limiters[trafficType]
+	if !ok || limiter.Take(1) {
+		return true
+	}
+
+	control.drops[trafficType]++
+	log.Printf("Bridge: Storm control dropped frame of type %d on port %d", trafficType, portNum)
+	return false
+}
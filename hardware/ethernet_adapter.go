@@ -97,8 +97,12 @@ func (e *EthernetAdapter) TurnOff() {
 	defer e.lock.Unlock()
 
 	e.isOn = false
-	e.readBuffer = make(chan *byte, readBufferSize)
 	e.writeBuffer = nil
+
+	//Drain the read buffer rather than replacing it, since the protocol reading from it holds on to the channel
+	for len(e.readBuffer) > 0 {
+		<-e.readBuffer
+	}
 }
 
 /*
@@ -109,9 +113,19 @@ func (e *EthernetAdapter) GetMacAddress() []byte {
 }
 
 func (e *EthernetAdapter) IsPromiscuous() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
 	return e.promiscuousMode
 }
 
+func (e *EthernetAdapter) SetPromiscuous(promiscuousMode bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.promiscuousMode = promiscuousMode
+}
+
 func (e *EthernetAdapter) GetReadBuffer() chan *byte {
 	return e.readBuffer
 }
@@ -7,8 +7,21 @@ var DefaultRouteCidr = &CIDR{
 	Mask:    0,
 }
 
+var DefaultRouteCidrIPv6 = &CIDR{
+	Address: make([]byte, 16),
+	Mask:    0,
+}
+
 var (
-	IP  = utils.HexStringToBytes("0800")
-	UDP = utils.HexStringToBytes("11")
-	TCP = utils.HexStringToBytes("06")
+	IP     = utils.HexStringToBytes("0800")
+	IPv6   = utils.HexStringToBytes("86DD")
+	ARP    = utils.HexStringToBytes("0806")
+	LACP   = utils.HexStringToBytes("8809")
+	ICMP   = utils.HexStringToBytes("01")
+	ICMPv6 = utils.HexStringToBytes("3A")
+	IGMP   = utils.HexStringToBytes("02")
+	OSPF   = utils.HexStringToBytes("59")
+	PIM    = utils.HexStringToBytes("67")
+	UDP    = utils.HexStringToBytes("11")
+	TCP    = utils.HexStringToBytes("06")
 )
@@ -0,0 +1,303 @@
+package dhcp
+
+import (
+	"log"
+	"math/rand"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"netsim/protocol/l4"
+	"sync"
+	"time"
+)
+
+/*
+The client gets an address for one interface of a host. Until it does, the interface has the address 0.0.0.0 and
+messages are broadcast from it. Once the lease is acknowledged, the address is set on the interface, and routes are
+added for the network of the interface and for the default gateway. These are taken away if the lease is lost.
+*/
+type ClientLease struct {
+	Address    []byte
+	Mask       int
+	Gateway    []byte
+	Dns        [][]byte
+	Server     []byte
+	LeaseTime  time.Duration
+	ObtainedAt time.Time
+}
+
+type Client struct {
+	ip            *l3.IP
+	udp           *l4.UDP
+	routeProvider *l3.RoutingTable
+	intfNum       int
+	hwAddr        []byte
+	binding       *l4.UdpBinding
+	lease         *ClientLease
+	routes        []*l3.Route
+	running       bool
+	lock          sync.Mutex
+}
+
+/*
+Constructor
+*/
+func NewClient(ip *l3.IP, udp *l4.UDP, routeProvider *l3.RoutingTable, intfNum int) *Client {
+	return &Client{
+		ip:            ip,
+		udp:           udp,
+		routeProvider: routeProvider,
+		intfNum:       intfNum,
+	}
+}
+
+/*
+DHCP client public API
+*/
+func (c *Client) Start() {
+	c.hwAddr = c.ip.GetL2ProtocolForInterface(c.intfNum).GetAdapter().(hardwareAddressProvider).GetMacAddress()
+	c.binding = c.udp.Bind(unspecifiedAddr, ClientPort, protocol.IP)
+	if c.binding == nil {
+		return
+	}
+
+	c.setRunning(true)
+	go c.run()
+}
+
+/*
+Stopping releases the lease, if there is one
+*/
+func (c *Client) Stop() {
+	c.setRunning(false)
+
+	lease := c.GetLease()
+	if lease != nil {
+		m := newMessage(opRequest, msgRelease, rand.Uint32(), c.hwAddr)
+		m.ciaddr = lease.Address
+		m.serverId = lease.Server
+		sendUdp(c.udp, m.encode(), lease.Server, ServerPort, ClientPort, -1)
+		c.unconfigure()
+	}
+
+	if c.binding != nil {
+		c.binding.Close()
+	}
+}
+
+/*
+Returns the current lease, or nil if the client does not have an address
+*/
+func (c *Client) GetLease() *ClientLease {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.lease == nil {
+		return nil
+	}
+
+	lease := *c.lease
+	return &lease
+}
+
+/*
+Internal methods
+*/
+func (c *Client) setRunning(running bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.running = running
+}
+
+func (c *Client) isRunning() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.running
+}
+
+func (c *Client) run() {
+	for c.isRunning() {
+		offer := c.discover()
+		if offer == nil {
+			continue
+		}
+
+		ack := c.request(offer)
+		if ack == nil {
+			continue
+		}
+
+		c.configure(ack)
+		c.keepLease()
+	}
+}
+
+func (c *Client) discover() *message {
+	m := newMessage(opRequest, msgDiscover, rand.Uint32(), c.hwAddr)
+	m.flags = broadcastFlag
+	c.broadcast(m)
+
+	return c.waitForReply(m.xid, time.Now().Add(replyTimeout), msgOffer)
+}
+
+func (c *Client) request(offer *message) *message {
+	m := newMessage(opRequest, msgRequest, offer.xid, c.hwAddr)
+	m.flags = broadcastFlag
+	m.requestedAddr = offer.yiaddr
+	m.serverId = offer.serverId
+	c.broadcast(m)
+
+	reply := c.waitForReply(m.xid, time.Now().Add(replyTimeout), msgAck, msgNak)
+	if reply == nil || reply.msgType == msgNak {
+		return nil
+	}
+	return reply
+}
+
+/*
+Renews the lease with the server when half of it is over, until the lease is lost
+*/
+func (c *Client) keepLease() {
+	for c.isRunning() {
+		lease := c.GetLease()
+		if lease == nil {
+			return
+		}
+
+		if !c.sleepUntil(lease.ObtainedAt.Add(lease.LeaseTime / 2)) {
+			return
+		}
+
+		expiresAt := lease.ObtainedAt.Add(lease.LeaseTime)
+		var reply *message
+		for reply == nil && c.isRunning() && time.Now().Before(expiresAt) {
+			m := newMessage(opRequest, msgRequest, rand.Uint32(), c.hwAddr)
+			m.ciaddr = lease.Address
+			sendUdp(c.udp, m.encode(), lease.Server, ServerPort, ClientPort, -1)
+
+			deadline := time.Now().Add(replyTimeout)
+			if deadline.After(expiresAt) {
+				deadline = expiresAt
+			}
+			reply = c.waitForReply(m.xid, deadline, msgAck, msgNak)
+		}
+
+		if reply == nil || reply.msgType == msgNak {
+			if c.isRunning() {
+				log.Printf("DHCP: Lost lease for %v", lease.Address)
+				c.unconfigure()
+			}
+			return
+		}
+
+		c.lock.Lock()
+		if c.lease != nil {
+			c.lease.ObtainedAt = time.Now()
+			c.lease.LeaseTime = time.Duration(reply.leaseTime) * time.Second
+		}
+		c.lock.Unlock()
+	}
+}
+
+func (c *Client) configure(ack *message) {
+	lease := &ClientLease{
+		Address:    append([]byte{}, ack.yiaddr...),
+		Mask:       32,
+		Gateway:    ack.router,
+		Dns:        ack.dns,
+		Server:     ack.serverId,
+		LeaseTime:  time.Duration(ack.leaseTime) * time.Second,
+		ObtainedAt: time.Now(),
+	}
+	if ack.subnetMask != nil {
+		lease.Mask = protocol.BytesToMask(ack.subnetMask)
+	}
+
+	//The route for the network has to come before the default route
+	c.ip.SetAddressForInterface(c.intfNum, lease.Address)
+	routes := []*l3.Route{{
+		Cidr:      networkOf(lease.Address, lease.Mask),
+		Interface: c.intfNum,
+		Distance:  l3.DistanceStatic,
+	}}
+	if lease.Gateway != nil {
+		routes = append(routes, &l3.Route{
+			Cidr:      protocol.DefaultRouteCidr,
+			Gateway:   lease.Gateway,
+			Interface: c.intfNum,
+			Distance:  l3.DistanceStatic,
+		})
+	}
+	for _, r := range routes {
+		c.routeProvider.AddRoute(r)
+	}
+
+	c.lock.Lock()
+	c.lease = lease
+	c.routes = routes
+	c.lock.Unlock()
+	log.Printf("DHCP: Got address %v/%d with gateway %v", lease.Address, lease.Mask, lease.Gateway)
+}
+
+func (c *Client) unconfigure() {
+	c.lock.Lock()
+	routes := c.routes
+	c.lease = nil
+	c.routes = nil
+	c.lock.Unlock()
+
+	//Only the routes installed by the client are removed, others for the same networks are left alone
+	for _, r := range routes {
+		c.routeProvider.RemoveRoute(r)
+	}
+	c.ip.SetAddressForInterface(c.intfNum, unspecifiedAddr)
+}
+
+func (c *Client) broadcast(m *message) {
+	sendUdp(c.udp, m.encode(), l3.BroadcastAddress, ServerPort, ClientPort, c.intfNum)
+}
+
+/*
+Waits for a reply to the transaction, of one of the given types. Returns nil if none arrives before the deadline.
+*/
+func (c *Client) waitForReply(xid uint32, deadline time.Time, msgTypes ...byte) *message {
+	for c.isRunning() && time.Now().Before(deadline) {
+		data, _, _, _ := c.binding.RecvFrom()
+		if data == nil {
+			time.Sleep(pollInterval)
+			continue
+		}
+
+		m := decodeMessage(data)
+		if m == nil || m.op != opReply || m.xid != xid || string(m.chaddr) != string(c.hwAddr) {
+			continue
+		}
+		for _, t := range msgTypes {
+			if m.msgType == t {
+				return m
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+Returns false if the client was stopped while sleeping
+*/
+func (c *Client) sleepUntil(t time.Time) bool {
+	for time.Now().Before(t) {
+		if !c.isRunning() {
+			return false
+		}
+		time.Sleep(pollInterval)
+	}
+
+	return c.isRunning()
+}
+
+//Internal struct
+type hardwareAddressProvider interface {
+	GetMacAddress() []byte
+}
@@ -0,0 +1,246 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"netsim/protocol"
+	"time"
+)
+
+/*
+DHCP lets hosts get their address and other configuration from a server instead of an administrator. A host without an
+address broadcasts a DISCOVER, the servers which can serve it answer with an OFFER, the host picks one offer and
+broadcasts a REQUEST for it (so that the other servers know they were not picked), and the chosen server confirms with an
+ACK. The address is leased for some time, and the host renews the lease by sending a REQUEST to the server directly when
+half the time is over. If the lease cannot be renewed before it expires, the host has to stop using the address.
+Since broadcasts do not cross routers, a router on the network of the host can relay the messages to a server on another
+network. The relay puts the address of its interface in GIAddr, which tells the server which pool to use and where to
+send the answer.
+
+We use the message format of DHCP without the server name and file fields, which were inherited from BOOTP and are not
+needed here.
+
+Message Format:
+
+Op		- 1 byte
+HType	- 1 byte
+HLen	- 1 byte
+Hops	- 1 byte
+Xid		- 4 bytes
+Secs	- 2 bytes
+Flags	- 2 bytes
+CIAddr	- 4 bytes
+YIAddr	- 4 bytes
+SIAddr	- 4 bytes
+GIAddr	- 4 bytes
+CHAddr	- 16 bytes
+Options	- No fixed length. Each option is Code (1 byte), Length (1 byte) and Value. The last option is End.
+*/
+const (
+	ServerPort = 67
+	ClientPort = 68
+)
+
+const (
+	opRequest        = 1
+	opReply          = 2
+	headerLength     = 44
+	hardwareType     = 1
+	hwAddrLength     = 6
+	broadcastFlag    = 0x8000
+	replyTimeout     = 2 * time.Second
+	pollInterval     = 20 * time.Millisecond
+	defaultLeaseTime = 3600 * time.Second
+)
+
+//Message types
+const (
+	msgDiscover = 1
+	msgOffer    = 2
+	msgRequest  = 3
+	msgDecline  = 4
+	msgAck      = 5
+	msgNak      = 6
+	msgRelease  = 7
+)
+
+//Option codes
+const (
+	optSubnetMask    = 1
+	optRouter        = 3
+	optDns           = 6
+	optRequestedAddr = 50
+	optLeaseTime     = 51
+	optMsgType       = 53
+	optServerId      = 54
+	optEnd           = 255
+)
+
+var (
+	unspecifiedAddr = []byte{0, 0, 0, 0}
+)
+
+/*
+Length of the value of the options which have a fixed one. The router option is a list, with at least one address.
+*/
+var optionLengths = map[byte]int{
+	optMsgType:       1,
+	optSubnetMask:    4,
+	optRequestedAddr: 4,
+	optLeaseTime:     4,
+	optServerId:      4,
+}
+
+/*
+Internal struct for a decoded message
+*/
+type message struct {
+	op            byte
+	hops          byte
+	xid           uint32
+	flags         uint16
+	ciaddr        []byte
+	yiaddr        []byte
+	siaddr        []byte
+	giaddr        []byte
+	chaddr        []byte
+	msgType       byte
+	subnetMask    []byte
+	router        []byte
+	dns           [][]byte
+	requestedAddr []byte
+	leaseTime     uint32
+	serverId      []byte
+}
+
+func newMessage(op byte, msgType byte, xid uint32, chaddr []byte) *message {
+	return &message{
+		op:      op,
+		xid:     xid,
+		ciaddr:  unspecifiedAddr,
+		yiaddr:  unspecifiedAddr,
+		siaddr:  unspecifiedAddr,
+		giaddr:  unspecifiedAddr,
+		chaddr:  chaddr,
+		msgType: msgType,
+	}
+}
+
+func (m *message) encode() []byte {
+	b := make([]byte, headerLength)
+	b[0] = m.op
+	b[1] = hardwareType
+	b[2] = hwAddrLength
+	b[3] = m.hops
+	binary.BigEndian.PutUint32(b[4:8], m.xid)
+	binary.BigEndian.PutUint16(b[10:12], m.flags)
+	copy(b[12:16], m.ciaddr)
+	copy(b[16:20], m.yiaddr)
+	copy(b[20:24], m.siaddr)
+	copy(b[24:28], m.giaddr)
+	copy(b[28:44], m.chaddr)
+
+	b = appendOption(b, optMsgType, []byte{m.msgType})
+	if m.subnetMask != nil {
+		b = appendOption(b, optSubnetMask, m.subnetMask)
+	}
+	if m.router != nil {
+		b = appendOption(b, optRouter, m.router)
+	}
+	if len(m.dns) > 0 {
+		var servers []byte
+		for _, d := range m.dns {
+			servers = append(servers, d...)
+		}
+		b = appendOption(b, optDns, servers)
+	}
+	if m.requestedAddr != nil {
+		b = appendOption(b, optRequestedAddr, m.requestedAddr)
+	}
+	if m.leaseTime != 0 {
+		leaseTime := make([]byte, 4)
+		binary.BigEndian.PutUint32(leaseTime, m.leaseTime)
+		b = appendOption(b, optLeaseTime, leaseTime)
+	}
+	if m.serverId != nil {
+		b = appendOption(b, optServerId, m.serverId)
+	}
+
+	return append(b, optEnd)
+}
+
+func decodeMessage(b []byte) *message {
+	if len(b) < headerLength+1 || b[1] != hardwareType || b[2] != hwAddrLength {
+		return nil
+	}
+
+	m := &message{
+		op:     b[0],
+		hops:   b[3],
+		xid:    binary.BigEndian.Uint32(b[4:8]),
+		flags:  binary.BigEndian.Uint16(b[10:12]),
+		ciaddr: b[12:16],
+		yiaddr: b[16:20],
+		siaddr: b[20:24],
+		giaddr: b[24:28],
+		chaddr: b[28 : 28+hwAddrLength],
+	}
+
+	for i := headerLength; i < len(b) && b[i] != optEnd; {
+		if i+2 > len(b) || i+2+int(b[i+1]) > len(b) {
+			return nil
+		}
+		code := b[i]
+		value := b[i+2 : i+2+int(b[i+1])]
+		i += 2 + len(value)
+
+		//Options of the wrong length would be read past their end later
+		if length, found := optionLengths[code]; found && len(value) != length {
+			return nil
+		}
+		if code == optRouter && len(value) < 4 {
+			return nil
+		}
+
+		switch code {
+		case optMsgType:
+			m.msgType = value[0]
+		case optSubnetMask:
+			m.subnetMask = value
+		case optRouter:
+			m.router = value[0:4]
+		case optDns:
+			for j := 0; j+4 <= len(value); j += 4 {
+				m.dns = append(m.dns, value[j:j+4])
+			}
+		case optRequestedAddr:
+			m.requestedAddr = value
+		case optLeaseTime:
+			m.leaseTime = binary.BigEndian.Uint32(value)
+		case optServerId:
+			m.serverId = value
+		}
+	}
+
+	if m.msgType == 0 {
+		return nil
+	}
+	return m
+}
+
+func appendOption(b []byte, code byte, value []byte) []byte {
+	b = append(b, code, byte(len(value)))
+	return append(b, value...)
+}
+
+/*
+Helpers for addresses
+*/
+func networkOf(addr []byte, mask int) *protocol.CIDR {
+	network := make([]byte, 4)
+	binary.BigEndian.PutUint32(network, binary.BigEndian.Uint32(addr)&binary.BigEndian.Uint32(protocol.MaskToBytes(mask)))
+	return &protocol.CIDR{Address: network, Mask: mask}
+}
+
+func isUnspecified(addr []byte) bool {
+	return binary.BigEndian.Uint32(addr) == 0
+}
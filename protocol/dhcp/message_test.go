@@ -0,0 +1,40 @@
+package dhcp
+
+import (
+	"testing"
+)
+
+func TestDecodeMessageOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    byte
+		value   []byte
+		decoded bool
+	}{
+		{"empty message type", optMsgType, []byte{}, false},
+		{"long message type", optMsgType, []byte{msgRequest, 0}, false},
+		{"short subnet mask", optSubnetMask, []byte{255, 255, 255}, false},
+		{"subnet mask", optSubnetMask, []byte{255, 255, 255, 0}, true},
+		{"short router", optRouter, []byte{10, 0, 0}, false},
+		{"router", optRouter, []byte{10, 0, 0, 1}, true},
+		{"two routers", optRouter, []byte{10, 0, 0, 1, 10, 0, 0, 2}, true},
+		{"short requested address", optRequestedAddr, []byte{10, 0, 0}, false},
+		{"long requested address", optRequestedAddr, []byte{10, 0, 0, 5, 0}, false},
+		{"requested address", optRequestedAddr, []byte{10, 0, 0, 5}, true},
+		{"short lease time", optLeaseTime, []byte{0, 0, 1}, false},
+		{"lease time", optLeaseTime, []byte{0, 0, 1, 0}, true},
+		{"short server id", optServerId, []byte{}, false},
+		{"server id", optServerId, []byte{10, 0, 0, 1}, true},
+	}
+
+	for _, test := range tests {
+		b := newMessage(opRequest, msgRequest, 1, []byte("immac1")).encode()
+		b = appendOption(b[:len(b)-1], test.code, test.value)
+		b = append(b, optEnd)
+
+		m := decodeMessage(b)
+		if (m != nil) != test.decoded {
+			t.Errorf("%s: expected decoded to be %v but got %v", test.name, test.decoded, m != nil)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package dhcp
+
+import (
+	"bytes"
+	"log"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"netsim/protocol/l4"
+	"sync"
+	"time"
+)
+
+/*
+The relay runs on a router and passes messages between the clients on its networks and servers on other networks.
+Requests are sent to all the servers with GIAddr set to the address of the interface they arrived on, and replies are
+broadcast on the interface having the address in GIAddr.
+*/
+const (
+	maxHops = 16
+)
+
+type Relay struct {
+	host    Host
+	servers [][]byte
+	binding *l4.UdpBinding
+	running bool
+	lock    sync.Mutex
+}
+
+/*
+Constructor
+*/
+func NewRelay(host Host, servers [][]byte) *Relay {
+	return &Relay{
+		host:    host,
+		servers: servers,
+	}
+}
+
+/*
+DHCP relay public API
+*/
+func (r *Relay) Start() {
+	r.binding = r.host.GetUDP().Bind(unspecifiedAddr, ServerPort, protocol.IP)
+	if r.binding == nil {
+		return
+	}
+
+	r.setRunning(true)
+	go r.serve()
+}
+
+func (r *Relay) Stop() {
+	r.setRunning(false)
+	if r.binding != nil {
+		r.binding.Close()
+	}
+}
+
+/*
+Internal methods
+*/
+func (r *Relay) setRunning(running bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.running = running
+}
+
+func (r *Relay) isRunning() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.running
+}
+
+func (r *Relay) serve() {
+	for r.isRunning() {
+		data, _, _, intfNum := r.binding.RecvFrom()
+		if data == nil {
+			time.Sleep(pollInterval)
+			continue
+		}
+
+		m := decodeMessage(data)
+		if m == nil {
+			log.Printf("DHCP: Relay got invalid message. Dropping.")
+			continue
+		}
+
+		if m.op == opRequest {
+			r.relayRequest(m, intfNum)
+		} else {
+			r.relayReply(m)
+		}
+	}
+}
+
+func (r *Relay) relayRequest(m *message, intfNum int) {
+	if m.hops >= maxHops {
+		log.Printf("DHCP: Relay got message with too many hops. Dropping.")
+		return
+	}
+
+	m.hops++
+	if isUnspecified(m.giaddr) {
+		m.giaddr = r.host.GetL3Protocol().GetAddressForInterface(intfNum)
+	}
+
+	for _, server := range r.servers {
+		sendUdp(r.host.GetUDP(), m.encode(), server, ServerPort, ServerPort, -1)
+	}
+}
+
+func (r *Relay) relayReply(m *message) {
+	ip, ok := r.host.GetL3Protocol().(*l3.IP)
+	if !ok {
+		return
+	}
+
+	for i := 0; i < ip.NumInterfaces(); i++ {
+		if bytes.Equal(ip.GetAddressForInterface(i), m.giaddr) {
+			sendUdp(r.host.GetUDP(), m.encode(), l3.BroadcastAddress, ClientPort, ServerPort, i)
+			return
+		}
+	}
+
+	log.Printf("DHCP: Relay got reply for unknown network. Dropping.")
+}
@@ -0,0 +1,385 @@
+package dhcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"netsim/protocol/l4"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+The server hands out addresses from pools. The pool for a client is the one whose network contains the address of the
+relay which forwarded the request, or the address the client already has when renewing, or otherwise the address of the
+interface the request arrived on. An address offered to a client is held for a short time, so that it is not offered to
+someone else while the client decides. Clients get back the address they had before if it is still free.
+*/
+const (
+	offerTimeout = 10 * time.Second
+)
+
+/*
+Any device with UDP, like a Computer or a Router, can run the server or the relay
+*/
+type Host interface {
+	GetUDP() *l4.UDP
+	GetL3Protocol() protocol.L3Protocol
+}
+
+type Pool struct {
+	Network   *protocol.CIDR
+	Start     []byte
+	End       []byte
+	Gateway   []byte
+	Dns       [][]byte
+	LeaseTime time.Duration
+}
+
+/*
+Snapshot of a lease, as returned by GetLeases
+*/
+type Lease struct {
+	HwAddr    []byte
+	Address   []byte
+	ExpiresAt time.Time
+}
+
+type Server struct {
+	host    Host
+	pools   []*Pool
+	leases  map[string]*serverLease
+	binding *l4.UdpBinding
+	running bool
+	lock    sync.Mutex
+}
+
+/*
+Constructor
+*/
+func NewServer(host Host, pools []*Pool) *Server {
+	return &Server{
+		host:   host,
+		pools:  pools,
+		leases: map[string]*serverLease{},
+	}
+}
+
+/*
+DHCP server public API
+*/
+func (s *Server) Start() {
+	s.binding = s.host.GetUDP().Bind(unspecifiedAddr, ServerPort, protocol.IP)
+	if s.binding == nil {
+		return
+	}
+
+	s.setRunning(true)
+	go s.serve()
+}
+
+func (s *Server) Stop() {
+	s.setRunning(false)
+	if s.binding != nil {
+		s.binding.Close()
+	}
+}
+
+/*
+Returns the addresses currently leased, leaving out the ones only offered
+*/
+func (s *Server) GetLeases() []*Lease {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var leases []*Lease
+	for _, l := range s.leases {
+		if l.offered || l.isExpired() {
+			continue
+		}
+		leases = append(leases, &Lease{
+			HwAddr:    l.hwAddr,
+			Address:   l.address,
+			ExpiresAt: l.expiresAt,
+		})
+	}
+
+	sort.Slice(leases, func(i, j int) bool {
+		return bytes.Compare(leases[i].Address, leases[j].Address) < 0
+	})
+	return leases
+}
+
+/*
+Internal methods
+*/
+func (s *Server) setRunning(running bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.running = running
+}
+
+func (s *Server) isRunning() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.running
+}
+
+func (s *Server) serve() {
+	for s.isRunning() {
+		data, _, _, intfNum := s.binding.RecvFrom()
+		if data == nil {
+			time.Sleep(pollInterval)
+			continue
+		}
+
+		m := decodeMessage(data)
+		if m == nil || m.op != opRequest {
+			log.Printf("DHCP: Server got invalid message. Dropping.")
+			continue
+		}
+
+		s.handle(m, intfNum)
+	}
+}
+
+func (s *Server) handle(m *message, intfNum int) {
+	serverId := s.host.GetL3Protocol().GetAddressForInterface(intfNum)
+	pool := s.selectPool(m, serverId)
+	if pool == nil {
+		log.Printf("DHCP: No pool for client %s. Dropping.", m.chaddr)
+		return
+	}
+
+	switch m.msgType {
+	case msgDiscover:
+		addr := s.allocate(m.chaddr, pool, m.requestedAddr)
+		if addr == nil {
+			log.Printf("DHCP: Pool exhausted. Cannot serve client %s.", m.chaddr)
+			return
+		}
+		s.send(s.createReply(m, msgOffer, addr, pool, serverId), m, intfNum)
+	case msgRequest:
+		//The client chose the offer of another server
+		if m.serverId != nil && !bytes.Equal(m.serverId, serverId) {
+			s.releaseOffer(m.chaddr)
+			return
+		}
+
+		requested := m.requestedAddr
+		if requested == nil {
+			requested = m.ciaddr
+		}
+		if s.confirm(m.chaddr, requested, pool) {
+			s.send(s.createReply(m, msgAck, requested, pool, serverId), m, intfNum)
+		} else {
+			s.send(s.createReply(m, msgNak, unspecifiedAddr, nil, serverId), m, intfNum)
+		}
+	case msgRelease, msgDecline:
+		s.release(m.chaddr)
+	}
+}
+
+func (s *Server) selectPool(m *message, serverId []byte) *Pool {
+	addr := serverId
+	if !isUnspecified(m.giaddr) {
+		addr = m.giaddr
+	} else if !isUnspecified(m.ciaddr) {
+		addr = m.ciaddr
+	}
+
+	for _, p := range s.pools {
+		if p.Network.Contains(addr) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+/*
+Finds an address for the client and holds it as offered
+*/
+func (s *Server) allocate(hwAddr []byte, pool *Pool, requested []byte) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	lease, ok := s.leases[string(hwAddr)]
+	if ok && isInRange(lease.address, pool) && (!lease.isExpired() || s.isFree(lease.address, hwAddr)) {
+		if lease.offered {
+			lease.expiresAt = time.Now().Add(offerTimeout)
+		}
+		return lease.address
+	}
+
+	var addr []byte
+	if requested != nil && isInRange(requested, pool) && s.isFree(requested, hwAddr) {
+		addr = requested
+	} else {
+		start := binary.BigEndian.Uint32(pool.Start)
+		end := binary.BigEndian.Uint32(pool.End)
+		for a := start; a <= end; a++ {
+			candidate := make([]byte, 4)
+			binary.BigEndian.PutUint32(candidate, a)
+			if s.isFree(candidate, hwAddr) {
+				addr = candidate
+				break
+			}
+		}
+	}
+
+	if addr == nil {
+		return nil
+	}
+
+	s.leases[string(hwAddr)] = &serverLease{
+		hwAddr:    append([]byte{}, hwAddr...),
+		address:   addr,
+		offered:   true,
+		expiresAt: time.Now().Add(offerTimeout),
+	}
+	return addr
+}
+
+/*
+Turns the offer into a lease, or extends the lease. Clients which remember their address from before can also get it
+directly, if it is still free.
+*/
+func (s *Server) confirm(hwAddr []byte, requested []byte, pool *Pool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if requested == nil || !isInRange(requested, pool) {
+		return false
+	}
+
+	lease, ok := s.leases[string(hwAddr)]
+	if ok && !bytes.Equal(lease.address, requested) {
+		return false
+	}
+	if !ok {
+		if !s.isFree(requested, hwAddr) {
+			return false
+		}
+		lease = &serverLease{
+			hwAddr:  append([]byte{}, hwAddr...),
+			address: append([]byte{}, requested...),
+		}
+		s.leases[string(hwAddr)] = lease
+	}
+
+	lease.offered = false
+	lease.expiresAt = time.Now().Add(leaseTimeOf(pool))
+	log.Printf("DHCP: Leased %v to %s", lease.address, hwAddr)
+	return true
+}
+
+func (s *Server) release(hwAddr []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.leases, string(hwAddr))
+}
+
+/*
+Drops the address held for the client, unless it is already leased to it
+*/
+func (s *Server) releaseOffer(hwAddr []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if lease, ok := s.leases[string(hwAddr)]; ok && lease.offered {
+		delete(s.leases, string(hwAddr))
+	}
+}
+
+/*
+Expects the lock to be held
+*/
+func (s *Server) isFree(addr []byte, hwAddr []byte) bool {
+	for _, l := range s.leases {
+		if bytes.Equal(l.address, addr) && !bytes.Equal(l.hwAddr, hwAddr) && !l.isExpired() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *Server) createReply(request *message, msgType byte, addr []byte, pool *Pool, serverId []byte) *message {
+	reply := newMessage(opReply, msgType, request.xid, request.chaddr)
+	reply.flags = request.flags
+	reply.giaddr = request.giaddr
+	reply.yiaddr = addr
+	reply.serverId = serverId
+
+	if pool != nil {
+		reply.siaddr = serverId
+		reply.subnetMask = protocol.MaskToBytes(pool.Network.Mask)
+		reply.router = pool.Gateway
+		reply.dns = pool.Dns
+		reply.leaseTime = uint32(leaseTimeOf(pool) / time.Second)
+	}
+
+	return reply
+}
+
+/*
+Replies go back through the relay if there was one. Otherwise, they are broadcast on the interface the request came
+from, unless the client already has an address.
+*/
+func (s *Server) send(reply *message, request *message, intfNum int) {
+	udp := s.host.GetUDP()
+	if !isUnspecified(request.giaddr) {
+		sendUdp(udp, reply.encode(), request.giaddr, ServerPort, ServerPort, -1)
+	} else if !isUnspecified(request.ciaddr) {
+		sendUdp(udp, reply.encode(), request.ciaddr, ClientPort, ServerPort, -1)
+	} else {
+		sendUdp(udp, reply.encode(), l3.BroadcastAddress, ClientPort, ServerPort, intfNum)
+	}
+}
+
+/*
+Send a message on UDP. The interface is used only if it is not negative.
+*/
+func sendUdp(udp *l4.UDP, data []byte, destAddr []byte, destPort uint16, srcPort uint16, intfNum int) {
+	metadata := make([]byte, 4)
+	binary.BigEndian.PutUint16(metadata[0:2], destPort)
+	binary.BigEndian.PutUint16(metadata[2:4], srcPort)
+	metadata = append(metadata, protocol.IP...)
+	if intfNum >= 0 {
+		metadata = append(metadata, byte(intfNum))
+	}
+
+	udp.SendDown(data, destAddr, metadata, nil)
+}
+
+func isInRange(addr []byte, pool *Pool) bool {
+	a := binary.BigEndian.Uint32(addr)
+	return a >= binary.BigEndian.Uint32(pool.Start) && a <= binary.BigEndian.Uint32(pool.End)
+}
+
+func leaseTimeOf(pool *Pool) time.Duration {
+	if pool.LeaseTime == 0 {
+		return defaultLeaseTime
+	}
+
+	return pool.LeaseTime
+}
+
+//Internal struct
+type serverLease struct {
+	hwAddr    []byte
+	address   []byte
+	offered   bool
+	expiresAt time.Time
+}
+
+func (l *serverLease) isExpired() bool {
+	return l.expiresAt.Before(time.Now())
+}
@@ -0,0 +1,32 @@
+package dhcp
+
+import (
+	"netsim/protocol"
+	"testing"
+)
+
+func TestReleaseOffer(t *testing.T) {
+	pool := &Pool{
+		Network: &protocol.CIDR{Address: []byte{10, 0, 0, 0}, Mask: 24},
+		Start:   []byte{10, 0, 0, 100},
+		End:     []byte{10, 0, 0, 200},
+	}
+	s := NewServer(nil, []*Pool{pool})
+
+	//An address only offered is dropped when the client picks another server
+	s.allocate([]byte("immac1"), pool, nil)
+	s.releaseOffer([]byte("immac1"))
+	if _, ok := s.leases["immac1"]; ok {
+		t.Errorf("Expected the offer to be dropped")
+	}
+
+	//A lease already confirmed is kept
+	addr := s.allocate([]byte("immac2"), pool, nil)
+	if !s.confirm([]byte("immac2"), addr, pool) {
+		t.Fatalf("Expected the offer to be confirmed")
+	}
+	s.releaseOffer([]byte("immac2"))
+	if leases := s.GetLeases(); len(leases) != 1 || string(leases[0].HwAddr) != "immac2" {
+		t.Errorf("Expected the confirmed lease to be kept but got %v", leases)
+	}
+}
@@ -0,0 +1,22 @@
+package protocol
+
+import "errors"
+
+/*
+Errors reported back to the sender of a packet which could not be delivered
+*/
+var (
+	ErrNetUnreachable      = errors.New("network unreachable")
+	ErrHostUnreachable     = errors.New("host unreachable")
+	ErrProtocolUnreachable = errors.New("protocol unreachable")
+	ErrPortUnreachable     = errors.New("port unreachable")
+	ErrFragmentationNeeded = errors.New("fragmentation needed")
+	ErrTTLExceeded         = errors.New("time to live exceeded")
+	ErrReassemblyTimeout   = errors.New("fragment reassembly time exceeded")
+	ErrProhibited          = errors.New("communication administratively prohibited")
+)
+
+/*
+Returned by a routing table when it has no route for an address
+*/
+var ErrNoRoute = errors.New("no route to host")
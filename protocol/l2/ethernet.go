@@ -1,6 +1,8 @@
 package l2
 
 import (
+	"bytes"
+	"encoding/binary"
 	"log"
 	"netsim/hardware"
 	"netsim/protocol"
@@ -16,23 +18,30 @@ Frame format:
 Preamble  - 8 bytes
 Dest addr - 6 bytes
 Src addr  - 6 bytes
-VLAN Id   - 2 bytes
+VLAN Tag  - 2 bytes
 Type      - 2 bytes
 Body      - No fixed length
 Checksum  - checksumLength bytes
+
+The VLAN tag is always present and follows the layout of the 802.1Q tag control information: 3 bits of priority (PCP),
+1 bit of drop eligibility (DEI) and 12 bits of VLAN Id. A VLAN Id of 0 means the frame is untagged.
 */
 
 var (
 	checksumLength = 1
-	mtu            = 1500
+	defaultMtu     = 1500
+	minMtu         = 68
+	minIPv6Mtu     = 1280
 	broadcastAddr  = utils.HexStringToBytes("FFFFFFFFFFFF")
 	multicastAddr  = utils.HexStringToBytes("01005E")
+	ipv6Multicast  = utils.HexStringToBytes("3333")
 	defaultVlanId  = utils.HexStringToBytes("0000")
 )
 
 type Ethernet struct {
 	buffer      []byte
 	preamble    []byte
+	mtu         int
 	adapter     *hardware.EthernetAdapter
 	l3Protocols []protocol.L3Protocol
 	rawConsumer protocol.FrameConsumer
@@ -44,6 +53,7 @@ Constructor
 func NewEthernet(adapter *hardware.EthernetAdapter, rawConsumer protocol.FrameConsumer) *Ethernet {
 	s := &Ethernet{
 		preamble:    []byte("01020304"),
+		mtu:         defaultMtu,
 		adapter:     adapter,
 		rawConsumer: rawConsumer,
 	}
@@ -61,6 +71,12 @@ func (s *Ethernet) GetIdentifier() []byte {
 }
 
 func (s *Ethernet) SendDown(data []byte, destAddr []byte, metadata []byte, l3Protocol protocol.Protocol) {
+	//The link cannot carry more than the MTU, the L3 protocols have to fragment
+	if len(data) > s.mtu {
+		log.Printf("Ethernet: mac %s: Frame of %d bytes exceeds the MTU of %d. Dropping.", string(s.adapter.GetMacAddress()), len(data), s.mtu)
+		return
+	}
+
 	b := []byte{}
 	b = append(b, s.preamble...)
 	b = append(b, destAddr...)
@@ -80,7 +96,7 @@ func (s *Ethernet) SendUp([]byte, []byte, protocol.Protocol) {
 Next 2 methods make this an implementation of L2Protocol
 */
 func (s *Ethernet) GetMTU() int {
-	return mtu
+	return s.mtu
 }
 
 func (s *Ethernet) GetAdapter() hardware.Adapter {
@@ -91,6 +107,41 @@ func (s *Ethernet) AddL3Protocol(l3Protocol protocol.L3Protocol) {
 	s.l3Protocols = append(s.l3Protocols, l3Protocol)
 }
 
+func (s *Ethernet) RemoveL3Protocol(l3Protocol protocol.L3Protocol) {
+	for i, p := range s.l3Protocols {
+		if p == l3Protocol {
+			s.l3Protocols = append(s.l3Protocols[:i], s.l3Protocols[i+1:]...)
+			return
+		}
+	}
+}
+
+/*
+Sets the largest packet the L3 protocols may send over the link, like for links which carry tunnelled packets.
+MTUs smaller than IP can work with are refused: 68 bytes, or 1280 bytes once IPv6 runs over the link.
+*/
+func (s *Ethernet) SetMTU(mtu int) {
+	min := minMtu
+	for _, p := range s.l3Protocols {
+		if bytes.Equal(p.GetIdentifier(), protocol.IPv6) {
+			min = minIPv6Mtu
+		}
+	}
+
+	if mtu < min {
+		log.Printf("Ethernet: MTU %d is below the minimum of %d. Ignoring.", mtu, min)
+		return
+	}
+	s.mtu = mtu
+}
+
+/*
+The raw consumer gets every frame accepted by the adapter, before it is de-multiplexed to the L3 protocols
+*/
+func (s *Ethernet) SetRawConsumer(rawConsumer protocol.FrameConsumer) {
+	s.rawConsumer = rawConsumer
+}
+
 /*
 Internal methods
 */
@@ -184,28 +235,8 @@ func (s *Ethernet) validateChecksum(data []byte) bool {
 }
 
 func (s *Ethernet) isFrameForMe(destAddr []byte) bool {
-	// Is broadcast address
-	isBroadcast := true
-	for i := 0; i < len(broadcastAddr); i++ {
-		if broadcastAddr[i] != destAddr[i] {
-			isBroadcast = false
-		}
-	}
-
-	if isBroadcast {
-		return isBroadcast
-	}
-
-	// Is multicast address
-	isMulticast := true
-	for i := 0; i < len(multicastAddr); i++ {
-		if multicastAddr[i] != destAddr[i] {
-			isMulticast = false
-		}
-	}
-
-	if isMulticast {
-		return isMulticast
+	if IsBroadcastAddress(destAddr) || IsMulticastAddress(destAddr) || IsSlowProtocolsAddress(destAddr) {
+		return true
 	}
 
 	// Is this adapter's address
@@ -222,6 +253,54 @@ func (s *Ethernet) isFrameForMe(destAddr []byte) bool {
 	return isMatch
 }
 
+/*
+Helpers for devices which look into or modify frames
+*/
+func IsBroadcastAddress(addr []byte) bool {
+	for i := 0; i < len(broadcastAddr); i++ {
+		if broadcastAddr[i] != addr[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+IPv4 multicast groups map to addresses starting with 01:00:5E and IPv6 ones to addresses starting with 33:33
+*/
+func IsMulticastAddress(addr []byte) bool {
+	return bytes.HasPrefix(addr, multicastAddr) || bytes.HasPrefix(addr, ipv6Multicast)
+}
+
+/*
+Frames sent to the slow protocols address are control frames for the link itself, like LACP, and are never forwarded
+*/
+func IsSlowProtocolsAddress(addr []byte) bool {
+	return bytes.Equal(addr[:6], slowProtocolsAddr)
+}
+
+/*
+Returns the type and body of the frame, which is the packet of the L3 protocol
+*/
+func GetPayload(frame []byte) ([]byte, []byte) {
+	return frame[22:24], frame[24 : len(frame)-checksumLength]
+}
+
+func GetVlanTag(frame []byte) (uint16, uint8) {
+	tci := binary.BigEndian.Uint16(frame[20:22])
+	return tci & 0x0FFF, uint8(tci >> 13)
+}
+
+func SetVlanTag(frame []byte, vlanId uint16, priority uint8) {
+	tci := (uint16(priority&0x07) << 13) | (vlanId & 0x0FFF)
+	binary.BigEndian.PutUint16(frame[20:22], tci)
+
+	//Frame has changed, hence the checksum has to be recalculated
+	checksum := utils.CalculateChecksum(frame[:len(frame)-checksumLength])
+	copy(frame[len(frame)-checksumLength:], checksum)
+}
+
 func (s *Ethernet) run() {
 	for {
 		select {
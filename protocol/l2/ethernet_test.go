@@ -77,3 +77,39 @@ func TestSimpleDataTransfer(t *testing.T) {
 	time.Sleep(5 * time.Second)
 
 }
+
+/*
+Dummy IPv6 node, only its identifier matters
+*/
+type ipv6Node struct {
+	node
+}
+
+func (d *ipv6Node) GetIdentifier() []byte {
+	return protocol.IPv6
+}
+
+func TestSetMTU(t *testing.T) {
+	ethernet := NewEthernet(hardware.NewEthernetAdapter([]byte("mtumac"), false), nil)
+	ethernet.AddL3Protocol(&node{})
+
+	ethernet.SetMTU(20)
+	if ethernet.GetMTU() != defaultMtu {
+		t.Errorf("Expected an MTU below the IP minimum to be refused but got %d", ethernet.GetMTU())
+	}
+	ethernet.SetMTU(576)
+	if ethernet.GetMTU() != 576 {
+		t.Errorf("Expected MTU 576 but got %d", ethernet.GetMTU())
+	}
+
+	//IPv6 needs links of at least 1280 bytes
+	ethernet.AddL3Protocol(&ipv6Node{})
+	ethernet.SetMTU(1000)
+	if ethernet.GetMTU() != 576 {
+		t.Errorf("Expected an MTU below the IPv6 minimum to be refused but got %d", ethernet.GetMTU())
+	}
+	ethernet.SetMTU(1280)
+	if ethernet.GetMTU() != 1280 {
+		t.Errorf("Expected MTU 1280 but got %d", ethernet.GetMTU())
+	}
+}
@@ -0,0 +1,433 @@
+package l2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"log"
+	"netsim/hardware"
+	"netsim/protocol"
+	"sync"
+	"time"
+)
+
+/*
+Link aggregation bundles multiple ethernet ports connecting the same two devices into one logical port. The members of the
+bundle negotiate with the other end using a simplified version of LACP: every member periodically sends a LACPDU carrying
+the identity of its own end (actor) and of the other end as last seen (partner). A member starts carrying traffic once
+both ends have seen each other, and stops if no LACPDU arrives within the timeout, which is how a failed link is detected.
+All members have to lead to the same partner. The partner of the first member to come up is chosen for the bundle, and
+members leading to any other device are left out.
+
+Frames are distributed across the active members by a hash of the addresses in them, so a flow always uses the same link
+and its frames are not reordered. Frames received on any active member are sent up as if they came from the bundle, hence
+the bundle appears as a single L2Protocol to the L3 protocols using it.
+Since frames of the bundle leave through any member, all members are expected to use the same MAC address.
+
+LACPDU format:
+
+Subtype         - 1 byte
+Version         - 1 byte
+Actor System    - 6 bytes
+Actor Key       - 2 bytes
+Actor Port      - 2 bytes
+Actor State     - 1 byte
+Partner System  - 6 bytes
+Partner Key     - 2 bytes
+Partner Port    - 2 bytes
+Partner State   - 1 byte
+*/
+const (
+	lacpInterval   = 1 * time.Second
+	lacpTimeout    = 3 * lacpInterval
+	lacpPduLength  = 24
+	lacpSubtype    = 0x01
+	lacpVersion    = 0x01
+	lacpStateSync  = 0x08
+	lacpStateDistr = 0x30
+)
+
+var (
+	slowProtocolsAddr = []byte{0x01, 0x80, 0xC2, 0x00, 0x00, 0x02}
+)
+
+type LinkAggregation struct {
+	systemId      []byte
+	key           uint16
+	members       []*aggregationMember
+	partnerSystem []byte
+	partnerKey    uint16
+	l3Protocols   []protocol.L3Protocol
+	adapter       *bundleAdapter
+	lacp          *lacpReceiver
+	lock          sync.Mutex
+}
+
+/*
+Constructor
+*/
+func NewLinkAggregation(systemId []byte, key uint16, members []*Ethernet) *LinkAggregation {
+	agg := &LinkAggregation{
+		systemId: systemId,
+		key:      key,
+	}
+	agg.adapter = &bundleAdapter{agg: agg}
+	agg.lacp = &lacpReceiver{agg: agg}
+
+	for i, m := range members {
+		agg.members = append(agg.members, &aggregationMember{
+			ethernet: m,
+			portNum:  uint16(i + 1),
+		})
+		m.AddL3Protocol(agg.lacp)
+	}
+
+	go agg.run()
+	return agg
+}
+
+/*
+Next 3 methods make this an implementation of Protocol
+*/
+func (a *LinkAggregation) GetIdentifier() []byte {
+	return nil
+}
+
+func (a *LinkAggregation) SendDown(data []byte, destAddr []byte, metadata []byte, l3Protocol protocol.Protocol) {
+	member := a.selectMember(a.flowHash(destAddr, l3Protocol.GetIdentifier(), data))
+	if member == nil {
+		log.Printf("LinkAggregation: No active member to send frame. Dropping.")
+		return
+	}
+
+	member.SendDown(data, destAddr, metadata, l3Protocol)
+}
+
+func (a *LinkAggregation) SendUp([]byte, []byte, protocol.Protocol) {
+	//Not used since frames are sent up by the members
+}
+
+/*
+Next 3 methods make this an implementation of L2Protocol
+*/
+func (a *LinkAggregation) GetMTU() int {
+	mtu := 0
+	for _, m := range a.members {
+		if mtu == 0 || m.ethernet.GetMTU() < mtu {
+			mtu = m.ethernet.GetMTU()
+		}
+	}
+
+	return mtu
+}
+
+func (a *LinkAggregation) GetAdapter() hardware.Adapter {
+	return a.adapter
+}
+
+func (a *LinkAggregation) AddL3Protocol(l3Protocol protocol.L3Protocol) {
+	a.l3Protocols = append(a.l3Protocols, l3Protocol)
+	for _, m := range a.members {
+		m.ethernet.AddL3Protocol(&memberReceiver{agg: a, member: m.ethernet, l3Protocol: l3Protocol})
+	}
+}
+
+/*
+Public API
+*/
+func (a *LinkAggregation) GetMember(num int) *Ethernet {
+	return a.members[num].ethernet
+}
+
+func (a *LinkAggregation) NumMembers() int {
+	return len(a.members)
+}
+
+func (a *LinkAggregation) IsMember(ethernet protocol.FrameConsumer) bool {
+	for _, m := range a.members {
+		if m.ethernet == ethernet {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Returns true if traffic is being carried on the member
+*/
+func (a *LinkAggregation) IsActive(ethernet protocol.FrameConsumer) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, m := range a.members {
+		if m.ethernet == ethernet {
+			return a.isActive(m)
+		}
+	}
+
+	return false
+}
+
+func (a *LinkAggregation) GetActiveMembers() []*Ethernet {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var active []*Ethernet
+	for _, m := range a.members {
+		if a.isActive(m) {
+			active = append(active, m.ethernet)
+		}
+	}
+
+	return active
+}
+
+/*
+Choose the member a frame will leave from. Used by devices which put frames directly on the adapters of the members.
+*/
+func (a *LinkAggregation) SelectMemberForFrame(frame []byte) *Ethernet {
+	return a.selectMember(a.flowHash(frame[8:14], frame[22:24], frame[24:len(frame)-checksumLength]))
+}
+
+/*
+Internal methods
+*/
+func (a *LinkAggregation) selectMember(hash uint32) *Ethernet {
+	active := a.GetActiveMembers()
+	if len(active) == 0 {
+		return nil
+	}
+
+	return active[hash%uint32(len(active))]
+}
+
+func (a *LinkAggregation) flowHash(destAddr []byte, frameType []byte, data []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(destAddr)
+
+	//For IP packets, use the source and destination IP addresses which sit at the same place in all header formats
+	if bytes.Equal(frameType, protocol.IP) && len(data) >= 20 {
+		h.Write(data[12:20])
+	}
+
+	return h.Sum32()
+}
+
+func (a *LinkAggregation) isActive(m *aggregationMember) bool {
+	return m.partnerInSync && time.Since(m.lastReceived) < lacpTimeout && a.partnerSystem != nil &&
+		bytes.Equal(m.partnerSystem, a.partnerSystem) && m.partnerKey == a.partnerKey
+}
+
+func (a *LinkAggregation) receivePdu(data []byte, sender protocol.Protocol) {
+	if len(data) < lacpPduLength || data[0] != lacpSubtype {
+		log.Printf("LinkAggregation: Got invalid LACPDU. Dropping.")
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var member *aggregationMember
+	for _, m := range a.members {
+		if m.ethernet == sender {
+			member = m
+		}
+	}
+	if member == nil {
+		return
+	}
+
+	member.partnerSystem = append([]byte{}, data[2:8]...)
+	member.partnerKey = binary.BigEndian.Uint16(data[8:10])
+	member.partnerPort = binary.BigEndian.Uint16(data[10:12])
+	member.lastReceived = time.Now()
+
+	//The partner is in sync if what it knows about us is correct
+	member.partnerInSync = bytes.Equal(data[14:20], a.systemId) &&
+		binary.BigEndian.Uint16(data[20:22]) == a.key &&
+		binary.BigEndian.Uint16(data[22:24]) == member.portNum
+
+	//Choose the partner of the bundle if there is no active member leading to the current one
+	if !a.hasActiveMember() {
+		a.partnerSystem = member.partnerSystem
+		a.partnerKey = member.partnerKey
+	}
+}
+
+func (a *LinkAggregation) hasActiveMember() bool {
+	for _, m := range a.members {
+		if a.isActive(m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *LinkAggregation) createPdu(m *aggregationMember) []byte {
+	pdu := make([]byte, lacpPduLength)
+	pdu[0] = lacpSubtype
+	pdu[1] = lacpVersion
+
+	copy(pdu[2:8], a.systemId)
+	binary.BigEndian.PutUint16(pdu[8:10], a.key)
+	binary.BigEndian.PutUint16(pdu[10:12], m.portNum)
+	if a.isActive(m) {
+		pdu[12] = lacpStateSync | lacpStateDistr
+	}
+
+	if m.partnerSystem != nil && time.Since(m.lastReceived) < lacpTimeout {
+		copy(pdu[14:20], m.partnerSystem)
+		binary.BigEndian.PutUint16(pdu[20:22], m.partnerKey)
+		binary.BigEndian.PutUint16(pdu[22:24], m.partnerPort)
+	}
+
+	return pdu
+}
+
+func (a *LinkAggregation) run() {
+	for {
+		a.lock.Lock()
+		var pdus [][]byte
+		for _, m := range a.members {
+			pdus = append(pdus, a.createPdu(m))
+		}
+		a.lock.Unlock()
+
+		for i, m := range a.members {
+			m.ethernet.SendDown(pdus[i], slowProtocolsAddr, nil, a.lacp)
+		}
+
+		time.Sleep(lacpInterval)
+	}
+}
+
+/*
+Internal struct tracking the state of a member
+*/
+type aggregationMember struct {
+	ethernet      *Ethernet
+	portNum       uint16
+	partnerSystem []byte
+	partnerKey    uint16
+	partnerPort   uint16
+	partnerInSync bool
+	lastReceived  time.Time
+}
+
+/*
+Adapter of the bundle which turns all members on or off together
+*/
+type bundleAdapter struct {
+	agg *LinkAggregation
+}
+
+func (b *bundleAdapter) GetMacAddress() []byte {
+	return b.agg.systemId
+}
+
+func (b *bundleAdapter) GetByte() *byte {
+	//Not used since bytes are read from the adapters of the members
+	return nil
+}
+
+func (b *bundleAdapter) SetByte(*byte) {
+	//Not used since bytes are written to the adapters of the members
+}
+
+func (b *bundleAdapter) PutInBuffer(frame []byte) {
+	member := b.agg.SelectMemberForFrame(frame)
+	if member != nil {
+		member.GetAdapter().PutInBuffer(frame)
+	}
+}
+
+func (b *bundleAdapter) TurnOn() {
+	for _, m := range b.agg.members {
+		m.ethernet.GetAdapter().TurnOn()
+	}
+}
+
+func (b *bundleAdapter) TurnOff() {
+	for _, m := range b.agg.members {
+		m.ethernet.GetAdapter().TurnOff()
+	}
+}
+
+/*
+Registered on each member to receive the LACPDUs
+*/
+type lacpReceiver struct {
+	agg *LinkAggregation
+}
+
+func (l *lacpReceiver) GetIdentifier() []byte {
+	return protocol.LACP
+}
+
+func (l *lacpReceiver) SendUp(data []byte, metadata []byte, sender protocol.Protocol) {
+	l.agg.receivePdu(data, sender)
+}
+
+func (l *lacpReceiver) SendDown([]byte, []byte, []byte, protocol.Protocol) {
+
+}
+
+func (l *lacpReceiver) GetAddressForInterface(int) []byte {
+	return nil
+}
+
+func (l *lacpReceiver) SetL2ProtocolForInterface(int, protocol.L2Protocol) {
+
+}
+
+func (l *lacpReceiver) GetL2ProtocolForInterface(int) protocol.L2Protocol {
+	return l.agg
+}
+
+func (l *lacpReceiver) AddL4Protocol(protocol.L4Protocol) {
+
+}
+
+/*
+Registered on each member to send the frames of an L3 protocol up as if they came from the bundle
+*/
+type memberReceiver struct {
+	agg        *LinkAggregation
+	member     *Ethernet
+	l3Protocol protocol.L3Protocol
+}
+
+func (r *memberReceiver) GetIdentifier() []byte {
+	return r.l3Protocol.GetIdentifier()
+}
+
+func (r *memberReceiver) SendUp(data []byte, metadata []byte, sender protocol.Protocol) {
+	//Frames are collected only on active members
+	if !r.agg.IsActive(r.member) {
+		return
+	}
+
+	r.l3Protocol.SendUp(data, metadata, r.agg)
+}
+
+func (r *memberReceiver) SendDown([]byte, []byte, []byte, protocol.Protocol) {
+
+}
+
+func (r *memberReceiver) GetAddressForInterface(intfNum int) []byte {
+	return r.l3Protocol.GetAddressForInterface(intfNum)
+}
+
+func (r *memberReceiver) SetL2ProtocolForInterface(int, protocol.L2Protocol) {
+
+}
+
+func (r *memberReceiver) GetL2ProtocolForInterface(int) protocol.L2Protocol {
+	return r.agg
+}
+
+func (r *memberReceiver) AddL4Protocol(protocol.L4Protocol) {
+
+}
@@ -0,0 +1,173 @@
+package l2
+
+import (
+	"bytes"
+	"fmt"
+	"netsim/hardware"
+	"netsim/protocol"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+Dummy IP node which remembers what it receives, so that frames are hashed by their addresses
+*/
+type ipNode struct {
+	node
+	received []string
+	lock     sync.Mutex
+}
+
+func (n *ipNode) GetIdentifier() []byte {
+	return protocol.IP
+}
+
+func (n *ipNode) SendDown(data []byte, destAddr []byte, metadata []byte, sender protocol.Protocol) {
+	n.l2Protocol.SendDown(data, n.getMacForAddr(destAddr), metadata, n)
+}
+
+func (n *ipNode) SendUp(b []byte, metadata []byte, source protocol.Protocol) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.received = append(n.received, string(b[20:]))
+}
+
+func (n *ipNode) hasReceived(payload string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for _, r := range n.received {
+		if r == payload {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Counts the IP frames received on a member of the bundle
+*/
+type memberCounter struct {
+	count int
+	lock  sync.Mutex
+}
+
+func (c *memberCounter) SendUp(frame []byte, metadata []byte, sender protocol.Protocol) {
+	if !bytes.Equal(frame[22:24], protocol.IP) {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.count++
+}
+
+func (c *memberCounter) get() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.count
+}
+
+/*
+Builds a dummy packet of a flow, with the addresses where IP has them
+*/
+func flowPacket(flow int, payload string) []byte {
+	packet := make([]byte, 20)
+	copy(packet[12:16], []byte{10, 0, 0, 1})
+	copy(packet[16:20], []byte{10, 0, 1, byte(flow)})
+	return append(packet, []byte(payload)...)
+}
+
+/*
+Testcase
+*/
+func TestLinkAggregation(t *testing.T) {
+	var aggs []*LinkAggregation
+	var nodes []*ipNode
+	for i, mac := range []string{"immac1", "immac2"} {
+		var members []*Ethernet
+		for j := 0; j < 2; j++ {
+			members = append(members, NewEthernet(hardware.NewEthernetAdapter([]byte(mac), false), nil))
+		}
+		agg := NewLinkAggregation([]byte(mac), uint16(i+1), members)
+		n := &ipNode{}
+		agg.AddL3Protocol(n)
+		n.SetL2ProtocolForInterface(0, agg)
+
+		aggs = append(aggs, agg)
+		nodes = append(nodes, n)
+	}
+
+	var counters []*memberCounter
+	for j := 0; j < 2; j++ {
+		counter := &memberCounter{}
+		aggs[1].GetMember(j).SetRawConsumer(counter)
+		counters = append(counters, counter)
+		_ = hardware.NewDuplexLink(100, 1e9, 0.00, aggs[0].GetMember(j).GetAdapter(), aggs[1].GetMember(j).GetAdapter())
+	}
+
+	go hardware.Clk.Start()
+	aggs[0].GetAdapter().TurnOn()
+	aggs[1].GetAdapter().TurnOn()
+
+	// Wait for the bundle to come up
+	time.Sleep(3 * time.Second)
+	if len(aggs[0].GetActiveMembers()) != 2 || len(aggs[1].GetActiveMembers()) != 2 {
+		t.Fatalf("Expected all members to be active")
+	}
+
+	// The frames of a flow all take the same member
+	for i := 0; i < 4; i++ {
+		nodes[0].SendDown(flowPacket(0, fmt.Sprintf("same_flow_%d", i)), []byte("10.0.1.1"), nil, nil)
+	}
+	time.Sleep(1 * time.Second)
+	for i := 0; i < 4; i++ {
+		if !nodes[1].hasReceived(fmt.Sprintf("same_flow_%d", i)) {
+			t.Errorf("Frame %d of the flow was not delivered", i)
+		}
+	}
+	if !(counters[0].get() == 4 && counters[1].get() == 0) && !(counters[0].get() == 0 && counters[1].get() == 4) {
+		t.Errorf("Expected the frames of a flow on a single member, got %d and %d", counters[0].get(), counters[1].get())
+	}
+
+	// Different flows are spread over both members
+	before := []int{counters[0].get(), counters[1].get()}
+	for i := 1; i <= 16; i++ {
+		nodes[0].SendDown(flowPacket(i, fmt.Sprintf("flow_%d", i)), []byte("10.0.1.1"), nil, nil)
+	}
+	time.Sleep(1 * time.Second)
+	for i := 1; i <= 16; i++ {
+		if !nodes[1].hasReceived(fmt.Sprintf("flow_%d", i)) {
+			t.Errorf("Frame of flow %d was not delivered", i)
+		}
+	}
+	spread := []int{counters[0].get() - before[0], counters[1].get() - before[1]}
+	if spread[0] == 0 || spread[1] == 0 || spread[0]+spread[1] != 16 {
+		t.Errorf("Expected the flows to be spread over both members, got %d and %d", spread[0], spread[1])
+	}
+
+	// Fail a member link, every flow moves to the remaining member
+	aggs[1].GetMember(0).GetAdapter().TurnOff()
+	time.Sleep(4 * time.Second)
+	if len(aggs[0].GetActiveMembers()) != 1 {
+		t.Fatalf("Expected failed member to be removed from the bundle")
+	}
+
+	before = []int{counters[0].get(), counters[1].get()}
+	for i := 1; i <= 8; i++ {
+		nodes[0].SendDown(flowPacket(i, fmt.Sprintf("after_failover_%d", i)), []byte("10.0.1.1"), nil, nil)
+	}
+	time.Sleep(1 * time.Second)
+	for i := 1; i <= 8; i++ {
+		if !nodes[1].hasReceived(fmt.Sprintf("after_failover_%d", i)) {
+			t.Errorf("Frame of flow %d was not delivered after failover", i)
+		}
+	}
+	if counters[0].get() != before[0] || counters[1].get()-before[1] != 8 {
+		t.Errorf("Expected every frame on the remaining member, got %d and %d",
+			counters[0].get()-before[0], counters[1].get()-before[1])
+	}
+}
@@ -0,0 +1,351 @@
+package l3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"netsim/protocol"
+	"netsim/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ARP resolves IP addresses to MAC addresses dynamically. To resolve an address, a request is broadcast on the interface
+the packet has to leave from, and the host owning the address replies with its MAC address. Replies are cached for a
+while so that every packet does not need a request. Packets waiting for a resolution are queued and sent once the reply
+arrives, or dropped if no reply arrives after a few retries.
+A host also learns the address of anyone who sends it a request, since it is very likely to talk back to them. A
+gratuitous ARP, which is a request for one's own address, updates the caches of the hosts which already know the sender.
+
+Packet Format:
+
+HType  - 2 bytes
+PType  - 2 bytes
+HLen   - 1 byte
+PLen   - 1 byte
+Op     - 2 bytes
+SHA    - 6 bytes
+SPA    - 4 bytes
+THA    - 6 bytes
+TPA    - 4 bytes
+*/
+const (
+	arpPacketLength       = 28
+	arpRequest            = 1
+	arpReply              = 2
+	defaultArpCacheExpiry = 300 * time.Second
+	arpRetryInterval      = 1 * time.Second
+	arpMaxRetries         = 3
+	arpMaxQueuedPackets   = 10
+)
+
+var (
+	arpHardwareType = []byte{0, 1}
+	arpUnknownAddr  = utils.HexStringToBytes("000000000000")
+)
+
+type ARP struct {
+	identifier  []byte
+	ip          *IP
+	cache       map[string]*arpEntry
+	pending     map[string]*arpPendingRequest
+	cacheExpiry time.Duration
+	lock        sync.Mutex
+}
+
+/*
+Constructor
+*/
+func NewARP() *ARP {
+	return &ARP{
+		identifier:  protocol.ARP,
+		cache:       map[string]*arpEntry{},
+		pending:     map[string]*arpPendingRequest{},
+		cacheExpiry: defaultArpCacheExpiry,
+	}
+}
+
+/*
+Attaching registers ARP on the L2 protocol of each interface of the IP instance. Has to be done after the L2 protocols
+have been set on the interfaces.
+*/
+func (a *ARP) Attach(ip *IP) {
+	a.ip = ip
+	for i := range ip.interfaces {
+		ip.GetL2ProtocolForInterface(i).AddL3Protocol(a)
+	}
+}
+
+/*
+Next 3 methods make this an implementation of Protocol
+*/
+func (a *ARP) GetIdentifier() []byte {
+	return a.identifier
+}
+
+func (a *ARP) SendDown(data []byte, destAddr []byte, metadata []byte, sender protocol.Protocol) {
+	//Not used. ARP generates its own packets.
+}
+
+func (a *ARP) SendUp(packet []byte, metadata []byte, sender protocol.Protocol) {
+	if len(packet) < arpPacketLength || !bytes.Equal(packet[2:4], protocol.IP) {
+		log.Printf("ARP: Got invalid packet. Dropping.")
+		return
+	}
+
+	intfNum := a.ip.getInterfaceNum(sender)
+	if intfNum < 0 {
+		return
+	}
+
+	op := binary.BigEndian.Uint16(packet[6:8])
+	senderHwAddr := packet[8:14]
+	senderAddr := packet[14:18]
+	targetAddr := packet[24:28]
+	myAddr := a.ip.GetAddressForInterface(intfNum)
+	isForMe := bytes.Equal(targetAddr, myAddr) && !isUnspecifiedAddress(myAddr)
+
+	//Update the entry if it is known, or learn it if the packet was meant for us
+	a.lock.Lock()
+	_, known := a.cache[string(senderAddr)]
+	var callbacks []func([]byte)
+	if known || isForMe {
+		callbacks = a.update(senderAddr, senderHwAddr)
+	}
+	a.lock.Unlock()
+
+	for _, c := range callbacks {
+		c(senderHwAddr)
+	}
+
+	if isForMe && op == arpRequest {
+		reply := a.createPacket(arpReply, intfNum, senderHwAddr, senderAddr)
+		a.ip.GetL2ProtocolForInterface(intfNum).SendDown(reply, senderHwAddr, nil, a)
+	}
+}
+
+/*
+Next 4 methods make this an implementation of L3Protocol. ARP is registered with L2 protocols like any L3 protocol, but
+only works on behalf of the IP instance it is attached to.
+*/
+func (a *ARP) GetAddressForInterface(intfNum int) []byte {
+	return a.ip.GetAddressForInterface(intfNum)
+}
+
+func (a *ARP) SetL2ProtocolForInterface(intfNum int, l2Protocol protocol.L2Protocol) {
+	//Not used. Interfaces belong to the IP instance.
+}
+
+func (a *ARP) GetL2ProtocolForInterface(intfNum int) protocol.L2Protocol {
+	return a.ip.GetL2ProtocolForInterface(intfNum)
+}
+
+func (a *ARP) AddL4Protocol(l4Protocol protocol.L4Protocol) {
+	//Not used. Nothing runs on top of ARP.
+}
+
+/*
+Next 2 methods make this an implementation of AddressResolver and DynamicAddressResolver
+*/
+func (a *ARP) Resolve(ipAddr []byte) []byte {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	entry, ok := a.cache[string(ipAddr)]
+	if !ok || a.isExpired(entry) {
+		return nil
+	}
+
+	return entry.hwAddr
+}
+
+func (a *ARP) Request(ipAddr []byte, intfNum int, onResolved func([]byte)) {
+	hwAddr := a.Resolve(ipAddr)
+	if hwAddr != nil {
+		onResolved(hwAddr)
+		return
+	}
+
+	a.lock.Lock()
+	pending, ok := a.pending[string(ipAddr)]
+	if ok {
+		if len(pending.callbacks) < arpMaxQueuedPackets {
+			pending.callbacks = append(pending.callbacks, onResolved)
+		} else {
+			log.Printf("ARP: Too many packets waiting for %v. Dropping.", ipAddr)
+		}
+		a.lock.Unlock()
+		return
+	}
+
+	a.pending[string(ipAddr)] = &arpPendingRequest{
+		callbacks: []func([]byte){onResolved},
+	}
+	a.lock.Unlock()
+
+	go a.sendRequests(ipAddr, intfNum)
+}
+
+/*
+ARP public API
+*/
+func (a *ARP) Add(ipAddr []byte, mac []byte) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.cache[string(ipAddr)] = &arpEntry{
+		ipAddr: ipAddr,
+		hwAddr: mac,
+		static: true,
+	}
+}
+
+func (a *ARP) Remove(ipAddr []byte) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.cache, string(ipAddr))
+}
+
+func (a *ARP) SetCacheExpiry(expiry time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.cacheExpiry = expiry
+}
+
+/*
+Broadcasts a gratuitous ARP for the address of the interface, so that others update their caches
+*/
+func (a *ARP) Announce(intfNum int) {
+	packet := a.createPacket(arpRequest, intfNum, arpUnknownAddr, a.ip.GetAddressForInterface(intfNum))
+	a.ip.GetL2ProtocolForInterface(intfNum).SendDown(packet, l2BroadcastAddress, nil, a)
+}
+
+/*
+Returns the valid entries of the cache
+*/
+func (a *ARP) GetEntries() []*ArpEntry {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var entries []*ArpEntry
+	for _, e := range a.cache {
+		if a.isExpired(e) {
+			continue
+		}
+		entries = append(entries, &ArpEntry{
+			IpAddr:    e.ipAddr,
+			MacAddr:   e.hwAddr,
+			Static:    e.static,
+			ExpiresAt: e.expiresAt,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].IpAddr, entries[j].IpAddr) < 0
+	})
+	return entries
+}
+
+/*
+Internal methods
+*/
+func (a *ARP) sendRequests(ipAddr []byte, intfNum int) {
+	packet := a.createPacket(arpRequest, intfNum, arpUnknownAddr, ipAddr)
+
+	for i := 0; i < arpMaxRetries; i++ {
+		a.ip.GetL2ProtocolForInterface(intfNum).SendDown(packet, l2BroadcastAddress, nil, a)
+		time.Sleep(arpRetryInterval)
+
+		a.lock.Lock()
+		_, stillPending := a.pending[string(ipAddr)]
+		a.lock.Unlock()
+		if !stillPending {
+			return
+		}
+	}
+
+	a.lock.Lock()
+	pending, ok := a.pending[string(ipAddr)]
+	delete(a.pending, string(ipAddr))
+	a.lock.Unlock()
+	if !ok {
+		return
+	}
+
+	log.Printf("ARP: Could not resolve %v. Dropping queued packets.", ipAddr)
+	for _, c := range pending.callbacks {
+		c(nil)
+	}
+}
+
+/*
+Expects the lock to be held. Returns the callbacks of the packets waiting for this address.
+*/
+func (a *ARP) update(ipAddr []byte, hwAddr []byte) []func([]byte) {
+	entry, ok := a.cache[string(ipAddr)]
+	if !ok || !entry.static {
+		a.cache[string(ipAddr)] = &arpEntry{
+			ipAddr:    append([]byte{}, ipAddr...),
+			hwAddr:    append([]byte{}, hwAddr...),
+			expiresAt: time.Now().Add(a.cacheExpiry),
+		}
+	}
+
+	pending, ok := a.pending[string(ipAddr)]
+	if !ok {
+		return nil
+	}
+	delete(a.pending, string(ipAddr))
+	return pending.callbacks
+}
+
+func (a *ARP) isExpired(entry *arpEntry) bool {
+	return !entry.static && entry.expiresAt.Before(time.Now())
+}
+
+func (a *ARP) createPacket(op uint16, intfNum int, targetHwAddr []byte, targetAddr []byte) []byte {
+	opBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(opBytes, op)
+	hwAddr := a.ip.GetL2ProtocolForInterface(intfNum).GetAdapter().(hardwareAddressProvider).GetMacAddress()
+
+	b := []byte{}
+	b = append(b, arpHardwareType...)
+	b = append(b, protocol.IP...)
+	b = append(b, byte(6), byte(4))
+	b = append(b, opBytes...)
+	b = append(b, hwAddr...)
+	b = append(b, a.ip.GetAddressForInterface(intfNum)...)
+	b = append(b, targetHwAddr...)
+	b = append(b, targetAddr...)
+	return b
+}
+
+/*
+Snapshot of a cache entry, as returned by GetEntries
+*/
+type ArpEntry struct {
+	IpAddr    []byte
+	MacAddr   []byte
+	Static    bool
+	ExpiresAt time.Time
+}
+
+//Internal structs
+type hardwareAddressProvider interface {
+	GetMacAddress() []byte
+}
+
+type arpEntry struct {
+	ipAddr    []byte
+	hwAddr    []byte
+	static    bool
+	expiresAt time.Time
+}
+
+type arpPendingRequest struct {
+	callbacks []func([]byte)
+}
@@ -0,0 +1,58 @@
+package l3
+
+import (
+	"bytes"
+	"log"
+	"netsim/hardware"
+	"testing"
+	"time"
+)
+
+/*
+Testcase
+*/
+func TestARP(t *testing.T) {
+	routeProvider := &staticRouteProvider{}
+	arp1 := NewARP()
+	arp2 := NewARP()
+
+	node1 := newNode([]byte("arpmc1"), []byte{10, 0, 1, 1}, routeProvider, arp1)
+	node2 := newNode([]byte("arpmc2"), []byte{10, 0, 1, 2}, routeProvider, arp2)
+	arp1.Attach(node1.l3Protocol.(*IP))
+	arp2.Attach(node2.l3Protocol.(*IP))
+
+	_ = hardware.NewDuplexLink(100, 1e8, 0.00, node1.l3Protocol.GetL2ProtocolForInterface(0).GetAdapter(), node2.l3Protocol.GetL2ProtocolForInterface(0).GetAdapter())
+
+	go hardware.Clk.Start()
+	node1.l3Protocol.GetL2ProtocolForInterface(0).GetAdapter().TurnOn()
+	node2.l3Protocol.GetL2ProtocolForInterface(0).GetAdapter().TurnOn()
+
+	// Packets are queued until the address is resolved
+	log.Printf("Testcase: Sending packet")
+	node1.SendDown([]byte("this_is_a_test"), []byte{10, 0, 1, 2}, []byte{0, 5}, nil)
+	node1.SendDown([]byte("hope_this_works"), []byte{10, 0, 1, 2}, []byte{0, 5}, nil)
+	time.Sleep(3 * time.Second)
+
+	if !bytes.Equal(arp1.Resolve([]byte{10, 0, 1, 2}), []byte("arpmc2")) {
+		t.Errorf("Expected node 1 to resolve address of node 2")
+	}
+
+	// The target of a request learns the sender
+	if !bytes.Equal(arp2.Resolve([]byte{10, 0, 1, 1}), []byte("arpmc1")) {
+		t.Errorf("Expected node 2 to learn address of node 1")
+	}
+
+	// A gratuitous ARP corrects a stale entry
+	arp2.lock.Lock()
+	arp2.update([]byte{10, 0, 1, 1}, []byte("stale1"))
+	arp2.lock.Unlock()
+	arp1.Announce(0)
+	time.Sleep(2 * time.Second)
+
+	if !bytes.Equal(arp2.Resolve([]byte{10, 0, 1, 1}), []byte("arpmc1")) {
+		t.Errorf("Expected gratuitous ARP to update the cache")
+	}
+	for _, e := range arp2.GetEntries() {
+		log.Printf("ARP entry: %v -> %s", e.IpAddr, e.MacAddr)
+	}
+}
@@ -0,0 +1,693 @@
+package l3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"netsim/protocol"
+	"netsim/utils"
+	"sync"
+	"time"
+)
+
+/*
+Connection tracking follows the flows of packets passing through IP, so that firewalls can tell the packets of known
+connections apart from new ones, and NAT can translate every packet of a connection the same way.
+A connection is identified by the tuple of its first packet: the protocol, the addresses and the ports. Pings use their
+identifier as both ports, and protocols without ports are told apart by their addresses only. Replies are expected with
+the reverse of that tuple, the reply tuple. NAT changes the reply tuple to the addresses and ports the other end is
+meant to see, see SetReplyTuple. The packets of the connection are then translated to match it, see TranslateSource and
+TranslateDestination.
+The state of a connection, as seen by filters, is:
+1. New			- No reply has been seen yet
+2. Established	- Packets have been seen both ways
+3. Related		- ICMP errors about the packets of a known connection
+4. Invalid		- Packets which cannot start a connection and do not belong to one, like TCP packets other than a SYN
+
+TCP connections also go through the states of the handshake and the teardown, seen from the flags of their packets, and
+each state has its own timeout. UDP connections are kept longer once they have been replied to. Connections are
+forgotten when nothing has been seen on them within their timeout.
+Connections are created for the packets arriving at prerouting and sent at output, and are confirmed once their first
+packet has made it through all hooks. Connections of packets which were dropped on the way are never listed or
+replied to. Fragments are put back together before they are tracked, see defrag.go.
+*/
+const (
+	ConnStateNew = 1 << iota
+	ConnStateEstablished
+	ConnStateRelated
+	ConnStateInvalid
+)
+
+const (
+	TcpStateNone = iota
+	TcpStateSynSent
+	TcpStateSynReceived
+	TcpStateEstablished
+	TcpStateFinWait
+	TcpStateCloseWait
+	TcpStateLastAck
+	TcpStateTimeWait
+	TcpStateClose
+)
+
+/*
+Flags of TCP packets, as sent by l4.TCP
+*/
+const (
+	tcpSyn    = 2
+	tcpFin    = 4
+	tcpAck    = 8
+	tcpSynAck = 9
+	tcpFinAck = 12
+	tcpReset  = 16
+)
+
+const (
+	conntrackSweepInterval = time.Second
+)
+
+/*
+How long connections are remembered in each state without seeing a packet. TcpClosing is used for the states between
+the first FIN and TIME_WAIT.
+*/
+type ConntrackTimeouts struct {
+	TcpSynSent     time.Duration
+	TcpSynReceived time.Duration
+	TcpEstablished time.Duration
+	TcpClosing     time.Duration
+	TcpTimeWait    time.Duration
+	TcpClose       time.Duration
+	Udp            time.Duration
+	UdpReplied     time.Duration
+	Icmp           time.Duration
+	Generic        time.Duration
+}
+
+var DefaultConntrackTimeouts = ConntrackTimeouts{
+	TcpSynSent:     2 * time.Minute,
+	TcpSynReceived: time.Minute,
+	TcpEstablished: 5 * 24 * time.Hour,
+	TcpClosing:     2 * time.Minute,
+	TcpTimeWait:    2 * time.Minute,
+	TcpClose:       10 * time.Second,
+	Udp:            30 * time.Second,
+	UdpReplied:     180 * time.Second,
+	Icmp:           30 * time.Second,
+	Generic:        10 * time.Minute,
+}
+
+type Tuple struct {
+	Protocol    byte
+	Source      []byte
+	SourcePort  uint16
+	Destination []byte
+	DestPort    uint16
+}
+
+type Connection struct {
+	Original        Tuple
+	Reply           Tuple
+	TcpState        int
+	Replied         bool
+	OriginalPackets uint64
+	OriginalBytes   uint64
+	ReplyPackets    uint64
+	ReplyBytes      uint64
+	ExpiresAt       time.Time
+	confirmed       bool
+	finFromReply    bool
+}
+
+type Conntrack struct {
+	connections map[string]*Connection
+	timeouts    ConntrackTimeouts
+	lastSweep   time.Time
+	lock        sync.Mutex
+}
+
+func newConntrack() *Conntrack {
+	return &Conntrack{
+		connections: map[string]*Connection{},
+		timeouts:    DefaultConntrackTimeouts,
+	}
+}
+
+/*
+Returns the connection tracking of the IP, which is started the first time it is asked for, so that IPs which do not
+need it do not pay for it. Everyone using it on an IP shares it.
+*/
+func (ip *IP) GetConntrack() *Conntrack {
+	ip.lock.Lock()
+	conntrack := ip.conntrack
+	if conntrack != nil {
+		ip.lock.Unlock()
+		return conntrack
+	}
+	conntrack = newConntrack()
+	ip.conntrack = conntrack
+	ip.lock.Unlock()
+
+	ip.RegisterHook(HookPrerouting, PriorityDefrag, ip.defrag)
+	ip.RegisterHook(HookPrerouting, PriorityConntrack, conntrack.track)
+	ip.RegisterHook(HookOutput, PriorityConntrack, conntrack.track)
+	ip.RegisterHook(HookInput, PriorityConntrackConfirm, conntrack.confirm)
+	ip.RegisterHook(HookPostrouting, PriorityConntrackConfirm, conntrack.confirm)
+	return conntrack
+}
+
+func (c *Conntrack) SetTimeouts(timeouts ConntrackTimeouts) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.timeouts = timeouts
+}
+
+/*
+Returns copies of the confirmed connections which have not expired
+*/
+func (c *Conntrack) GetConnections() []Connection {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var connections []Connection
+	now := time.Now()
+	for key, conn := range c.connections {
+		//Every connection is in the map under both of its tuples
+		if key != conn.Original.key() || !conn.confirmed || conn.ExpiresAt.Before(now) {
+			continue
+		}
+		connections = append(connections, *conn)
+	}
+	return connections
+}
+
+/*
+Returns a copy of the connection of the packet, and whether the packet is a reply. Returns nil if the packet does not
+belong to a connection.
+*/
+func (c *Conntrack) Lookup(packet []byte) (*Connection, bool) {
+	tuple, ok := getTuple(packet)
+	if !ok {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	conn, reply := c.lookup(tuple)
+	if conn == nil {
+		return nil, false
+	}
+	copied := *conn
+	return &copied, reply
+}
+
+/*
+Returns the state of the connection of the packet, one of the ConnState constants
+*/
+func (c *Conntrack) GetState(packet []byte) int {
+	if isIcmpError(packet) {
+		tuple, ok := getTuple(packet[20+icmpHeaderLength:])
+		if !ok {
+			return ConnStateInvalid
+		}
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if conn, _ := c.lookup(tuple); conn != nil {
+			return ConnStateRelated
+		}
+		return ConnStateInvalid
+	}
+
+	tuple, ok := getTuple(packet)
+	if !ok {
+		return ConnStateInvalid
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	conn, _ := c.lookup(tuple)
+	if conn == nil {
+		return ConnStateInvalid
+	}
+	if conn.Replied {
+		return ConnStateEstablished
+	}
+	return ConnStateNew
+}
+
+/*
+Changes the tuple the replies of the connection are expected with. Returns false if the connection is gone, or if the
+tuple is used by another connection already.
+*/
+func (c *Conntrack) SetReplyTuple(original Tuple, reply Tuple) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	conn := c.getConnection(original.key())
+	if conn == nil || conn.Original.key() != original.key() {
+		return false
+	}
+	if other := c.getConnection(reply.key()); other != nil && other != conn {
+		return false
+	}
+
+	delete(c.connections, conn.Reply.key())
+	conn.Reply = reply.copy()
+	c.connections[reply.key()] = conn
+	return true
+}
+
+/*
+Changes the source of the packet to what the tuple of the other direction of its connection expects. Done by source NAT
+at postrouting. ICMP errors about a connection are translated along with the packet they carry. Returns true if the
+packet has been changed.
+*/
+func (c *Conntrack) TranslateSource(packet []byte) bool {
+	return c.translate(packet, true)
+}
+
+/*
+Changes the destination of the packet to what the tuple of the other direction of its connection expects. Done by
+destination NAT at prerouting, and undoes source NAT for the replies.
+*/
+func (c *Conntrack) TranslateDestination(packet []byte) bool {
+	return c.translate(packet, false)
+}
+
+/*
+Internal methods
+*/
+
+/*
+The hook which finds or creates the connections of the packets coming in and going out
+*/
+func (c *Conntrack) track(p *HookPacket) int {
+	packet := p.Packet
+	if isIcmpError(packet) {
+		return VerdictAccept
+	}
+	tuple, ok := getTuple(packet)
+	if !ok {
+		return VerdictAccept
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	conn, reply := c.lookup(tuple)
+
+	//A reply to a connection which never made it through is a connection of its own
+	if conn != nil && reply && !conn.confirmed {
+		c.remove(conn)
+		conn = nil
+	}
+	if conn == nil {
+		if !canStartConnection(packet) {
+			return VerdictAccept
+		}
+		conn = &Connection{Original: tuple, Reply: tuple.reverse()}
+		c.add(conn)
+	}
+
+	c.update(conn, reply, packet)
+	return VerdictAccept
+}
+
+/*
+The hook which confirms the connections of the packets which made it through all hooks
+*/
+func (c *Conntrack) confirm(p *HookPacket) int {
+	tuple, ok := getTuple(p.Packet)
+	if !ok || isIcmpError(p.Packet) {
+		return VerdictAccept
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if conn, _ := c.lookup(tuple); conn != nil {
+		conn.confirmed = true
+	}
+	return VerdictAccept
+}
+
+/*
+Expects the lock to be held
+*/
+func (c *Conntrack) update(conn *Connection, reply bool, packet []byte) {
+	if reply {
+		conn.Replied = true
+		conn.ReplyPackets++
+		conn.ReplyBytes += uint64(len(packet))
+	} else {
+		conn.OriginalPackets++
+		conn.OriginalBytes += uint64(len(packet))
+	}
+
+	timeout := c.timeouts.Generic
+	switch conn.Original.Protocol {
+	case protocol.TCP[0]:
+		if len(packet) > 32 {
+			conn.updateTcpState(reply, packet[32])
+		}
+		timeout = c.tcpTimeout(conn.TcpState)
+	case protocol.UDP[0]:
+		timeout = c.timeouts.Udp
+		if conn.Replied {
+			timeout = c.timeouts.UdpReplied
+		}
+	case protocol.ICMP[0]:
+		timeout = c.timeouts.Icmp
+	}
+	conn.ExpiresAt = time.Now().Add(timeout)
+}
+
+/*
+Moves the connection along the handshake and the teardown. A connection which is closed or closing can be opened again
+with a SYN.
+*/
+func (conn *Connection) updateTcpState(reply bool, flags byte) {
+	switch flags {
+	case tcpReset:
+		conn.TcpState = TcpStateClose
+	case tcpSyn:
+		if !reply && (conn.TcpState == TcpStateNone || conn.TcpState >= TcpStateTimeWait) {
+			conn.TcpState = TcpStateSynSent
+		}
+	case tcpSynAck:
+		if reply && conn.TcpState == TcpStateSynSent {
+			conn.TcpState = TcpStateSynReceived
+		}
+	case tcpFin, tcpFinAck:
+		if conn.TcpState == TcpStateEstablished {
+			conn.TcpState = TcpStateFinWait
+			conn.finFromReply = reply
+		} else if (conn.TcpState == TcpStateFinWait || conn.TcpState == TcpStateCloseWait) && reply != conn.finFromReply {
+			conn.TcpState = TcpStateLastAck
+		}
+	case tcpAck:
+		if conn.TcpState == TcpStateSynReceived && !reply {
+			conn.TcpState = TcpStateEstablished
+		} else if conn.TcpState == TcpStateFinWait && reply != conn.finFromReply {
+			conn.TcpState = TcpStateCloseWait
+		} else if conn.TcpState == TcpStateLastAck && reply == conn.finFromReply {
+			conn.TcpState = TcpStateTimeWait
+		}
+	}
+}
+
+/*
+Expects the lock to be held
+*/
+func (c *Conntrack) tcpTimeout(state int) time.Duration {
+	switch state {
+	case TcpStateSynSent:
+		return c.timeouts.TcpSynSent
+	case TcpStateSynReceived:
+		return c.timeouts.TcpSynReceived
+	case TcpStateEstablished:
+		return c.timeouts.TcpEstablished
+	case TcpStateTimeWait:
+		return c.timeouts.TcpTimeWait
+	case TcpStateClose:
+		return c.timeouts.TcpClose
+	default:
+		return c.timeouts.TcpClosing
+	}
+}
+
+func (c *Conntrack) translate(packet []byte, source bool) bool {
+	if isIcmpError(packet) {
+		return c.translateIcmpError(packet, source)
+	}
+
+	tuple, ok := getTuple(packet)
+	if !ok {
+		return false
+	}
+
+	c.lock.Lock()
+	conn, reply := c.lookup(tuple)
+	var addr []byte
+	var port uint16
+	if conn != nil {
+		addr, port = conn.target(reply, source)
+	}
+	c.lock.Unlock()
+
+	if conn == nil {
+		return false
+	}
+	if source && bytes.Equal(tuple.Source, addr) && tuple.SourcePort == port {
+		return false
+	}
+	if !source && bytes.Equal(tuple.Destination, addr) && tuple.DestPort == port {
+		return false
+	}
+
+	setEndpoint(packet, source, addr, port)
+	updateL4Checksum(packet)
+	return true
+}
+
+/*
+An ICMP error goes the other way from the packet it carries, hence the destination of the packet carried changes with
+the source of the error, and the other way round
+*/
+func (c *Conntrack) translateIcmpError(packet []byte, source bool) bool {
+	carried := packet[20+icmpHeaderLength:]
+	tuple, ok := getTuple(carried)
+	if !ok {
+		return false
+	}
+
+	c.lock.Lock()
+	conn, reply := c.lookup(tuple)
+	var addr []byte
+	var port uint16
+	if conn != nil {
+		addr, port = conn.target(!reply, source)
+	}
+	c.lock.Unlock()
+
+	if conn == nil {
+		return false
+	}
+	outerAddr := packet[16:20]
+	if source {
+		outerAddr = packet[12:16]
+	}
+	if bytes.Equal(outerAddr, addr) {
+		return false
+	}
+
+	copy(outerAddr, addr)
+	setEndpoint(carried, !source, addr, port)
+	carried[11] = byte(0)
+	carried[11] = utils.CalculateChecksum(carried[:20])[0]
+	updateL4Checksum(packet)
+	return true
+}
+
+/*
+Returns the address and port the packets going the way of the direction have to be sent from, or to. Packets one way
+look like the reverse of the tuple of the other way.
+*/
+func (conn *Connection) target(reply bool, source bool) ([]byte, uint16) {
+	tuple := conn.Reply
+	if reply {
+		tuple = conn.Original
+	}
+	if source {
+		return tuple.Destination, tuple.DestPort
+	}
+	return tuple.Source, tuple.SourcePort
+}
+
+/*
+Returns the connection the tuple belongs to, and whether the tuple is of a reply. Packets which have been translated
+look like the reverse of the tuple of the other direction. Expects the lock to be held.
+*/
+func (c *Conntrack) lookup(tuple Tuple) (*Connection, bool) {
+	key := tuple.key()
+	if conn := c.getConnection(key); conn != nil {
+		return conn, key != conn.Original.key()
+	}
+
+	reverseKey := tuple.reverse().key()
+	if conn := c.getConnection(reverseKey); conn != nil {
+		return conn, reverseKey == conn.Original.key()
+	}
+	return nil, false
+}
+
+/*
+Expects the lock to be held
+*/
+func (c *Conntrack) getConnection(key string) *Connection {
+	conn, ok := c.connections[key]
+	if !ok {
+		return nil
+	}
+	if conn.ExpiresAt.Before(time.Now()) {
+		c.remove(conn)
+		return nil
+	}
+	return conn
+}
+
+/*
+Connections holding either tuple of the new one are replaced. Expects the lock to be held.
+*/
+func (c *Conntrack) add(conn *Connection) {
+	c.sweep()
+	for _, key := range []string{conn.Original.key(), conn.Reply.key()} {
+		if old, ok := c.connections[key]; ok {
+			c.remove(old)
+		}
+	}
+	c.connections[conn.Original.key()] = conn
+	c.connections[conn.Reply.key()] = conn
+}
+
+/*
+Expects the lock to be held
+*/
+func (c *Conntrack) remove(conn *Connection) {
+	for _, key := range []string{conn.Original.key(), conn.Reply.key()} {
+		if c.connections[key] == conn {
+			delete(c.connections, key)
+		}
+	}
+}
+
+/*
+Forgets the connections which have expired, at most once per sweep interval. Expects the lock to be held.
+*/
+func (c *Conntrack) sweep() {
+	now := time.Now()
+	if now.Sub(c.lastSweep) < conntrackSweepInterval {
+		return
+	}
+	c.lastSweep = now
+
+	for _, conn := range c.connections {
+		if conn.ExpiresAt.Before(now) {
+			c.remove(conn)
+		}
+	}
+}
+
+func (t Tuple) reverse() Tuple {
+	return Tuple{
+		Protocol:    t.Protocol,
+		Source:      t.Destination,
+		SourcePort:  t.DestPort,
+		Destination: t.Source,
+		DestPort:    t.SourcePort,
+	}
+}
+
+func (t Tuple) copy() Tuple {
+	t.Source = append([]byte{}, t.Source...)
+	t.Destination = append([]byte{}, t.Destination...)
+	return t
+}
+
+func (t Tuple) key() string {
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], t.SourcePort)
+	binary.BigEndian.PutUint16(ports[2:4], t.DestPort)
+	return string([]byte{t.Protocol}) + string(t.Source) + string(t.Destination) + string(ports)
+}
+
+/*
+Returns the tuple of the packet. Packets too short to have one, and fragments other than the first, have none.
+*/
+func getTuple(packet []byte) (Tuple, bool) {
+	if len(packet) < 20 || binary.BigEndian.Uint16(packet[7:9]) != 0 {
+		return Tuple{}, false
+	}
+
+	tuple := Tuple{
+		Protocol:    packet[10],
+		Source:      append([]byte{}, packet[12:16]...),
+		Destination: append([]byte{}, packet[16:20]...),
+	}
+	if hasPorts(packet) {
+		tuple.SourcePort = binary.BigEndian.Uint16(packet[20:22])
+		tuple.DestPort = binary.BigEndian.Uint16(packet[22:24])
+	} else if isIcmpEcho(packet) {
+		tuple.SourcePort = binary.BigEndian.Uint16(packet[23:25])
+		tuple.DestPort = tuple.SourcePort
+	}
+	return tuple, true
+}
+
+/*
+Changes the source or destination address and port of the packet. The checksums are left to the caller.
+*/
+func setEndpoint(packet []byte, source bool, addr []byte, port uint16) {
+	if source {
+		copy(packet[12:16], addr)
+	} else {
+		copy(packet[16:20], addr)
+	}
+
+	if hasPorts(packet) {
+		if source {
+			binary.BigEndian.PutUint16(packet[20:22], port)
+		} else {
+			binary.BigEndian.PutUint16(packet[22:24], port)
+		}
+	} else if isIcmpEcho(packet) {
+		binary.BigEndian.PutUint16(packet[23:25], port)
+	}
+}
+
+/*
+The checksum of the L4 protocols covers only their own header and data, hence the header checksum is left to IP
+*/
+func updateL4Checksum(packet []byte) {
+	var offset int
+	switch packet[10] {
+	case protocol.TCP[0]:
+		offset = 13
+	case protocol.UDP[0]:
+		offset = 6
+	case protocol.ICMP[0]:
+		offset = 2
+	default:
+		return
+	}
+	if len(packet) <= 20+offset {
+		return
+	}
+
+	packet[20+offset] = 0
+	packet[20+offset] = utils.CalculateChecksum(packet[20:])[0]
+}
+
+func canStartConnection(packet []byte) bool {
+	switch packet[10] {
+	case protocol.TCP[0]:
+		return len(packet) > 32 && packet[32] == tcpSyn
+	case protocol.ICMP[0]:
+		return len(packet) > 20 && packet[20] != IcmpEchoReply
+	}
+	return true
+}
+
+func hasPorts(packet []byte) bool {
+	return len(packet) >= 24 && (packet[10] == protocol.TCP[0] || packet[10] == protocol.UDP[0])
+}
+
+func isIcmpEcho(packet []byte) bool {
+	return packet[10] == protocol.ICMP[0] && len(packet) >= 25 && (packet[20] == IcmpEchoRequest || packet[20] == IcmpEchoReply)
+}
+
+func isIcmpError(packet []byte) bool {
+	return len(packet) >= 20+icmpHeaderLength+24 && packet[10] == protocol.ICMP[0] && (packet[20] == IcmpDestinationUnreachable || packet[20] == IcmpTimeExceeded)
+}
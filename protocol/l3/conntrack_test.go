@@ -0,0 +1,104 @@
+package l3
+
+import (
+	"bytes"
+	"netsim/protocol"
+	"testing"
+)
+
+/*
+Testcase
+*/
+func TestConntrack(t *testing.T) {
+	ip := NewIP([][]byte{{10, 0, 0, 1}}, false, nil, &staticRouteProvider{}, &staticAddressResolver{})
+	conntrack := ip.GetConntrack()
+	local, remote := []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}
+
+	//Packets are sent through output and postrouting, and received through prerouting and input
+	tcp := func(srcAddr []byte, destAddr []byte, flags byte) []byte {
+		segment := []byte{0x13, 0x88, 0, 80, 0, 0, 0, 0, 0, 0, 0, 0, flags, 0}
+		if bytes.Equal(srcAddr, remote) {
+			segment[0], segment[1], segment[2], segment[3] = 0, 80, 0x13, 0x88
+		}
+		return createPacket(ip.version, segment, srcAddr, destAddr, 0, []byte{0, 0}, lastFragment, []byte{0, 0}, 5, protocol.TCP)
+	}
+	pass := func(packet []byte) {
+		first, second := HookOutput, HookPostrouting
+		if bytes.Equal(packet[16:20], local) {
+			first, second = HookPrerouting, HookInput
+		}
+		ip.runHooks(first, packet, -1, -1, func(packet []byte) {
+			ip.runHooks(second, packet, -1, -1, func(packet []byte) {})
+		})
+	}
+
+	//Only a SYN starts a TCP connection, which goes through the handshake and teardown
+	if state := conntrack.GetState(tcp(local, remote, tcpAck)); state != ConnStateInvalid {
+		t.Errorf("Expected a stray ACK to be invalid but got %d", state)
+	}
+	pass(tcp(local, remote, tcpSyn))
+	if state := conntrack.GetState(tcp(remote, local, tcpSynAck)); state != ConnStateNew {
+		t.Errorf("Expected the connection to be new before the reply but got %d", state)
+	}
+	steps := []struct {
+		packet []byte
+		state  int
+	}{
+		{tcp(remote, local, tcpSynAck), TcpStateSynReceived},
+		{tcp(local, remote, tcpAck), TcpStateEstablished},
+		{tcp(remote, local, tcpFin), TcpStateFinWait},
+		{tcp(local, remote, tcpFinAck), TcpStateLastAck},
+		{tcp(remote, local, tcpAck), TcpStateTimeWait},
+	}
+	for _, step := range steps {
+		pass(step.packet)
+		connections := conntrack.GetConnections()
+		if len(connections) != 1 || connections[0].TcpState != step.state {
+			t.Fatalf("Expected the connection to be in state %d but got %+v", step.state, connections)
+		}
+	}
+	if state := conntrack.GetState(tcp(local, remote, tcpAck)); state != ConnStateEstablished {
+		t.Errorf("Expected the connection to be established after the reply but got %d", state)
+	}
+
+	//ICMP errors about a connection are related to it
+	icmpError := []byte{IcmpDestinationUnreachable, icmpCodePortUnreachable, 0, 0, 0, 0, 0}
+	icmpError = append(icmpError, tcp(local, remote, 0)[:icmpErrorDataLength]...)
+	packet := createPacket(ip.version, icmpError, remote, local, 0, []byte{0, 0}, lastFragment, []byte{0, 0}, 5, protocol.ICMP)
+	if state := conntrack.GetState(packet); state != ConnStateRelated {
+		t.Errorf("Expected the ICMP error to be related but got %d", state)
+	}
+
+	//Connections of packets which were dropped are never confirmed
+	id := ip.RegisterHook(HookPostrouting, PriorityFilter, func(p *HookPacket) int {
+		return VerdictDrop
+	})
+	udp := createPacket(ip.version, []byte{0, 53, 0, 53, 0, 8, 0, 0}, local, remote, 0, []byte{0, 0}, lastFragment, []byte{0, 0}, 5, protocol.UDP)
+	pass(udp)
+	if connections := conntrack.GetConnections(); len(connections) != 1 {
+		t.Errorf("Expected the dropped packet to leave no connection but got %+v", connections)
+	}
+	ip.UnregisterHook(id)
+
+	//Translated packets match the reply tuple set by NAT, and replies are translated back
+	pass(udp)
+	conn, reply := conntrack.Lookup(udp)
+	if conn == nil || reply {
+		t.Fatalf("Expected the UDP packet to belong to a connection")
+	}
+	nat := conn.Reply
+	nat.Destination = []byte{201, 0, 0, 1}
+	nat.DestPort = 2000
+	if !conntrack.SetReplyTuple(conn.Original, nat) {
+		t.Fatalf("Expected the reply tuple to be set")
+	}
+
+	translated := append([]byte{}, udp...)
+	if !conntrack.TranslateSource(translated) || !bytes.Equal(translated[12:16], []byte{201, 0, 0, 1}) || translated[20] != 0x07 || translated[21] != 0xD0 {
+		t.Errorf("Expected the source to be translated but got %v", translated)
+	}
+	answer := createPacket(ip.version, []byte{0, 53, 0x07, 0xD0, 0, 8, 0, 0}, remote, []byte{201, 0, 0, 1}, 0, []byte{0, 0}, lastFragment, []byte{0, 0}, 5, protocol.UDP)
+	if !conntrack.TranslateDestination(answer) || !bytes.Equal(answer[16:20], local) || answer[22] != 0 || answer[23] != 53 {
+		t.Errorf("Expected the reply to be translated back but got %v", answer)
+	}
+}
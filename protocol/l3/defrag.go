@@ -0,0 +1,23 @@
+package l3
+
+/*
+Connection tracking needs the ports of every packet, which only the first fragment of a packet carries. Hence once it is
+started, the fragments arriving at prerouting are put back together before any other hook sees them, like nf_defrag
+does in Linux. The fragments are held until the whole packet has arrived, and the hooks then go on with the whole packet
+in place of its last fragment. Forwarded packets are fragmented again if they do not fit the next link. Packets sent by
+this host go through output before they are fragmented, hence they are always whole there.
+The fragments are kept along with those of the packets for this host, under the same timeout and memory limit, see
+SetReassemblyTimeout and SetReassemblyMemoryLimit.
+*/
+func (ip *IP) defrag(p *HookPacket) int {
+	if !isFragment(p.Packet) {
+		return VerdictAccept
+	}
+
+	ready, data := ip.reassemble(p.Packet)
+	if !ready {
+		return VerdictDrop
+	}
+	p.Packet = wholePacket(p.Packet, data)
+	return VerdictModify
+}
@@ -0,0 +1,155 @@
+package l3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"netsim/protocol"
+	"sort"
+)
+
+/*
+Equal-cost multipath spreads the packets a router forwards over all the best routes to their destination, instead of
+using only one of them. It needs a routing table which can return every equal-cost route, see MultipathRouteProvider,
+like RoutingTable does for the routes of a prefix with the same distance and metric. The path is picked either:
+1. Per flow		- By a hash of the addresses, protocol and ports, which keeps a flow in order, see fragments below
+2. Per packet	- In turn, which spreads the load evenly but may reorder the packets of a flow
+
+Flows are mapped to paths by hash-threshold (RFC 2992), so that only some of the flows move when a path is added or
+removed. The hash is seeded with the addresses of the router, so that the routers of a multi-stage network like a fat
+tree do not all make the same choices. Fragments, the first one included, are hashed without the ports, so that all the
+fragments of a packet take the same path. This also means that the fragmented packets of a flow may take another path
+than its packets which fit the MTU, and arrive out of order with them. TCP does not run into this since it sets DF on
+its segments, but a UDP flow mixing large and small datagrams may.
+Packets sent by the router itself use a single route.
+*/
+const (
+	MultipathPerFlow = iota
+	MultipathPerPacket
+)
+
+/*
+A routing table which can return all the equal-cost routes for an address
+*/
+type MultipathRouteProvider interface {
+	protocol.RouteProvider
+	LookupAll(ipAddr []byte) ([]*Route, error)
+}
+
+/*
+Counters of the packets forwarded to a next hop. The gateway is nil for directly connected networks.
+*/
+type NextHopStats struct {
+	Interface int
+	Gateway   []byte
+	Packets   uint64
+	Bytes     uint64
+}
+
+/*
+Picks how the packets are spread over equal-cost routes, either MultipathPerFlow or MultipathPerPacket
+*/
+func (ip *IP) SetMultipathMode(mode int) {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	ip.multipathMode = mode
+}
+
+/*
+Returns the counters of every next hop packets have been forwarded to, ordered by interface and gateway
+*/
+func (ip *IP) GetNextHopStats() []NextHopStats {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	var stats []NextHopStats
+	for _, s := range ip.nextHopStats {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Interface != stats[j].Interface {
+			return stats[i].Interface < stats[j].Interface
+		}
+		return bytes.Compare(stats[i].Gateway, stats[j].Gateway) < 0
+	})
+	return stats
+}
+
+/*
+Internal methods
+*/
+
+/*
+Returns the interface and the gateway the packet is forwarded through. The interface is the one of the route the table
+was picked by, unless there are other routes as good.
+*/
+func (ip *IP) selectPath(routes protocol.RouteProvider, intfNum int, packet []byte) (int, []byte) {
+	destAddr := packet[16:20]
+	if multipath, ok := routes.(MultipathRouteProvider); ok {
+		if paths, err := multipath.LookupAll(destAddr); err == nil && len(paths) > 1 {
+			path := paths[ip.pickPath(packet, len(paths))]
+			return path.Interface, path.Gateway
+		}
+	}
+	return intfNum, routes.GetGatewayForAddress(destAddr)
+}
+
+func (ip *IP) pickPath(packet []byte, numPaths int) int {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	if ip.multipathMode == MultipathPerPacket {
+		ip.nextPath++
+		return int(ip.nextPath % uint32(numPaths))
+	}
+
+	//Hash-threshold: the range of the hash is split in as many parts as there are paths
+	hash := ip.flowHash(packet)
+	return int(uint64(hash) * uint64(numPaths) >> 32)
+}
+
+/*
+Expects the lock to be held
+*/
+func (ip *IP) flowHash(packet []byte) uint32 {
+	h := fnv.New32a()
+	seed := make([]byte, 4)
+	binary.BigEndian.PutUint32(seed, ip.multipathSeed)
+	h.Write(seed)
+	h.Write(packet[12:20])
+	h.Write(packet[10:11])
+
+	if hasPorts(packet) && !isFragment(packet) {
+		h.Write(packet[20:24])
+	}
+	return h.Sum32()
+}
+
+/*
+Counts a packet forwarded to the next hop
+*/
+func (ip *IP) countNextHop(intfNum int, gateway []byte, length int) {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	key := string([]byte{byte(intfNum)}) + string(gateway)
+	stats, ok := ip.nextHopStats[key]
+	if !ok {
+		stats = &NextHopStats{Interface: intfNum}
+		if gateway != nil {
+			stats.Gateway = append([]byte{}, gateway...)
+		}
+		ip.nextHopStats[key] = stats
+	}
+	stats.Packets++
+	stats.Bytes += uint64(length)
+}
+
+func newMultipathSeed(ipAddresses [][]byte) uint32 {
+	h := fnv.New32a()
+	for _, ipAddr := range ipAddresses {
+		h.Write(ipAddr)
+	}
+	return h.Sum32()
+}
@@ -0,0 +1,395 @@
+package l3
+
+import (
+	"encoding/binary"
+	"log"
+	"netsim/protocol"
+	"netsim/utils"
+	"sync"
+	"time"
+)
+
+/*
+ICMP is used by IP to tell the sender of a packet why it could not be delivered, and by tools like ping to check if a
+host is reachable. Even though it is carried inside IP packets like an L4 protocol, it is very much a part of the network
+layer, hence it lives here.
+Errors received are handed to the L4 protocol which sent the packet that caused the error, so that it can tell the
+socket. An error message is never sent about another error message, or about any fragment other than the first.
+
+Packet Format:
+
+Type		- 1 byte
+Code		- 1 byte
+Checksum	- 1 byte
+Rest		- 4 bytes
+Data		- No fixed length
+
+For echo messages, Rest holds an identifier and a sequence number, and Data is whatever the sender put in the request.
+For error messages, the last 2 bytes of Rest hold the MTU of the next hop if fragmentation was needed, and Data holds
+the header and first 8 bytes of data of the packet which caused the error.
+*/
+const (
+	IcmpEchoReply              = 0
+	IcmpDestinationUnreachable = 3
+	IcmpEchoRequest            = 8
+	IcmpTimeExceeded           = 11
+)
+
+const (
+	icmpCodeNetUnreachable      = 0
+	icmpCodeHostUnreachable     = 1
+	icmpCodeProtocolUnreachable = 2
+	icmpCodePortUnreachable     = 3
+	icmpCodeFragmentationNeeded = 4
+	icmpCodeProhibited          = 13
+	icmpCodeReassemblyTimeout   = 1
+	icmpHeaderLength            = 7
+	icmpErrorDataLength         = 28
+	icmpTTL                     = 64
+	icmpBufferSize              = 64
+)
+
+type ICMP struct {
+	identifier  []byte
+	l3Protocols []protocol.L3Protocol
+	bindings    map[uint16]*IcmpBinding
+	noErrors    bool
+	lock        sync.Mutex
+}
+
+/*
+Constructor
+*/
+func NewICMP() *ICMP {
+	return &ICMP{
+		identifier: protocol.ICMP,
+		bindings:   map[uint16]*IcmpBinding{},
+	}
+}
+
+/*
+Next 3 methods make this an implementation of Protocol
+*/
+func (i *ICMP) GetIdentifier() []byte {
+	return i.identifier
+}
+
+func (i *ICMP) SendUp(data []byte, metadata []byte, sender protocol.Protocol) {
+	if len(data) < icmpHeaderLength || !i.isValid(data) {
+		log.Printf("ICMP: Got corrupted packet")
+		return
+	}
+
+	sourceAddr := metadata[0:4]
+
+	switch data[0] {
+	case IcmpEchoRequest:
+		reply := make([]byte, len(data))
+		copy(reply, data)
+		reply[0] = IcmpEchoReply
+		reply[2] = 0
+		reply[2] = utils.CalculateChecksum(reply)[0]
+
+		sender.SendDown(reply, sourceAddr, []byte{0, icmpTTL}, i)
+	case IcmpEchoReply:
+		i.deliver(binary.BigEndian.Uint16(data[3:5]), &IcmpMessage{
+			Type:   int(data[0]),
+			Code:   int(data[1]),
+			Source: sourceAddr,
+			Id:     binary.BigEndian.Uint16(data[3:5]),
+			Seq:    binary.BigEndian.Uint16(data[5:7]),
+			Data:   data[icmpHeaderLength:],
+		})
+	case IcmpDestinationUnreachable, IcmpTimeExceeded:
+		if len(data) < icmpHeaderLength+icmpErrorDataLength {
+			log.Printf("ICMP: Got truncated error message. Dropping.")
+			return
+		}
+
+		err := errorForMessage(data[0], data[1])
+		originalHeader := data[icmpHeaderLength : icmpHeaderLength+20]
+		originalData := data[icmpHeaderLength+20:]
+		originalMetadata := originalHeader[12:20]
+
+		//The MTU reported by the router is remembered for the destination, so that smaller packets are sent to it
+		ip, isIP := sender.(*IP)
+		if isIP && err == protocol.ErrFragmentationNeeded {
+			ip.updatePathMTU(originalHeader[16:20], int(binary.BigEndian.Uint16(data[5:7])), int(binary.BigEndian.Uint16(originalHeader[2:4])))
+		}
+
+		//Errors about our own echo requests go to the binding which sent them
+		if originalHeader[10] == i.identifier[0] {
+			if originalData[0] == IcmpEchoRequest {
+				i.deliver(binary.BigEndian.Uint16(originalData[3:5]), &IcmpMessage{
+					Type:   int(data[0]),
+					Code:   int(data[1]),
+					Source: sourceAddr,
+					Id:     binary.BigEndian.Uint16(originalData[3:5]),
+					Seq:    binary.BigEndian.Uint16(originalData[5:7]),
+					Err:    err,
+					Mtu:    int(binary.BigEndian.Uint16(data[5:7])),
+				})
+			}
+			return
+		}
+
+		if !isIP {
+			return
+		}
+		for _, l4P := range ip.l4Protocols {
+			if l4P.GetIdentifier()[0] != originalHeader[10] {
+				continue
+			}
+			if consumer, ok := l4P.(protocol.ErrorConsumer); ok {
+				consumer.ConsumeError(err, originalData, originalMetadata)
+			}
+		}
+	default:
+		log.Printf("ICMP: Got unsupported message type %d. Dropping.", data[0])
+	}
+}
+
+func (i *ICMP) SendDown(data []byte, destAddr []byte, metadata []byte, sender protocol.Protocol) {
+	//Not used. Messages are sent using the bindings or generated by IP.
+}
+
+/*
+Following methods make this an implementation of L4 Protocol
+*/
+func (i *ICMP) AddL3Protocol(l3Protocol protocol.L3Protocol) {
+	i.l3Protocols = append(i.l3Protocols, l3Protocol)
+}
+
+/*
+Next method makes this an implementation of ErrorConsumer. Errors for echo requests which could not even leave this host
+are handed to the binding which sent them.
+*/
+func (i *ICMP) ConsumeError(err error, data []byte, metadata []byte) {
+	if len(data) < icmpHeaderLength || data[0] != IcmpEchoRequest {
+		return
+	}
+
+	i.deliver(binary.BigEndian.Uint16(data[3:5]), &IcmpMessage{
+		Source: metadata[0:4],
+		Id:     binary.BigEndian.Uint16(data[3:5]),
+		Seq:    binary.BigEndian.Uint16(data[5:7]),
+		Err:    err,
+	})
+}
+
+/*
+ICMP public API
+*/
+func (i *ICMP) Bind(id uint16) *IcmpBinding {
+	if i.IsIdInUse(id) {
+		log.Printf("Error: Identifier already in use")
+		return nil
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	b := &IcmpBinding{
+		icmp:     i,
+		id:       id,
+		messages: make(chan *IcmpMessage, icmpBufferSize),
+	}
+	i.bindings[id] = b
+
+	return b
+}
+
+/*
+Stops sending error messages, like routers configured not to send unreachables. Senders whose packets are too large for
+such a router are never told, making it a black hole for path MTU discovery.
+*/
+func (i *ICMP) SetSendErrors(send bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.noErrors = !send
+}
+
+func (i *ICMP) IsIdInUse(id uint16) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	_, found := i.bindings[id]
+	return found
+}
+
+/*
+Internal methods
+*/
+func (i *ICMP) isValid(packet []byte) bool {
+	actual := packet[2]
+	calculated := utils.CalculateChecksum(packet)[0] - actual
+	return actual == calculated
+}
+
+func (i *ICMP) deliver(id uint16, message *IcmpMessage) {
+	i.lock.Lock()
+	b, found := i.bindings[id]
+	i.lock.Unlock()
+
+	if !found {
+		log.Printf("ICMP: Got message for identifier no one is listening on. Dropping.")
+		return
+	}
+
+	message.ReceivedAt = time.Now()
+	select {
+	case b.messages <- message:
+	default:
+	}
+}
+
+func (i *ICMP) getL3Protocol() protocol.L3Protocol {
+	if len(i.l3Protocols) == 0 {
+		log.Printf("Error: Could not find matching network protocol")
+		return nil
+	}
+
+	return i.l3Protocols[0]
+}
+
+/*
+Sends an error message about the packet to its source. The MTU is used only if fragmentation was needed.
+*/
+func (i *ICMP) sendError(err error, packet []byte, mtu int) {
+	//Never send errors about errors, or about packets which cannot be answered
+	if packet[10] == i.identifier[0] && len(packet) > 20 && packet[20] != IcmpEchoRequest && packet[20] != IcmpEchoReply {
+		return
+	}
+	if binary.BigEndian.Uint16(packet[7:9]) != 0 || isUnspecifiedAddress(packet[12:16]) || isBroadcastAddress(packet[16:20]) || isMulticastAddress(packet[16:20]) {
+		return
+	}
+
+	i.lock.Lock()
+	noErrors := i.noErrors
+	i.lock.Unlock()
+	if noErrors {
+		return
+	}
+
+	l3Protocol := i.getL3Protocol()
+	if l3Protocol == nil {
+		return
+	}
+
+	msgType, code := messageForError(err)
+	message := []byte{msgType, code, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(message[5:7], uint16(mtu))
+
+	end := icmpErrorDataLength
+	if len(packet) < end {
+		end = len(packet)
+	}
+	message = append(message, packet[:end]...)
+	message[2] = utils.CalculateChecksum(message)[0]
+
+	l3Protocol.SendDown(message, packet[12:16], []byte{0, icmpTTL}, i)
+}
+
+func errorForMessage(msgType byte, code byte) error {
+	if msgType == IcmpTimeExceeded && code == icmpCodeReassemblyTimeout {
+		return protocol.ErrReassemblyTimeout
+	}
+	if msgType == IcmpTimeExceeded {
+		return protocol.ErrTTLExceeded
+	}
+
+	switch code {
+	case icmpCodeNetUnreachable:
+		return protocol.ErrNetUnreachable
+	case icmpCodeProtocolUnreachable:
+		return protocol.ErrProtocolUnreachable
+	case icmpCodePortUnreachable:
+		return protocol.ErrPortUnreachable
+	case icmpCodeFragmentationNeeded:
+		return protocol.ErrFragmentationNeeded
+	case icmpCodeProhibited:
+		return protocol.ErrProhibited
+	default:
+		return protocol.ErrHostUnreachable
+	}
+}
+
+func messageForError(err error) (byte, byte) {
+	switch err {
+	case protocol.ErrTTLExceeded:
+		return IcmpTimeExceeded, 0
+	case protocol.ErrReassemblyTimeout:
+		return IcmpTimeExceeded, icmpCodeReassemblyTimeout
+	case protocol.ErrNetUnreachable:
+		return IcmpDestinationUnreachable, icmpCodeNetUnreachable
+	case protocol.ErrProtocolUnreachable:
+		return IcmpDestinationUnreachable, icmpCodeProtocolUnreachable
+	case protocol.ErrPortUnreachable:
+		return IcmpDestinationUnreachable, icmpCodePortUnreachable
+	case protocol.ErrFragmentationNeeded:
+		return IcmpDestinationUnreachable, icmpCodeFragmentationNeeded
+	case protocol.ErrProhibited:
+		return IcmpDestinationUnreachable, icmpCodeProhibited
+	default:
+		return IcmpDestinationUnreachable, icmpCodeHostUnreachable
+	}
+}
+
+/*
+A message received for a binding. Err is set for error messages about the echo requests sent from the binding.
+*/
+type IcmpMessage struct {
+	Type       int
+	Code       int
+	Source     []byte
+	Id         uint16
+	Seq        uint16
+	Data       []byte
+	Err        error
+	Mtu        int
+	ReceivedAt time.Time
+}
+
+/*
+Struct to track bindings. A binding receives the echo replies and errors for the echo requests carrying its identifier.
+*/
+type IcmpBinding struct {
+	icmp     *ICMP
+	id       uint16
+	messages chan *IcmpMessage
+}
+
+func (b *IcmpBinding) SendEcho(destAddr []byte, seq uint16, data []byte, ttl byte, flags byte) {
+	l3Protocol := b.icmp.getL3Protocol()
+	if l3Protocol == nil {
+		return
+	}
+
+	packet := []byte{IcmpEchoRequest, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(packet[3:5], b.id)
+	binary.BigEndian.PutUint16(packet[5:7], seq)
+	packet = append(packet, data...)
+	packet[2] = utils.CalculateChecksum(packet)[0]
+
+	l3Protocol.SendDown(packet, destAddr, []byte{0, ttl, flags}, b.icmp)
+}
+
+/*
+Waits for a message until the timeout. Returns nil if none arrives.
+*/
+func (b *IcmpBinding) Recv(timeout time.Duration) *IcmpMessage {
+	select {
+	case m := <-b.messages:
+		return m
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func (b *IcmpBinding) Close() {
+	b.icmp.lock.Lock()
+	defer b.icmp.lock.Unlock()
+
+	delete(b.icmp.bindings, b.id)
+}
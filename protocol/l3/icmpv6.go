@@ -0,0 +1,185 @@
+package l3
+
+import (
+	"encoding/binary"
+	"log"
+	"netsim/protocol"
+	"netsim/utils"
+)
+
+/*
+ICMPv6 does for IPv6 what ICMP does for IP, and also carries the messages of NDP. Since IPv6 cannot work without it,
+ICMPv6 is part of IPv6 rather than an L4 protocol which has to be added.
+Like with ICMP, errors received are handed to the L4 protocol which sent the packet that caused the error, and an error
+message is never sent about another error message, a packet sent to a multicast address, or a fragment other than the
+first.
+
+Packet Format:
+
+Type		- 1 byte
+Code		- 1 byte
+Checksum	- 1 byte
+Body		- No fixed length
+
+For error messages, the body has 4 bytes which hold the MTU of the next hop for Packet Too Big messages, followed by the
+beginning of the packet which caused the error.
+*/
+const (
+	Icmpv6DestinationUnreachable = 1
+	Icmpv6PacketTooBig           = 2
+	Icmpv6TimeExceeded           = 3
+	Icmpv6ParameterProblem       = 4
+	Icmpv6RouterSolicitation     = 133
+	Icmpv6RouterAdvertisement    = 134
+	Icmpv6NeighborSolicitation   = 135
+	Icmpv6NeighborAdvertisement  = 136
+)
+
+const (
+	icmpv6CodeNoRoute            = 0
+	icmpv6CodeAddressUnreachable = 3
+	icmpv6CodePortUnreachable    = 4
+	icmpv6CodeUnknownNextHeader  = 1
+	icmpv6CodeReassemblyTimeout  = 1
+	icmpv6HeaderLength           = 3
+	icmpv6ErrorDataLength        = 96
+	icmpv6HopLimit               = 64
+)
+
+/*
+Internal methods
+*/
+func (ip *IPv6) handleIcmp(intfNum int, srcAddr []byte, destAddr []byte, hopLimit byte, message []byte) {
+	if len(message) < icmpv6HeaderLength || utils.CalculateChecksum(message)[0]-message[2] != message[2] {
+		log.Printf("IPv6: Got corrupted ICMPv6 message")
+		return
+	}
+
+	switch message[0] {
+	case Icmpv6DestinationUnreachable, Icmpv6PacketTooBig, Icmpv6TimeExceeded, Icmpv6ParameterProblem:
+		ip.handleIcmpError(message)
+	case Icmpv6RouterSolicitation, Icmpv6RouterAdvertisement, Icmpv6NeighborSolicitation, Icmpv6NeighborAdvertisement:
+		ip.ndp.handle(intfNum, srcAddr, destAddr, hopLimit, message)
+	default:
+		log.Printf("IPv6: Got unsupported ICMPv6 message type %d. Dropping.", message[0])
+	}
+}
+
+func (ip *IPv6) handleIcmpError(message []byte) {
+	if len(message) < icmpv6HeaderLength+4+ipv6HeaderLength {
+		log.Printf("IPv6: Got truncated ICMPv6 error message. Dropping.")
+		return
+	}
+
+	err := errorForIcmpv6Message(message[0], message[1])
+	original := message[icmpv6HeaderLength+4:]
+
+	//The MTU of the link the packet did not fit is remembered for its destination, before the sender is told to resize
+	if err == protocol.ErrFragmentationNeeded {
+		mtu := int(binary.BigEndian.Uint32(message[icmpv6HeaderLength : icmpv6HeaderLength+4]))
+		log.Printf("IPv6: Path MTU to %v is %d", original[24:40], mtu)
+		ip.pathMTUs.update(original[24:40], mtu, false)
+	}
+
+	nextHeader, offset, _ := parseExtensionHeaders(original)
+	if offset < 0 || offset >= len(original) {
+		return
+	}
+
+	for _, l4P := range ip.l4Protocols {
+		if l4P.GetIdentifier()[0] != nextHeader {
+			continue
+		}
+		if consumer, ok := l4P.(protocol.ErrorConsumer); ok {
+			consumer.ConsumeError(err, original[offset:], original[8:40])
+		}
+	}
+}
+
+/*
+Sends an error message about the packet to its source. The MTU is used only for Packet Too Big messages.
+*/
+func (ip *IPv6) sendError(err error, packet []byte, mtu int) {
+	srcAddr := packet[8:24]
+	destAddr := packet[24:40]
+	if isUnspecifiedAddress(srcAddr) || isIpv6Multicast(srcAddr) || isIpv6Multicast(destAddr) {
+		return
+	}
+
+	//Never send errors about errors, or about fragments other than the first
+	nextHeader, offset, fragmentHeader := parseExtensionHeaders(packet)
+	if offset < 0 || (fragmentHeader != nil && binary.BigEndian.Uint16(fragmentHeader[2:4])>>3 != 0) {
+		return
+	}
+	if nextHeader == protocol.ICMPv6[0] && (offset >= len(packet) || packet[offset] < 128) {
+		return
+	}
+
+	msgType, code := icmpv6MessageForError(err)
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, uint32(mtu))
+
+	end := icmpv6ErrorDataLength
+	if len(packet) < end {
+		end = len(packet)
+	}
+	body = append(body, packet[:end]...)
+
+	intfNum := ip.routingTable.GetInterfaceForAddress(srcAddr)
+	if isLinkLocal(srcAddr) {
+		intfNum = 0
+	}
+	if intfNum < 0 {
+		return
+	}
+	ip.sendIcmp(intfNum, srcAddr, msgType, code, body, icmpv6HopLimit)
+}
+
+func (ip *IPv6) sendIcmp(intfNum int, destAddr []byte, msgType byte, code byte, body []byte, hopLimit byte) {
+	message := append([]byte{msgType, code, 0}, body...)
+	message[2] = utils.CalculateChecksum(message)[0]
+
+	ip.send(intfNum, message, ip.getSourceAddress(intfNum, destAddr), destAddr, protocol.ICMPv6[0], 0, hopLimit, false, nil)
+}
+
+func errorForIcmpv6Message(msgType byte, code byte) error {
+	switch msgType {
+	case Icmpv6PacketTooBig:
+		return protocol.ErrFragmentationNeeded
+	case Icmpv6TimeExceeded:
+		if code == icmpv6CodeReassemblyTimeout {
+			return protocol.ErrReassemblyTimeout
+		}
+		return protocol.ErrTTLExceeded
+	case Icmpv6ParameterProblem:
+		return protocol.ErrProtocolUnreachable
+	}
+
+	switch code {
+	case icmpv6CodeNoRoute:
+		return protocol.ErrNetUnreachable
+	case icmpv6CodePortUnreachable:
+		return protocol.ErrPortUnreachable
+	default:
+		return protocol.ErrHostUnreachable
+	}
+}
+
+func icmpv6MessageForError(err error) (byte, byte) {
+	switch err {
+	case protocol.ErrFragmentationNeeded:
+		return Icmpv6PacketTooBig, 0
+	case protocol.ErrTTLExceeded:
+		return Icmpv6TimeExceeded, 0
+	case protocol.ErrReassemblyTimeout:
+		return Icmpv6TimeExceeded, icmpv6CodeReassemblyTimeout
+	case protocol.ErrProtocolUnreachable:
+		return Icmpv6ParameterProblem, icmpv6CodeUnknownNextHeader
+	case protocol.ErrNetUnreachable:
+		return Icmpv6DestinationUnreachable, icmpv6CodeNoRoute
+	case protocol.ErrPortUnreachable:
+		return Icmpv6DestinationUnreachable, icmpv6CodePortUnreachable
+	default:
+		return Icmpv6DestinationUnreachable, icmpv6CodeAddressUnreachable
+	}
+}
@@ -0,0 +1,515 @@
+package l3
+
+import (
+	"bytes"
+	"log"
+	"math/rand"
+	"netsim/protocol"
+	"netsim/utils"
+	"sync"
+	"time"
+)
+
+/*
+IGMP (version 2) is how hosts tell the routers on their link which multicast groups they want to receive. Like ICMP it
+is carried inside IP packets, and is part of the network layer. IP tells IGMP when an interface joins a group, or leaves
+it because no one on the host wants it anymore.
+
+Hosts:
+A host reports a group as soon as it joins it, and once more a little later in case the first report is lost. When it
+leaves a group it sends a Leave to all routers on the link. Routers ask for the groups periodically with a Query, and
+hosts answer with a report for each of their groups after a random delay within the maximum response time of the query.
+A host which hears someone else report a group it was about to report keeps quiet, since one report is enough.
+
+Routers:
+A router in querier mode sends general queries on all its links and keeps track of the groups which have listeners on
+each of them. A group is forgotten when no one reports it for a few query intervals. When a Leave is received, the group
+is queried specifically a couple of times in quick succession, and forgotten soon if no one answers. When there are
+multiple routers on a link, the one with the lowest address is the querier and the others only listen.
+
+Messages are sent with TTL 1 so that they never leave the link. Reports are sent to the group they are about, queries to
+all hosts (224.0.0.1), and leaves to all routers (224.0.0.2).
+
+Packet Format:
+
+Type			- 1 byte
+MaxResponseTime	- 1 byte, in units of 1/10 second, only used in queries
+Checksum		- 1 byte
+Group			- 4 bytes, 0.0.0.0 in general queries
+*/
+const (
+	IgmpQuery       = 0x11
+	IgmpReportV2    = 0x16
+	IgmpLeave       = 0x17
+	igmpReportV1    = 0x12
+	igmpMessageSize = 7
+	igmpTTL         = 1
+)
+
+const (
+	defaultIgmpQueryInterval      = 125 * time.Second
+	maxIgmpQueryResponseTime      = 10 * time.Second
+	igmpUnsolicitedReportInterval = 1 * time.Second
+	igmpLastMemberQueryInterval   = 1 * time.Second
+	igmpLastMemberQueryCount      = 2
+	igmpRobustness                = 2
+	igmpTimerInterval             = 100 * time.Millisecond
+)
+
+var (
+	AllHostsGroup   = []byte{224, 0, 0, 1}
+	AllRoutersGroup = []byte{224, 0, 0, 2}
+)
+
+type IGMP struct {
+	identifier        []byte
+	l3Protocols       []protocol.L3Protocol
+	ip                *IP
+	reports           map[igmpGroupKey]time.Time
+	querier           bool
+	queryInterval     time.Duration
+	nextQueryAt       time.Time
+	otherQuerierUntil map[int]time.Time
+	groups            map[igmpGroupKey]*igmpGroup
+	membershipHandler func(intfNum int, group []byte, hasListeners bool)
+	lock              sync.Mutex
+}
+
+/*
+Constructor
+*/
+func NewIGMP() *IGMP {
+	i := &IGMP{
+		identifier:        protocol.IGMP,
+		reports:           map[igmpGroupKey]time.Time{},
+		queryInterval:     defaultIgmpQueryInterval,
+		otherQuerierUntil: map[int]time.Time{},
+		groups:            map[igmpGroupKey]*igmpGroup{},
+	}
+
+	go i.run()
+	return i
+}
+
+/*
+Next 3 methods make this an implementation of Protocol
+*/
+func (i *IGMP) GetIdentifier() []byte {
+	return i.identifier
+}
+
+func (i *IGMP) SendUp(data []byte, metadata []byte, sender protocol.Protocol) {
+	if len(data) < igmpMessageSize || utils.CalculateChecksum(data)[0]-data[2] != data[2] {
+		log.Printf("IGMP: Got corrupted packet")
+		return
+	}
+
+	sourceAddr := metadata[0:4]
+	intfNum := int(metadata[8])
+	group := data[3:7]
+
+	switch data[0] {
+	case IgmpQuery:
+		i.handleQuery(intfNum, sourceAddr, group, data[1])
+	case IgmpReportV2, igmpReportV1:
+		i.handleReport(intfNum, group)
+	case IgmpLeave:
+		i.handleLeave(intfNum, group)
+	default:
+		log.Printf("IGMP: Got unsupported message type %d. Dropping.", data[0])
+	}
+}
+
+func (i *IGMP) SendDown(data []byte, destAddr []byte, metadata []byte, sender protocol.Protocol) {
+	//Not used. Messages are generated by IGMP itself.
+}
+
+/*
+Following methods make this an implementation of L4 Protocol
+*/
+func (i *IGMP) AddL3Protocol(l3Protocol protocol.L3Protocol) {
+	i.l3Protocols = append(i.l3Protocols, l3Protocol)
+	if ip, ok := l3Protocol.(*IP); ok {
+		i.ip = ip
+	}
+}
+
+/*
+IGMP public API
+*/
+
+/*
+In querier mode, the groups which have listeners on each link are tracked, and queries are sent on the links where no
+router with a lower address is querying already
+*/
+func (i *IGMP) SetQuerier(querier bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.querier = querier
+	i.nextQueryAt = time.Time{}
+	if !querier {
+		i.groups = map[igmpGroupKey]*igmpGroup{}
+	}
+}
+
+func (i *IGMP) SetQueryInterval(interval time.Duration) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.queryInterval = interval
+	i.nextQueryAt = time.Time{}
+}
+
+/*
+The handler is called when a group gets its first listener on a link, and when it has none left. Used by multicast
+routing protocols to find the links which want a group.
+*/
+func (i *IGMP) SetMembershipHandler(handler func(intfNum int, group []byte, hasListeners bool)) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.membershipHandler = handler
+}
+
+/*
+Returns true if this router sends the queries on the interface
+*/
+func (i *IGMP) IsQuerier(intfNum int) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return i.querier && i.otherQuerierUntil[intfNum].Before(time.Now())
+}
+
+/*
+Returns the groups which have listeners on the link of the interface. Only known in querier mode.
+*/
+func (i *IGMP) GetGroups(intfNum int) [][]byte {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	var groups [][]byte
+	now := time.Now()
+	for key, g := range i.groups {
+		if key.intfNum == intfNum && g.expiresAt.After(now) {
+			groups = append(groups, []byte(key.group))
+		}
+	}
+	return groups
+}
+
+func (i *IGMP) HasListeners(intfNum int, group []byte) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	g, ok := i.groups[igmpGroupKey{intfNum, string(group)}]
+	return ok && g.expiresAt.After(time.Now())
+}
+
+/*
+Internal methods
+*/
+
+/*
+Called by IP when the interface joins a group
+*/
+func (i *IGMP) join(intfNum int, group []byte) {
+	if bytes.Equal(group, AllHostsGroup) {
+		return
+	}
+
+	i.sendMessage(intfNum, IgmpReportV2, 0, group, group)
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.reports[igmpGroupKey{intfNum, string(group)}] = time.Now().Add(igmpUnsolicitedReportInterval)
+}
+
+/*
+Called by IP when the interface leaves a group
+*/
+func (i *IGMP) leave(intfNum int, group []byte) {
+	if bytes.Equal(group, AllHostsGroup) {
+		return
+	}
+
+	i.lock.Lock()
+	delete(i.reports, igmpGroupKey{intfNum, string(group)})
+	i.lock.Unlock()
+
+	i.sendMessage(intfNum, IgmpLeave, 0, group, AllRoutersGroup)
+}
+
+func (i *IGMP) handleQuery(intfNum int, sourceAddr []byte, group []byte, maxResponseTime byte) {
+	if i.ip == nil {
+		return
+	}
+
+	//Version 1 queries have no maximum response time
+	maxDelay := time.Duration(maxResponseTime) * time.Second / 10
+	if maxDelay == 0 {
+		maxDelay = maxIgmpQueryResponseTime
+	}
+
+	now := time.Now()
+	isGeneral := isUnspecifiedAddress(group)
+	groups := i.ip.getGroups(intfNum)
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	//The router with the lowest address is the querier, and the others only listen
+	if i.querier && bytes.Compare(sourceAddr, i.ip.GetAddressForInterface(intfNum)) < 0 {
+		if i.otherQuerierUntil[intfNum].Before(now) {
+			log.Printf("IGMP: %v is the querier on interface %d", sourceAddr, intfNum)
+		}
+		i.otherQuerierUntil[intfNum] = now.Add(i.otherQuerierPresentInterval())
+
+		//The querier asks for a group specifically when someone leaves it, which will be forgotten unless reported
+		if !isGeneral {
+			if g, ok := i.groups[igmpGroupKey{intfNum, string(group)}]; ok {
+				expiresAt := now.Add(igmpLastMemberQueryCount * maxDelay)
+				if expiresAt.Before(g.expiresAt) {
+					g.expiresAt = expiresAt
+				}
+			}
+		}
+	}
+
+	//Report the groups asked for, unless a report is due earlier anyway
+	for _, g := range groups {
+		if bytes.Equal(g, AllHostsGroup) || (!isGeneral && !bytes.Equal(g, group)) {
+			continue
+		}
+
+		key := igmpGroupKey{intfNum, string(g)}
+		reportAt := now.Add(time.Duration(rand.Int63n(int64(maxDelay))))
+		if due, ok := i.reports[key]; !ok || reportAt.Before(due) {
+			i.reports[key] = reportAt
+		}
+	}
+}
+
+func (i *IGMP) handleReport(intfNum int, group []byte) {
+	i.lock.Lock()
+
+	//Someone else on the link has reported the group, hence there is no need to report it again
+	delete(i.reports, igmpGroupKey{intfNum, string(group)})
+
+	if !i.querier {
+		i.lock.Unlock()
+		return
+	}
+
+	key := igmpGroupKey{intfNum, string(group)}
+	g, ok := i.groups[key]
+	isNew := !ok || g.expiresAt.Before(time.Now())
+	if isNew {
+		log.Printf("IGMP: Group %v has listeners on interface %d", group, intfNum)
+		g = &igmpGroup{}
+		i.groups[key] = g
+	}
+	g.expiresAt = time.Now().Add(i.groupMembershipInterval())
+	g.queriesLeft = 0
+	handler := i.membershipHandler
+	i.lock.Unlock()
+
+	if isNew && handler != nil {
+		handler(intfNum, append([]byte{}, group...), true)
+	}
+}
+
+func (i *IGMP) handleLeave(intfNum int, group []byte) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if !i.querier || i.otherQuerierUntil[intfNum].After(time.Now()) {
+		return
+	}
+
+	//Ask if anyone else still wants the group before forgetting it
+	g, ok := i.groups[igmpGroupKey{intfNum, string(group)}]
+	if !ok {
+		return
+	}
+	g.queriesLeft = igmpLastMemberQueryCount
+	g.nextQueryAt = time.Now()
+	g.expiresAt = time.Now().Add(igmpLastMemberQueryCount * igmpLastMemberQueryInterval)
+}
+
+/*
+Sends the reports which are due, the queries of the querier, and forgets the groups no one has reported for long
+*/
+func (i *IGMP) run() {
+	for {
+		time.Sleep(igmpTimerInterval)
+		if i.ip == nil {
+			continue
+		}
+
+		for _, key := range i.getDueReports() {
+			group := []byte(key.group)
+			i.sendMessage(key.intfNum, IgmpReportV2, 0, group, group)
+		}
+
+		generalQuery, groupQueries, expired := i.getDueQueries()
+		for intfNum := 0; intfNum < i.ip.NumInterfaces() && generalQuery; intfNum++ {
+			if i.ip.GetL2ProtocolForInterface(intfNum) != nil && i.IsQuerier(intfNum) {
+				i.sendMessage(intfNum, IgmpQuery, i.getMaxResponseTime(), make([]byte, 4), AllHostsGroup)
+			}
+		}
+		for _, key := range groupQueries {
+			group := []byte(key.group)
+			i.sendMessage(key.intfNum, IgmpQuery, byte(igmpLastMemberQueryInterval*10/time.Second), group, group)
+		}
+
+		i.lock.Lock()
+		handler := i.membershipHandler
+		i.lock.Unlock()
+		for _, key := range expired {
+			if handler != nil {
+				handler(key.intfNum, []byte(key.group), false)
+			}
+		}
+	}
+}
+
+func (i *IGMP) getDueReports() []igmpGroupKey {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	var due []igmpGroupKey
+	now := time.Now()
+	for key, reportAt := range i.reports {
+		if reportAt.Before(now) {
+			due = append(due, key)
+			delete(i.reports, key)
+		}
+	}
+	return due
+}
+
+/*
+Returns if a general query is due, the groups which have to be queried specifically, and the groups which have no
+listeners anymore
+*/
+func (i *IGMP) getDueQueries() (bool, []igmpGroupKey, []igmpGroupKey) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if !i.querier {
+		return false, nil, nil
+	}
+
+	now := time.Now()
+	var groupQueries, expired []igmpGroupKey
+	for key, g := range i.groups {
+		if g.expiresAt.Before(now) {
+			log.Printf("IGMP: Group %v has no listeners on interface %d anymore", []byte(key.group), key.intfNum)
+			delete(i.groups, key)
+			expired = append(expired, key)
+			continue
+		}
+		if g.queriesLeft > 0 && g.nextQueryAt.Before(now) {
+			groupQueries = append(groupQueries, key)
+			g.queriesLeft--
+			g.nextQueryAt = now.Add(igmpLastMemberQueryInterval)
+		}
+	}
+
+	generalQuery := i.nextQueryAt.Before(now)
+	if generalQuery {
+		i.nextQueryAt = now.Add(i.queryInterval)
+	}
+	return generalQuery, groupQueries, expired
+}
+
+/*
+Hosts have to answer well within the query interval
+*/
+func (i *IGMP) getMaxResponseTime() byte {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	maxDelay := i.queryInterval / 2
+	if maxDelay > maxIgmpQueryResponseTime {
+		maxDelay = maxIgmpQueryResponseTime
+	}
+	return byte(maxDelay * 10 / time.Second)
+}
+
+/*
+Next 2 methods expect the lock to be held
+*/
+func (i *IGMP) groupMembershipInterval() time.Duration {
+	return igmpRobustness*i.queryInterval + maxIgmpQueryResponseTime
+}
+
+func (i *IGMP) otherQuerierPresentInterval() time.Duration {
+	return igmpRobustness*i.queryInterval + maxIgmpQueryResponseTime/2
+}
+
+func (i *IGMP) sendMessage(intfNum int, msgType byte, maxResponseTime byte, group []byte, destAddr []byte) {
+	if i.ip == nil || i.ip.GetL2ProtocolForInterface(intfNum) == nil {
+		return
+	}
+
+	message := []byte{msgType, maxResponseTime, 0}
+	message = append(message, group...)
+	message[2] = utils.CalculateChecksum(message)[0]
+
+	i.ip.SendDownOnInterface(intfNum, message, destAddr, []byte{0, igmpTTL}, i)
+}
+
+/*
+Helper for devices which look into frames, like bridges snooping on IGMP. Returns the type of the IGMP message and the
+group it is about if the IP packet carries one, in either header format.
+*/
+func ParseIgmp(packet []byte) (byte, []byte, bool) {
+	if isRfc791Packet(packet) {
+		var ok bool
+		packet, ok = fromRfc791(packet)
+		if !ok {
+			return 0, nil, false
+		}
+	}
+
+	if len(packet) < 20+igmpMessageSize || packet[10] != protocol.IGMP[0] {
+		return 0, nil, false
+	}
+	return packet[20], packet[23:27], true
+}
+
+/*
+The MAC address a group is sent to is made of 01:00:5E and the lower 23 bits of the group address
+*/
+func GroupMacAddress(group []byte) []byte {
+	return append(append([]byte{}, l2IpMulticast...), group[1]&0x7F, group[2], group[3])
+}
+
+func isMulticastAddress(addr []byte) bool {
+	return len(addr) == 4 && addr[0]&0xF0 == 0xE0
+}
+
+/*
+Groups in 224.0.0.0/24 are for protocols which only talk on the link, like IGMP itself
+*/
+func isLinkLocalGroup(addr []byte) bool {
+	return addr[0] == 224 && addr[1] == 0 && addr[2] == 0
+}
+
+type igmpGroupKey struct {
+	intfNum int
+	group   string
+}
+
+/*
+A group which has listeners on a link
+*/
+type igmpGroup struct {
+	expiresAt   time.Time
+	queriesLeft int
+	nextQueryAt time.Time
+}
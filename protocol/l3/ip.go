@@ -1,6 +1,7 @@
 package l3
 
 import (
+	"bytes"
 	"encoding/binary"
 	"log"
 	"netsim/protocol"
@@ -29,21 +30,67 @@ Checksum 		- 1 byte
 SourceAddr      - 4 byte
 DestinationAddr - 4 byte
 Data			- No fixed length but should be less than 2^16 - 20 bytes
+
+Flags:
+Last Fragment	- bit 1
+Don't Fragment	- bit 2
+
+Packets can also be sent with the header of RFC 791 instead, see SetHeaderFormat, along with options, see
+SetHeaderOptions. Packets received are accepted in both formats. The room the options take is left out of the MTUs
+packets are sized with.
+
+Packets which cannot be delivered are dropped, and if an ICMP instance has been added as an L4 protocol, the sender is
+told why using an ICMP error message. The MTUs learnt from these messages are used to size the packets sent to each
+destination, see pmtu.go. Routers fragment the packets which do not fit the next link, unless Don't Fragment is set.
+Routes without a gateway lead to networks the interface is directly connected to, hence packets are sent straight to
+their destination. Packets for the broadcast address 255.255.255.255 are sent to everyone on the link and are never
+forwarded. They are mostly needed by hosts which do not have an address yet.
+Packets for multicast groups (224.0.0.0/4) are received on the interfaces which have joined the group, see JoinGroup,
+and are sent to the MAC address the group maps to, without address resolution. The routers on the link are told about
+the groups joined using IGMP, if an IGMP instance has been added as an L4 protocol. Routers forward multicast packets out
+of the interfaces picked by a multicast routing protocol, see SetMulticastRouter. Groups in 224.0.0.0/24 never leave the
+link.
+Other modules can look at, change, hold back or drop the packets passing through using hooks, see netfilter.go.
+The routing table a packet is routed with can be picked by rules about the packet, see policy_routing.go. Forwarded
+packets are spread over the equal-cost routes to their destination, see ecmp.go.
 */
 
 const (
-	identifierExpiryDuration = 10 * time.Second
+	lastFragment = 0x01
+	DontFragment = 0x02
+)
+
+var (
+	BroadcastAddress   = []byte{255, 255, 255, 255}
+	l2BroadcastAddress = utils.HexStringToBytes("FFFFFFFFFFFF")
+	l2IpMulticast      = utils.HexStringToBytes("01005E")
 )
 
 type IP struct {
 	forwardingMode      bool
+	headerFormat        int
+	headerOptions       []byte
 	version             []byte
 	identifier          []byte
 	interfaces          []*ipInterface
 	l4Protocols         []protocol.L4Protocol
+	icmp                *ICMP
+	igmp                *IGMP
 	rawConsumer         protocol.FrameConsumer
+	multicastRouter     protocol.MulticastRouter
 	routingTable        protocol.RouteProvider
+	routingTables       map[int]protocol.RouteProvider
+	routingRules        []*RoutingRule
 	addrResolutionTable protocol.AddressResolver
+	reassembler         *reassembler
+	pathMTUs            *pathMTUCache
+	hooks               [numHooks][]*registeredHook
+	conntrack           *Conntrack
+	lastHookId          int
+	multipathMode       int
+	multipathSeed       uint32
+	nextPath            uint32
+	nextHopStats        map[string]*NextHopStats
 	lock                sync.Mutex
 }
 
@@ -57,7 +104,12 @@ func NewIP(ipAddresses [][]byte, forwardingMode bool, rawConsumer protocol.Frame
 		identifier:          protocol.IP,
 		rawConsumer:         rawConsumer,
 		routingTable:        routingTable,
+		routingTables:       map[int]protocol.RouteProvider{TableMain: routingTable},
+		routingRules:        []*RoutingRule{{Priority: DefaultRulePriority, Table: TableMain}},
 		addrResolutionTable: addrResolutionTable,
+		pathMTUs:            newPathMTUCache(minPathMTU),
+		multipathSeed:       newMultipathSeed(ipAddresses),
+		nextHopStats:        map[string]*NextHopStats{},
 	}
 
 	var interfaces []*ipInterface
@@ -66,6 +118,14 @@ func NewIP(ipAddresses [][]byte, forwardingMode bool, rawConsumer protocol.Frame
 	}
 	ip.interfaces = interfaces
 
+	//The sender is told about the packets for this host which could not be reassembled in time. Packets being forwarded
+	//are only reassembled for connection tracking, and it is up to their destination to complain.
+	ip.reassembler = newReassembler(func(firstFragment []byte) {
+		if isForMe, _ := ip.isPacketForMe(firstFragment, nil); isForMe {
+			ip.sendError(protocol.ErrReassemblyTimeout, firstFragment, 0)
+		}
+	})
+
 	go ip.cleanBuffersPeriodically()
 	return ip
 }
@@ -78,59 +138,40 @@ func (ip *IP) GetIdentifier() []byte {
 }
 
 func (ip *IP) SendDown(data []byte, destAddr []byte, metadata []byte, l4Protocol protocol.Protocol) {
-	intfNum := ip.routingTable.GetInterfaceForAddress(destAddr)
-	ip.interfaces[intfNum].sendDown(data, destAddr, metadata, l4Protocol)
+	routes, intfNum := ip.lookupLocalRoute(getLocalRoutingKey(data, destAddr, metadata[0], l4Protocol.GetIdentifier()[0]))
+
+	//Groups without a route are sent on the first interface
+	if intfNum < 0 && isMulticastAddress(destAddr) {
+		intfNum = 0
+	}
+	if intfNum < 0 {
+		log.Printf("IP: No route to %v. Dropping.", destAddr)
+		notifySender(protocol.ErrNetUnreachable, data, []byte{0, 0, 0, 0}, destAddr, l4Protocol)
+		return
+	}
+
+	ip.interfaces[intfNum].sendDown(data, destAddr, metadata, l4Protocol, routes)
 }
 
 func (ip *IP) SendUp(packet []byte, metadata []byte, source protocol.Protocol) {
+	if isRfc791Packet(packet) {
+		var ok bool
+		packet, ok = fromRfc791(packet)
+		if !ok {
+			log.Printf("IP: Got corrupted packet")
+			return
+		}
+	}
+
 	isValid := ip.isValidPacket(packet)
 	if isValid {
 		if ip.rawConsumer != nil {
 			ip.rawConsumer.SendUp(packet, nil, ip)
 		}
 
-		isPacketForMe, intfNum := ip.isPacketForMe(packet)
-		if isPacketForMe {
-			ip.interfaces[intfNum].sendUp(packet, metadata, source)
-		} else {
-			if ip.forwardingMode {
-				//Copy the packet
-				newPacket := make([]byte, len(packet))
-				copy(newPacket, packet)
-
-				//Reduce the TTL for the packet
-				ttl := int(newPacket[9])
-				ttl -= 1
-
-				//If TTL reached 0, then drop the packet
-				if ttl == 0 {
-					return
-				}
-
-				//Set the new TTL in packet
-				newPacket[9] = byte(ttl)
-
-				//Calculate the new checksum since packet has changed
-				newPacket[11] = byte(0)
-				newPacket[11] = utils.CalculateChecksum(newPacket[:20])[0]
-
-				//Get the interface through which the packet has to leave
-				destinationAddr := newPacket[16:20]
-				intf := ip.routingTable.GetInterfaceForAddress(destinationAddr)
-
-				//If incoming interface is same as outgoing interface, then drop the packet
-				if intf == ip.getInterfaceNum(source) {
-					return
-				}
-
-				//Get the next hop address
-				nextHopAddr := ip.routingTable.GetGatewayForAddress(destinationAddr)
-				l2Address := ip.addrResolutionTable.Resolve(nextHopAddr)
-
-				//Forward the packet
-				ip.interfaces[intf].l2Protocol.SendDown(newPacket, l2Address, nil, ip)
-			}
-		}
+		ip.runHooks(HookPrerouting, packet, ip.getInterfaceNum(source), -1, func(packet []byte) {
+			ip.route(packet, metadata, source)
+		})
 	} else {
 		log.Printf("IP: Got corrupted packet")
 	}
@@ -148,11 +189,201 @@ func (ip *IP) GetL2ProtocolForInterface(intfNum int) protocol.L2Protocol {
 }
 
 func (ip *IP) GetAddressForInterface(intfNum int) []byte {
-	return ip.interfaces[intfNum].ipAddress
+	return ip.interfaces[intfNum].getAddress()
 }
 
 func (ip *IP) AddL4Protocol(l4Protocol protocol.L4Protocol) {
 	ip.l4Protocols = append(ip.l4Protocols, l4Protocol)
+	if icmp, ok := l4Protocol.(*ICMP); ok {
+		ip.icmp = icmp
+	}
+	if igmp, ok := l4Protocol.(*IGMP); ok {
+		ip.igmp = igmp
+	}
+}
+
+/*
+Next method makes this an implementation of InterfaceSender
+*/
+func (ip *IP) SendDownOnInterface(intfNum int, data []byte, destAddr []byte, metadata []byte, l4Protocol protocol.Protocol) {
+	routes, _ := ip.lookupLocalRoute(getLocalRoutingKey(data, destAddr, metadata[0], l4Protocol.GetIdentifier()[0]))
+	ip.interfaces[intfNum].sendDown(data, destAddr, metadata, l4Protocol, routes)
+}
+
+/*
+Next method makes this an implementation of ErrorReporter. The header of the packet is rebuilt from the metadata since
+L4 protocols only get the data.
+*/
+func (ip *IP) ReportError(err error, data []byte, metadata []byte, sender protocol.Protocol) {
+	if ip.icmp == nil {
+		return
+	}
+
+	packet := createPacket(ip.version, data, metadata[0:4], metadata[4:8], 0, []byte{0, 0}, lastFragment, []byte{0, 0}, 0, sender.GetIdentifier())
+	ip.icmp.sendError(err, packet, 0)
+}
+
+/*
+Next 2 methods make this an implementation of GroupMembership. IGMP is told when an interface joins a group for the first
+time, and when no one wants it anymore.
+*/
+func (ip *IP) JoinGroup(group []byte, intfAddr []byte) {
+	if !isMulticastAddress(group) {
+		log.Printf("IP: %v is not a multicast group", group)
+		return
+	}
+
+	intfNum := ip.getInterfaceForGroup(group, intfAddr)
+	if intfNum < 0 {
+		log.Printf("IP: No interface with address %v to join %v on", intfAddr, group)
+		return
+	}
+
+	ip.lock.Lock()
+	intf := ip.interfaces[intfNum]
+	intf.groups[string(group)]++
+	isFirst := intf.groups[string(group)] == 1
+	igmp := ip.igmp
+	ip.lock.Unlock()
+
+	if isFirst && igmp != nil {
+		igmp.join(intfNum, group)
+	}
+}
+
+func (ip *IP) LeaveGroup(group []byte, intfAddr []byte) {
+	intfNum := ip.getInterfaceForGroup(group, intfAddr)
+	if intfNum < 0 {
+		return
+	}
+
+	ip.lock.Lock()
+	intf := ip.interfaces[intfNum]
+	count, ok := intf.groups[string(group)]
+	if !ok {
+		ip.lock.Unlock()
+		return
+	}
+	if count > 1 {
+		intf.groups[string(group)]--
+		ip.lock.Unlock()
+		return
+	}
+	delete(intf.groups, string(group))
+	igmp := ip.igmp
+	ip.lock.Unlock()
+
+	if igmp != nil {
+		igmp.leave(intfNum, group)
+	}
+}
+
+/*
+IP public API
+*/
+func (ip *IP) NumInterfaces() int {
+	return len(ip.interfaces)
+}
+
+func (ip *IP) SetAddressForInterface(intfNum int, ipAddr []byte) {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	ip.interfaces[intfNum].ipAddress = ipAddr
+}
+
+/*
+Picks the header packets are sent with, either HeaderFormatCustom or HeaderFormatRfc791
+*/
+func (ip *IP) SetHeaderFormat(format int) {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	ip.headerFormat = format
+}
+
+/*
+Sets the options sent in RFC 791 headers. They are padded to a multiple of 4 bytes, and are ignored if they are not
+valid or do not fit the header.
+*/
+func (ip *IP) SetHeaderOptions(options []byte) {
+	options = padOptions(append([]byte{}, options...))
+	if len(options) > maxOptionsLength || !isValidOptions(options) {
+		log.Printf("IP: Invalid header options %v. Ignoring.", options)
+		return
+	}
+
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	ip.headerOptions = options
+}
+
+/*
+Sets how long the fragments of a packet are kept waiting for the rest
+*/
+func (ip *IP) SetReassemblyTimeout(timeout time.Duration) {
+	ip.reassembler.setTimeout(timeout)
+}
+
+/*
+Sets how many bytes of data the fragments of all incomplete packets may take
+*/
+func (ip *IP) SetReassemblyMemoryLimit(limit int) {
+	ip.reassembler.setMemoryLimit(limit)
+}
+
+func (ip *IP) GetReassemblyStats() ReassemblyStats {
+	return ip.reassembler.getStats()
+}
+
+/*
+Next 2 methods make this an implementation of PathMTUProvider. The path MTU is never larger than the MTU of the interface
+the destination is reached through, less the room the header options take, and is 0 if there is no route to it.
+*/
+func (ip *IP) GetPathMTU(destAddr []byte) int {
+	_, intfNum := ip.lookupLocalRoute(getLocalRoutingKey(nil, destAddr, 0, 0))
+	if intfNum < 0 {
+		return 0
+	}
+
+	return ip.getPathMTU(intfNum, destAddr)
+}
+
+func (ip *IP) ReportBlackHole(destAddr []byte) {
+	log.Printf("IP: Packets to %v are being lost. Sending them with fragmentation allowed.", destAddr)
+	ip.pathMTUs.update(destAddr, blackHolePathMTU, true)
+}
+
+/*
+Sets how long a learnt path MTU is used before a larger one is tried again
+*/
+func (ip *IP) SetPathMTUAging(aging time.Duration) {
+	ip.pathMTUs.setAging(aging)
+}
+
+/*
+Returns the path MTUs which have been learnt and not aged out yet
+*/
+func (ip *IP) GetPathMTUCache() []PathMTU {
+	return ip.pathMTUs.list()
+}
+
+/*
+Sets the protocol which decides where multicast packets are forwarded
+*/
+func (ip *IP) SetMulticastRouter(multicastRouter protocol.MulticastRouter) {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	ip.multicastRouter = multicastRouter
+}
+
+/*
+Returns the groups the interface has joined
+*/
+func (ip *IP) GetGroups(intfNum int) [][]byte {
+	return ip.getGroups(intfNum)
 }
 
 /*
@@ -169,9 +400,28 @@ func (ip *IP) isValidPacket(packet []byte) bool {
 	return calculated == actual
 }
 
-func (ip *IP) isPacketForMe(packet []byte) (bool, int) {
+func (ip *IP) isPacketForMe(packet []byte, source protocol.Protocol) (bool, int) {
 	destinationAddr := packet[16:20]
 
+	//Broadcasts are for everyone on the link they came from
+	if isBroadcastAddress(destinationAddr) {
+		intfNum := ip.getInterfaceNum(source)
+		return intfNum >= 0, intfNum
+	}
+
+	//Multicasts are for the interfaces which have joined the group. IGMP messages are sent to the groups they are about,
+	//hence they are always taken.
+	if isMulticastAddress(destinationAddr) {
+		intfNum := ip.getInterfaceNum(source)
+		if intfNum < 0 {
+			return false, -1
+		}
+		return packet[10] == protocol.IGMP[0] || ip.isMember(intfNum, destinationAddr), intfNum
+	}
+
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
 	for i := 0; i < len(ip.interfaces); i++ {
 		match := true
 		for j := 0; j < 4; j++ {
@@ -188,6 +438,263 @@ func (ip *IP) isPacketForMe(packet []byte) (bool, int) {
 	return false, -1
 }
 
+/*
+Everyone is in the all hosts group, and routers are also in the all routers group
+*/
+func (ip *IP) isMember(intfNum int, group []byte) bool {
+	if bytes.Equal(group, AllHostsGroup) || (ip.forwardingMode && bytes.Equal(group, AllRoutersGroup)) {
+		return true
+	}
+
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	return ip.interfaces[intfNum].groups[string(group)] > 0
+}
+
+func (ip *IP) getGroups(intfNum int) [][]byte {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	var groups [][]byte
+	for group := range ip.interfaces[intfNum].groups {
+		groups = append(groups, []byte(group))
+	}
+	return groups
+}
+
+/*
+Groups are joined on the interface with the given address. Without one, the interface the group is routed through is
+used, or the first one if there is no route.
+*/
+func (ip *IP) getInterfaceForGroup(group []byte, intfAddr []byte) int {
+	if intfAddr == nil || isUnspecifiedAddress(intfAddr) {
+		_, intfNum := ip.lookupLocalRoute(getLocalRoutingKey(nil, group, 0, 0))
+		if intfNum < 0 {
+			intfNum = 0
+		}
+		return intfNum
+	}
+
+	for i := range ip.interfaces {
+		if bytes.Equal(ip.interfaces[i].getAddress(), intfAddr) {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+Delivers the packet to this host or forwards it
+*/
+func (ip *IP) route(packet []byte, metadata []byte, source protocol.Protocol) {
+	isPacketForMe, intfNum := ip.isPacketForMe(packet, source)
+	if isPacketForMe {
+		ip.interfaces[intfNum].sendUp(packet, metadata, source)
+	} else if ip.forwardingMode && !isMulticastAddress(packet[16:20]) {
+		ip.forward(packet, source)
+	}
+
+	//Multicasts can be for this host and for the networks beyond it at the same time
+	if ip.forwardingMode && isMulticastAddress(packet[16:20]) {
+		ip.forwardMulticast(packet, source)
+	}
+}
+
+func (ip *IP) forward(packet []byte, source protocol.Protocol) {
+	//Copy the packet
+	newPacket := make([]byte, len(packet))
+	copy(newPacket, packet)
+
+	//Reduce the TTL for the packet
+	ttl := int(newPacket[9])
+	ttl -= 1
+
+	//If TTL reached 0, then drop the packet and tell the sender
+	if ttl <= 0 {
+		ip.sendError(protocol.ErrTTLExceeded, packet, 0)
+		return
+	}
+
+	//Set the new TTL in packet
+	newPacket[9] = byte(ttl)
+
+	//Calculate the new checksum since packet has changed
+	newPacket[11] = byte(0)
+	newPacket[11] = utils.CalculateChecksum(newPacket[:20])[0]
+
+	//Get the interface through which the packet has to leave. The hooks cannot change it anymore.
+	destinationAddr := append([]byte{}, newPacket[16:20]...)
+	inIntf := ip.getInterfaceNum(source)
+	routes, intf := ip.lookupRoute(getRoutingKey(newPacket, inIntf))
+	if intf < 0 {
+		ip.sendError(protocol.ErrNetUnreachable, packet, 0)
+		return
+	}
+	intf, gateway := ip.selectPath(routes, intf, newPacket)
+
+	//If incoming interface is same as outgoing interface, then drop the packet
+	if intf == inIntf {
+		return
+	}
+
+	ip.runHooks(HookForward, newPacket, inIntf, intf, func(newPacket []byte) {
+		ip.runHooks(HookPostrouting, newPacket, inIntf, intf, func(newPacket []byte) {
+			ip.sendForwarded(newPacket, packet, intf, destinationAddr, gateway)
+		})
+	})
+}
+
+/*
+Sends a packet which went through the hooks on the outgoing interface. Errors are about the packet as it was received.
+*/
+func (ip *IP) sendForwarded(newPacket []byte, packet []byte, intf int, destinationAddr []byte, gateway []byte) {
+	//A packet which does not fit the outgoing link is fragmented, unless it must not be, in which case it is dropped
+	mtu := ip.interfaces[intf].l2Protocol.GetMTU() - ip.getHeaderOverhead()
+	packets := [][]byte{newPacket}
+	if len(newPacket) > mtu {
+		if newPacket[6]&DontFragment != 0 {
+			ip.sendError(protocol.ErrFragmentationNeeded, packet, mtu)
+			return
+		}
+		if packets = fragment(newPacket, mtu); packets == nil {
+			log.Printf("IP: MTU %d is too small to fragment packets. Dropping.", mtu)
+			return
+		}
+	}
+
+	//The destination is the next hop if it is on a directly connected network
+	nextHopAddr := gateway
+	if nextHopAddr == nil {
+		nextHopAddr = destinationAddr
+	}
+
+	//Forward the packet
+	ip.resolveAndSend(intf, nextHopAddr, func(l2Address []byte) {
+		if l2Address == nil {
+			ip.sendError(protocol.ErrHostUnreachable, packet, 0)
+			return
+		}
+		ip.countNextHop(intf, gateway, len(newPacket))
+		for _, p := range packets {
+			ip.interfaces[intf].l2Protocol.SendDown(ip.encode(p), l2Address, nil, ip)
+		}
+	})
+}
+
+/*
+Multicasts are sent to the MAC address of the group on every interface the multicast router picks. No errors are sent
+about them, hence they are dropped quietly if they cannot be forwarded.
+*/
+func (ip *IP) forwardMulticast(packet []byte, source protocol.Protocol) {
+	destinationAddr := packet[16:20]
+	if isLinkLocalGroup(destinationAddr) || packet[9] <= 1 {
+		return
+	}
+
+	ip.lock.Lock()
+	multicastRouter := ip.multicastRouter
+	ip.lock.Unlock()
+	if multicastRouter == nil {
+		return
+	}
+
+	intfNums := multicastRouter.GetOutgoingInterfaces(packet[12:16], destinationAddr, ip.getInterfaceNum(source))
+	if len(intfNums) == 0 {
+		return
+	}
+
+	newPacket := make([]byte, len(packet))
+	copy(newPacket, packet)
+	newPacket[9]--
+	newPacket[11] = byte(0)
+	newPacket[11] = utils.CalculateChecksum(newPacket[:20])[0]
+
+	for _, intfNum := range intfNums {
+		l2Protocol := ip.interfaces[intfNum].l2Protocol
+		if len(newPacket) > l2Protocol.GetMTU()-ip.getHeaderOverhead() {
+			log.Printf("IP: Multicast packet too big for interface %d. Dropping.", intfNum)
+			continue
+		}
+		l2Protocol.SendDown(ip.encode(newPacket), GroupMacAddress(destinationAddr), nil, ip)
+	}
+}
+
+/*
+Puts the packet in the header format it is sent with
+*/
+func (ip *IP) encode(packet []byte) []byte {
+	ip.lock.Lock()
+	format := ip.headerFormat
+	options := ip.headerOptions
+	ip.lock.Unlock()
+
+	if format == HeaderFormatRfc791 {
+		return toRfc791(packet, options)
+	}
+	return packet
+}
+
+/*
+Returns how much longer the header packets are sent with is than our own, which is the room the options take
+*/
+func (ip *IP) getHeaderOverhead() int {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	if ip.headerFormat != HeaderFormatRfc791 {
+		return 0
+	}
+	return len(ip.headerOptions)
+}
+
+/*
+Records the MTU a router reported for the destination of a packet it could not forward. Reports which would not make the
+packet fit are replaced by a guess based on its length.
+*/
+func (ip *IP) updatePathMTU(destAddr []byte, mtu int, length int) {
+	if mtu <= 0 || mtu >= length {
+		mtu = nextLowerPlateau(length)
+	}
+
+	log.Printf("IP: Path MTU to %v is %d", destAddr, mtu)
+	ip.pathMTUs.update(destAddr, mtu, false)
+}
+
+func (ip *IP) getPathMTU(intfNum int, destAddr []byte) int {
+	mtu := ip.interfaces[intfNum].l2Protocol.GetMTU()
+	if entry := ip.pathMTUs.get(destAddr); entry != nil && entry.MTU < mtu {
+		mtu = entry.MTU
+	}
+	return mtu - ip.getHeaderOverhead()
+}
+
+/*
+Don't Fragment is ignored for destinations behind a black hole, since packets which cannot be fragmented never arrive
+*/
+func (ip *IP) isBlackHole(destAddr []byte) bool {
+	entry := ip.pathMTUs.get(destAddr)
+	return entry != nil && entry.BlackHole
+}
+
+func (ip *IP) sendError(err error, packet []byte, mtu int) {
+	if ip.icmp != nil {
+		ip.icmp.sendError(err, packet, mtu)
+	}
+}
+
+/*
+Find the L2 address of the next hop and send the packets to it. With a dynamic resolver the packets might be sent later.
+*/
+func (ip *IP) resolveAndSend(intfNum int, nextHopAddr []byte, send func(l2Address []byte)) {
+	if resolver, ok := ip.addrResolutionTable.(protocol.DynamicAddressResolver); ok {
+		resolver.Request(nextHopAddr, intfNum, send)
+		return
+	}
+
+	send(ip.addrResolutionTable.Resolve(nextHopAddr))
+}
+
 func (ip *IP) getInterfaceNum(source protocol.Protocol) int {
 	for i, intf := range ip.interfaces {
 		if source == intf.l2Protocol {
@@ -200,11 +707,112 @@ func (ip *IP) getInterfaceNum(source protocol.Protocol) int {
 
 func (ip *IP) cleanBuffersPeriodically() {
 	for {
-		for _, intf := range ip.interfaces {
-			intf.cleanBuffers()
+		time.Sleep(reassemblyCheckInterval)
+		ip.reassembler.expire()
+	}
+}
+
+/*
+Returns the data of the packet, once all of it has arrived if it is fragmented. Fragments belong to the same packet if
+they have the same addresses, protocol and identifier.
+*/
+func (ip *IP) reassemble(packet []byte) (bool, []byte) {
+	if !isFragment(packet) {
+		return true, packet[20:]
+	}
+
+	key := string(packet[12:20]) + string(packet[10:11]) + string(packet[4:6])
+	offset := int(binary.BigEndian.Uint16(packet[7:9]))
+	return ip.reassembler.add(key, offset, packet[20:], packet[6]&lastFragment != 0, packet)
+}
+
+/*
+Puts the data of a reassembled packet back under the header of the last of its fragments to arrive
+*/
+func wholePacket(fragment []byte, data []byte) []byte {
+	whole := append(fragment[:20:20], data...)
+	copy(whole[6:9], []byte{fragment[6] | lastFragment, 0, 0})
+	binary.BigEndian.PutUint16(whole[2:4], uint16(len(whole)))
+	whole[11] = byte(0)
+	whole[11] = utils.CalculateChecksum(whole[:20])[0]
+	return whole
+}
+
+/*
+Splits the packet in fragments which fit the MTU. The data of each is a multiple of 8 bytes, so that offsets fit in RFC
+791 headers. Fragments keep the identifier of the packet, and the offsets of the fragments of a fragment follow on from
+its own, so that the destination puts the original packet back together whoever fragmented it. Returns nil if no data
+fits the MTU.
+*/
+func fragment(packet []byte, mtu int) [][]byte {
+	data := packet[20:]
+	fragmentSize := (mtu - 20) &^ 7
+	if fragmentSize <= 0 {
+		return nil
+	}
+
+	var fragments [][]byte
+	baseOffset := int(binary.BigEndian.Uint16(packet[7:9]))
+	for totalBytesConsumed := 0; totalBytesConsumed < len(data); totalBytesConsumed += fragmentSize {
+		//Only the end of the packet is the last fragment, and only if the packet was
+		endIndex := totalBytesConsumed + fragmentSize
+		flags := packet[6] &^ lastFragment
+		if endIndex >= len(data) {
+			endIndex = len(data)
+			flags |= packet[6] & lastFragment
 		}
-		time.Sleep(600 * time.Second)
+
+		//Offset of bytes in this fragment
+		var offset = make([]byte, 2)
+		binary.BigEndian.PutUint16(offset, uint16(baseOffset+totalBytesConsumed))
+
+		fragment := createPacket(packet[0:1], data[totalBytesConsumed:endIndex], packet[12:16], packet[16:20], packet[1], packet[4:6], flags, offset, packet[9], packet[10:11])
+		fragments = append(fragments, fragment)
 	}
+	return fragments
+}
+
+/*
+Fragments are the packets which have more to follow or do not start at offset 0
+*/
+func isFragment(packet []byte) bool {
+	return packet[6]&lastFragment == 0 || binary.BigEndian.Uint16(packet[7:9]) != 0
+}
+
+/*
+Tell the L4 protocol on this host that its packet could not be sent. Done asynchronously since the sender might be
+holding locks while sending.
+*/
+func notifySender(err error, data []byte, srcAddr []byte, destAddr []byte, l4Protocol protocol.Protocol) {
+	consumer, ok := l4Protocol.(protocol.ErrorConsumer)
+	if !ok {
+		return
+	}
+
+	metadata := []byte{}
+	metadata = append(metadata, srcAddr...)
+	metadata = append(metadata, destAddr...)
+	go consumer.ConsumeError(err, data, metadata)
+}
+
+func isBroadcastAddress(addr []byte) bool {
+	for _, b := range addr {
+		if b != 0xFF {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isUnspecifiedAddress(addr []byte) bool {
+	for _, b := range addr {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
 }
 
 /*
@@ -212,8 +820,8 @@ Per-interface struct
 */
 type ipInterface struct {
 	ipIdentMap map[string]uint16
-	buffer     map[uint64]*fragmentTracker
 	ipAddress  []byte
+	groups     map[string]int
 	l2Protocol protocol.L2Protocol
 	lock       sync.Mutex
 	ip         *IP
@@ -222,13 +830,16 @@ type ipInterface struct {
 func newIPInterface(ipAddress []byte, ip *IP) *ipInterface {
 	return &ipInterface{
 		ipIdentMap: make(map[string]uint16),
-		buffer:     make(map[uint64]*fragmentTracker),
 		ipAddress:  ipAddress,
+		groups:     make(map[string]int),
 		ip:         ip,
 	}
 }
 
 func (i *ipInterface) getAddress() []byte {
+	i.ip.lock.Lock()
+	defer i.ip.lock.Unlock()
+
 	return i.ipAddress
 }
 
@@ -241,189 +852,182 @@ func (i *ipInterface) getL2Protocol() protocol.L2Protocol {
 }
 
 func (i *ipInterface) sendUp(packet []byte, metadata []byte, source protocol.Protocol) {
-	ready, data := i.reassemble(packet)
-	if ready {
-		//Extract relevant info from packet
-		sourceAddr := packet[12:16]
-		destinationAddr := packet[16:20]
-
-		ipMetadata := []byte{}
-		ipMetadata = append(ipMetadata, sourceAddr...)
-		ipMetadata = append(ipMetadata, destinationAddr...)
-
-		if len(i.ip.l4Protocols) > 0 {
-			proto := packet[10]
-			var upperLayerProtocol protocol.L4Protocol
-			for _, l4P := range i.ip.l4Protocols {
-				if l4P.GetIdentifier()[0] == proto {
-					upperLayerProtocol = l4P
-					break
-				}
-			}
+	ready, data := i.ip.reassemble(packet)
+	if !ready {
+		return
+	}
+
+	//The hooks see the whole packet
+	if isFragment(packet) {
+		packet = wholePacket(packet, data)
+	}
+
+	i.ip.runHooks(HookInput, packet, i.getInterfaceNum(), -1, i.deliver)
+}
 
-			if upperLayerProtocol != nil {
-				upperLayerProtocol.SendUp(data, ipMetadata, i.ip)
-			} else {
-				log.Printf("IP: addr %s: Got unrecognized packet type: %v", string(i.ipAddress), proto)
+/*
+Hands the packet to the L4 protocol it is for
+*/
+func (i *ipInterface) deliver(packet []byte) {
+	//Extract relevant info from packet
+	sourceAddr := packet[12:16]
+	destinationAddr := packet[16:20]
+
+	ipMetadata := []byte{}
+	ipMetadata = append(ipMetadata, sourceAddr...)
+	ipMetadata = append(ipMetadata, destinationAddr...)
+	ipMetadata = append(ipMetadata, byte(i.getInterfaceNum()))
+
+	if len(i.ip.l4Protocols) > 0 {
+		proto := packet[10]
+		var upperLayerProtocol protocol.L4Protocol
+		for _, l4P := range i.ip.l4Protocols {
+			if l4P.GetIdentifier()[0] == proto {
+				upperLayerProtocol = l4P
+				break
 			}
 		}
+
+		if upperLayerProtocol != nil {
+			upperLayerProtocol.SendUp(packet[20:], ipMetadata, i.ip)
+		} else {
+			log.Printf("IP: addr %s: Got unrecognized packet type: %v", string(i.getAddress()), proto)
+			i.ip.sendError(protocol.ErrProtocolUnreachable, packet, 0)
+		}
 	}
 }
 
-func (i *ipInterface) sendDown(data []byte, destAddr []byte, metadata []byte, l4Protocol protocol.Protocol) {
+/*
+The next hop is found in the routing table the packet was routed with
+*/
+func (i *ipInterface) sendDown(data []byte, destAddr []byte, metadata []byte, l4Protocol protocol.Protocol, routes protocol.RouteProvider) {
 	tos := metadata[0]
 	ttl := metadata[1]
 	proto := l4Protocol.GetIdentifier()
-	nextHopAddr := i.ip.routingTable.GetGatewayForAddress(destAddr)
-	l2Address := i.ip.addrResolutionTable.Resolve(nextHopAddr)
 
-	//Fragmentation logic follows. We use ident=0 for packets in which no fragmentation occurs
-	if len(data) <= i.l2Protocol.GetMTU() {
-		packet := i.createPacket(data, destAddr, tos, []byte{0, 0}, byte(1), []byte{0, 0}, ttl, proto)
-		i.l2Protocol.SendDown(packet, l2Address, nil, i.ip)
-	} else {
-		//Get the identifier to use
-		i.lock.Lock()
-		var identifier uint16
-		usedIdent, ok := i.ipIdentMap[string(destAddr)]
-		if ok {
-			identifier = usedIdent + 1
-		} else {
-			identifier = 1
-		}
-		i.ipIdentMap[string(destAddr)] = identifier
-		i.lock.Unlock()
-
-		//Create fragments and send
-		for totalBytesConsumed := 0; totalBytesConsumed < len(data); totalBytesConsumed += i.l2Protocol.GetMTU() - 20 {
-			//Flag indicates if this is the last fragment
-			flag := 0
-			if totalBytesConsumed+i.l2Protocol.GetMTU()-20 >= len(data) {
-				flag = 1
-			}
-
-			//Offset of bytes in this fragment
-			var offset = make([]byte, 2)
-			binary.BigEndian.PutUint16(offset, uint16(totalBytesConsumed))
-
-			var ident = make([]byte, 2)
-			binary.BigEndian.PutUint16(ident, identifier)
+	//Optional flags set by the L4 protocol
+	var dontFragment byte
+	if len(metadata) > 2 && !i.ip.isBlackHole(destAddr) {
+		dontFragment = metadata[2] & DontFragment
+	}
 
-			//Create and send the packet
-			endIndex := totalBytesConsumed + i.l2Protocol.GetMTU() - 20
-			if endIndex > len(data) {
-				endIndex = len(data)
+	//The hooks see the packet before it is fragmented. Every packet gets an identifier, since routers on the way may
+	//fragment it too.
+	packet := i.createPacket(data, destAddr, tos, i.newIdent(destAddr), lastFragment|dontFragment, []byte{0, 0}, ttl, proto)
+	intfNum := i.getInterfaceNum()
+	i.ip.runHooks(HookOutput, packet, -1, intfNum, func(packet []byte) {
+		//A hook which changed the destination may have changed the way out too
+		outIntf, outRoutes := i, routes
+		if !bytes.Equal(packet[16:20], destAddr) {
+			var outIntfNum int
+			outRoutes, outIntfNum = i.ip.lookupRoute(getRoutingKey(packet, -1))
+			if outIntfNum < 0 && isMulticastAddress(packet[16:20]) {
+				outIntfNum = 0
 			}
-			packet := i.createPacket(data[totalBytesConsumed:endIndex], destAddr, tos, ident, byte(flag), offset, ttl, proto)
-			i.l2Protocol.SendDown(packet, l2Address, nil, i.ip)
+			if outIntfNum < 0 {
+				log.Printf("IP: No route to %v. Dropping.", packet[16:20])
+				notifySender(protocol.ErrNetUnreachable, packet[20:], packet[12:16], packet[16:20], l4Protocol)
+				return
+			}
+			outIntf = i.ip.interfaces[outIntfNum]
 		}
-	}
-}
 
-func (i *ipInterface) cleanBuffers() {
-	i.lock.Lock()
-	now := time.Now()
+		i.ip.runHooks(HookPostrouting, packet, -1, outIntf.getInterfaceNum(), func(packet []byte) {
+			outIntf.send(packet, l4Protocol, outRoutes)
+		})
+	})
+}
 
-	var expiredKeys []uint64
-	for key, tracker := range i.buffer {
-		if tracker.lastFragmentAt.Add(identifierExpiryDuration).After(now) {
-			expiredKeys = append(expiredKeys, key)
-		}
+/*
+Fragments the packet if it does not fit, and sends it
+*/
+func (i *ipInterface) send(packet []byte, l4Protocol protocol.Protocol, routes protocol.RouteProvider) {
+	srcAddr := packet[12:16]
+	destAddr := packet[16:20]
+	data := packet[20:]
+	nextHopAddr := routes.GetGatewayForAddress(destAddr)
+	if nextHopAddr == nil {
+		nextHopAddr = destAddr
 	}
 
-	for _, k := range expiredKeys {
-		delete(i.buffer, k)
+	//Packets are sized to fit the whole path if its MTU is known. Broadcasts never leave the link, and multicasts go
+	//to many destinations.
+	mtu := i.l2Protocol.GetMTU() - i.ip.getHeaderOverhead()
+	if !isBroadcastAddress(destAddr) && !isMulticastAddress(destAddr) {
+		mtu = i.ip.getPathMTU(i.getInterfaceNum(), destAddr)
 	}
-	i.lock.Unlock()
-}
-
-func (i *ipInterface) isReadyForReassembly(tracker *fragmentTracker) (bool, [][]byte) {
-	maxDataPerPacket := 65536 - 20
-	maxDataPerFragment := i.l2Protocol.GetMTU() - 20
-	maxFragments := maxDataPerPacket / maxDataPerFragment
 
-	var sortedPackets = make([][]byte, maxFragments)
-	for _, packet := range tracker.packets {
-		offset := binary.BigEndian.Uint16(packet[7:9])
-		sortedPackets[int(offset)/maxDataPerFragment] = packet
+	//Fragmentation logic follows
+	var packets [][]byte
+	if len(packet) <= mtu {
+		packets = append(packets, packet)
+	} else if packet[6]&DontFragment != 0 {
+		log.Printf("IP: Packet too big to send without fragmentation. Dropping.")
+		notifySender(protocol.ErrFragmentationNeeded, data, srcAddr, destAddr, l4Protocol)
+		return
+	} else if packets = fragment(packet, mtu); packets == nil {
+		log.Printf("IP: MTU %d is too small to fragment packets. Dropping.", mtu)
+		notifySender(protocol.ErrFragmentationNeeded, data, srcAddr, destAddr, l4Protocol)
+		return
 	}
 
-	isReady := true
-	j := 0
-	for ; j < maxFragments; j++ {
-		if sortedPackets[j] == nil {
-			isReady = false
-			break
+	send := func(l2Address []byte) {
+		if l2Address == nil {
+			notifySender(protocol.ErrHostUnreachable, data, srcAddr, destAddr, l4Protocol)
+			return
 		}
-		if int(sortedPackets[j][6]) == 1 {
-			break
+		for _, packet := range packets {
+			i.l2Protocol.SendDown(i.ip.encode(packet), l2Address, nil, i.ip)
 		}
 	}
 
-	if !isReady {
-		return false, nil
+	//Broadcasts and multicasts do not need address resolution
+	if isBroadcastAddress(destAddr) {
+		send(l2BroadcastAddress)
+		return
 	}
-
-	return true, sortedPackets[:j+1]
+	if isMulticastAddress(destAddr) {
+		send(GroupMacAddress(destAddr))
+		return
+	}
+	i.ip.resolveAndSend(i.getInterfaceNum(), nextHopAddr, send)
 }
 
-func (i *ipInterface) reassemble(packet []byte) (bool, []byte) {
+/*
+Identifiers are counted per destination, which is enough to tell apart the fragments of the packets in flight to it
+*/
+func (i *ipInterface) newIdent(destAddr []byte) []byte {
 	i.lock.Lock()
 	defer i.lock.Unlock()
 
-	//Extract relevant info from packet
-	sourceAddr := packet[12:16]
-	ident := packet[4:6]
-
-	identifier := binary.BigEndian.Uint16(ident)
+	identifier := i.ipIdentMap[string(destAddr)] + 1
+	i.ipIdentMap[string(destAddr)] = identifier
 
-	//Return data if packet is un-fragmented
-	if identifier == 0 {
-		return true, packet[20:]
-	}
+	ident := make([]byte, 2)
+	binary.BigEndian.PutUint16(ident, identifier)
+	return ident
+}
 
-	//Add packet to buffer
-	key := i.getBufferKey(sourceAddr, ident)
-	tracker, ok := i.buffer[key]
-	if ok {
-		tracker.lastFragmentAt = time.Now()
-		tracker.packets = append(tracker.packets, packet)
-	} else {
-		tracker = &fragmentTracker{
-			lastFragmentAt: time.Now(),
-			packets:        [][]byte{packet},
+func (i *ipInterface) getInterfaceNum() int {
+	for n, intf := range i.ip.interfaces {
+		if intf == i {
+			return n
 		}
-		i.buffer[key] = tracker
-	}
-
-	//Check if all fragments have arrived
-	ready, packets := i.isReadyForReassembly(tracker)
-	if !ready {
-		return false, nil
 	}
 
-	//Reassemble
-	var data []byte
-	for _, p := range packets {
-		data = append(data, p[20:]...)
-	}
-	return true, data
+	return -1
 }
 
-func (i *ipInterface) getBufferKey(sourceAddr []byte, ident []byte) uint64 {
-	k := []byte{}
-	k = append(k, []byte{0, 0}...)
-	k = append(k, sourceAddr...)
-	k = append(k, ident...)
-	return binary.BigEndian.Uint64(k)
+func (i *ipInterface) createPacket(data []byte, destAddr []byte, tos byte, ident []byte, flags byte, offset []byte, ttl byte, proto []byte) []byte {
+	return createPacket(i.ip.version, data, i.getAddress(), destAddr, tos, ident, flags, offset, ttl, proto)
 }
 
-func (i *ipInterface) createPacket(data []byte, destAddr []byte, tos byte, ident []byte, flags byte, offset []byte, ttl byte, proto []byte) []byte {
+func createPacket(version []byte, data []byte, srcAddr []byte, destAddr []byte, tos byte, ident []byte, flags byte, offset []byte, ttl byte, proto []byte) []byte {
 	var packetLength = make([]byte, 2)
 	binary.BigEndian.PutUint16(packetLength, uint16(len(data)+20))
 
 	b := []byte{}
-	b = append(b, i.ip.version...)
+	b = append(b, version...)
 	b = append(b, tos)
 	b = append(b, packetLength...)
 	b = append(b, ident...)
@@ -432,18 +1036,10 @@ func (i *ipInterface) createPacket(data []byte, destAddr []byte, tos byte, ident
 	b = append(b, ttl)
 	b = append(b, proto...)
 	b = append(b, byte(0))
-	b = append(b, i.ipAddress...)
+	b = append(b, srcAddr...)
 	b = append(b, destAddr...)
 	b = append(b, data...)
 
 	b[11] = utils.CalculateChecksum(b[:20])[0]
 	return b
 }
-
-/*
-Internal struct to track fragments
-*/
-type fragmentTracker struct {
-	lastFragmentAt time.Time
-	packets        [][]byte
-}
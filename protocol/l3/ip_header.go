@@ -0,0 +1,165 @@
+package l3
+
+import (
+	"encoding/binary"
+	"netsim/utils"
+)
+
+/*
+IP can put its packets on the wire with the header defined in RFC 791 instead of its own, so that captures can be read
+by standard tools, and packets can be checked against real parsers. Inside IP, and for the raw consumer, packets always
+have our own header. They are converted when they leave the host, and packets received in either format are accepted,
+since the first byte tells them apart. Only the IP header changes; the protocols carried inside keep their own formats.
+
+Header Format (RFC 791):
+
+Version/IHL		- 1 byte, the version (4) in the upper 4 bits and the header length in units of 4 bytes in the lower
+TOS				- 1 byte, DSCP in the upper 6 bits and ECN in the lower 2
+Length			- 2 bytes
+Ident			- 2 bytes
+Flags/Offset	- 2 bytes, Don't Fragment (0x4000) and More Fragments (0x2000) followed by the offset in units of 8 bytes
+TTL				- 1 byte
+Protocol		- 1 byte
+Checksum		- 2 bytes, see utils.CalculateInternetChecksum
+SourceAddr		- 4 bytes
+DestinationAddr	- 4 bytes
+Options			- Up to 40 bytes, to make the header length a multiple of 4
+
+Options are sent after the address, see IP.SetHeaderOptions. Each is either a single byte, End of Option List (0) or No
+Operation (1), or a type byte, a length byte covering the whole option and the option data. Options whose type has the
+copied flag (0x80) set go in every fragment, and the others only in the first one. The options are padded with End of
+Option List to a multiple of 4 bytes. Options received are checked and dropped, since IP has no use for them. Fragment
+offsets are in units of 8 bytes, hence the data of every fragment but the last has to be a multiple of 8 bytes long.
+*/
+const (
+	HeaderFormatCustom = 0
+	HeaderFormatRfc791 = 1
+)
+
+const (
+	rfc791HeaderLength  = 20
+	rfc791Version       = 0x40
+	rfc791DontFragment  = 0x4000
+	rfc791MoreFragments = 0x2000
+	rfc791OffsetMask    = 0x1FFF
+	maxOptionsLength    = 40
+	optionEndOfList     = 0
+	optionNoOperation   = 1
+	optionCopied        = 0x80
+)
+
+/*
+Packets with our own header start with the version byte 0x04, and RFC 791 ones with 0x45 or more
+*/
+func isRfc791Packet(packet []byte) bool {
+	return len(packet) >= rfc791HeaderLength && packet[0]>>4 == 4 && packet[0]&0x0F >= 5
+}
+
+/*
+Converts a packet with our own header to one with an RFC 791 header, carrying the options given
+*/
+func toRfc791(packet []byte, options []byte) []byte {
+	flagsOffset := binary.BigEndian.Uint16(packet[7:9]) / 8
+	if packet[6]&DontFragment != 0 {
+		flagsOffset |= rfc791DontFragment
+	}
+	if packet[6]&lastFragment == 0 {
+		flagsOffset |= rfc791MoreFragments
+	}
+
+	if binary.BigEndian.Uint16(packet[7:9]) != 0 {
+		options = copiedOptions(options)
+	}
+
+	b := make([]byte, rfc791HeaderLength, rfc791HeaderLength+len(options))
+	b = append(b, options...)
+	b[0] = rfc791Version | byte(len(b)/4)
+	b[1] = packet[1]
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)+len(packet)-rfc791HeaderLength))
+	copy(b[4:6], packet[4:6])
+	binary.BigEndian.PutUint16(b[6:8], flagsOffset)
+	b[8] = packet[9]
+	b[9] = packet[10]
+	copy(b[12:16], packet[12:16])
+	copy(b[16:20], packet[16:20])
+	binary.BigEndian.PutUint16(b[10:12], utils.CalculateInternetChecksum(b))
+
+	return append(b, packet[20:]...)
+}
+
+/*
+Converts a packet with an RFC 791 header to one with our own header. Returns false if the packet is corrupted.
+*/
+func fromRfc791(packet []byte) ([]byte, bool) {
+	headerLength := int(packet[0]&0x0F) * 4
+	length := int(binary.BigEndian.Uint16(packet[2:4]))
+	if headerLength > len(packet) || length < headerLength || length > len(packet) {
+		return nil, false
+	}
+	if utils.CalculateInternetChecksum(packet[:headerLength]) != 0 || !isValidOptions(packet[rfc791HeaderLength:headerLength]) {
+		return nil, false
+	}
+
+	flagsOffset := binary.BigEndian.Uint16(packet[6:8])
+	var flags byte
+	if flagsOffset&rfc791DontFragment != 0 {
+		flags |= DontFragment
+	}
+	if flagsOffset&rfc791MoreFragments == 0 {
+		flags |= lastFragment
+	}
+
+	offset := make([]byte, 2)
+	binary.BigEndian.PutUint16(offset, (flagsOffset&rfc791OffsetMask)*8)
+
+	return createPacket(utils.HexStringToBytes("04"), packet[headerLength:length], packet[12:16], packet[16:20], packet[1], packet[4:6], flags, offset, packet[8], packet[9:10]), true
+}
+
+/*
+Checks that every option fits the options
+*/
+func isValidOptions(options []byte) bool {
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case optionEndOfList:
+			return true
+		case optionNoOperation:
+			i++
+		default:
+			if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+				return false
+			}
+			i += int(options[i+1])
+		}
+	}
+	return true
+}
+
+/*
+Returns the options which go in every fragment, padded. Expects the options to be valid.
+*/
+func copiedOptions(options []byte) []byte {
+	var copied []byte
+	for i := 0; i < len(options) && options[i] != optionEndOfList; {
+		if options[i] == optionNoOperation {
+			i++
+			continue
+		}
+		length := int(options[i+1])
+		if options[i]&optionCopied != 0 {
+			copied = append(copied, options[i:i+length]...)
+		}
+		i += length
+	}
+	return padOptions(copied)
+}
+
+/*
+Pads the options with End of Option List to a multiple of 4 bytes
+*/
+func padOptions(options []byte) []byte {
+	for len(options)%4 != 0 {
+		options = append(options, optionEndOfList)
+	}
+	return options
+}
@@ -0,0 +1,180 @@
+package l3
+
+import (
+	"bytes"
+	"log"
+	"netsim/hardware"
+	"netsim/protocol"
+	"netsim/protocol/l2"
+	"netsim/utils"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+Testcase
+*/
+func TestRfc791Header(t *testing.T) {
+	//A well known header, of a UDP packet from 192.168.0.1 to 192.168.0.199 with Don't Fragment set
+	expected := utils.HexStringToBytes("45000073000040004011b861c0a80001c0a800c7")
+	data := bytes.Repeat([]byte{0xAB}, 0x73-20)
+	packet := createPacket(utils.HexStringToBytes("04"), data, []byte{192, 168, 0, 1}, []byte{192, 168, 0, 199}, 0, []byte{0, 0}, lastFragment|DontFragment, []byte{0, 0}, 64, []byte{0x11})
+
+	encoded := toRfc791(packet, nil)
+	if !bytes.Equal(encoded[:20], expected) || !bytes.Equal(encoded[20:], data) {
+		t.Fatalf("Expected header %x but got %x", expected, encoded[:20])
+	}
+	if !isRfc791Packet(encoded) || isRfc791Packet(packet) {
+		t.Errorf("Expected the formats to be told apart")
+	}
+
+	decoded, ok := fromRfc791(encoded)
+	if !ok || !bytes.Equal(decoded, packet) {
+		t.Errorf("Expected the packet back but got %x", decoded)
+	}
+
+	//The offset is in units of 8 bytes and More Fragments is set on all fragments but the last
+	fragment := createPacket(utils.HexStringToBytes("04"), data, []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}, 0, []byte{0, 7}, 0, []byte{0x05, 0xC8}, 10, []byte{0x11})
+	encoded = toRfc791(fragment, nil)
+	if encoded[6] != 0x20 || encoded[7] != 0xB9 {
+		t.Errorf("Expected More Fragments and offset 185 but got %x", encoded[6:8])
+	}
+	decoded, ok = fromRfc791(encoded)
+	if !ok || !bytes.Equal(decoded, fragment) {
+		t.Errorf("Expected the fragment back but got %x", decoded)
+	}
+
+	//Options are dropped, and a wrong checksum is caught
+	withOptions := append(append([]byte{0x46}, expected[1:]...), 0x01, 0x01, 0x01, 0x00)
+	withOptions[3] += 4
+	withOptions[10], withOptions[11] = 0, 0
+	checksum := utils.CalculateInternetChecksum(withOptions)
+	withOptions[10], withOptions[11] = byte(checksum>>8), byte(checksum)
+	decoded, ok = fromRfc791(append(withOptions, data...))
+	if !ok || !bytes.Equal(decoded, packet) {
+		t.Errorf("Expected the packet without options but got %x", decoded)
+	}
+
+	encoded = toRfc791(packet, nil)
+	encoded[8]--
+	if _, ok := fromRfc791(encoded); ok {
+		t.Errorf("Expected the corrupted header to be rejected")
+	}
+
+	//Options lengthen the header, and only the copied ones go in fragments after the first
+	options := []byte{0x94, 0x04, 0x00, 0x00, 0x07, 0x03, 0x04, 0x00}
+	encoded = toRfc791(packet, options)
+	if encoded[0] != 0x47 || int(encoded[2])<<8|int(encoded[3]) != len(encoded) || !bytes.Equal(encoded[20:28], options) {
+		t.Errorf("Expected a header of 28 bytes with the options but got %x", encoded[:28])
+	}
+	if decoded, ok = fromRfc791(encoded); !ok || !bytes.Equal(decoded, packet) {
+		t.Errorf("Expected the packet with options back but got %x", decoded)
+	}
+	encoded = toRfc791(fragment, options)
+	if encoded[0] != 0x46 || !bytes.Equal(encoded[20:24], options[:4]) {
+		t.Errorf("Expected only the copied option in the fragment but got %x", encoded[:24])
+	}
+
+	//An option running past the header is caught
+	encoded = toRfc791(packet, []byte{0x07, 0x08, 0x04, 0x00})
+	if _, ok := fromRfc791(encoded); ok {
+		t.Errorf("Expected the header with a broken option to be rejected")
+	}
+}
+
+func TestRfc791HeaderOnTheWire(t *testing.T) {
+	routeProvider := &staticRouteProvider{}
+	addressResolver := &staticAddressResolver{}
+
+	node1 := newNode([]byte("immac1"), []byte{10, 0, 0, 1}, routeProvider, addressResolver)
+	node1.l3Protocol.(*IP).SetHeaderFormat(HeaderFormatRfc791)
+
+	//The frames are captured before IP gets them, and the packets after IP has accepted them
+	frames := &packetCollector{}
+	packets := &packetCollector{}
+	adapter := hardware.NewEthernetAdapter([]byte("immac2"), false)
+	ethernet := l2.NewEthernet(adapter, frames)
+	ip := NewIP([][]byte{{10, 0, 0, 2}}, false, packets, routeProvider, addressResolver)
+	ip.SetL2ProtocolForInterface(0, ethernet)
+	ethernet.AddL3Protocol(ip)
+
+	_ = hardware.NewLink(1, 1e9, 0.00, node1.l3Protocol.GetL2ProtocolForInterface(0).GetAdapter(), adapter)
+
+	go hardware.Clk.Start()
+	node1.l3Protocol.GetL2ProtocolForInterface(0).GetAdapter().TurnOn()
+	adapter.TurnOn()
+
+	log.Printf("Testcase: Sending packet with RFC 791 header")
+	node1.SendDown([]byte("this_is_a_test"), []byte{10, 0, 0, 2}, []byte{0, 5}, nil)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && packets.count() == 0; time.Sleep(50 * time.Millisecond) {
+	}
+
+	if packets.count() != 1 || frames.count() != 1 {
+		t.Fatalf("Expected the packet to be accepted but got %d packets", packets.count())
+	}
+	if frames.get(0)[24] != 0x45 || packets.get(0)[0] != 0x04 {
+		t.Errorf("Expected RFC 791 header on the wire and our own inside IP but got %x and %x", frames.get(0)[24], packets.get(0)[0])
+	}
+	if !bytes.Equal(packets.get(0)[20:], []byte("this_is_a_test")) {
+		t.Errorf("Expected the data intact but got %s", packets.get(0)[20:])
+	}
+
+	//The options take room from the fragments, and only the copied one is repeated in every fragment
+	log.Printf("Testcase: Sending fragments with options")
+	node1.l3Protocol.(*IP).SetHeaderOptions([]byte{0x94, 0x04, 0x00, 0x00, 0x07, 0x03, 0x04})
+	node1.l3Protocol.GetL2ProtocolForInterface(0).(*l2.Ethernet).SetMTU(200)
+	ethernet.SetMTU(200)
+	data := bytes.Repeat([]byte("0123456789"), 40)
+	node1.SendDown(data, []byte{10, 0, 0, 2}, []byte{0, 5}, nil)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && packets.count() < 4; time.Sleep(50 * time.Millisecond) {
+	}
+
+	if packets.count() != 4 || frames.count() != 4 {
+		t.Fatalf("Expected the packet in 3 fragments but got %d", packets.count()-1)
+	}
+	var received []byte
+	for i := 1; i < 4; i++ {
+		frame := frames.get(i)
+		expected := byte(0x46)
+		if i == 1 {
+			expected = 0x47
+		}
+		if frame[24] != expected || int(frame[26])<<8|int(frame[27]) > 200 {
+			t.Errorf("Expected header %x within the MTU but got %x of %d bytes", expected, frame[24], int(frame[26])<<8|int(frame[27]))
+		}
+		received = append(received, packets.get(i)[20:]...)
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("Expected the data intact in the fragments but got %d bytes", len(received))
+	}
+}
+
+/*
+Raw consumer keeping what it gets
+*/
+type packetCollector struct {
+	packets [][]byte
+	lock    sync.Mutex
+}
+
+func (c *packetCollector) SendUp(data []byte, metadata []byte, sender protocol.Protocol) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.packets = append(c.packets, append([]byte{}, data...))
+}
+
+func (c *packetCollector) count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.packets)
+}
+
+func (c *packetCollector) get(i int) []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.packets[i]
+}
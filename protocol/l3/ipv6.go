@@ -0,0 +1,651 @@
+package l3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"netsim/protocol"
+	"sync"
+	"time"
+)
+
+/*
+IPv6 is the successor of IP with 128 bit addresses. Unlike our IP, it follows the real packet format, since there is
+not much to simplify in it. It runs side by side with IP on the same L2 protocols, which tell them apart by the
+identifier, so that hosts and routers can be dual-stack.
+
+Packet Format:
+
+Version/Class/Flow	- 4 bytes, the version is in the upper 4 bits and the traffic class in the next 8
+PayloadLength		- 2 bytes
+NextHeader			- 1 byte
+HopLimit			- 1 byte
+SourceAddr			- 16 bytes
+DestinationAddr		- 16 bytes
+Extension headers	- Optional
+Data				- No fixed length
+
+There is no checksum in the header. Extension headers start with the next header (1 byte) and their length in units of
+8 bytes, not counting the first 8 (1 byte). Hop-by-hop options, routing and destination options headers are skipped on
+receiving. The fragment header has a fixed length:
+
+NextHeader	- 1 byte
+Reserved	- 1 byte
+Offset		- 2 bytes, in units of 8 bytes in the upper 13 bits, and the more fragments flag in the lowest bit
+Ident		- 4 bytes
+
+Only the source of a packet fragments it. A router which cannot send a packet on the next link drops it, and the source
+is told the MTU of the link with a Packet Too Big message. The source remembers it for the destination and sizes the
+packets it sends there to fit, see pmtu.go.
+Every interface has a link local address in fe80::/64 made from the MAC address of the interface. Other addresses are
+either given when creating the instance, or learnt from router advertisements, see NDP. Networks are always /64 long,
+hence the route for the network of every address is added to the routing table. Packets to link local and multicast
+addresses never leave the link, and are sent from the first interface unless the sender picks one. Multicast packets go
+to the MAC address made of 33:33 followed by the last 4 bytes of the group.
+*/
+const (
+	ipv6HeaderLength         = 40
+	ipv6FragmentHeaderLength = 8
+	ipv6PrefixLength         = 64
+	ipv6Version              = 6
+	nextHeaderHopByHop       = 0
+	nextHeaderRouting        = 43
+	nextHeaderFragment       = 44
+	nextHeaderNone           = 59
+	nextHeaderDestination    = 60
+	moreFragments            = 0x01
+)
+
+var (
+	AllNodesAddress     = []byte{0xFF, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	AllRoutersAddress   = []byte{0xFF, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}
+	linkLocalPrefix     = []byte{0xFE, 0x80, 0, 0, 0, 0, 0, 0}
+	solicitedNodePrefix = []byte{0xFF, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0xFF}
+	l2Ipv6Multicast     = []byte{0x33, 0x33}
+	unspecifiedIpv6     = make([]byte, 16)
+)
+
+type IPv6 struct {
+	forwardingMode bool
+	identifier     []byte
+	interfaces     []*ipv6Interface
+	l4Protocols    []protocol.L4Protocol
+	rawConsumer    protocol.FrameConsumer
+	routingTable   *RoutingTable
+	ndp            *NDP
+	nextIdent      uint32
+	reassembler    *reassembler
+	pathMTUs       *pathMTUCache
+	lock           sync.Mutex
+}
+
+/*
+Constructor. There is one address per interface, which can be nil for the interfaces which learn their addresses from
+router advertisements.
+*/
+func NewIPv6(ipAddresses [][]byte, forwardingMode bool, rawConsumer protocol.FrameConsumer, routingTable *RoutingTable) *IPv6 {
+	ip := &IPv6{
+		forwardingMode: forwardingMode,
+		identifier:     protocol.IPv6,
+		rawConsumer:    rawConsumer,
+		routingTable:   routingTable,
+		pathMTUs:       newPathMTUCache(minIPv6PathMTU),
+	}
+	ip.reassembler = newReassembler(func(firstFragment []byte) {
+		ip.sendError(protocol.ErrReassemblyTimeout, firstFragment, 0)
+	})
+
+	for i, ipAddr := range ipAddresses {
+		ip.interfaces = append(ip.interfaces, &ipv6Interface{})
+		if ipAddr != nil {
+			ip.AddAddressForInterface(i, ipAddr)
+		}
+	}
+	ip.ndp = newNDP(ip)
+
+	go ip.cleanBuffersPeriodically()
+	return ip
+}
+
+/*
+Next 3 methods make this an implementation of Protocol
+*/
+func (ip *IPv6) GetIdentifier() []byte {
+	return ip.identifier
+}
+
+func (ip *IPv6) SendDown(data []byte, destAddr []byte, metadata []byte, l4Protocol protocol.Protocol) {
+	intfNum := ip.getInterfaceForAddress(destAddr)
+	if intfNum < 0 {
+		log.Printf("IPv6: No route to %v. Dropping.", destAddr)
+		notifySender(protocol.ErrNetUnreachable, data, unspecifiedIpv6, destAddr, l4Protocol)
+		return
+	}
+
+	ip.SendDownOnInterface(intfNum, data, destAddr, metadata, l4Protocol)
+}
+
+func (ip *IPv6) SendUp(packet []byte, metadata []byte, source protocol.Protocol) {
+	if !ip.isValidPacket(packet) {
+		log.Printf("IPv6: Got corrupted packet")
+		return
+	}
+	packet = packet[:ipv6HeaderLength+int(binary.BigEndian.Uint16(packet[4:6]))]
+
+	if ip.rawConsumer != nil {
+		ip.rawConsumer.SendUp(packet, nil, ip)
+	}
+
+	intfNum := ip.getInterfaceNum(source)
+	if intfNum < 0 {
+		return
+	}
+
+	destAddr := packet[24:40]
+	if ip.isPacketForMe(intfNum, destAddr) {
+		ip.deliver(intfNum, packet)
+	} else if ip.forwardingMode && !isIpv6Multicast(destAddr) {
+		ip.forward(intfNum, packet)
+	}
+}
+
+/*
+Next 4 methods make this an implementation of L3Protocol. The address of an interface is its first address which is
+not link local, or the link local address if it has no other.
+*/
+func (ip *IPv6) SetL2ProtocolForInterface(intfNum int, l2Protocol protocol.L2Protocol) {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	intf := ip.interfaces[intfNum]
+	intf.l2Protocol = l2Protocol
+	mac := l2Protocol.GetAdapter().(hardwareAddressProvider).GetMacAddress()
+	intf.linkLocal = append(append([]byte{}, linkLocalPrefix...), interfaceIdentifier(mac)...)
+}
+
+func (ip *IPv6) GetL2ProtocolForInterface(intfNum int) protocol.L2Protocol {
+	return ip.interfaces[intfNum].l2Protocol
+}
+
+func (ip *IPv6) GetAddressForInterface(intfNum int) []byte {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	intf := ip.interfaces[intfNum]
+	if len(intf.addresses) > 0 {
+		return intf.addresses[0]
+	}
+	return intf.linkLocal
+}
+
+func (ip *IPv6) AddL4Protocol(l4Protocol protocol.L4Protocol) {
+	ip.l4Protocols = append(ip.l4Protocols, l4Protocol)
+}
+
+/*
+Next method makes this an implementation of InterfaceSender
+*/
+func (ip *IPv6) SendDownOnInterface(intfNum int, data []byte, destAddr []byte, metadata []byte, l4Protocol protocol.Protocol) {
+	var dontFragment bool
+	if len(metadata) > 2 {
+		dontFragment = metadata[2]&DontFragment != 0
+	}
+
+	srcAddr := ip.getSourceAddress(intfNum, destAddr)
+	ip.send(intfNum, data, srcAddr, destAddr, l4Protocol.GetIdentifier()[0], metadata[0], metadata[1], dontFragment, l4Protocol)
+}
+
+/*
+Next method makes this an implementation of ErrorReporter. The header of the packet is rebuilt from the metadata since
+L4 protocols only get the data.
+*/
+func (ip *IPv6) ReportError(err error, data []byte, metadata []byte, sender protocol.Protocol) {
+	packet := createIPv6Packet(data, metadata[0:16], metadata[16:32], sender.GetIdentifier()[0], 0, 0)
+	ip.sendError(err, packet, 0)
+}
+
+/*
+Next 2 methods make this an implementation of PathMTUProvider. The path MTU is never larger than the MTU of the interface
+the destination is reached through, and is 0 if there is no route to it.
+*/
+func (ip *IPv6) GetPathMTU(destAddr []byte) int {
+	intfNum := ip.getInterfaceForAddress(destAddr)
+	if intfNum < 0 {
+		return 0
+	}
+
+	return ip.getPathMTU(intfNum, destAddr)
+}
+
+/*
+Routers never fragment IPv6 packets, hence packets to a destination behind a black hole are sent at the smallest MTU
+*/
+func (ip *IPv6) ReportBlackHole(destAddr []byte) {
+	log.Printf("IPv6: Packets to %v are being lost. Sending them at the minimum MTU.", destAddr)
+	ip.pathMTUs.update(destAddr, minIPv6PathMTU, true)
+}
+
+/*
+IPv6 public API
+*/
+func (ip *IPv6) NumInterfaces() int {
+	return len(ip.interfaces)
+}
+
+/*
+Returns all the addresses of the interface, starting with the link local one
+*/
+func (ip *IPv6) GetAddressesForInterface(intfNum int) [][]byte {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	intf := ip.interfaces[intfNum]
+	addresses := [][]byte{intf.linkLocal}
+	return append(addresses, intf.addresses...)
+}
+
+func (ip *IPv6) GetLinkLocalAddress(intfNum int) []byte {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	return ip.interfaces[intfNum].linkLocal
+}
+
+/*
+Adds an address to the interface along with the route for its network. Adding an address the interface already has does
+nothing.
+*/
+func (ip *IPv6) AddAddressForInterface(intfNum int, ipAddr []byte) {
+	ip.lock.Lock()
+	intf := ip.interfaces[intfNum]
+	for _, addr := range intf.addresses {
+		if bytes.Equal(addr, ipAddr) {
+			ip.lock.Unlock()
+			return
+		}
+	}
+	intf.addresses = append(intf.addresses, ipAddr)
+	ip.lock.Unlock()
+
+	ip.routingTable.AddRoute(&Route{
+		Cidr:      &protocol.CIDR{Address: ipAddr, Mask: ipv6PrefixLength},
+		Interface: intfNum,
+		Distance:  DistanceConnected,
+	})
+}
+
+func (ip *IPv6) GetNDP() *NDP {
+	return ip.ndp
+}
+
+func (ip *IPv6) GetReassemblyStats() ReassemblyStats {
+	return ip.reassembler.getStats()
+}
+
+/*
+Sets how long a learnt path MTU is used before a larger one is tried again
+*/
+func (ip *IPv6) SetPathMTUAging(aging time.Duration) {
+	ip.pathMTUs.setAging(aging)
+}
+
+/*
+Returns the path MTUs which have been learnt and not aged out yet
+*/
+func (ip *IPv6) GetPathMTUCache() []PathMTU {
+	return ip.pathMTUs.list()
+}
+
+/*
+Internal methods
+*/
+func (ip *IPv6) isValidPacket(packet []byte) bool {
+	if len(packet) < ipv6HeaderLength || packet[0]>>4 != ipv6Version {
+		return false
+	}
+
+	return ipv6HeaderLength+int(binary.BigEndian.Uint16(packet[4:6])) <= len(packet)
+}
+
+func (ip *IPv6) isPacketForMe(intfNum int, destAddr []byte) bool {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	//Multicast packets are for the groups every node, or every router, is in, or the solicited-node groups of our addresses
+	if isIpv6Multicast(destAddr) {
+		if bytes.Equal(destAddr, AllNodesAddress) || (ip.forwardingMode && bytes.Equal(destAddr, AllRoutersAddress)) {
+			return true
+		}
+
+		intf := ip.interfaces[intfNum]
+		for _, addr := range append([][]byte{intf.linkLocal}, intf.addresses...) {
+			if bytes.Equal(destAddr, solicitedNodeAddress(addr)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, intf := range ip.interfaces {
+		if bytes.Equal(destAddr, intf.linkLocal) {
+			return true
+		}
+		for _, addr := range intf.addresses {
+			if bytes.Equal(destAddr, addr) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+/*
+Hands the data of the packet to the L4 protocol after skipping the extension headers and, if needed, reassembling it
+*/
+func (ip *IPv6) deliver(intfNum int, packet []byte) {
+	srcAddr := packet[8:24]
+	destAddr := packet[24:40]
+	nextHeader, offset, fragmentHeader := parseExtensionHeaders(packet)
+	if offset < 0 {
+		log.Printf("IPv6: Got packet with malformed extension headers. Dropping.")
+		return
+	}
+
+	data := packet[offset:]
+	if fragmentHeader != nil {
+		var ready bool
+		ready, data = ip.reassemble(packet, fragmentHeader, data)
+		if !ready {
+			return
+		}
+	}
+
+	if nextHeader == protocol.ICMPv6[0] {
+		ip.handleIcmp(intfNum, srcAddr, destAddr, packet[7], data)
+		return
+	}
+	if nextHeader == nextHeaderNone {
+		return
+	}
+
+	ipMetadata := []byte{}
+	ipMetadata = append(ipMetadata, srcAddr...)
+	ipMetadata = append(ipMetadata, destAddr...)
+	ipMetadata = append(ipMetadata, byte(intfNum))
+
+	for _, l4P := range ip.l4Protocols {
+		if l4P.GetIdentifier()[0] == nextHeader {
+			l4P.SendUp(data, ipMetadata, ip)
+			return
+		}
+	}
+
+	log.Printf("IPv6: Got unrecognized next header: %v", nextHeader)
+	ip.sendError(protocol.ErrProtocolUnreachable, createIPv6Packet(data, srcAddr, destAddr, nextHeader, 0, packet[7]), 0)
+}
+
+func (ip *IPv6) forward(intfNum int, packet []byte) {
+	srcAddr := packet[8:24]
+	destAddr := packet[24:40]
+
+	//Link local packets never leave the link
+	if isLinkLocal(srcAddr) || isLinkLocal(destAddr) {
+		return
+	}
+
+	//Copy the packet
+	newPacket := make([]byte, len(packet))
+	copy(newPacket, packet)
+
+	//If the hop limit is reached, then drop the packet and tell the sender
+	hopLimit := int(newPacket[7]) - 1
+	if hopLimit <= 0 {
+		ip.sendError(protocol.ErrTTLExceeded, packet, 0)
+		return
+	}
+	newPacket[7] = byte(hopLimit)
+
+	//Get the interface through which the packet has to leave
+	route, err := ip.routingTable.Lookup(destAddr)
+	if err != nil {
+		ip.sendError(protocol.ErrNetUnreachable, packet, 0)
+		return
+	}
+
+	//If incoming interface is same as outgoing interface, then drop the packet
+	if route.Interface == intfNum {
+		return
+	}
+
+	//Routers never fragment. The source has to send smaller packets.
+	mtu := ip.interfaces[route.Interface].l2Protocol.GetMTU()
+	if len(newPacket) > mtu {
+		ip.sendError(protocol.ErrFragmentationNeeded, packet, mtu)
+		return
+	}
+
+	//The destination is the next hop if it is on a directly connected network
+	nextHopAddr := route.Gateway
+	if nextHopAddr == nil {
+		nextHopAddr = destAddr
+	}
+
+	l2Protocol := ip.interfaces[route.Interface].l2Protocol
+	ip.ndp.Request(nextHopAddr, route.Interface, func(l2Address []byte) {
+		if l2Address == nil {
+			ip.sendError(protocol.ErrHostUnreachable, packet, 0)
+			return
+		}
+		l2Protocol.SendDown(newPacket, l2Address, nil, ip)
+	})
+}
+
+/*
+Sends the data from this host, in fragments if it does not fit the path
+*/
+func (ip *IPv6) send(intfNum int, data []byte, srcAddr []byte, destAddr []byte, nextHeader byte, trafficClass byte, hopLimit byte, dontFragment bool, l4Protocol protocol.Protocol) {
+	l2Protocol := ip.interfaces[intfNum].l2Protocol
+	mtu := l2Protocol.GetMTU()
+	if !isIpv6Multicast(destAddr) {
+		mtu = ip.getPathMTU(intfNum, destAddr)
+	}
+
+	var packets [][]byte
+	if ipv6HeaderLength+len(data) <= mtu {
+		packets = append(packets, createIPv6Packet(data, srcAddr, destAddr, nextHeader, trafficClass, hopLimit))
+	} else if dontFragment {
+		log.Printf("IPv6: Packet too big to send without fragmentation. Dropping.")
+		notifySender(protocol.ErrFragmentationNeeded, data, srcAddr, destAddr, l4Protocol)
+		return
+	} else {
+		ident := ip.newIdent()
+		maxDataPerFragment := (mtu - ipv6HeaderLength - ipv6FragmentHeaderLength) / 8 * 8
+		if maxDataPerFragment <= 0 {
+			log.Printf("IPv6: MTU %d is too small to fragment packets. Dropping.", mtu)
+			notifySender(protocol.ErrFragmentationNeeded, data, srcAddr, destAddr, l4Protocol)
+			return
+		}
+		for offset := 0; offset < len(data); offset += maxDataPerFragment {
+			end := offset + maxDataPerFragment
+			flags := uint16(moreFragments)
+			if end >= len(data) {
+				end = len(data)
+				flags = 0
+			}
+
+			fragment := make([]byte, ipv6FragmentHeaderLength)
+			fragment[0] = nextHeader
+			binary.BigEndian.PutUint16(fragment[2:4], uint16(offset/8)<<3|flags)
+			binary.BigEndian.PutUint32(fragment[4:8], ident)
+			fragment = append(fragment, data[offset:end]...)
+			packets = append(packets, createIPv6Packet(fragment, srcAddr, destAddr, nextHeaderFragment, trafficClass, hopLimit))
+		}
+	}
+
+	//Multicast packets need no resolution
+	if isIpv6Multicast(destAddr) {
+		for _, p := range packets {
+			l2Protocol.SendDown(p, multicastMacAddress(destAddr), nil, ip)
+		}
+		return
+	}
+
+	//The destination is the next hop if it is on the link
+	var nextHopAddr []byte
+	if !isLinkLocal(destAddr) {
+		nextHopAddr = ip.routingTable.GetGatewayForAddress(destAddr)
+	}
+	if nextHopAddr == nil {
+		nextHopAddr = destAddr
+	}
+
+	ip.ndp.Request(nextHopAddr, intfNum, func(l2Address []byte) {
+		if l2Address == nil {
+			notifySender(protocol.ErrHostUnreachable, data, srcAddr, destAddr, l4Protocol)
+			return
+		}
+		for _, p := range packets {
+			l2Protocol.SendDown(p, l2Address, nil, ip)
+		}
+	})
+}
+
+/*
+Returns the reassembled data once all fragments of the packet have arrived. Fragments belong to the same packet if they
+have the same addresses and identifier.
+*/
+func (ip *IPv6) reassemble(packet []byte, fragmentHeader []byte, data []byte) (bool, []byte) {
+	offset := int(binary.BigEndian.Uint16(fragmentHeader[2:4])>>3) * 8
+	isLast := fragmentHeader[3]&moreFragments == 0
+	key := string(packet[8:40]) + string(fragmentHeader[4:8])
+	return ip.reassembler.add(key, offset, data, isLast, packet)
+}
+
+func (ip *IPv6) getPathMTU(intfNum int, destAddr []byte) int {
+	mtu := ip.interfaces[intfNum].l2Protocol.GetMTU()
+	if entry := ip.pathMTUs.get(destAddr); entry != nil && entry.MTU < mtu {
+		mtu = entry.MTU
+	}
+	return mtu
+}
+
+func (ip *IPv6) newIdent() uint32 {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	ip.nextIdent++
+	return ip.nextIdent
+}
+
+/*
+Link local and multicast addresses have no routes, hence they are reached from the first interface
+*/
+func (ip *IPv6) getInterfaceForAddress(destAddr []byte) int {
+	if isLinkLocal(destAddr) || isIpv6Multicast(destAddr) {
+		return 0
+	}
+
+	return ip.routingTable.GetInterfaceForAddress(destAddr)
+}
+
+func (ip *IPv6) getSourceAddress(intfNum int, destAddr []byte) []byte {
+	if isLinkLocal(destAddr) || isIpv6Multicast(destAddr) {
+		return ip.GetLinkLocalAddress(intfNum)
+	}
+
+	return ip.GetAddressForInterface(intfNum)
+}
+
+func (ip *IPv6) getInterfaceNum(source protocol.Protocol) int {
+	for i, intf := range ip.interfaces {
+		if source == intf.l2Protocol {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (ip *IPv6) cleanBuffersPeriodically() {
+	for {
+		time.Sleep(reassemblyCheckInterval)
+		ip.reassembler.expire()
+	}
+}
+
+func createIPv6Packet(data []byte, srcAddr []byte, destAddr []byte, nextHeader byte, trafficClass byte, hopLimit byte) []byte {
+	b := make([]byte, ipv6HeaderLength)
+	binary.BigEndian.PutUint32(b[0:4], uint32(ipv6Version)<<28|uint32(trafficClass)<<20)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(data)))
+	b[6] = nextHeader
+	b[7] = hopLimit
+	copy(b[8:24], srcAddr)
+	copy(b[24:40], destAddr)
+	return append(b, data...)
+}
+
+/*
+Walks the extension headers of the packet. Returns the header of the data, where the data starts and the fragment header
+if there is one. The offset is negative if the headers are malformed.
+*/
+func parseExtensionHeaders(packet []byte) (byte, int, []byte) {
+	nextHeader := packet[6]
+	offset := ipv6HeaderLength
+	var fragmentHeader []byte
+
+	for {
+		switch nextHeader {
+		case nextHeaderHopByHop, nextHeaderRouting, nextHeaderDestination:
+			if offset+2 > len(packet) {
+				return 0, -1, nil
+			}
+			nextHeader = packet[offset]
+			offset += (int(packet[offset+1]) + 1) * 8
+		case nextHeaderFragment:
+			if offset+ipv6FragmentHeaderLength > len(packet) {
+				return 0, -1, nil
+			}
+			fragmentHeader = packet[offset : offset+ipv6FragmentHeaderLength]
+			nextHeader = packet[offset]
+			offset += ipv6FragmentHeaderLength
+		default:
+			if offset > len(packet) {
+				return 0, -1, nil
+			}
+			return nextHeader, offset, fragmentHeader
+		}
+	}
+}
+
+/*
+The interface identifier is the MAC address with FF:FE in the middle and the universal/local bit flipped (EUI-64)
+*/
+func interfaceIdentifier(mac []byte) []byte {
+	return []byte{mac[0] ^ 0x02, mac[1], mac[2], 0xFF, 0xFE, mac[3], mac[4], mac[5]}
+}
+
+func solicitedNodeAddress(addr []byte) []byte {
+	return append(append([]byte{}, solicitedNodePrefix...), addr[13:16]...)
+}
+
+func multicastMacAddress(addr []byte) []byte {
+	return append(append([]byte{}, l2Ipv6Multicast...), addr[12:16]...)
+}
+
+func isLinkLocal(addr []byte) bool {
+	return addr[0] == 0xFE && addr[1]&0xC0 == 0x80
+}
+
+func isIpv6Multicast(addr []byte) bool {
+	return addr[0] == 0xFF
+}
+
+/*
+Per-interface struct
+*/
+type ipv6Interface struct {
+	linkLocal  []byte
+	addresses  [][]byte
+	l2Protocol protocol.L2Protocol
+}
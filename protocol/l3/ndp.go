@@ -0,0 +1,463 @@
+package l3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"netsim/protocol"
+	"sync"
+	"time"
+)
+
+/*
+NDP (Neighbor Discovery Protocol) does for IPv6 what ARP does for IP, and a bit more. Its messages are ICMPv6 messages,
+hence every IPv6 instance has its own NDP.
+To resolve an address, a Neighbor Solicitation is sent to the solicited-node multicast group of the address, which only
+the hosts having an address ending with the same 3 bytes are in. The owner of the address replies with a Neighbor
+Advertisement carrying its MAC address. Like with ARP, answers are cached for a while, and the packets waiting for one
+are queued and dropped if no answer arrives after a few retries.
+Routers send Router Advertisements on their interfaces periodically, and whenever a host asks for one with a Router
+Solicitation. An advertisement carries the prefixes of the addresses of the router on the link. A host which hears one
+forms an address on every prefix from its MAC address (SLAAC) and adds a default route through the router, which is
+removed if the router is not heard from for the lifetime it advertised. Hosts keep soliciting on the interfaces they
+know no router on.
+Duplicate address detection is not done, since addresses made from MAC addresses are unique anyway. Messages are sent
+with a hop limit of 255, and messages received with a lower one are dropped, since they came from another link.
+
+Message Format (the body of the ICMPv6 message):
+
+Router Solicitation		- Reserved (4 bytes), Options
+Router Advertisement	- HopLimit (1 byte), Flags (1 byte), Lifetime in seconds (2 bytes), Reachable (4 bytes), Retransmit (4 bytes), Options
+Neighbor Solicitation	- Reserved (4 bytes), Target (16 bytes), Options
+Neighbor Advertisement	- Flags (1 byte), Reserved (3 bytes), Target (16 bytes), Options
+
+Options start with their type (1 byte) and length in units of 8 bytes (1 byte). The options used are the source (1) and
+target (2) link-layer addresses, which hold a MAC address, and the prefix information (3):
+
+PrefixLength		- 1 byte
+Flags				- 1 byte, on-link (0x80) and autonomous address configuration (0x40)
+ValidLifetime		- 4 bytes
+PreferredLifetime	- 4 bytes
+Reserved			- 4 bytes
+Prefix				- 16 bytes
+*/
+const (
+	defaultNdpCacheExpiry            = 300 * time.Second
+	defaultAdvertisementInterval     = 10 * time.Second
+	ndpSolicitationInterval          = 4 * time.Second
+	ndpTimerInterval                 = 100 * time.Millisecond
+	ndpRetryInterval                 = 1 * time.Second
+	ndpMaxRetries                    = 3
+	ndpMaxQueuedPackets              = 10
+	ndpHopLimit                      = 255
+	ndpOptionSourceLinkLayerAddress  = 1
+	ndpOptionTargetLinkLayerAddress  = 2
+	ndpOptionPrefixInformation       = 3
+	ndpPrefixFlagOnLink              = 0x80
+	ndpPrefixFlagAutonomous          = 0x40
+	ndpAdvertisementFlagRouter       = 0x80
+	ndpAdvertisementFlagSolicited    = 0x40
+	ndpAdvertisementFlagOverride     = 0x20
+	ndpInfiniteLifetime              = 0xFFFFFFFF
+	ndpRouterLifetimeFactor          = 3
+	ndpNeighborMessageLength         = 20
+	ndpRouterAdvertisementBodyLength = 12
+)
+
+type NDP struct {
+	ip                    *IPv6
+	cache                 map[string]*ndpEntry
+	pending               map[string]*ndpPendingRequest
+	routers               map[string]*ndpRouter
+	cacheExpiry           time.Duration
+	advertisementInterval time.Duration
+	lock                  sync.Mutex
+}
+
+func newNDP(ip *IPv6) *NDP {
+	n := &NDP{
+		ip:                    ip,
+		cache:                 map[string]*ndpEntry{},
+		pending:               map[string]*ndpPendingRequest{},
+		routers:               map[string]*ndpRouter{},
+		cacheExpiry:           defaultNdpCacheExpiry,
+		advertisementInterval: defaultAdvertisementInterval,
+	}
+
+	go n.run()
+	return n
+}
+
+/*
+Next 2 methods make this an implementation of AddressResolver and DynamicAddressResolver
+*/
+func (n *NDP) Resolve(ipAddr []byte) []byte {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	entry, ok := n.cache[string(ipAddr)]
+	if !ok || entry.expiresAt.Before(time.Now()) {
+		return nil
+	}
+
+	return entry.hwAddr
+}
+
+func (n *NDP) Request(ipAddr []byte, intfNum int, onResolved func([]byte)) {
+	hwAddr := n.Resolve(ipAddr)
+	if hwAddr != nil {
+		onResolved(hwAddr)
+		return
+	}
+
+	n.lock.Lock()
+	pending, ok := n.pending[string(ipAddr)]
+	if ok {
+		if len(pending.callbacks) < ndpMaxQueuedPackets {
+			pending.callbacks = append(pending.callbacks, onResolved)
+		} else {
+			log.Printf("NDP: Too many packets waiting for %v. Dropping.", ipAddr)
+		}
+		n.lock.Unlock()
+		return
+	}
+
+	n.pending[string(ipAddr)] = &ndpPendingRequest{
+		callbacks: []func([]byte){onResolved},
+	}
+	n.lock.Unlock()
+
+	go n.sendSolicitations(ipAddr, intfNum)
+}
+
+/*
+NDP public API
+*/
+func (n *NDP) SetCacheExpiry(expiry time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.cacheExpiry = expiry
+}
+
+/*
+Sets how often a router advertises itself. Hosts keep the routers for 3 times the interval.
+*/
+func (n *NDP) SetAdvertisementInterval(interval time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.advertisementInterval = interval
+}
+
+/*
+Returns the link local addresses of the routers a host has heard from on the interface
+*/
+func (n *NDP) GetRouters(intfNum int) [][]byte {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	var routers [][]byte
+	for _, r := range n.routers {
+		if r.intfNum == intfNum {
+			routers = append(routers, r.addr)
+		}
+	}
+	return routers
+}
+
+/*
+Internal methods
+*/
+func (n *NDP) handle(intfNum int, srcAddr []byte, destAddr []byte, hopLimit byte, message []byte) {
+	if hopLimit != ndpHopLimit {
+		log.Printf("NDP: Got message from another link. Dropping.")
+		return
+	}
+
+	body := message[icmpv6HeaderLength:]
+	switch message[0] {
+	case Icmpv6RouterSolicitation:
+		if n.ip.forwardingMode && len(body) >= 4 {
+			n.learn(srcAddr, body[4:], ndpOptionSourceLinkLayerAddress, true)
+			n.sendAdvertisement(intfNum, srcAddr)
+		}
+	case Icmpv6RouterAdvertisement:
+		if !n.ip.forwardingMode && len(body) >= ndpRouterAdvertisementBodyLength {
+			n.learn(srcAddr, body[ndpRouterAdvertisementBodyLength:], ndpOptionSourceLinkLayerAddress, true)
+			n.handleAdvertisement(intfNum, srcAddr, body)
+		}
+	case Icmpv6NeighborSolicitation:
+		if len(body) < ndpNeighborMessageLength {
+			return
+		}
+		target := body[4:20]
+		if !n.hasAddress(intfNum, target) {
+			return
+		}
+
+		//The sender is very likely to talk to us, hence it is learnt
+		n.learn(srcAddr, body[ndpNeighborMessageLength:], ndpOptionSourceLinkLayerAddress, true)
+		n.sendNeighborAdvertisement(intfNum, srcAddr, target)
+	case Icmpv6NeighborAdvertisement:
+		if len(body) >= ndpNeighborMessageLength {
+			n.learn(body[4:20], body[ndpNeighborMessageLength:], ndpOptionTargetLinkLayerAddress, false)
+		}
+	}
+}
+
+/*
+Updates the cache entry for the address from the link-layer address option. Entries are created only if asked to, or if
+someone is waiting for the address.
+*/
+func (n *NDP) learn(ipAddr []byte, options []byte, optionType byte, create bool) {
+	hwAddr := findOption(options, optionType)
+	if hwAddr == nil || isUnspecifiedAddress(ipAddr) {
+		return
+	}
+	hwAddr = hwAddr[:6]
+
+	n.lock.Lock()
+	_, known := n.cache[string(ipAddr)]
+	pending, waiting := n.pending[string(ipAddr)]
+	if known || waiting || create {
+		n.cache[string(ipAddr)] = &ndpEntry{
+			hwAddr:    append([]byte{}, hwAddr...),
+			expiresAt: time.Now().Add(n.cacheExpiry),
+		}
+	}
+	delete(n.pending, string(ipAddr))
+	n.lock.Unlock()
+
+	if waiting {
+		for _, c := range pending.callbacks {
+			c(hwAddr)
+		}
+	}
+}
+
+/*
+Configures an address on every prefix which allows it, and keeps the router as a default router for its lifetime
+*/
+func (n *NDP) handleAdvertisement(intfNum int, routerAddr []byte, body []byte) {
+	options := body[ndpRouterAdvertisementBodyLength:]
+	for len(options) >= 2 && options[1] > 0 && len(options) >= int(options[1])*8 {
+		option := options[:int(options[1])*8]
+		options = options[len(option):]
+		if option[0] != ndpOptionPrefixInformation || len(option) < 32 {
+			continue
+		}
+
+		prefixLength := int(option[2])
+		if option[3]&ndpPrefixFlagAutonomous == 0 || prefixLength != ipv6PrefixLength {
+			continue
+		}
+
+		mac := n.ip.GetL2ProtocolForInterface(intfNum).GetAdapter().(hardwareAddressProvider).GetMacAddress()
+		addr := append(append([]byte{}, option[16:24]...), interfaceIdentifier(mac)...)
+		n.ip.AddAddressForInterface(intfNum, addr)
+	}
+
+	route := &Route{
+		Cidr:      protocol.DefaultRouteCidrIPv6,
+		Gateway:   append([]byte{}, routerAddr...),
+		Interface: intfNum,
+		Distance:  DistanceStatic,
+	}
+	lifetime := time.Duration(binary.BigEndian.Uint16(body[2:4])) * time.Second
+	key := string(routerAddr) + string(rune(intfNum))
+
+	n.lock.Lock()
+	if lifetime == 0 {
+		delete(n.routers, key)
+	} else {
+		n.routers[key] = &ndpRouter{
+			addr:      route.Gateway,
+			intfNum:   intfNum,
+			route:     route,
+			expiresAt: time.Now().Add(lifetime),
+		}
+	}
+	n.lock.Unlock()
+
+	if lifetime == 0 {
+		n.ip.routingTable.RemoveRoute(route)
+	} else {
+		n.ip.routingTable.AddRoute(route)
+	}
+}
+
+/*
+Advertises the prefixes of the addresses of the router on the interface
+*/
+func (n *NDP) sendAdvertisement(intfNum int, destAddr []byte) {
+	n.lock.Lock()
+	lifetime := n.advertisementInterval * ndpRouterLifetimeFactor
+	n.lock.Unlock()
+
+	body := make([]byte, ndpRouterAdvertisementBodyLength)
+	body[0] = icmpv6HopLimit
+	binary.BigEndian.PutUint16(body[2:4], uint16((lifetime+time.Second-1)/time.Second))
+	body = append(body, n.linkLayerAddressOption(intfNum, ndpOptionSourceLinkLayerAddress)...)
+
+	addresses := n.ip.GetAddressesForInterface(intfNum)
+	for _, addr := range addresses[1:] {
+		option := make([]byte, 32)
+		option[0] = ndpOptionPrefixInformation
+		option[1] = 4
+		option[2] = ipv6PrefixLength
+		option[3] = ndpPrefixFlagOnLink | ndpPrefixFlagAutonomous
+		binary.BigEndian.PutUint32(option[4:8], ndpInfiniteLifetime)
+		binary.BigEndian.PutUint32(option[8:12], ndpInfiniteLifetime)
+		copy(option[16:24], addr[0:8])
+		body = append(body, option...)
+	}
+
+	n.ip.sendIcmp(intfNum, destAddr, Icmpv6RouterAdvertisement, 0, body, ndpHopLimit)
+}
+
+func (n *NDP) sendNeighborAdvertisement(intfNum int, destAddr []byte, target []byte) {
+	body := make([]byte, 4)
+	body[0] = ndpAdvertisementFlagSolicited | ndpAdvertisementFlagOverride
+	if n.ip.forwardingMode {
+		body[0] |= ndpAdvertisementFlagRouter
+	}
+	body = append(body, target...)
+	body = append(body, n.linkLayerAddressOption(intfNum, ndpOptionTargetLinkLayerAddress)...)
+
+	n.ip.sendIcmp(intfNum, destAddr, Icmpv6NeighborAdvertisement, 0, body, ndpHopLimit)
+}
+
+func (n *NDP) sendSolicitations(ipAddr []byte, intfNum int) {
+	body := make([]byte, 4)
+	body = append(body, ipAddr...)
+	body = append(body, n.linkLayerAddressOption(intfNum, ndpOptionSourceLinkLayerAddress)...)
+
+	for i := 0; i < ndpMaxRetries; i++ {
+		n.ip.sendIcmp(intfNum, solicitedNodeAddress(ipAddr), Icmpv6NeighborSolicitation, 0, body, ndpHopLimit)
+		time.Sleep(ndpRetryInterval)
+
+		n.lock.Lock()
+		_, stillPending := n.pending[string(ipAddr)]
+		n.lock.Unlock()
+		if !stillPending {
+			return
+		}
+	}
+
+	n.lock.Lock()
+	pending, ok := n.pending[string(ipAddr)]
+	delete(n.pending, string(ipAddr))
+	n.lock.Unlock()
+	if !ok {
+		return
+	}
+
+	log.Printf("NDP: Could not resolve %v. Dropping queued packets.", ipAddr)
+	for _, c := range pending.callbacks {
+		c(nil)
+	}
+}
+
+/*
+Routers advertise themselves periodically. Hosts solicit advertisements on the interfaces they know no router on, and
+forget the routers whose lifetime is over.
+*/
+func (n *NDP) run() {
+	var nextAdvertisement, nextSolicitation time.Time
+	for {
+		time.Sleep(ndpTimerInterval)
+		now := time.Now()
+
+		n.lock.Lock()
+		interval := n.advertisementInterval
+		n.lock.Unlock()
+
+		if n.ip.forwardingMode {
+			if now.After(nextAdvertisement) {
+				for i := 0; i < n.ip.NumInterfaces(); i++ {
+					if n.ip.GetL2ProtocolForInterface(i) != nil {
+						n.sendAdvertisement(i, AllNodesAddress)
+					}
+				}
+				nextAdvertisement = now.Add(interval)
+			}
+			continue
+		}
+
+		for _, route := range n.removeExpiredRouters(now) {
+			n.ip.routingTable.RemoveRoute(route)
+		}
+
+		if now.After(nextSolicitation) {
+			for i := 0; i < n.ip.NumInterfaces(); i++ {
+				if n.ip.GetL2ProtocolForInterface(i) != nil && len(n.GetRouters(i)) == 0 {
+					body := make([]byte, 4)
+					body = append(body, n.linkLayerAddressOption(i, ndpOptionSourceLinkLayerAddress)...)
+					n.ip.sendIcmp(i, AllRoutersAddress, Icmpv6RouterSolicitation, 0, body, ndpHopLimit)
+				}
+			}
+			nextSolicitation = now.Add(ndpSolicitationInterval)
+		}
+	}
+}
+
+func (n *NDP) removeExpiredRouters(now time.Time) []*Route {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	var expired []*Route
+	for key, r := range n.routers {
+		if r.expiresAt.Before(now) {
+			log.Printf("NDP: Router %v timed out", r.addr)
+			expired = append(expired, r.route)
+			delete(n.routers, key)
+		}
+	}
+	return expired
+}
+
+func (n *NDP) hasAddress(intfNum int, ipAddr []byte) bool {
+	for _, addr := range n.ip.GetAddressesForInterface(intfNum) {
+		if bytes.Equal(addr, ipAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *NDP) linkLayerAddressOption(intfNum int, optionType byte) []byte {
+	mac := n.ip.GetL2ProtocolForInterface(intfNum).GetAdapter().(hardwareAddressProvider).GetMacAddress()
+	return append([]byte{optionType, 1}, mac...)
+}
+
+/*
+Returns the value of the first option of the type, or nil if there is none
+*/
+func findOption(options []byte, optionType byte) []byte {
+	for len(options) >= 2 && options[1] > 0 && len(options) >= int(options[1])*8 {
+		length := int(options[1]) * 8
+		if options[0] == optionType {
+			return options[2:length]
+		}
+		options = options[length:]
+	}
+	return nil
+}
+
+//Internal structs
+type ndpEntry struct {
+	hwAddr    []byte
+	expiresAt time.Time
+}
+
+type ndpPendingRequest struct {
+	callbacks []func([]byte)
+}
+
+type ndpRouter struct {
+	addr      []byte
+	intfNum   int
+	route     *Route
+	expiresAt time.Time
+}
@@ -0,0 +1,215 @@
+package l3
+
+import (
+	"encoding/binary"
+	"log"
+	"netsim/protocol"
+	"netsim/utils"
+	"sort"
+)
+
+/*
+Hooks let other modules look at and act on the packets passing through IP, like the netfilter hooks of Linux. NAT,
+firewalls, traffic accounting and tunnels are built by registering hooks, instead of changing the forwarding code.
+There are 5 points a packet can be hooked at:
+1. Prerouting	- Every valid packet received, before IP decides whether it is for this host or has to be forwarded
+2. Input		- Packets for this host, once all of their fragments have arrived, before they go to the L4 protocol
+3. Forward		- Packets being forwarded, once the outgoing interface is known
+4. Output		- Packets sent by the L4 protocols of this host, before they are fragmented
+5. Postrouting	- Every packet about to leave, forwarded or sent by this host, right before it is sent
+
+Hooks see packets in the header format of this package, whichever format they are received or sent in. Forwarded
+packets are seen fragment by fragment, since routers do not reassemble them, unless connections are tracked, see
+defrag.go. Multicasts forwarded by a router do not go through the hooks.
+Each hook point has a chain of hooks, run in the order of their priority, lowest first. Hooks with the same priority
+run in the order they were registered. Every hook returns a verdict for the packet:
+1. Accept	- The packet goes on to the next hook unchanged
+2. Drop		- The packet is dropped quietly, and the hooks after this one never see it
+3. Modify	- The hook has changed or replaced the packet, and IP fixes the length and checksum in its header
+4. Queue	- The hook keeps the packet, and hands it back later using Reinject
+
+Queueing is meant for hooks which have to wait for something before they can decide. A queued packet carries on after
+the hook which queued it in the chain as it is when the packet is handed back, so hooks can come and go in the meantime.
+The destination of a packet can only be changed at prerouting, before the packet is routed, or at output, after which
+the packet is routed again. Changes to it at the later points do not change where the packet goes.
+*/
+const (
+	HookPrerouting = iota
+	HookInput
+	HookForward
+	HookOutput
+	HookPostrouting
+	numHooks
+)
+
+const (
+	VerdictAccept = iota
+	VerdictDrop
+	VerdictModify
+	VerdictQueue
+)
+
+/*
+Priorities of the usual kinds of hooks, so that destinations are translated before packets are filtered, and sources
+after. Connections are tracked before anything else but putting fragments back together, and confirmed after everything
+but the queueing for quality of service, which holds packets back right before they are sent.
+*/
+const (
+	PriorityDefrag           = -400
+	PriorityConntrack        = -200
+	PriorityNatDst           = -100
+	PriorityFilter           = 0
+	PriorityNatSrc           = 100
+	PriorityConntrackConfirm = 300
+	PriorityQos              = 400
+)
+
+/*
+A packet going through a hook chain. Interfaces which are not known at the hook point are -1: the outgoing interface
+at prerouting and input, the incoming one at output and for packets sent by this host.
+*/
+type HookPacket struct {
+	Hook         int
+	Packet       []byte
+	InInterface  int
+	OutInterface int
+	last         *registeredHook
+	done         func(packet []byte)
+}
+
+/*
+Returns the verdict for the packet. Hooks which modify the packet either change HookPacket.Packet in place or replace
+it.
+*/
+type Hook func(p *HookPacket) int
+
+type registeredHook struct {
+	id       int
+	priority int
+	hook     Hook
+}
+
+/*
+Adds the hook to the chain of the hook point. Returns an identifier which can be used to remove it again.
+*/
+func (ip *IP) RegisterHook(hookNum int, priority int, hook Hook) int {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	ip.lastHookId++
+	entry := &registeredHook{id: ip.lastHookId, priority: priority, hook: hook}
+
+	//The chain is replaced instead of changed, so that packets going through the old one are not disturbed
+	chain := append([]*registeredHook{}, ip.hooks[hookNum]...)
+	chain = append(chain, entry)
+	sort.SliceStable(chain, func(i, j int) bool {
+		return chain[i].priority < chain[j].priority
+	})
+	ip.hooks[hookNum] = chain
+	return entry.id
+}
+
+func (ip *IP) UnregisterHook(id int) {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	for hookNum, chain := range ip.hooks {
+		for i, entry := range chain {
+			if entry.id == id {
+				newChain := append([]*registeredHook{}, chain[:i]...)
+				ip.hooks[hookNum] = append(newChain, chain[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+/*
+Hands back a packet a hook has queued, with the verdict of the hook for it. An accepted packet goes on through the rest
+of the chain, from the hook after the one which queued it.
+*/
+func (ip *IP) Reinject(p *HookPacket, verdict int) {
+	if !ip.applyVerdict(p, verdict) {
+		return
+	}
+	ip.continueHooks(p)
+}
+
+/*
+Drops the packet and tells its sender that it is not allowed through, like firewalls rejecting packets do. The L4
+protocol of this host is told directly about its own packets, and other senders get an ICMP error. Returns the verdict
+for the hook to return.
+*/
+func (ip *IP) Reject(p *HookPacket) int {
+	packet := p.Packet
+	if p.InInterface >= 0 {
+		ip.sendError(protocol.ErrProhibited, packet, 0)
+		return VerdictDrop
+	}
+
+	for _, l4Protocol := range ip.l4Protocols {
+		if l4Protocol.GetIdentifier()[0] == packet[10] {
+			notifySender(protocol.ErrProhibited, packet[20:], packet[12:16], packet[16:20], l4Protocol)
+		}
+	}
+	return VerdictDrop
+}
+
+/*
+Runs the packet through the chain of the hook point, and calls done with the packet if all hooks accept it
+*/
+func (ip *IP) runHooks(hookNum int, packet []byte, inIntf int, outIntf int, done func(packet []byte)) {
+	ip.continueHooks(&HookPacket{
+		Hook:         hookNum,
+		Packet:       packet,
+		InInterface:  inIntf,
+		OutInterface: outIntf,
+		done:         done,
+	})
+}
+
+/*
+Runs the hooks which come after the last one the packet went through. The chain is in the order of priority and then
+identifier, so a hook is after another one if it is later in that order.
+*/
+func (ip *IP) continueHooks(p *HookPacket) {
+	ip.lock.Lock()
+	chain := ip.hooks[p.Hook]
+	ip.lock.Unlock()
+
+	for _, entry := range chain {
+		if p.last != nil && (entry.priority < p.last.priority || entry.priority == p.last.priority && entry.id <= p.last.id) {
+			continue
+		}
+
+		p.last = entry
+		verdict := entry.hook(p)
+		if verdict == VerdictQueue {
+			return
+		}
+		if !ip.applyVerdict(p, verdict) {
+			return
+		}
+	}
+	p.done(p.Packet)
+}
+
+/*
+Returns false if the packet does not go on
+*/
+func (ip *IP) applyVerdict(p *HookPacket, verdict int) bool {
+	switch verdict {
+	case VerdictAccept:
+		return true
+	case VerdictModify:
+		if len(p.Packet) < 20 {
+			log.Printf("IP: Hook left a packet too short to be valid. Dropping.")
+			return false
+		}
+		binary.BigEndian.PutUint16(p.Packet[2:4], uint16(len(p.Packet)))
+		p.Packet[11] = byte(0)
+		p.Packet[11] = utils.CalculateChecksum(p.Packet[:20])[0]
+		return true
+	}
+	return false
+}
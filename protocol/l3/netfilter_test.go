@@ -0,0 +1,206 @@
+package l3
+
+import (
+	"bytes"
+	"netsim/hardware"
+	"netsim/protocol"
+	"sync"
+	"testing"
+)
+
+/*
+Testcase
+*/
+func TestHookChain(t *testing.T) {
+	ip := NewIP([][]byte{{10, 0, 0, 1}}, false, nil, &staticRouteProvider{}, &staticAddressResolver{})
+	packet := createPacket(ip.version, []byte("hooked"), []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}, 0, []byte{0, 0}, lastFragment, []byte{0, 0}, 5, []byte("d"))
+
+	//Hooks run by priority, and a modified packet gets a valid header
+	var order []int
+	ip.RegisterHook(HookOutput, PriorityNatSrc, func(p *HookPacket) int {
+		order = append(order, PriorityNatSrc)
+		return VerdictAccept
+	})
+	ip.RegisterHook(HookOutput, PriorityNatDst, func(p *HookPacket) int {
+		order = append(order, PriorityNatDst)
+		p.Packet = append(append([]byte{}, p.Packet...), []byte("_more")...)
+		return VerdictModify
+	})
+
+	var delivered []byte
+	ip.runHooks(HookOutput, packet, -1, 0, func(packet []byte) {
+		delivered = packet
+	})
+	if len(order) != 2 || order[0] != PriorityNatDst || order[1] != PriorityNatSrc {
+		t.Errorf("Expected the hooks to run by priority but got %v", order)
+	}
+	if !bytes.Equal(delivered[20:], []byte("hooked_more")) || !ip.isValidPacket(delivered) {
+		t.Fatalf("Expected a valid modified packet but got %v", delivered)
+	}
+	if int(delivered[2])<<8|int(delivered[3]) != len(delivered) {
+		t.Errorf("Expected the length to be fixed after modification")
+	}
+
+	//A queued packet goes on from the next hook once reinjected
+	var queued *HookPacket
+	id := ip.RegisterHook(HookOutput, PriorityFilter, func(p *HookPacket) int {
+		queued = p
+		return VerdictQueue
+	})
+	order, delivered = nil, nil
+	ip.runHooks(HookOutput, packet, -1, 0, func(packet []byte) {
+		delivered = packet
+	})
+	if delivered != nil || queued == nil {
+		t.Fatalf("Expected the packet to be held by the queueing hook")
+	}
+	ip.Reinject(queued, VerdictAccept)
+	if delivered == nil || len(order) != 2 {
+		t.Errorf("Expected the reinjected packet to go through the rest of the chain but got %v", order)
+	}
+
+	//Dropped packets go no further, and removed hooks are not run
+	ip.UnregisterHook(id)
+	ip.RegisterHook(HookOutput, PriorityFilter, func(p *HookPacket) int {
+		return VerdictDrop
+	})
+	order, delivered = nil, nil
+	ip.runHooks(HookOutput, packet, -1, 0, func(packet []byte) {
+		delivered = packet
+	})
+	if delivered != nil || len(order) != 1 {
+		t.Errorf("Expected the packet to be dropped after the first hook but got %v", order)
+	}
+
+	//Other hook points are not affected
+	delivered = nil
+	ip.runHooks(HookInput, packet, 0, -1, func(packet []byte) {
+		delivered = packet
+	})
+	if !bytes.Equal(delivered, packet) {
+		t.Errorf("Expected the packet to pass a hook point without hooks unchanged")
+	}
+}
+
+func TestReinjectAfterChainChange(t *testing.T) {
+	ip := NewIP([][]byte{{10, 0, 0, 1}}, false, nil, &staticRouteProvider{}, &staticAddressResolver{})
+	packet := createPacket(ip.version, []byte("hooked"), []byte{10, 0, 0, 2}, []byte{10, 0, 0, 1}, 0, []byte{0, 0}, lastFragment, []byte{0, 0}, 5, []byte("d"))
+
+	var order []string
+	var queued *HookPacket
+	earlier := ip.RegisterHook(HookInput, PriorityConntrack, func(p *HookPacket) int {
+		order = append(order, "earlier")
+		return VerdictAccept
+	})
+	ip.RegisterHook(HookInput, PriorityFilter, func(p *HookPacket) int {
+		order = append(order, "queue")
+		queued = p
+		return VerdictQueue
+	})
+	ip.RegisterHook(HookInput, PriorityFilter, func(p *HookPacket) int {
+		order = append(order, "same_priority")
+		return VerdictAccept
+	})
+	ip.RegisterHook(HookInput, PriorityNatSrc, func(p *HookPacket) int {
+		order = append(order, "later")
+		return VerdictAccept
+	})
+
+	var delivered []byte
+	ip.runHooks(HookInput, packet, 0, -1, func(packet []byte) {
+		delivered = packet
+	})
+
+	//While the packet is held, a hook before the queueing one goes away and one comes at the end
+	ip.UnregisterHook(earlier)
+	ip.RegisterHook(HookInput, PriorityQos, func(p *HookPacket) int {
+		order = append(order, "new_later")
+		return VerdictAccept
+	})
+	ip.Reinject(queued, VerdictAccept)
+
+	expected := []string{"earlier", "queue", "same_priority", "later", "new_later"}
+	if delivered == nil || len(order) != len(expected) {
+		t.Fatalf("Expected the hooks %v but got %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Errorf("Expected the hooks %v but got %v", expected, order)
+			break
+		}
+	}
+}
+
+func TestOutputChangesRoute(t *testing.T) {
+	table := NewRoutingTable()
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, nil, 0)
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 2, 0}, Mask: 24}, nil, 1)
+	ip := NewIP([][]byte{{10, 0, 1, 1}, {10, 0, 2, 1}}, false, nil, table, &staticAddressResolver{})
+	links := []*linkRecorder{{}, {}}
+	for i, link := range links {
+		ip.SetL2ProtocolForInterface(i, link)
+	}
+
+	//The destination is changed to one behind the other interface
+	ip.RegisterHook(HookOutput, PriorityNatDst, func(p *HookPacket) int {
+		copy(p.Packet[16:20], []byte{10, 0, 2, 2})
+		return VerdictModify
+	})
+	var postrouting []int
+	ip.RegisterHook(HookPostrouting, PriorityNatSrc, func(p *HookPacket) int {
+		postrouting = append(postrouting, p.OutInterface)
+		return VerdictAccept
+	})
+
+	ip.SendDown([]byte("redirected"), []byte{10, 0, 1, 2}, []byte{0, 5}, &node{})
+	if links[0].count() != 0 || links[1].count() != 1 {
+		t.Fatalf("Expected the packet on the second interface but got %d and %d", links[0].count(), links[1].count())
+	}
+	if len(postrouting) != 1 || postrouting[0] != 1 {
+		t.Errorf("Expected postrouting to see the new interface but got %v", postrouting)
+	}
+}
+
+/*
+Link which keeps what it is given to send
+*/
+type linkRecorder struct {
+	frames [][]byte
+	mtu    int
+	lock   sync.Mutex
+}
+
+func (l *linkRecorder) GetIdentifier() []byte {
+	return []byte("lr")
+}
+
+func (l *linkRecorder) SendUp(data []byte, metadata []byte, sender protocol.Protocol) {
+}
+
+func (l *linkRecorder) SendDown(data []byte, destAddr []byte, metadata []byte, sender protocol.Protocol) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.frames = append(l.frames, data)
+}
+
+func (l *linkRecorder) GetMTU() int {
+	if l.mtu == 0 {
+		return 1500
+	}
+	return l.mtu
+}
+
+func (l *linkRecorder) GetAdapter() hardware.Adapter {
+	return nil
+}
+
+func (l *linkRecorder) AddL3Protocol(l3Protocol protocol.L3Protocol) {
+}
+
+func (l *linkRecorder) count() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return len(l.frames)
+}
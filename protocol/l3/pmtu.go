@@ -0,0 +1,133 @@
+package l3
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Path MTU discovery lets a host find the largest packet which reaches a destination without being fragmented on the way.
+Packets are sent with Don't Fragment set, and a router which cannot forward one of them on the next link drops it and
+tells the source the MTU of that link. The source remembers the smaller MTU for the destination, and sends smaller
+packets from then on. Routers which do not send errors for old RFC 1191 style set the MTU to 0, in which case the next
+smaller plateau of common MTUs below the length of the dropped packet is used instead.
+Routes can change, hence a learnt MTU is forgotten after some time, so that a larger one can be found again.
+Routers which drop packets without sending an error at all are black holes, since the packets vanish. The sender can
+only notice that nothing arrives, and tell IP about it. Packets to the destination are then sent at a small MTU with
+Don't Fragment cleared, so that routers on the way can fragment them, until the MTU is forgotten.
+IPv6 keeps its own path MTUs the same way, learnt from Packet Too Big messages. They are never below 1280 bytes, the
+smallest MTU every IPv6 link has, and since IPv6 routers never fragment, that is also the MTU used behind black holes.
+*/
+const (
+	defaultPathMTUAging = 10 * time.Minute
+	minPathMTU          = 68
+	minIPv6PathMTU      = 1280
+	blackHolePathMTU    = 576
+)
+
+var mtuPlateaus = []int{32000, 17914, 8166, 4352, 2002, 1492, 1006, 508, 296, minPathMTU}
+
+/*
+A path MTU which has been learnt for a destination
+*/
+type PathMTU struct {
+	Destination []byte
+	MTU         int
+	BlackHole   bool
+	UpdatedAt   time.Time
+}
+
+type pathMTUCache struct {
+	entries map[string]*PathMTU
+	aging   time.Duration
+	minMTU  int
+	lock    sync.Mutex
+}
+
+func newPathMTUCache(minMTU int) *pathMTUCache {
+	return &pathMTUCache{
+		entries: map[string]*PathMTU{},
+		aging:   defaultPathMTUAging,
+		minMTU:  minMTU,
+	}
+}
+
+/*
+Returns the entry for the destination, or nil if nothing has been learnt about it or it has aged out
+*/
+func (c *pathMTUCache) get(destAddr []byte) *PathMTU {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[string(destAddr)]
+	if !ok {
+		return nil
+	}
+	if entry.UpdatedAt.Add(c.aging).Before(time.Now()) {
+		delete(c.entries, string(destAddr))
+		return nil
+	}
+	return entry
+}
+
+/*
+Lowers the MTU of the destination. The MTU of a path only grows when its entry ages out.
+*/
+func (c *pathMTUCache) update(destAddr []byte, mtu int, blackHole bool) {
+	if mtu < c.minMTU {
+		mtu = c.minMTU
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[string(destAddr)]
+	if ok && entry.UpdatedAt.Add(c.aging).After(time.Now()) {
+		if entry.MTU <= mtu && (entry.BlackHole || !blackHole) {
+			return
+		}
+		if entry.MTU < mtu {
+			mtu = entry.MTU
+		}
+		blackHole = blackHole || entry.BlackHole
+	}
+
+	c.entries[string(destAddr)] = &PathMTU{
+		Destination: append([]byte{}, destAddr...),
+		MTU:         mtu,
+		BlackHole:   blackHole,
+		UpdatedAt:   time.Now(),
+	}
+}
+
+func (c *pathMTUCache) setAging(aging time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.aging = aging
+}
+
+func (c *pathMTUCache) list() []PathMTU {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var entries []PathMTU
+	for _, entry := range c.entries {
+		if entry.UpdatedAt.Add(c.aging).After(time.Now()) {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries
+}
+
+/*
+Returns the largest common MTU which is smaller than the length of the packet
+*/
+func nextLowerPlateau(length int) int {
+	for _, plateau := range mtuPlateaus {
+		if plateau < length {
+			return plateau
+		}
+	}
+	return minPathMTU
+}
@@ -0,0 +1,249 @@
+package l3
+
+import (
+	"encoding/binary"
+	"netsim/protocol"
+	"sort"
+)
+
+/*
+Policy routing picks the routing table a packet is routed with by rules about the packet, like `ip rule` of Linux does.
+Sites with more than one uplink can send traffic out of the uplink of its source network, or give voice traffic a path
+of its own. Every table is a RouteProvider of its own, and the table given to NewIP is the main one.
+The rules are checked in the order of their priority, lowest first. A rule matches the packets which match all of its
+conditions, and conditions which are not set match every packet. The table of the first rule which matches and has a
+route for the destination is used, hence a rule whose table has no route lets the next rules decide. Without any rules
+added, every packet is routed with the main table, by a rule with priority DefaultRulePriority.
+Packets sent by this host are routed once without a source, and then again with the address of the interface picked as
+their source, so that rules about sources match them too, like the source address Linux picks. Rules about incoming
+interfaces only match forwarded packets. Ports match TCP and UDP packets only, and never match fragments, since only the
+first fragment of a packet carries them and all of them have to take the same route.
+*/
+const (
+	TableMain           = 254
+	DefaultRulePriority = 32766
+)
+
+/*
+Ports from From to To, both included
+*/
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+/*
+TOS matches the packets whose TOS has the bits in TosMask set as in Tos. The DSCP of a packet is matched with a mask of
+0xFC.
+*/
+type RoutingRule struct {
+	Priority     int
+	Source       *protocol.CIDR
+	Destination  *protocol.CIDR
+	Tos          byte
+	TosMask      byte
+	Protocol     []byte
+	SourcePorts  *PortRange
+	DestPorts    *PortRange
+	InInterfaces []int
+	Table        int
+}
+
+/*
+What the rules look at in a packet. The incoming interface is -1 for the packets of this host.
+*/
+type routingKey struct {
+	srcAddr  []byte
+	destAddr []byte
+	tos      byte
+	proto    byte
+	srcPort  uint16
+	destPort uint16
+	hasPorts bool
+	inIntf   int
+}
+
+func (r *PortRange) Contains(port uint16) bool {
+	return port >= r.From && port <= r.To
+}
+
+/*
+Adds a routing table, or replaces the one with the same identifier
+*/
+func (ip *IP) AddRoutingTable(id int, table protocol.RouteProvider) {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	tables := map[int]protocol.RouteProvider{}
+	for i, t := range ip.routingTables {
+		tables[i] = t
+	}
+	tables[id] = table
+	ip.routingTables = tables
+}
+
+/*
+Returns nil if there is no table with the identifier
+*/
+func (ip *IP) GetRoutingTable(id int) protocol.RouteProvider {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	return ip.routingTables[id]
+}
+
+/*
+Adds the rule after the other rules with the same priority
+*/
+func (ip *IP) AddRoutingRule(rule RoutingRule) {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	//The rules are replaced instead of changed, so that the packets being routed do not need the lock
+	rules := append([]*RoutingRule{}, ip.routingRules...)
+	rules = append(rules, &rule)
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority < rules[j].Priority
+	})
+	ip.routingRules = rules
+}
+
+/*
+Removes the rules with the priority, including the default one
+*/
+func (ip *IP) DeleteRoutingRule(priority int) {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	var rules []*RoutingRule
+	for _, rule := range ip.routingRules {
+		if rule.Priority != priority {
+			rules = append(rules, rule)
+		}
+	}
+	ip.routingRules = rules
+}
+
+func (ip *IP) GetRoutingRules() []RoutingRule {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+
+	var rules []RoutingRule
+	for _, rule := range ip.routingRules {
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+/*
+Internal methods
+*/
+
+/*
+Returns the table to route the packet with and the interface it leaves from, which is -1 if no table has a route
+*/
+func (ip *IP) lookupRoute(key *routingKey) (protocol.RouteProvider, int) {
+	ip.lock.Lock()
+	rules := ip.routingRules
+	tables := ip.routingTables
+	ip.lock.Unlock()
+
+	for _, rule := range rules {
+		table, ok := tables[rule.Table]
+		if !ok || !rule.matches(key) {
+			continue
+		}
+		if intfNum := table.GetInterfaceForAddress(key.destAddr); intfNum >= 0 {
+			return table, intfNum
+		}
+	}
+	return ip.routingTable, -1
+}
+
+/*
+Routes a packet of this host, with the address of the interface it leaves from as its source
+*/
+func (ip *IP) lookupLocalRoute(key *routingKey) (protocol.RouteProvider, int) {
+	routes, intfNum := ip.lookupRoute(key)
+	if intfNum < 0 {
+		return routes, intfNum
+	}
+
+	key.srcAddr = ip.GetAddressForInterface(intfNum)
+	if sourceRoutes, sourceIntfNum := ip.lookupRoute(key); sourceIntfNum >= 0 {
+		return sourceRoutes, sourceIntfNum
+	}
+	return routes, intfNum
+}
+
+func (r *RoutingRule) matches(key *routingKey) bool {
+	if r.Source != nil && (key.srcAddr == nil || !r.Source.Contains(key.srcAddr)) {
+		return false
+	}
+	if r.Destination != nil && !r.Destination.Contains(key.destAddr) {
+		return false
+	}
+	if key.tos&r.TosMask != r.Tos&r.TosMask {
+		return false
+	}
+	if r.Protocol != nil && r.Protocol[0] != key.proto {
+		return false
+	}
+	if (r.SourcePorts != nil || r.DestPorts != nil) && !key.hasPorts {
+		return false
+	}
+	if r.SourcePorts != nil && !r.SourcePorts.Contains(key.srcPort) {
+		return false
+	}
+	if r.DestPorts != nil && !r.DestPorts.Contains(key.destPort) {
+		return false
+	}
+	if len(r.InInterfaces) > 0 {
+		found := false
+		for _, intfNum := range r.InInterfaces {
+			found = found || intfNum == key.inIntf
+		}
+		return found
+	}
+	return true
+}
+
+/*
+Returns what the rules look at in a packet being forwarded
+*/
+func getRoutingKey(packet []byte, inIntf int) *routingKey {
+	key := &routingKey{
+		srcAddr:  packet[12:16],
+		destAddr: packet[16:20],
+		tos:      packet[1],
+		proto:    packet[10],
+		inIntf:   inIntf,
+	}
+
+	//Fragments other than the first do not have the ports, hence none of them is routed by its ports
+	if hasPorts(packet) && !isFragment(packet) {
+		key.srcPort = binary.BigEndian.Uint16(packet[20:22])
+		key.destPort = binary.BigEndian.Uint16(packet[22:24])
+		key.hasPorts = true
+	}
+	return key
+}
+
+/*
+Returns what the rules look at in a packet sent by an L4 protocol of this host
+*/
+func getLocalRoutingKey(data []byte, destAddr []byte, tos byte, proto byte) *routingKey {
+	key := &routingKey{
+		destAddr: destAddr,
+		tos:      tos,
+		proto:    proto,
+		inIntf:   -1,
+	}
+
+	if (proto == protocol.TCP[0] || proto == protocol.UDP[0]) && len(data) >= 4 {
+		key.srcPort = binary.BigEndian.Uint16(data[0:2])
+		key.destPort = binary.BigEndian.Uint16(data[2:4])
+		key.hasPorts = true
+	}
+	return key
+}
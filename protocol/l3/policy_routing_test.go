@@ -0,0 +1,77 @@
+package l3
+
+import (
+	"bytes"
+	"netsim/protocol"
+	"sync"
+	"testing"
+)
+
+/*
+Testcase
+*/
+func TestPolicyRoutingLocal(t *testing.T) {
+	table := NewRoutingTable()
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 1, 0}, Mask: 24}, nil, 0)
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 2, 0}, Mask: 24}, nil, 1)
+	table.Add(protocol.DefaultRouteCidr, []byte{10, 0, 1, 9}, 0)
+	resolver := &requestRecorder{}
+	ip := NewIP([][]byte{{10, 0, 1, 1}, {10, 0, 2, 1}}, false, nil, table, resolver)
+	links := []*linkRecorder{{}, {mtu: 1000}}
+	for i, link := range links {
+		ip.SetL2ProtocolForInterface(i, link)
+	}
+
+	//Groups and everything sent from the address of the first interface go out of the second one
+	other := NewRoutingTable()
+	other.Add(&protocol.CIDR{Address: []byte{239, 0, 0, 0}, Mask: 8}, nil, 1)
+	other.Add(protocol.DefaultRouteCidr, []byte{10, 0, 2, 9}, 1)
+	ip.AddRoutingTable(100, other)
+	ip.AddRoutingRule(RoutingRule{Priority: 100, Source: &protocol.CIDR{Address: []byte{10, 0, 1, 1}, Mask: 32}, Table: 100})
+	ip.AddRoutingRule(RoutingRule{Priority: 200, Destination: &protocol.CIDR{Address: []byte{239, 0, 0, 0}, Mask: 8}, Table: 100})
+
+	remote := []byte{8, 8, 8, 8}
+	ip.SendDown([]byte("by_source"), remote, []byte{0, 5}, &node{})
+	if links[0].count() != 0 || links[1].count() != 1 || !bytes.Equal(resolver.last(), []byte{10, 0, 2, 9}) {
+		t.Errorf("Expected the packet through the gateway of the source rule but got %d and %d to %v", links[0].count(), links[1].count(), resolver.last())
+	}
+
+	//The gateway of a packet sent on a given interface comes from the table the rules pick
+	ip.SendDownOnInterface(1, []byte("on_interface"), remote, []byte{0, 5}, &node{})
+	if links[1].count() != 2 || !bytes.Equal(resolver.last(), []byte{10, 0, 2, 9}) {
+		t.Errorf("Expected the packet through the gateway of the source rule but got %v", resolver.last())
+	}
+
+	if mtu := ip.GetPathMTU(remote); mtu != 1000 {
+		t.Errorf("Expected the MTU of the interface of the source rule but got %d", mtu)
+	}
+	if intfNum := ip.getInterfaceForGroup([]byte{239, 1, 1, 1}, nil); intfNum != 1 {
+		t.Errorf("Expected the group on the interface of its rule but got %d", intfNum)
+	}
+}
+
+/*
+Address resolution which remembers what it was asked for
+*/
+type requestRecorder struct {
+	requests [][]byte
+	lock     sync.Mutex
+}
+
+func (r *requestRecorder) Resolve(ipAddr []byte) []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.requests = append(r.requests, ipAddr)
+	return []byte("immac2")
+}
+
+func (r *requestRecorder) last() []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.requests) == 0 {
+		return nil
+	}
+	return r.requests[len(r.requests)-1]
+}
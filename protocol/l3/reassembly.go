@@ -0,0 +1,271 @@
+package l3
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Reassembly puts the fragments of packets back together, for both IP and IPv6. Fragments are kept by the offset of their
+data, hence they can arrive in any order and be of any size, like when they come over paths with different MTUs. Data
+already received is never overwritten. Fragments which bring nothing new are dropped as duplicates, and only the new
+parts of fragments which overlap others are kept. A packet whose fragments disagree on where it ends is dropped.
+A packet has to be complete within the timeout, counted from its first fragment to arrive. If it is not, it is dropped,
+and the sender is told with a time exceeded error if the fragment with offset 0 had arrived, since the error is about
+that fragment. The data of all incomplete packets is kept within a memory limit. When a fragment does not fit, the
+packets which have waited the longest are dropped to make room for it.
+*/
+const (
+	defaultReassemblyTimeout     = 30 * time.Second
+	defaultReassemblyMemoryLimit = 256 * 1024
+	reassemblyCheckInterval      = 1 * time.Second
+)
+
+/*
+Counters of the fragments received and of what became of them
+*/
+type ReassemblyStats struct {
+	Fragments   int
+	Reassembled int
+	Duplicates  int
+	Overlaps    int
+	Invalid     int
+	Timeouts    int
+	Evictions   int
+}
+
+type reassembler struct {
+	packets     map[string]*reassemblyBuffer
+	timeout     time.Duration
+	memoryLimit int
+	memoryUsed  int
+	stats       ReassemblyStats
+	onTimeout   func(firstFragment []byte)
+	lock        sync.Mutex
+}
+
+func newReassembler(onTimeout func(firstFragment []byte)) *reassembler {
+	return &reassembler{
+		packets:     map[string]*reassemblyBuffer{},
+		timeout:     defaultReassemblyTimeout,
+		memoryLimit: defaultReassemblyMemoryLimit,
+		onTimeout:   onTimeout,
+	}
+}
+
+/*
+Adds the data of a fragment of the packet with the key. Returns the data of the whole packet once all of it has arrived.
+The packet the fragment came in is kept if it is the first fragment, so that an error can be sent about it.
+*/
+func (r *reassembler) add(key string, offset int, data []byte, isLast bool, packet []byte) (bool, []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.stats.Fragments++
+	b, ok := r.packets[key]
+	if !ok {
+		b = &reassemblyBuffer{
+			length:    -1,
+			startedAt: time.Now(),
+		}
+		r.packets[key] = b
+	}
+
+	//The end of the packet is known from the last fragment, and no data may lie beyond it
+	end := offset + len(data)
+	if (isLast && ((b.length >= 0 && b.length != end) || b.end() > end)) || (!isLast && b.length >= 0 && end > b.length) {
+		r.stats.Invalid++
+		r.remove(key)
+		return false, nil
+	}
+	if isLast {
+		b.length = end
+	}
+	if offset == 0 {
+		b.firstFragment = packet
+	}
+
+	pieces := b.missingPieces(offset, data)
+	newBytes := 0
+	for _, p := range pieces {
+		newBytes += len(p.data)
+	}
+	if newBytes == 0 && len(data) > 0 {
+		r.stats.Duplicates++
+	} else if newBytes < len(data) {
+		r.stats.Overlaps++
+	}
+
+	//Make room for the new data
+	for r.memoryUsed+newBytes > r.memoryLimit {
+		if !r.evictOldest(key) {
+			r.stats.Evictions++
+			r.remove(key)
+			return false, nil
+		}
+	}
+	b.fragments = append(b.fragments, pieces...)
+	b.size += newBytes
+	r.memoryUsed += newBytes
+
+	if b.length < 0 || b.size < b.length {
+		return false, nil
+	}
+
+	//Since fragments never overlap, the packet is complete once there is as much data as its length
+	sort.Slice(b.fragments, func(i, j int) bool {
+		return b.fragments[i].offset < b.fragments[j].offset
+	})
+	reassembled := make([]byte, 0, b.length)
+	for _, f := range b.fragments {
+		reassembled = append(reassembled, f.data...)
+	}
+
+	r.stats.Reassembled++
+	r.remove(key)
+	return true, reassembled
+}
+
+/*
+Drops the packets which did not complete in time. Returns after the senders have been told.
+*/
+func (r *reassembler) expire() {
+	r.lock.Lock()
+	var firstFragments [][]byte
+	for key, b := range r.packets {
+		if b.startedAt.Add(r.timeout).After(time.Now()) {
+			continue
+		}
+
+		r.stats.Timeouts++
+		if b.firstFragment != nil {
+			firstFragments = append(firstFragments, b.firstFragment)
+		}
+		r.remove(key)
+	}
+	r.lock.Unlock()
+
+	for _, f := range firstFragments {
+		r.onTimeout(f)
+	}
+}
+
+func (r *reassembler) getStats() ReassemblyStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.stats
+}
+
+func (r *reassembler) setTimeout(timeout time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.timeout = timeout
+}
+
+func (r *reassembler) setMemoryLimit(limit int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.memoryLimit = limit
+}
+
+/*
+Expects the lock to be held. Drops the packet which started first, other than the one with the key. Returns false if
+there is none.
+*/
+func (r *reassembler) evictOldest(key string) bool {
+	var oldestKey string
+	var oldest *reassemblyBuffer
+	for k, b := range r.packets {
+		if k != key && (oldest == nil || b.startedAt.Before(oldest.startedAt)) {
+			oldestKey = k
+			oldest = b
+		}
+	}
+
+	if oldest == nil {
+		return false
+	}
+
+	r.stats.Evictions++
+	r.remove(oldestKey)
+	return true
+}
+
+/*
+Expects the lock to be held
+*/
+func (r *reassembler) remove(key string) {
+	b, ok := r.packets[key]
+	if !ok {
+		return
+	}
+
+	r.memoryUsed -= b.size
+	delete(r.packets, key)
+}
+
+//Internal structs
+type reassemblyBuffer struct {
+	fragments     []reassemblyFragment
+	size          int
+	length        int
+	firstFragment []byte
+	startedAt     time.Time
+}
+
+type reassemblyFragment struct {
+	offset int
+	data   []byte
+}
+
+/*
+Returns the parts of the data which have not been received yet
+*/
+func (b *reassemblyBuffer) missingPieces(offset int, data []byte) []reassemblyFragment {
+	pieces := []reassemblyFragment{{offset: offset, data: data}}
+	for _, f := range b.fragments {
+		var remaining []reassemblyFragment
+		for _, p := range pieces {
+			remaining = append(remaining, p.subtract(f)...)
+		}
+		pieces = remaining
+	}
+	return pieces
+}
+
+/*
+Returns where the data received so far ends
+*/
+func (b *reassemblyBuffer) end() int {
+	end := 0
+	for _, f := range b.fragments {
+		if f.offset+len(f.data) > end {
+			end = f.offset + len(f.data)
+		}
+	}
+	return end
+}
+
+/*
+Returns the parts of the fragment which are not covered by the other one
+*/
+func (f reassemblyFragment) subtract(other reassemblyFragment) []reassemblyFragment {
+	end := f.offset + len(f.data)
+	otherEnd := other.offset + len(other.data)
+	if otherEnd <= f.offset || other.offset >= end {
+		return []reassemblyFragment{f}
+	}
+
+	var pieces []reassemblyFragment
+	if f.offset < other.offset {
+		pieces = append(pieces, reassemblyFragment{offset: f.offset, data: f.data[:other.offset-f.offset]})
+	}
+	if otherEnd < end {
+		pieces = append(pieces, reassemblyFragment{offset: otherEnd, data: f.data[otherEnd-f.offset:]})
+	}
+	return pieces
+}
@@ -0,0 +1,132 @@
+package l3
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+/*
+Testcase
+*/
+func TestReassembly(t *testing.T) {
+	var timedOut [][]byte
+	r := newReassembler(func(firstFragment []byte) {
+		timedOut = append(timedOut, firstFragment)
+	})
+
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	//Fragments of different sizes which arrive out of order, with a duplicate and overlaps
+	fragments := []struct {
+		offset int
+		end    int
+		isLast bool
+	}{
+		{60, 100, true},
+		{10, 30, false},
+		{10, 30, false},
+		{25, 70, false},
+		{0, 15, false},
+	}
+	var ready bool
+	var reassembled []byte
+	for i, f := range fragments {
+		ready, reassembled = r.add("a", f.offset, data[f.offset:f.end], f.isLast, []byte{byte(i)})
+		if ready != (i == len(fragments)-1) {
+			t.Fatalf("Expected the packet to be ready only after the last fragment, got ready=%v at %d", ready, i)
+		}
+	}
+	if !bytes.Equal(reassembled, data) {
+		t.Errorf("Expected %v but got %v", data, reassembled)
+	}
+
+	stats := r.getStats()
+	if stats.Fragments != 5 || stats.Reassembled != 1 || stats.Duplicates != 1 || stats.Overlaps != 2 {
+		t.Errorf("Got unexpected stats %+v", stats)
+	}
+	if r.memoryUsed != 0 || len(r.packets) != 0 {
+		t.Errorf("Expected nothing to be kept after reassembly")
+	}
+
+	//Fragments which disagree on the length of the packet
+	r.add("b", 0, data[:40], false, nil)
+	r.add("b", 60, data[60:80], true, nil)
+	ready, _ = r.add("b", 40, data[40:100], false, nil)
+	if ready || r.getStats().Invalid != 1 || len(r.packets) != 0 {
+		t.Errorf("Expected the inconsistent packet to be dropped")
+	}
+
+	//The oldest packet makes room for the new one when over the memory limit
+	r.setMemoryLimit(100)
+	r.add("c", 0, data[:60], false, nil)
+	time.Sleep(time.Millisecond)
+	r.add("d", 0, data[:60], false, nil)
+	if _, ok := r.packets["c"]; ok || r.getStats().Evictions != 1 || r.memoryUsed != 60 {
+		t.Errorf("Expected the oldest packet to be evicted, got %+v", r.getStats())
+	}
+
+	//A fragment which can never fit is dropped along with its packet, after evicting all others
+	r.add("e", 0, data, false, nil)
+	r.add("e", 100, data, true, nil)
+	if len(r.packets) != 0 || r.getStats().Evictions != 3 {
+		t.Errorf("Expected the packet larger than the limit to be dropped")
+	}
+
+	//Only the packets whose first fragment arrived are reported on timeout
+	r.setMemoryLimit(defaultReassemblyMemoryLimit)
+	r.setTimeout(10 * time.Millisecond)
+	r.add("f", 0, data[:10], false, []byte{0xF})
+	r.add("g", 10, data[10:20], false, []byte{0xE})
+	time.Sleep(20 * time.Millisecond)
+	r.expire()
+	if len(r.packets) != 0 || r.memoryUsed != 0 {
+		t.Errorf("Expected all packets to expire")
+	}
+	if len(timedOut) != 1 || !bytes.Equal(timedOut[0], []byte{0xF}) {
+		t.Errorf("Expected the first fragments to be reported but got %v", timedOut)
+	}
+	if r.getStats().Timeouts != 2 {
+		t.Errorf("Expected 2 timeouts but got %+v", r.getStats())
+	}
+}
+
+func TestFragmentingFragments(t *testing.T) {
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	packet := createPacket([]byte{0x04}, data, []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}, 0, []byte{0, 9}, lastFragment, []byte{0, 0}, 5, []byte{0x11})
+
+	//A router on the way splits the first fragment again, the pieces keep the identifier and continue its offsets
+	fragments := fragment(packet, 60)
+	if len(fragments) != 3 {
+		t.Fatalf("Expected 3 fragments but got %d", len(fragments))
+	}
+	refragmented := fragment(fragments[0], 36)
+	if len(refragmented) != 3 {
+		t.Fatalf("Expected 3 pieces of the first fragment but got %d", len(refragmented))
+	}
+	for _, f := range refragmented {
+		if !isFragment(f) || f[6]&lastFragment != 0 || !bytes.Equal(f[4:6], []byte{0, 9}) {
+			t.Errorf("Expected pieces of a fragment which are not last and keep the identifier but got %x", f[:20])
+		}
+	}
+	if fragment(packet, 27) != nil {
+		t.Errorf("Expected no fragments when no data fits the MTU")
+	}
+
+	r := newReassembler(func([]byte) {})
+	var ready bool
+	var reassembled []byte
+	for _, f := range append(refragmented, fragments[1:]...) {
+		offset := int(f[7])<<8 | int(f[8])
+		ready, reassembled = r.add("a", offset, f[20:], f[6]&lastFragment != 0, f)
+	}
+	if !ready || !bytes.Equal(reassembled, data) {
+		t.Errorf("Expected the original data back but got %v", reassembled)
+	}
+}
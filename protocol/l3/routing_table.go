@@ -0,0 +1,424 @@
+package l3
+
+import (
+	"bytes"
+	"log"
+	"netsim/protocol"
+	"sort"
+	"sync"
+)
+
+/*
+Routing table which finds the route for an address by longest prefix match. The prefixes are kept in a Patricia trie,
+where a node is created only where two prefixes branch off, so the lookup needs at most one step per bit of the address.
+There is a separate trie for each address length, so the same table can hold routes for different address families.
+
+More than one route can be known for a prefix, for example a static route and one learnt by a routing protocol. The one
+with the lowest administrative distance is used, and if there is a tie, the one with the lowest metric. Routes which tie
+on both are equal-cost paths, which the IP can spread the traffic over, see ecmp.go. A route without a gateway is for a
+directly connected network.
+*/
+const (
+	DistanceConnected = 0
+	DistanceStatic    = 1
+)
+
+type Route struct {
+	Cidr      *protocol.CIDR
+	Gateway   []byte
+	Interface int
+	Metric    int
+	Distance  int
+}
+
+type RoutingTable struct {
+	roots map[int]*trieNode
+	lock  sync.Mutex
+}
+
+/*
+Constructor
+*/
+func NewRoutingTable() *RoutingTable {
+	return &RoutingTable{
+		roots: map[int]*trieNode{},
+	}
+}
+
+/*
+Next 2 methods make this an implementation of RouteProvider
+*/
+func (r *RoutingTable) GetGatewayForAddress(ipAddr []byte) []byte {
+	route, err := r.Lookup(ipAddr)
+	if err != nil {
+		return nil
+	}
+	return route.Gateway
+}
+
+/*
+Returns -1 if there is no route to the address
+*/
+func (r *RoutingTable) GetInterfaceForAddress(ipAddr []byte) int {
+	route, err := r.Lookup(ipAddr)
+	if err != nil {
+		return -1
+	}
+	return route.Interface
+}
+
+/*
+Routing table public API
+*/
+func (r *RoutingTable) Add(cidr *protocol.CIDR, gateway []byte, intf int) {
+	r.AddRoute(&Route{
+		Cidr:      cidr,
+		Gateway:   gateway,
+		Interface: intf,
+		Distance:  DistanceStatic,
+	})
+}
+
+/*
+Adds the route. A route for the same prefix, distance, gateway and interface is replaced. A route whose mask is longer
+than its address is dropped.
+*/
+func (r *RoutingTable) AddRoute(route *Route) {
+	route = normalizeRoute(route)
+	if route == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	node := r.insert(route.Cidr)
+	for i, existing := range node.routes {
+		if isSameRoute(existing, route) {
+			node.routes[i] = route
+			return
+		}
+	}
+	node.routes = append(node.routes, route)
+}
+
+/*
+Replaces all routes for the prefix with the same distance as the route. This is what a routing protocol does when it
+learns a new best path.
+*/
+func (r *RoutingTable) ReplaceRoute(route *Route) {
+	route = normalizeRoute(route)
+	if route == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	node := r.insert(route.Cidr)
+	var remaining []*Route
+	for _, existing := range node.routes {
+		if existing.Distance != route.Distance {
+			remaining = append(remaining, existing)
+		}
+	}
+	node.routes = append(remaining, route)
+}
+
+/*
+Removes all routes for the network
+*/
+func (r *RoutingTable) Remove(cidr *protocol.CIDR) {
+	r.removeMatching(cidr, func(*Route) bool {
+		return true
+	})
+}
+
+/*
+Removes the route for the same prefix, distance, gateway and interface as the given one
+*/
+func (r *RoutingTable) RemoveRoute(route *Route) {
+	route = normalizeRoute(route)
+	if route == nil {
+		return
+	}
+	r.removeMatching(route.Cidr, func(existing *Route) bool {
+		return isSameRoute(existing, route)
+	})
+}
+
+/*
+Removes all routes with the given distance. Useful when a routing protocol is stopped.
+*/
+func (r *RoutingTable) RemoveRoutesWithDistance(distance int) {
+	for _, route := range r.GetRoutes() {
+		if route.Distance == distance {
+			r.RemoveRoute(route)
+		}
+	}
+}
+
+/*
+Returns the best route for the address, or ErrNoRoute
+*/
+func (r *RoutingTable) Lookup(ipAddr []byte) (*Route, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	best := r.longestMatch(ipAddr)
+	if best == nil {
+		return nil, protocol.ErrNoRoute
+	}
+	route := *best.bestRoute()
+	return &route, nil
+}
+
+/*
+Returns the equal-cost routes for the address, ordered by interface and gateway so that the order does not depend on when
+they were added. Returns ErrNoRoute if there is none.
+*/
+func (r *RoutingTable) LookupAll(ipAddr []byte) ([]*Route, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	best := r.longestMatch(ipAddr)
+	if best == nil {
+		return nil, protocol.ErrNoRoute
+	}
+
+	var routes []*Route
+	bestRoute := best.bestRoute()
+	for _, route := range best.routes {
+		if route.Distance == bestRoute.Distance && route.Metric == bestRoute.Metric {
+			copied := *route
+			routes = append(routes, &copied)
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Interface != routes[j].Interface {
+			return routes[i].Interface < routes[j].Interface
+		}
+		return bytes.Compare(routes[i].Gateway, routes[j].Gateway) < 0
+	})
+	return routes, nil
+}
+
+/*
+Returns all the routes in the table, including those which are not used because a better one exists for the prefix
+*/
+func (r *RoutingTable) GetRoutes() []*Route {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var routes []*Route
+	for _, length := range []int{4, 16} {
+		r.roots[length].walk(func(n *trieNode) {
+			for _, route := range n.routes {
+				copied := *route
+				routes = append(routes, &copied)
+			}
+		})
+	}
+	return routes
+}
+
+/*
+Internal methods
+*/
+
+/*
+Returns the node of the longest prefix with routes which covers the address. Expects the lock to be held.
+*/
+func (r *RoutingTable) longestMatch(ipAddr []byte) *trieNode {
+	var best *trieNode
+	node := r.roots[len(ipAddr)]
+	for node != nil && hasPrefix(ipAddr, node.prefix, node.length) {
+		if len(node.routes) > 0 {
+			best = node
+		}
+		if node.length == len(ipAddr)*8 {
+			break
+		}
+		node = node.children[bitAt(ipAddr, node.length)]
+	}
+	return best
+}
+func (r *RoutingTable) insert(cidr *protocol.CIDR) *trieNode {
+	root := r.roots[len(cidr.Address)]
+	node := insertNode(&root, cidr.Address, cidr.Mask)
+	r.roots[len(cidr.Address)] = root
+	return node
+}
+
+func (r *RoutingTable) removeMatching(cidr *protocol.CIDR, matches func(*Route) bool) {
+	if !isValidCidr(cidr) {
+		return
+	}
+	cidr = maskCidr(cidr)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	root := r.roots[len(cidr.Address)]
+	removeNode(&root, cidr.Address, cidr.Mask, matches)
+	if root == nil {
+		delete(r.roots, len(cidr.Address))
+	} else {
+		r.roots[len(cidr.Address)] = root
+	}
+}
+
+/*
+Returns nil if the prefix of the route is not valid, since a mask longer than the address would make the lookups read
+past its end
+*/
+func normalizeRoute(route *Route) *Route {
+	if !isValidCidr(route.Cidr) {
+		log.Printf("RoutingTable: Invalid prefix %v/%d. Dropping the route.", route.Cidr.Address, route.Cidr.Mask)
+		return nil
+	}
+
+	normalized := *route
+	normalized.Cidr = maskCidr(route.Cidr)
+	return &normalized
+}
+
+func isValidCidr(cidr *protocol.CIDR) bool {
+	return cidr.Mask >= 0 && cidr.Mask <= len(cidr.Address)*8
+}
+
+func isSameRoute(a *Route, b *Route) bool {
+	return a.Distance == b.Distance && a.Interface == b.Interface && bytes.Equal(a.Gateway, b.Gateway)
+}
+
+/*
+Returns a copy of the CIDR with the host bits cleared
+*/
+func maskCidr(cidr *protocol.CIDR) *protocol.CIDR {
+	address := make([]byte, len(cidr.Address))
+	for i := range address {
+		bits := cidr.Mask - i*8
+		if bits >= 8 {
+			address[i] = cidr.Address[i]
+		} else if bits > 0 {
+			address[i] = cidr.Address[i] & byte(0xff<<uint(8-bits))
+		}
+	}
+	return &protocol.CIDR{Address: address, Mask: cidr.Mask}
+}
+
+func bitAt(addr []byte, pos int) int {
+	return int(addr[pos/8]>>uint(7-pos%8)) & 1
+}
+
+func hasPrefix(addr []byte, prefix []byte, length int) bool {
+	return commonPrefixLength(addr, prefix, length) == length
+}
+
+func commonPrefixLength(a []byte, b []byte, maxLength int) int {
+	for i := 0; i < maxLength; i++ {
+		if bitAt(a, i) != bitAt(b, i) {
+			return i
+		}
+	}
+	return maxLength
+}
+
+//Internal struct
+type trieNode struct {
+	prefix   []byte
+	length   int
+	routes   []*Route
+	children [2]*trieNode
+}
+
+/*
+Returns the node for the prefix, creating it if needed. Expects the prefix to be masked.
+*/
+func insertNode(node **trieNode, prefix []byte, length int) *trieNode {
+	n := *node
+	if n == nil {
+		*node = &trieNode{prefix: prefix, length: length}
+		return *node
+	}
+
+	maxLength := n.length
+	if length < maxLength {
+		maxLength = length
+	}
+	common := commonPrefixLength(prefix, n.prefix, maxLength)
+
+	//The node is for this prefix, or for a shorter prefix which covers it
+	if common == n.length {
+		if length == n.length {
+			return n
+		}
+		return insertNode(&n.children[bitAt(prefix, n.length)], prefix, length)
+	}
+
+	//The new prefix covers the node
+	if common == length {
+		newNode := &trieNode{prefix: prefix, length: length}
+		newNode.children[bitAt(n.prefix, length)] = n
+		*node = newNode
+		return newNode
+	}
+
+	//The prefixes branch off, so a node without routes is needed where they do
+	branch := &trieNode{prefix: maskCidr(&protocol.CIDR{Address: prefix, Mask: common}).Address, length: common}
+	newNode := &trieNode{prefix: prefix, length: length}
+	branch.children[bitAt(n.prefix, common)] = n
+	branch.children[bitAt(prefix, common)] = newNode
+	*node = branch
+	return newNode
+}
+
+/*
+Removes the matching routes of the prefix, and then the nodes which are no longer needed
+*/
+func removeNode(node **trieNode, prefix []byte, length int, matches func(*Route) bool) {
+	n := *node
+	if n == nil || length < n.length || !hasPrefix(prefix, n.prefix, n.length) {
+		return
+	}
+
+	if length == n.length {
+		var remaining []*Route
+		for _, route := range n.routes {
+			if !matches(route) {
+				remaining = append(remaining, route)
+			}
+		}
+		n.routes = remaining
+	} else {
+		removeNode(&n.children[bitAt(prefix, n.length)], prefix, length, matches)
+	}
+
+	if len(n.routes) > 0 {
+		return
+	}
+	if n.children[0] == nil {
+		*node = n.children[1]
+	} else if n.children[1] == nil {
+		*node = n.children[0]
+	}
+}
+
+func (n *trieNode) bestRoute() *Route {
+	best := n.routes[0]
+	for _, route := range n.routes[1:] {
+		if route.Distance < best.Distance || (route.Distance == best.Distance && route.Metric < best.Metric) {
+			best = route
+		}
+	}
+	return best
+}
+
+func (n *trieNode) walk(visit func(*trieNode)) {
+	if n == nil {
+		return
+	}
+	visit(n)
+	n.children[0].walk(visit)
+	n.children[1].walk(visit)
+}
@@ -0,0 +1,84 @@
+package l3
+
+import (
+	"bytes"
+	"netsim/protocol"
+	"testing"
+)
+
+/*
+Testcase
+*/
+func TestRoutingTable(t *testing.T) {
+	table := NewRoutingTable()
+	expect := func(name string, addr []byte, gateway []byte, intf int) {
+		route, err := table.Lookup(addr)
+		if err != nil {
+			t.Errorf("%s: Expected a route but got %v", name, err)
+			return
+		}
+		if !bytes.Equal(route.Gateway, gateway) || route.Interface != intf {
+			t.Errorf("%s: Got route via %v on interface %d", name, route.Gateway, route.Interface)
+		}
+	}
+
+	//No route
+	if _, err := table.Lookup([]byte{10, 0, 0, 1}); err != protocol.ErrNoRoute {
+		t.Errorf("Expected no route but got %v", err)
+	}
+	if table.GetInterfaceForAddress([]byte{10, 0, 0, 1}) != -1 {
+		t.Errorf("Expected interface -1 when there is no route")
+	}
+
+	//Longest prefix wins, whatever the order the routes are added in
+	table.Add(&protocol.CIDR{Address: []byte{10, 1, 2, 0}, Mask: 23}, []byte{1, 1, 1, 3}, 3)
+	table.Add(protocol.DefaultRouteCidr, []byte{1, 1, 1, 1}, 0)
+	table.Add(&protocol.CIDR{Address: []byte{10, 0, 0, 0}, Mask: 12}, []byte{1, 1, 1, 2}, 2)
+	table.Add(&protocol.CIDR{Address: []byte{10, 1, 3, 77}, Mask: 32}, nil, 4)
+	table.Add(&protocol.CIDR{Address: []byte{10, 1, 3, 64}, Mask: 27}, []byte{1, 1, 1, 5}, 5)
+
+	expect("Default", []byte{8, 8, 8, 8}, []byte{1, 1, 1, 1}, 0)
+	expect("/12", []byte{10, 15, 0, 1}, []byte{1, 1, 1, 2}, 2)
+	expect("Outside /12", []byte{10, 16, 0, 1}, []byte{1, 1, 1, 1}, 0)
+	expect("/23", []byte{10, 1, 3, 1}, []byte{1, 1, 1, 3}, 3)
+	expect("/27", []byte{10, 1, 3, 80}, []byte{1, 1, 1, 5}, 5)
+	expect("/32", []byte{10, 1, 3, 77}, nil, 4)
+
+	//Lower distance wins over lower metric, and lower metric wins for the same distance
+	prefix := &protocol.CIDR{Address: []byte{172, 16, 0, 0}, Mask: 16}
+	table.AddRoute(&Route{Cidr: prefix, Gateway: []byte{2, 2, 2, 1}, Interface: 1, Metric: 1, Distance: 120})
+	table.AddRoute(&Route{Cidr: prefix, Gateway: []byte{2, 2, 2, 2}, Interface: 2, Metric: 20, Distance: 110})
+	table.AddRoute(&Route{Cidr: prefix, Gateway: []byte{2, 2, 2, 3}, Interface: 3, Metric: 10, Distance: 110})
+	expect("Metric", []byte{172, 16, 9, 9}, []byte{2, 2, 2, 3}, 3)
+
+	table.ReplaceRoute(&Route{Cidr: prefix, Gateway: []byte{2, 2, 2, 4}, Interface: 4, Metric: 30, Distance: 110})
+	expect("Replace", []byte{172, 16, 9, 9}, []byte{2, 2, 2, 4}, 4)
+	table.RemoveRoute(&Route{Cidr: prefix, Gateway: []byte{2, 2, 2, 4}, Interface: 4, Distance: 110})
+	expect("Remove route", []byte{172, 16, 9, 9}, []byte{2, 2, 2, 1}, 1)
+	if len(table.GetRoutes()) != 6 {
+		t.Errorf("Expected 6 routes but got %d", len(table.GetRoutes()))
+	}
+
+	//Removing a prefix falls back to the covering one
+	table.Remove(&protocol.CIDR{Address: []byte{10, 1, 3, 64}, Mask: 27})
+	expect("Removed /27", []byte{10, 1, 3, 80}, []byte{1, 1, 1, 3}, 3)
+	table.Remove(&protocol.CIDR{Address: []byte{10, 1, 2, 0}, Mask: 23})
+	expect("Removed /23", []byte{10, 1, 3, 80}, []byte{1, 1, 1, 2}, 2)
+	expect("Kept /32", []byte{10, 1, 3, 77}, nil, 4)
+	table.Remove(protocol.DefaultRouteCidr)
+	if _, err := table.Lookup([]byte{8, 8, 8, 8}); err != protocol.ErrNoRoute {
+		t.Errorf("Expected no route after removing default route but got %v", err)
+	}
+
+	//Masks longer than the address, or negative, are dropped instead of breaking the lookups
+	routes := len(table.GetRoutes())
+	table.Add(&protocol.CIDR{Address: []byte{10, 1, 3, 0}, Mask: 40}, []byte{1, 1, 1, 6}, 6)
+	table.ReplaceRoute(&Route{Cidr: &protocol.CIDR{Address: []byte{10, 1, 3, 0}, Mask: 33}, Gateway: []byte{1, 1, 1, 7}, Interface: 7})
+	table.Add(&protocol.CIDR{Address: []byte{10, 1, 3, 0}, Mask: -1}, []byte{1, 1, 1, 8}, 8)
+	table.Remove(&protocol.CIDR{Address: []byte{10, 1, 3, 0}, Mask: 40})
+	if len(table.GetRoutes()) != routes {
+		t.Errorf("Expected routes with invalid masks to be dropped but got %d routes", len(table.GetRoutes()))
+	}
+	expect("Invalid masks", []byte{10, 1, 3, 77}, nil, 4)
+	expect("Invalid masks", []byte{10, 1, 3, 80}, []byte{1, 1, 1, 2}, 2)
+}
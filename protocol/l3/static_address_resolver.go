@@ -1,5 +1,7 @@
 package l3
 
+import "encoding/binary"
+
 /*
 Static Address Resolution
 */
@@ -24,5 +26,5 @@ func (s *StaticAddressResolver) Resolve(ipAddr []byte) []byte {
 }
 
 func (s *StaticAddressResolver) ipToKey(ipAddr []byte) int64 {
-	return int64(ipAddr[0]) + 10 ^ 3*int64(ipAddr[1]) + 10 ^ 6*int64(ipAddr[2]) + 10 ^ 9*int64(ipAddr[3])
+	return int64(binary.BigEndian.Uint32(ipAddr))
 }
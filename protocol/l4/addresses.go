@@ -0,0 +1,49 @@
+package l4
+
+import (
+	"netsim/protocol"
+	"strconv"
+)
+
+/*
+The metadata the network protocol sends up starts with the source and destination addresses, optionally followed by the
+interface the packet arrived on (1 byte). Addresses are 4 bytes long for IP and 16 bytes long for IPv6.
+*/
+func getAddresses(metadata []byte) ([]byte, []byte) {
+	addrLen := len(metadata) / 2
+	return metadata[0:addrLen], metadata[addrLen : 2*addrLen]
+}
+
+func getInterface(metadata []byte) byte {
+	if len(metadata)%2 == 0 {
+		return 0
+	}
+	return metadata[len(metadata)-1]
+}
+
+func isUnspecifiedAddress(addr []byte) bool {
+	for _, b := range addr {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+Returns the identifier of the network protocol the address belongs to
+*/
+func getNetworkProtocol(addr []byte) []byte {
+	if len(addr) == 16 {
+		return protocol.IPv6
+	}
+	return protocol.IP
+}
+
+/*
+Bindings of IP and IPv6 can share a port, hence they are kept by both
+*/
+func getPortKey(networkProtocolIdentifier []byte, port uint16) string {
+	return string(networkProtocolIdentifier) + strconv.Itoa(int(port))
+}
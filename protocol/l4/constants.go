@@ -4,5 +4,12 @@ const (
 	defaultBufferSize     = 4096
 	defaultByteBufferSize = 4096 * 8
 	defaultTOS            = 0
-	defaultTTL            = 10
+	dontFragment          = 0x02
+)
+
+/*
+TTL of the packets sent, unless asked for another one
+*/
+const (
+	DefaultTTL = 10
 )
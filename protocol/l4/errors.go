@@ -0,0 +1,20 @@
+package l4
+
+import (
+	"errors"
+	"netsim/protocol"
+)
+
+/*
+Set on a TCP connection which was aborted since the other end stopped acknowledging the data
+*/
+var ErrConnectionTimedOut = errors.New("connection timed out")
+
+/*
+Tell the sender of a packet that it could not be delivered, if the network protocol supports it
+*/
+func reportError(err error, data []byte, metadata []byte, l3Protocol protocol.Protocol, l4Protocol protocol.Protocol) {
+	if reporter, ok := l3Protocol.(protocol.ErrorReporter); ok {
+		reporter.ReportError(err, data, metadata, l4Protocol)
+	}
+}
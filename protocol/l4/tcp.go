@@ -1,6 +1,7 @@
 package l4
 
 import (
+	"bytes"
 	"encoding/binary"
 	"log"
 	"netsim/protocol"
@@ -16,6 +17,13 @@ communication and some other features like flow control, congestion control, etc
 with just reliable communication. That means that data will always arrive and in order. The implementation here is a very
 inefficient way of ensuring reliability called stop-and-wait. Actual protocol uses a sliding window protocol.
 TCP offers a byte based read and write interface.
+If the network protocol knows the path MTU to the other end, data is sent in segments which reach it without being
+fragmented, with Don't Fragment set. A segment which turns out to be too large on the way is sent again in smaller ones.
+Segments which are not acknowledged in time are sent again. The time to wait is worked out from the round trip times seen
+on the connection, and doubles with every attempt until an ACK arrives. If a segment of the full size the path MTU allows
+is lost several times in a row, the network protocol is told that a router on the way might be silently dropping it, and
+the data is sent again in small segments. Larger segments are tried again once the network protocol forgets about the
+small MTU. The connection is aborted if a segment is still not acknowledged after SetMaxRetransmits attempts.
 
 Packet Format:
 
@@ -33,17 +41,30 @@ FIN		- bit 2
 ACK		- bit 3
 RESET	- bit 4
 */
+const (
+	tcpHeaderLength          = 14
+	ipHeaderLength           = 20
+	ipv6HeaderLength         = 40
+	initialRetransmitTimeout = 3 * time.Second
+	minRetransmitTimeout     = 1 * time.Second
+	maxRetransmitTimeout     = 60 * time.Second
+	blackHoleRetransmits     = 3
+	defaultMaxRetransmits    = 8
+)
+
 type TCP struct {
-	identifier   []byte
-	l3Protocols  []protocol.L3Protocol
-	portBindings map[uint16]*TcpBinding
-	lock         sync.Mutex
+	identifier     []byte
+	l3Protocols    []protocol.L3Protocol
+	portBindings   map[string]*TcpBinding
+	maxRetransmits int
+	lock           sync.Mutex
 }
 
 func NewTCP() *TCP {
 	return &TCP{
-		identifier:   protocol.TCP,
-		portBindings: map[uint16]*TcpBinding{},
+		identifier:     protocol.TCP,
+		portBindings:   map[string]*TcpBinding{},
+		maxRetransmits: defaultMaxRetransmits,
 	}
 }
 
@@ -62,11 +83,12 @@ func (t *TCP) SendUp(data []byte, metadata []byte, sender protocol.Protocol) {
 
 	//Extract relevant information
 	destPort := binary.BigEndian.Uint16(data[2:4])
-	destAddr := metadata[4:8]
+	_, destAddr := getAddresses(metadata)
 
-	b, found := t.portBindings[destPort]
+	b, found := t.portBindings[getPortKey(getNetworkProtocol(destAddr), destPort)]
 	if !found {
 		log.Printf("UDP: Got packet for port no one is listening on. Dropping.")
+		reportError(protocol.ErrPortUnreachable, data, metadata, sender, t)
 		return
 	}
 
@@ -88,11 +110,38 @@ func (t *TCP) AddL3Protocol(l3Protocol protocol.L3Protocol) {
 	t.l3Protocols = append(t.l3Protocols, l3Protocol)
 }
 
+/*
+Next method makes this an implementation of ErrorConsumer. The error is handed to the connection which sent the packet.
+*/
+func (t *TCP) ConsumeError(err error, data []byte, metadata []byte) {
+	srcPort := binary.BigEndian.Uint16(data[0:2])
+	destPort := binary.BigEndian.Uint16(data[2:4])
+
+	_, destAddr := getAddresses(metadata)
+
+	t.lock.Lock()
+	b, found := t.portBindings[getPortKey(getNetworkProtocol(destAddr), srcPort)]
+	t.lock.Unlock()
+	if !found {
+		return
+	}
+	connection, found := b.connections[b.getConnectionKey(destAddr, destPort)]
+	if !found {
+		return
+	}
+
+	if err == protocol.ErrFragmentationNeeded {
+		connection.resize(data)
+	} else {
+		connection.fail(err)
+	}
+}
+
 /*
 TCP public API
 */
 func (t *TCP) Bind(ipAddr []byte, port uint16, networkProtocolIdentifier []byte) *TcpBinding {
-	if t.IsPortInUse(port) {
+	if t.IsPortInUseForProtocol(port, networkProtocolIdentifier) {
 		log.Printf("Error: Port already in use")
 		return nil
 	}
@@ -101,16 +150,36 @@ func (t *TCP) Bind(ipAddr []byte, port uint16, networkProtocolIdentifier []byte)
 	defer t.lock.Unlock()
 
 	b := newTcpBinding(t, ipAddr, port, networkProtocolIdentifier)
-	t.portBindings[port] = b
+	t.portBindings[getPortKey(networkProtocolIdentifier, port)] = b
 
 	return b
 }
 
+/*
+Sets how many times a segment is sent again before the connection is aborted
+*/
+func (t *TCP) SetMaxRetransmits(maxRetransmits int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.maxRetransmits = maxRetransmits
+}
+
+/*
+Tells whether the port is bound for IPv4
+*/
 func (t *TCP) IsPortInUse(port uint16) bool {
+	return t.IsPortInUseForProtocol(port, protocol.IP)
+}
+
+/*
+Tells whether the port is bound for the network protocol, since IPv4 and IPv6 each have their own ports
+*/
+func (t *TCP) IsPortInUseForProtocol(port uint16, networkProtocolIdentifier []byte) bool {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	_, found := t.portBindings[port]
+	_, found := t.portBindings[getPortKey(networkProtocolIdentifier, port)]
 	return found
 }
 
@@ -124,7 +193,7 @@ func (t *TCP) isValid(packet []byte) bool {
 }
 
 func (t *TCP) cleanup(b *TcpBinding) {
-	delete(t.portBindings, b.port)
+	delete(t.portBindings, getPortKey(b.networkProtocolIdentifier, b.port))
 }
 
 /*
@@ -138,6 +207,9 @@ type TcpBinding struct {
 	listening                 bool
 	backlogBuf                *utils.Buffer
 	connections               map[string]*TcpConnection
+	tos                       byte
+	err                       error
+	lock                      sync.Mutex
 }
 
 func newTcpBinding(t *TCP, addr []byte, portNum uint16, networkProtocolIdentifier []byte) *TcpBinding {
@@ -163,16 +235,19 @@ func (b *TcpBinding) Accept() *TcpConnection {
 	}
 
 	//Pull out a connection request and create a connection object
+	//The request has both addresses followed by their ports
 	connectionRequest := b.backlogBuf.Get(true)
+	n := (len(connectionRequest) - 4) / 2
 	connection := &TcpConnection{
 		binding:         b,
 		connectionDone:  make(chan bool),
 		isSrc:           false,
-		srcAddr:         connectionRequest[0:4],
-		srcPort:         binary.BigEndian.Uint16(connectionRequest[4:6]),
-		destAddr:        connectionRequest[6:10],
-		destPort:        binary.BigEndian.Uint16(connectionRequest[10:12]),
+		srcAddr:         connectionRequest[0:n],
+		srcPort:         binary.BigEndian.Uint16(connectionRequest[n : n+2]),
+		destAddr:        connectionRequest[n+2 : 2*n+2],
+		destPort:        binary.BigEndian.Uint16(connectionRequest[2*n+2 : 2*n+4]),
 		connectionState: 0,
+		tos:             b.getTos(),
 		readBuffer:      utils.NewByteBuffer(defaultByteBufferSize),
 		writeBuffer:     utils.NewByteBuffer(defaultByteBufferSize),
 	}
@@ -203,6 +278,7 @@ func (b *TcpBinding) Connect(addr []byte, port uint16) *TcpConnection {
 		destAddr:        addr,
 		destPort:        port,
 		connectionState: 0,
+		tos:             b.getTos(),
 		readBuffer:      utils.NewByteBuffer(defaultByteBufferSize),
 		writeBuffer:     utils.NewByteBuffer(defaultByteBufferSize),
 	}
@@ -211,16 +287,45 @@ func (b *TcpBinding) Connect(addr []byte, port uint16) *TcpConnection {
 	//Initiate to the handshake
 	connection.triggerConnectionRequest()
 
-	//Wait until the connection is done
-	<-connection.connectionDone
+	//Wait until the connection is done. Returns nil if the other end could not be reached.
+	if !<-connection.connectionDone {
+		b.err = connection.err
+		return nil
+	}
 	return connection
 }
 
+/*
+Sets the TOS of the connections made or accepted later. The connections already made keep theirs, see
+TcpConnection.SetTos.
+*/
+func (b *TcpBinding) SetTos(tos byte) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.tos = tos
+}
+
+/*
+Returns the error due to which the last connection attempt failed
+*/
+func (b *TcpBinding) GetError() error {
+	return b.err
+}
+
 /*
 Internal methods
 */
+func (b *TcpBinding) getTos() byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.tos
+}
+
 func (b *TcpBinding) sendUp(data []byte, metadata []byte, sender protocol.Protocol) {
-	connectionKey := b.getConnectionKey(metadata[0:4], binary.BigEndian.Uint16(data[0:2]))
+	srcAddr, destAddr := getAddresses(metadata)
+	connectionKey := b.getConnectionKey(srcAddr, binary.BigEndian.Uint16(data[0:2]))
 	connection, found := b.connections[connectionKey]
 	if found {
 		connection.sendUp(data, metadata, sender)
@@ -230,9 +335,9 @@ func (b *TcpBinding) sendUp(data []byte, metadata []byte, sender protocol.Protoc
 			if b.listening {
 				//Received SYN. Create connection requests
 				var connectionRequest []byte
-				connectionRequest = append(connectionRequest, metadata[0:4]...)
+				connectionRequest = append(connectionRequest, srcAddr...)
 				connectionRequest = append(connectionRequest, data[0:2]...)
-				connectionRequest = append(connectionRequest, metadata[4:8]...)
+				connectionRequest = append(connectionRequest, destAddr...)
 				connectionRequest = append(connectionRequest, data[2:4]...)
 
 				//Queue the request
@@ -256,25 +361,22 @@ func (b *TcpBinding) isMatch(destIp []byte, port uint16) bool {
 		return false
 	}
 
-	if binary.BigEndian.Uint32(b.addr) == 0 {
-		return true
+	//Bindings only get the packets of the network protocol they were made for
+	if len(destIp) != len(b.addr) {
+		return false
 	}
 
-	match := true
-	for i := 0; i < 4; i++ {
-		if destIp[i] != b.addr[i] {
-			match = false
-			break
-		}
+	if isUnspecifiedAddress(b.addr) {
+		return true
 	}
 
-	return match
+	return bytes.Equal(destIp, b.addr)
 }
 
 func (b *TcpBinding) cleanup(t *TcpConnection) {
-	key := b.getConnectionKey(t.srcAddr, t.srcPort)
+	key := b.getConnectionKey(t.GetPeerAddress())
 	delete(b.connections, key)
-	if len(b.connections) == 0 {
+	if len(b.connections) == 0 && !b.listening {
 		b.tcp.cleanup(b)
 	}
 }
@@ -303,8 +405,18 @@ type TcpConnection struct {
 	connectionState int
 	dataState       int
 	lastPacketSent  []byte
+	lastSentAt      time.Time
+	retransmits     int
+	blackHoleMss    int
+	srtt            time.Duration
+	rttVar          time.Duration
+	pending         []byte
 	readBuffer      *utils.ByteBuffer
 	writeBuffer     *utils.ByteBuffer
+	err             error
+	lock            sync.Mutex
+	tos             byte
+	tosLock         sync.Mutex
 }
 
 /*
@@ -322,16 +434,59 @@ func (t *TcpConnection) Close() {
 	t.triggerTeardown()
 }
 
+/*
+Returns the address and port of the other end of the connection
+*/
+func (t *TcpConnection) GetPeerAddress() ([]byte, uint16) {
+	if t.isSrc {
+		return t.destAddr, t.destPort
+	}
+	return t.srcAddr, t.srcPort
+}
+
+/*
+Returns false once the connection starts closing, from either end
+*/
+func (t *TcpConnection) IsConnected() bool {
+	return t.connectionState == 3
+}
+
+/*
+Returns the last error reported for the packets sent on the connection
+*/
+func (t *TcpConnection) GetError() error {
+	return t.err
+}
+
+/*
+Sets the TOS of the packets of the connection, leaving the binding and its other connections alone
+*/
+func (t *TcpConnection) SetTos(tos byte) {
+	t.tosLock.Lock()
+	defer t.tosLock.Unlock()
+
+	t.tos = tos
+}
+
 /*
 Internal methods
 */
+func (t *TcpConnection) getTos() byte {
+	t.tosLock.Lock()
+	defer t.tosLock.Unlock()
+
+	return t.tos
+}
+
 func (t *TcpConnection) triggerConnectionRequest() {
+	t.lastSentAt = time.Now()
 	t.sendDown([]byte(""), byte(2))
 	t.connectionState = 1
 	log.Printf("TCP: SYN sent")
 }
 
 func (t *TcpConnection) ackConnectionRequest() {
+	t.lastSentAt = time.Now()
 	t.sendDown([]byte(""), byte(9))
 	t.connectionState = 2
 	log.Printf("TCP: SYN+ACK sent")
@@ -364,6 +519,30 @@ func (t *TcpConnection) completeTeardown() {
 	log.Printf("TCP: ACK sent")
 }
 
+/*
+An error during the handshake aborts the connection. Errors after that are only recorded, since they might be transient.
+*/
+func (t *TcpConnection) fail(err error) {
+	t.err = err
+	log.Printf("TCP: Got error %v", err)
+
+	if t.connectionState == 1 {
+		t.connectionState = 5
+		t.binding.cleanup(t)
+		t.connectionDone <- false
+	}
+}
+
+/*
+Expects the lock to be held. Gives up on the connection, which is closed without telling the other end.
+*/
+func (t *TcpConnection) abort(err error) {
+	t.err = err
+	log.Printf("TCP: Aborting connection: %v", err)
+	t.connectionState = 5
+	t.binding.cleanup(t)
+}
+
 func (t *TcpConnection) triggerAckForPacket(data []byte) {
 	t.sendDown([]byte(""), byte(8))
 	t.recvSeqNum += 1
@@ -371,41 +550,182 @@ func (t *TcpConnection) triggerAckForPacket(data []byte) {
 
 func (t *TcpConnection) sendPeriodically() {
 	for t.connectionState == 3 {
+		t.lock.Lock()
 		if t.dataState == 0 {
-			var data []byte
-			for {
-				b := t.writeBuffer.Get(false)
-				if b == nil {
-					break
-				}
-				data = append(data, *b)
-			}
-
-			if len(data) > 0 {
-				t.sendDown(data, byte(0))
-				//go t.triggerRedeliveryOnTimer(data, t.sendSeqNum, time.NewTimer(2000 * time.Millisecond))
-				t.sendSeqNum += 1
-				t.dataState = 1
-			}
+			t.sendNextSegment()
+		} else if time.Since(t.lastSentAt) > t.getRetransmitTimeout() {
+			t.retransmit()
 		}
+		t.lock.Unlock()
 
 		time.Sleep(500 * time.Millisecond)
 	}
 }
 
-func (t *TcpConnection) triggerRedeliveryOnTimer(data []byte, seqNum uint32, timer *time.Timer) {
-	<-timer.C
-	if t.dataState == 1 && seqNum == t.sendSeqNum-1 {
-		t.sendSeqNum -= 1
-		t.sendDown(data, byte(0))
-		t.sendSeqNum += 1
+/*
+Expects the lock to be held. Sends as much of the data waiting to be sent as fits in one segment.
+*/
+func (t *TcpConnection) sendNextSegment() {
+	mss := t.getMaxSegmentSize()
+	for mss <= 0 || len(t.pending) < mss {
+		b := t.writeBuffer.Get(false)
+		if b == nil {
+			break
+		}
+		t.pending = append(t.pending, *b)
+	}
+	if len(t.pending) == 0 {
+		return
+	}
+
+	size := len(t.pending)
+	if mss > 0 && mss < size {
+		size = mss
+	}
+	data := t.pending[:size]
+	t.pending = t.pending[size:]
+
+	t.sendDown(data, byte(0))
+	t.sendSeqNum += 1
+	t.dataState = 1
+	t.lastSentAt = time.Now()
+}
+
+/*
+Expects the lock to be held. Sends the unacknowledged segment again, or gives up on the other end after too many attempts.
+A segment of the full size the path MTU allows which keeps being lost is taken to be too large for a router which drops
+it without telling. That is only done once per size, since smaller segments lost after that are lost for other reasons.
+*/
+func (t *TcpConnection) retransmit() {
+	t.retransmits++
+	if t.retransmits > t.getMaxRetransmits() {
+		t.abort(ErrConnectionTimedOut)
+		return
+	}
+
+	provider, ok := t.getL3Protocol().(protocol.PathMTUProvider)
+	mss := t.getMaxSegmentSize()
+	isFullSize := mss > 0 && len(t.lastPacketSent)-tcpHeaderLength == mss
+	if ok && isFullSize && mss > t.blackHoleMss && t.retransmits >= blackHoleRetransmits {
+		destAddr, _ := t.GetPeerAddress()
+		provider.ReportBlackHole(destAddr)
+		t.blackHoleMss = t.getMaxSegmentSize()
+		t.requeue()
+		t.sendNextSegment()
+		return
+	}
+
+	log.Printf("TCP: Sending segment again")
+	t.sendSeqNum -= 1
+	t.sendDown(t.lastPacketSent[tcpHeaderLength:], byte(0))
+	t.sendSeqNum += 1
+	t.lastSentAt = time.Now()
+}
+
+/*
+Called when the segment was too large for a link on the way. The path MTU has been updated by now, hence the data is sent
+again in smaller segments.
+*/
+func (t *TcpConnection) resize(data []byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.dataState != 1 || len(data) < 8 || !bytes.Equal(data[4:8], t.lastPacketSent[4:8]) {
+		return
+	}
+
+	log.Printf("TCP: Segment too large for the path. Sending it again in smaller segments.")
+	t.requeue()
+	t.sendNextSegment()
+}
+
+/*
+Expects the lock to be held. Puts the data of the unacknowledged segment back in front of the data waiting to be sent.
+*/
+func (t *TcpConnection) requeue() {
+	t.pending = append(append([]byte{}, t.lastPacketSent[tcpHeaderLength:]...), t.pending...)
+	t.sendSeqNum -= 1
+	t.dataState = 0
+}
+
+/*
+Takes a round trip time into the smoothed estimate and its variation, as in RFC 6298
+*/
+func (t *TcpConnection) updateRtt(rtt time.Duration) {
+	if t.srtt == 0 {
+		t.srtt = rtt
+		t.rttVar = rtt / 2
+		return
+	}
+
+	diff := t.srtt - rtt
+	if diff < 0 {
+		diff = -diff
 	}
+	t.rttVar = (3*t.rttVar + diff) / 4
+	t.srtt = (7*t.srtt + rtt) / 8
+}
+
+/*
+Expects the lock to be held
+*/
+func (t *TcpConnection) getRetransmitTimeout() time.Duration {
+	timeout := initialRetransmitTimeout
+	if t.srtt > 0 {
+		timeout = t.srtt + 4*t.rttVar
+	}
+	if timeout < minRetransmitTimeout {
+		timeout = minRetransmitTimeout
+	}
+
+	for i := 0; i < t.retransmits && timeout < maxRetransmitTimeout; i++ {
+		timeout *= 2
+	}
+	if timeout > maxRetransmitTimeout {
+		timeout = maxRetransmitTimeout
+	}
+	return timeout
+}
+
+func (t *TcpConnection) getMaxRetransmits() int {
+	t.binding.tcp.lock.Lock()
+	defer t.binding.tcp.lock.Unlock()
+
+	return t.binding.tcp.maxRetransmits
+}
+
+/*
+Returns the largest amount of data a segment can carry without being fragmented, or 0 if there is no limit
+*/
+func (t *TcpConnection) getMaxSegmentSize() int {
+	provider, ok := t.getL3Protocol().(protocol.PathMTUProvider)
+	if !ok {
+		return 0
+	}
+
+	headerLength := ipHeaderLength
+	if bytes.Equal(t.binding.networkProtocolIdentifier, protocol.IPv6) {
+		headerLength = ipv6HeaderLength
+	}
+
+	destAddr, _ := t.GetPeerAddress()
+	mtu := provider.GetPathMTU(destAddr)
+	if mtu <= headerLength+tcpHeaderLength {
+		return 0
+	}
+	return mtu - headerLength - tcpHeaderLength
 }
 
 func (t *TcpConnection) sendUp(data []byte, metadata []byte, sender protocol.Protocol) {
 	flags := data[12]
 	switch flags {
 	case 0:
+		//Data sent again after its ACK was lost is only acknowledged again
+		if binary.BigEndian.Uint32(data[4:8]) == t.recvSeqNum-1 {
+			t.recvSeqNum -= 1
+			t.triggerAckForPacket(data)
+			return
+		}
 		for _, b := range data[14:] {
 			t.readBuffer.Put(b)
 		}
@@ -419,6 +739,7 @@ func (t *TcpConnection) sendUp(data []byte, metadata []byte, sender protocol.Pro
 	case 8:
 		if t.connectionState == 2 {
 			//Got ACK for final leg of 3-way handshake
+			t.updateRtt(time.Since(t.lastSentAt))
 			t.connectionState = 3
 			t.connectionDone <- true
 			go t.sendPeriodically()
@@ -428,14 +749,22 @@ func (t *TcpConnection) sendUp(data []byte, metadata []byte, sender protocol.Pro
 			t.binding.cleanup(t)
 		} else if t.connectionState == 3 {
 			// Got ACK for previously sent packet
-			if binary.BigEndian.Uint32(t.lastPacketSent[4:8]) == binary.BigEndian.Uint32(data[8:12]) {
+			t.lock.Lock()
+			if t.dataState == 1 && binary.BigEndian.Uint32(t.lastPacketSent[4:8]) == binary.BigEndian.Uint32(data[8:12]) {
+				//The ACK of a segment sent more than once cannot tell which copy it is for
+				if t.retransmits == 0 {
+					t.updateRtt(time.Since(t.lastSentAt))
+				}
 				t.dataState = 0
+				t.retransmits = 0
 			} else {
 				log.Printf("TCP: Got ACK for incorrect packet")
 			}
+			t.lock.Unlock()
 		}
 	case 9:
 		if t.connectionState == 1 {
+			t.updateRtt(time.Since(t.lastSentAt))
 			t.completeHandshake()
 		} else {
 			log.Printf("TCP: Got unexpected SYN+ACK")
@@ -450,16 +779,7 @@ func (t *TcpConnection) sendUp(data []byte, metadata []byte, sender protocol.Pro
 }
 
 func (t *TcpConnection) sendDown(data []byte, flags byte) {
-	//Find which network protocol to use
-	var l3Protocol protocol.L3Protocol
-	for _, l3P := range t.binding.tcp.l3Protocols {
-		l3PIdentifier := l3P.GetIdentifier()
-		if t.binding.networkProtocolIdentifier[0] == l3PIdentifier[0] && t.binding.networkProtocolIdentifier[1] == l3PIdentifier[1] {
-			l3Protocol = l3P
-			break
-		}
-	}
-
+	l3Protocol := t.getL3Protocol()
 	if l3Protocol == nil {
 		log.Printf("Error: Could not find matching network protocol")
 		return
@@ -504,9 +824,29 @@ func (t *TcpConnection) sendDown(data []byte, flags byte) {
 	//Fill in the checksum
 	packet[13] = utils.CalculateChecksum(packet)[0]
 
-	//Send the packet
-	l3Protocol.SendDown(packet, destAddr, []byte{defaultTOS, defaultTTL}, t.binding.tcp)
+	//Send the packet. Data is sent without fragmentation if it has been sized for the path.
+	metadata := []byte{t.getTos(), DefaultTTL}
+	if _, ok := l3Protocol.(protocol.PathMTUProvider); ok && int(flags) == 0 {
+		metadata = append(metadata, dontFragment)
+	}
+	l3Protocol.SendDown(packet, destAddr, metadata, t.binding.tcp)
+
+	//Hold a copy of data packets for ACK checks. Data can flow both ways, so ACKs sent must not replace it.
+	if int(flags) == 0 {
+		t.lastPacketSent = packet
+	}
+}
+
+/*
+Find which network protocol to use
+*/
+func (t *TcpConnection) getL3Protocol() protocol.L3Protocol {
+	for _, l3P := range t.binding.tcp.l3Protocols {
+		l3PIdentifier := l3P.GetIdentifier()
+		if t.binding.networkProtocolIdentifier[0] == l3PIdentifier[0] && t.binding.networkProtocolIdentifier[1] == l3PIdentifier[1] {
+			return l3P
+		}
+	}
 
-	//Hold a copy for ACK checks
-	t.lastPacketSent = packet
+	return nil
 }
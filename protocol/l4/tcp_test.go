@@ -144,3 +144,86 @@ func runClient(client *tcpNode) {
 	time.Sleep(10 * time.Second)
 	client.close()
 }
+
+func TestRetransmitLimit(t *testing.T) {
+	node1 := newTcpNode(0, []byte("immac1"), []byte{10, 0, 0, 1})
+	node2 := newTcpNode(1, []byte("immac2"), []byte{10, 0, 0, 2})
+	node1.tcp.SetMaxRetransmits(2)
+
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, node1.adapter, node2.adapter)
+
+	go hardware.Clk.Start()
+	node1.turnOn()
+	node2.turnOn()
+
+	node2.bind([]byte{0, 0, 0, 0}, 80)
+	node2.listen()
+	go node2.accept()
+	node1.bind([]byte{0, 0, 0, 0}, 8000)
+	node1.connect([]byte{10, 0, 0, 2}, 80)
+	if node1.conn == nil || !node1.conn.IsConnected() {
+		t.Fatalf("Expected to connect")
+	}
+
+	//The other end goes away, the segment is sent again with growing timeouts until the sender gives up
+	log.Printf("Testcase: Sending to a peer which went away")
+	node2.adapter.TurnOff()
+	start := time.Now()
+	node1.send([]byte("lost"))
+	for deadline := time.Now().Add(60 * time.Second); time.Now().Before(deadline) && node1.conn.IsConnected(); time.Sleep(100 * time.Millisecond) {
+	}
+
+	if node1.conn.IsConnected() || node1.conn.GetError() != ErrConnectionTimedOut {
+		t.Fatalf("Expected the connection to be aborted but got %v", node1.conn.GetError())
+	}
+	//Timeouts of at least 1, 2 and 4 seconds
+	if elapsed := time.Since(start); elapsed < 7*time.Second {
+		t.Errorf("Expected the timeouts to back off but the connection was aborted after %v", elapsed)
+	}
+	if node1.tcp.IsPortInUse(8000) {
+		t.Errorf("Expected the port to be released")
+	}
+}
+
+func TestTosPerConnection(t *testing.T) {
+	node1 := newTcpNode(0, []byte("immac1"), []byte{10, 0, 0, 1})
+	node2 := newTcpNode(1, []byte("immac2"), []byte{10, 0, 0, 2})
+
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, node1.adapter, node2.adapter)
+
+	go hardware.Clk.Start()
+	node1.turnOn()
+	node2.turnOn()
+
+	//The connections accepted start with the TOS of the listening binding
+	node2.bind([]byte{0, 0, 0, 0}, 80)
+	node2.binding.SetTos(0xB8)
+	if !node2.tcp.IsPortInUse(80) || node2.tcp.IsPortInUseForProtocol(80, protocol.IPv6) {
+		t.Errorf("Expected the port to be in use for IPv4 only")
+	}
+	node2.listen()
+	accepted := make(chan *TcpConnection, 1)
+	go func() { accepted <- node2.binding.Accept() }()
+	node1.bind([]byte{0, 0, 0, 0}, 8000)
+	node1.connect([]byte{10, 0, 0, 2}, 80)
+
+	var conn *TcpConnection
+	select {
+	case conn = <-accepted:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected the connection to be accepted")
+	}
+	if conn.getTos() != 0xB8 {
+		t.Fatalf("Expected the accepted connection to inherit the TOS but got %#x", conn.getTos())
+	}
+
+	//Later changes on either side do not leak to the other
+	node2.binding.SetTos(0x20)
+	if conn.getTos() != 0xB8 {
+		t.Errorf("Expected the accepted connection to keep its TOS but got %#x", conn.getTos())
+	}
+	conn.SetTos(0x10)
+	if conn.getTos() != 0x10 || node2.binding.getTos() != 0x20 {
+		t.Errorf("Expected the TOS to be set on the connection only but got %#x and %#x", conn.getTos(), node2.binding.getTos())
+	}
+}
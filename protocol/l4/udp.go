@@ -1,6 +1,7 @@
 package l4
 
 import (
+	"bytes"
 	"encoding/binary"
 	"log"
 	"netsim/protocol"
@@ -10,8 +11,9 @@ import (
 
 /*
 We will implement UDP which is a simple de-multiplexing protocol for process-to-process communication. I will keep the
-implementation as simple as possible. That means no two processes can listen on same port no matter what. This is very
-different than what happens in real OS implementations, if host has multiple IP addresses or SO_REUSEADDR is set. Also,
+implementation as simple as possible. That means no two processes can listen on same port no matter what, unless one uses IP
+and the other IPv6. This is very different than what happens in real OS implementations, if host has multiple IP
+addresses or SO_REUSEADDR is set. Also,
 since UDP only needs to run on hosts, I am making the assumption that there is just one network interface on the host
 and hence do not need to deal multi-host scenario.
 
@@ -22,18 +24,30 @@ DestPort	- 2 byte
 Length		- 2 byte
 Checksum	- 1 byte
 Data		- No fixed length
+
+Metadata for sending is DestPort (2 bytes), SrcPort (2 bytes) and network protocol (2 bytes), optionally followed by the
+interface to send from (1 byte), for when the network protocol cannot route the packet itself, the TTL (1 byte) and the
+TOS (1 byte). An interface of AnyInterface lets the network protocol pick one, and packets are sent with DefaultTTL
+unless a TTL is given.
+
+Bindings can join multicast groups, if the network protocol supports them. The groups are left when the binding is
+closed.
 */
+const (
+	AnyInterface = 0xFF
+)
+
 type UDP struct {
 	identifier   []byte
 	l3Protocols  []protocol.L3Protocol
-	portBindings map[uint16]*UdpBinding
+	portBindings map[string]*UdpBinding
 	lock         sync.Mutex
 }
 
 func NewUDP() *UDP {
 	return &UDP{
 		identifier:   protocol.UDP,
-		portBindings: map[uint16]*UdpBinding{},
+		portBindings: map[string]*UdpBinding{},
 	}
 }
 
@@ -52,18 +66,27 @@ func (u *UDP) SendUp(data []byte, metadata []byte, sender protocol.Protocol) {
 
 	//Extract relevant information
 	destPort := binary.BigEndian.Uint16(data[2:4])
-	destAddr := metadata[4:8]
+	srcAddr, destAddr := getAddresses(metadata)
 
-	b, found := u.portBindings[destPort]
+	b, found := u.portBindings[getPortKey(getNetworkProtocol(destAddr), destPort)]
 	if !found {
 		log.Printf("UDP: Got packet for port no one is listening on. Dropping.")
+		reportError(protocol.ErrPortUnreachable, data, metadata, sender, u)
 		return
 	}
 
 	if b.isMatch(destAddr, destPort) {
-		b.putInBuffer(data[7:])
+		//Keep where the packet came from along with the data. The address is preceded by its length.
+		var item []byte
+		item = append(item, byte(len(srcAddr)))
+		item = append(item, srcAddr...)
+		item = append(item, data[0:2]...)
+		item = append(item, getInterface(metadata))
+		item = append(item, data[7:]...)
+		b.putInBuffer(item)
 	} else {
 		log.Printf("UDP: Got packet for different address. Dropping.")
+		reportError(protocol.ErrPortUnreachable, data, metadata, sender, u)
 	}
 }
 
@@ -77,15 +100,7 @@ func (u *UDP) SendDown(data []byte, destAddr []byte, metadata []byte, sender pro
 	binary.BigEndian.PutUint16(length, uint16(7+len(data)))
 
 	//Find which network protocol to use
-	networkProtocolIdentifier := metadata[4:6]
-	var l3Protocol protocol.L3Protocol
-	for _, l3P := range u.l3Protocols {
-		l3PIdentifier := l3P.GetIdentifier()
-		if networkProtocolIdentifier[0] == l3PIdentifier[0] && networkProtocolIdentifier[1] == l3PIdentifier[1] {
-			l3Protocol = l3P
-			break
-		}
-	}
+	l3Protocol := u.getL3Protocol(metadata[4:6])
 
 	if l3Protocol == nil {
 		log.Printf("Error: Could not find matching network protocol")
@@ -103,8 +118,21 @@ func (u *UDP) SendDown(data []byte, destAddr []byte, metadata []byte, sender pro
 	//Fill in the checksum
 	packet[6] = utils.CalculateChecksum(packet)[0]
 
-	//Send the packet
-	l3Protocol.SendDown(packet, destAddr, []byte{defaultTOS, defaultTTL}, u)
+	ttl := byte(DefaultTTL)
+	if len(metadata) > 7 {
+		ttl = metadata[7]
+	}
+	tos := byte(defaultTOS)
+	if len(metadata) > 8 {
+		tos = metadata[8]
+	}
+
+	//Send the packet, from the given interface if any
+	if sender, ok := l3Protocol.(protocol.InterfaceSender); ok && len(metadata) > 6 && metadata[6] != AnyInterface {
+		sender.SendDownOnInterface(int(metadata[6]), packet, destAddr, []byte{tos, ttl}, u)
+		return
+	}
+	l3Protocol.SendDown(packet, destAddr, []byte{tos, ttl}, u)
 }
 
 /*
@@ -114,11 +142,28 @@ func (u *UDP) AddL3Protocol(l3Protocol protocol.L3Protocol) {
 	u.l3Protocols = append(u.l3Protocols, l3Protocol)
 }
 
+/*
+Next method makes this an implementation of ErrorConsumer. The error is kept on the binding which sent the packet.
+*/
+func (u *UDP) ConsumeError(err error, data []byte, metadata []byte) {
+	srcPort := binary.BigEndian.Uint16(data[0:2])
+	_, destAddr := getAddresses(metadata)
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	b, found := u.portBindings[getPortKey(getNetworkProtocol(destAddr), srcPort)]
+	if !found {
+		return
+	}
+	b.err = err
+}
+
 /*
 UDP public API
 */
 func (u *UDP) Bind(ipAddr []byte, port uint16, networkProtocolIdentifier []byte) *UdpBinding {
-	if u.IsPortInUse(port) {
+	if u.IsPortInUseForProtocol(port, networkProtocolIdentifier) {
 		log.Printf("Error: Port already in use")
 		return nil
 	}
@@ -127,22 +172,42 @@ func (u *UDP) Bind(ipAddr []byte, port uint16, networkProtocolIdentifier []byte)
 	defer u.lock.Unlock()
 
 	b := newUdpBinding(u, ipAddr, port, networkProtocolIdentifier)
-	u.portBindings[port] = b
+	u.portBindings[getPortKey(networkProtocolIdentifier, port)] = b
 
 	return b
 }
 
+/*
+Tells whether the port is bound for IPv4
+*/
 func (u *UDP) IsPortInUse(port uint16) bool {
+	return u.IsPortInUseForProtocol(port, protocol.IP)
+}
+
+/*
+Tells whether the port is bound for the network protocol, since IPv4 and IPv6 each have their own ports
+*/
+func (u *UDP) IsPortInUseForProtocol(port uint16, networkProtocolIdentifier []byte) bool {
 	u.lock.Lock()
 	defer u.lock.Unlock()
 
-	_, found := u.portBindings[port]
+	_, found := u.portBindings[getPortKey(networkProtocolIdentifier, port)]
 	return found
 }
 
 /*
 Internal methods
 */
+func (u *UDP) getL3Protocol(networkProtocolIdentifier []byte) protocol.L3Protocol {
+	for _, l3P := range u.l3Protocols {
+		if bytes.Equal(l3P.GetIdentifier(), networkProtocolIdentifier) {
+			return l3P
+		}
+	}
+
+	return nil
+}
+
 func (u *UDP) isValid(packet []byte) bool {
 	actual := packet[6]
 	calculated := utils.CalculateChecksum(packet)[0] - actual
@@ -158,6 +223,13 @@ type UdpBinding struct {
 	port                      uint16
 	networkProtocolIdentifier []byte
 	buffer                    *utils.Buffer
+	err                       error
+	groups                    []udpGroupMembership
+}
+
+type udpGroupMembership struct {
+	group    []byte
+	intfAddr []byte
 }
 
 func newUdpBinding(udp *UDP, ipAddr []byte, port uint16, networkProtocolIdentifier []byte) *UdpBinding {
@@ -172,13 +244,89 @@ func newUdpBinding(udp *UDP, ipAddr []byte, port uint16, networkProtocolIdentifi
 
 func (b *UdpBinding) Close() {
 	b.udp.lock.Lock()
-	defer b.udp.lock.Unlock()
+	groups := b.groups
+	b.groups = nil
+	delete(b.udp.portBindings, getPortKey(b.networkProtocolIdentifier, b.port))
+	b.udp.lock.Unlock()
 
-	delete(b.udp.portBindings, b.port)
+	for _, m := range groups {
+		b.leaveGroup(m.group, m.intfAddr)
+	}
+}
+
+/*
+Receive the packets sent to the group on the interface with the given address, or the one chosen by the network protocol
+if the address is nil
+*/
+func (b *UdpBinding) JoinGroup(group []byte, intfAddr []byte) {
+	membership, ok := b.udp.getL3Protocol(b.networkProtocolIdentifier).(protocol.GroupMembership)
+	if !ok {
+		log.Printf("UDP: Network protocol does not support multicast")
+		return
+	}
+
+	b.udp.lock.Lock()
+	b.groups = append(b.groups, udpGroupMembership{group: group, intfAddr: intfAddr})
+	b.udp.lock.Unlock()
+
+	membership.JoinGroup(group, intfAddr)
+}
+
+func (b *UdpBinding) LeaveGroup(group []byte, intfAddr []byte) {
+	b.udp.lock.Lock()
+	found := false
+	for i, m := range b.groups {
+		if bytes.Equal(m.group, group) && bytes.Equal(m.intfAddr, intfAddr) {
+			b.groups = append(b.groups[:i], b.groups[i+1:]...)
+			found = true
+			break
+		}
+	}
+	b.udp.lock.Unlock()
+
+	if found {
+		b.leaveGroup(group, intfAddr)
+	}
+}
+
+func (b *UdpBinding) leaveGroup(group []byte, intfAddr []byte) {
+	if membership, ok := b.udp.getL3Protocol(b.networkProtocolIdentifier).(protocol.GroupMembership); ok {
+		membership.LeaveGroup(group, intfAddr)
+	}
 }
 
 func (b *UdpBinding) Recv() []byte {
-	return b.buffer.Get(false)
+	item := b.buffer.Get(false)
+	if item == nil {
+		return nil
+	}
+
+	return item[int(item[0])+4:]
+}
+
+/*
+Same as Recv, but also returns the address and port the data came from, and the interface it arrived on
+*/
+func (b *UdpBinding) RecvFrom() ([]byte, []byte, uint16, int) {
+	item := b.buffer.Get(false)
+	if item == nil {
+		return nil, nil, 0, -1
+	}
+
+	n := int(item[0])
+	return item[n+4:], item[1 : n+1], binary.BigEndian.Uint16(item[n+1 : n+3]), int(item[n+3])
+}
+
+/*
+Returns the error for the last packet which could not be delivered, if any, and clears it
+*/
+func (b *UdpBinding) GetError() error {
+	b.udp.lock.Lock()
+	defer b.udp.lock.Unlock()
+
+	err := b.err
+	b.err = nil
+	return err
 }
 
 func (b *UdpBinding) putInBuffer(item []byte) {
@@ -190,17 +338,14 @@ func (b *UdpBinding) isMatch(destIp []byte, port uint16) bool {
 		return false
 	}
 
-	if binary.BigEndian.Uint32(b.ip) == 0 {
-		return true
+	//Bindings only get the packets of the network protocol they were made for
+	if len(destIp) != len(b.ip) {
+		return false
 	}
 
-	match := true
-	for i := 0; i < 4; i++ {
-		if destIp[i] != b.ip[i] {
-			match = false
-			break
-		}
+	if isUnspecifiedAddress(b.ip) {
+		return true
 	}
 
-	return match
+	return bytes.Equal(destIp, b.ip)
 }
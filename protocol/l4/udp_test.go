@@ -7,12 +7,14 @@ import (
 	"netsim/protocol"
 	"netsim/protocol/l2"
 	"netsim/protocol/l3"
+	"sync"
 	"testing"
 	"time"
 )
 
 type node struct {
 	adapter         *hardware.EthernetAdapter
+	ethernet        *l2.Ethernet
 	udp             *UDP
 	binding         *UdpBinding
 	routeProvider   protocol.RouteProvider
@@ -50,6 +52,7 @@ func newNode(id int, mac []byte, ipAddr []byte) *node {
 	ip.AddL4Protocol(udp)
 	udp.AddL3Protocol(ip)
 
+	n.ethernet = ethernet
 	n.udp = udp
 	return n
 }
@@ -100,3 +103,55 @@ func TestSimpleDataTransfer(t *testing.T) {
 	node2.recv()
 	time.Sleep(5 * time.Second)
 }
+
+/*
+Remembers the TTL of the IP packets received
+*/
+type ttlRecorder struct {
+	ttls []byte
+	lock sync.Mutex
+}
+
+func (r *ttlRecorder) SendUp(frame []byte, metadata []byte, sender protocol.Protocol) {
+	if frame[22] != protocol.IP[0] || frame[23] != protocol.IP[1] {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ttls = append(r.ttls, frame[24+9])
+}
+
+func (r *ttlRecorder) get() []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]byte{}, r.ttls...)
+}
+
+func TestSendTtl(t *testing.T) {
+	node1 := newNode(0, []byte("immac1"), []byte{10, 0, 0, 1})
+	node2 := newNode(1, []byte("immac2"), []byte{10, 0, 0, 2})
+	recorder := &ttlRecorder{}
+	node2.ethernet.SetRawConsumer(recorder)
+
+	_ = hardware.NewDuplexLink(1, 1e9, 0.00, node1.adapter, node2.adapter)
+
+	go hardware.Clk.Start()
+	node1.turnOn()
+	node2.turnOn()
+
+	//Without a TTL the default one is used, and a TTL of 0 is sent as is
+	node1.send([]byte("default_ttl"), []byte{10, 0, 0, 2}, 80)
+	metadata := []byte{0, 80, 0, 100}
+	metadata = append(metadata, protocol.IP...)
+	metadata = append(metadata, AnyInterface, 0, defaultTOS)
+	node1.udp.SendDown([]byte("zero_ttl"), []byte{10, 0, 0, 2}, metadata, nil)
+
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline) && len(recorder.get()) < 2; time.Sleep(100 * time.Millisecond) {
+	}
+	ttls := recorder.get()
+	if len(ttls) != 2 || ttls[0] != DefaultTTL || ttls[1] != 0 {
+		t.Fatalf("Expected TTLs %d and 0 but got %v", DefaultTTL, ttls)
+	}
+}
@@ -0,0 +1,836 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"math/rand"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"netsim/protocol/l4"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+BGP is the routing protocol used between autonomous systems (AS), which are networks run by different organisations.
+Each AS has a number, and its border routers talk to the border routers of the neighbouring ASes over TCP sessions. A
+router tells its neighbours which prefixes it can reach, along with the list of ASes the path goes through (AS_PATH).
+This is why it is called a path vector protocol. A router which finds its own AS in a path drops it, which prevents loops.
+Routers in the same AS also talk over BGP (iBGP) to share what they learn from the outside, but they do not pass on what
+they learn from each other, since every router in the AS is expected to peer with every other one.
+
+Unlike interior protocols, BGP is driven by policy rather than by the shortest path. The paths learnt from a neighbour go
+through its import policy, which can drop them or set their local preference, and the paths sent to a neighbour go through
+its export policy. The best path for a prefix is the one with the highest local preference, then the shortest AS_PATH,
+then the one learnt over eBGP, and finally the one from the neighbour with the lowest address. Nothing stops a router
+from announcing a prefix it does not own, or passing on paths it should not (route leak), other than the policies of its
+neighbours.
+
+Since the TCP of the simulation cannot handle both ends connecting at the same time, only the router with the lower
+address on the link connects, and the other one waits for the connection. Once connected, both send an OPEN with their AS
+number, and after that KEEPALIVEs, so that a session whose peer went quiet for the hold time can be taken down. Paths
+are sent in UPDATE messages, and the paths of a session which goes down are forgotten.
+
+Best paths learnt from neighbours are put in the routing table of the router, after resolving their next hop through
+the table.
+
+Message Format (simplified BGP-4):
+
+Length		- 2 bytes
+Type		- 1 byte
+Body		- No fixed length
+
+OPEN Body:
+
+Version		- 1 byte
+AS			- 2 bytes
+Hold Time	- 4 bytes, in milliseconds
+BGP ID		- 4 bytes
+
+UPDATE Body:
+
+Withdrawn Count		- 2 bytes
+Withdrawn Prefixes	- 5 bytes each. Each is Mask (1 byte) and Address (4 bytes).
+Local Preference	- 4 bytes
+Next Hop			- 4 bytes
+AS_PATH Length		- 1 byte
+AS_PATH				- 2 bytes each
+NLRI Count			- 2 bytes
+NLRI				- 5 bytes each, like the withdrawn prefixes
+
+NOTIFICATION Body:
+
+Error Code	- 1 byte. 2 for a bad OPEN, 3 for a bad UPDATE, 4 when the hold time expired, and 6 when BGP is stopped.
+
+KEEPALIVE has no body.
+*/
+const (
+	BgpPort       = 179
+	DistanceEbgp  = 20
+	DistanceIbgp  = 200
+	BgpLocalPref  = 100
+	bgpConnectMin = 49152
+)
+
+const (
+	bgpOpen             = 1
+	bgpUpdate           = 2
+	bgpNotification     = 3
+	bgpKeepalive        = 4
+	bgpVersion          = 4
+	bgpHeaderLength     = 3
+	bgpOpenLength       = 11
+	bgpPrefixLength     = 5
+	bgpErrorOpen        = 2
+	bgpErrorUpdate      = 3
+	bgpErrorHoldTimer   = 4
+	bgpErrorCease       = 6
+	bgpHoldTime         = 90 * time.Second
+	bgpConnectRetryTime = 5 * time.Second
+	bgpSendInterval     = 100 * time.Millisecond
+	bgpListenBacklog    = 16
+	bgpStateIdle        = 0
+	bgpStateOpenSent    = 1
+	bgpStateEstablished = 2
+)
+
+/*
+A policy gets a copy of each path, and returns false to drop it. It can change the local preference or the AS_PATH.
+*/
+type BgpPolicy func(path *BgpPath) bool
+
+/*
+A path to a prefix. From is the address of the neighbour it was learnt from, or nil for the prefixes of this router.
+*/
+type BgpPath struct {
+	Prefix    *protocol.CIDR
+	NextHop   []byte
+	AsPath    []uint16
+	LocalPref int
+	From      []byte
+	Ebgp      bool
+}
+
+type BgpNeighbor struct {
+	Address []byte
+	As      uint16
+	Import  BgpPolicy
+	Export  BgpPolicy
+}
+
+type BGP struct {
+	as        uint16
+	routerId  []byte
+	ip        *l3.IP
+	tcp       *l4.TCP
+	table     *l3.RoutingTable
+	networks  map[string]*protocol.CIDR
+	peers     map[string]*bgpPeer
+	best      map[string]*BgpPath
+	installed map[string]*l3.Route
+	holdTime  time.Duration
+	retryTime time.Duration
+	binding   *l4.TcpBinding
+	running   bool
+	lock      sync.Mutex
+}
+
+/*
+Constructor
+*/
+func NewBGP(ip *l3.IP, tcp *l4.TCP, table *l3.RoutingTable, as uint16, routerId []byte) *BGP {
+	return &BGP{
+		as:        as,
+		routerId:  routerId,
+		ip:        ip,
+		tcp:       tcp,
+		table:     table,
+		networks:  map[string]*protocol.CIDR{},
+		peers:     map[string]*bgpPeer{},
+		best:      map[string]*BgpPath{},
+		installed: map[string]*l3.Route{},
+		holdTime:  bgpHoldTime,
+		retryTime: bgpConnectRetryTime,
+	}
+}
+
+/*
+BGP public API
+*/
+func (b *BGP) Start() {
+	b.binding = b.tcp.Bind([]byte{0, 0, 0, 0}, BgpPort, protocol.IP)
+	if b.binding == nil {
+		return
+	}
+	b.binding.Listen(bgpListenBacklog)
+
+	b.lock.Lock()
+	b.running = true
+	b.selectBestPaths()
+	for _, p := range b.peers {
+		go b.runPeer(p)
+	}
+	b.lock.Unlock()
+
+	go b.accept()
+}
+
+func (b *BGP) Stop() {
+	b.lock.Lock()
+	b.running = false
+	for key, route := range b.installed {
+		b.table.RemoveRoute(route)
+		delete(b.installed, key)
+	}
+	b.lock.Unlock()
+}
+
+/*
+Changes the timers. The hold time is offered to the neighbours, and the lower of the two is used for a session.
+*/
+func (b *BGP) SetTimers(holdTime time.Duration, connectRetryTime time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.holdTime = holdTime
+	b.retryTime = connectRetryTime
+}
+
+/*
+Adds a neighbour. It is in the same AS if it has the AS of this router.
+*/
+func (b *BGP) AddNeighbor(neighbor *BgpNeighbor) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	p := &bgpPeer{
+		config:     neighbor,
+		incoming:   make(chan *l4.TcpConnection, 1),
+		received:   map[string]*BgpPath{},
+		advertised: map[string]string{},
+	}
+	b.peers[string(neighbor.Address)] = p
+	if b.running {
+		go b.runPeer(p)
+	}
+}
+
+/*
+Announces the prefix as reachable through this router. The prefix should be routed by the router, either because it is
+connected or through an interior protocol.
+*/
+func (b *BGP) AddNetwork(prefix *protocol.CIDR) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.networks[cidrKey(prefix)] = prefix
+	b.selectBestPaths()
+}
+
+func (b *BGP) RemoveNetwork(prefix *protocol.CIDR) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.networks, cidrKey(prefix))
+	b.selectBestPaths()
+}
+
+/*
+Returns the best path for every prefix known
+*/
+func (b *BGP) GetBestPaths() []*BgpPath {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var paths []*BgpPath
+	for _, path := range b.best {
+		paths = append(paths, path.copy())
+	}
+	sortPaths(paths)
+	return paths
+}
+
+/*
+Returns all the paths known for the prefix, including the ones not used
+*/
+func (b *BGP) GetPaths(prefix *protocol.CIDR) []*BgpPath {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var paths []*BgpPath
+	for _, path := range b.candidates(cidrKey(prefix)) {
+		paths = append(paths, path.copy())
+	}
+	return paths
+}
+
+/*
+Returns the addresses of the neighbours with an established session
+*/
+func (b *BGP) GetEstablishedNeighbors() [][]byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var neighbors [][]byte
+	for _, p := range b.peers {
+		if p.state == bgpStateEstablished {
+			neighbors = append(neighbors, p.config.Address)
+		}
+	}
+	return neighbors
+}
+
+/*
+Internal methods
+*/
+func (b *BGP) isRunning() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.running
+}
+
+/*
+Hands the connections from the neighbours to their sessions
+*/
+func (b *BGP) accept() {
+	for b.isRunning() {
+		conn := b.binding.Accept()
+		if conn == nil {
+			continue
+		}
+
+		addr, _ := conn.GetPeerAddress()
+		b.lock.Lock()
+		p, found := b.peers[string(addr)]
+		b.lock.Unlock()
+
+		if !found || !b.isRunning() {
+			log.Printf("BGP: Got connection from %v which is not a neighbour. Closing.", addr)
+			conn.Close()
+			continue
+		}
+		select {
+		case p.incoming <- conn:
+		default:
+			conn.Close()
+		}
+	}
+}
+
+/*
+Keeps a session with the neighbour up while BGP is running
+*/
+func (b *BGP) runPeer(p *bgpPeer) {
+	for b.isRunning() {
+		conn := b.connect(p)
+		if conn == nil {
+			continue
+		}
+
+		b.runSession(p, conn)
+		conn.Close()
+
+		b.lock.Lock()
+		p.state = bgpStateIdle
+		p.received = map[string]*BgpPath{}
+		p.advertised = map[string]string{}
+		b.selectBestPaths()
+		retryTime := b.retryTime
+		b.lock.Unlock()
+
+		time.Sleep(retryTime)
+	}
+}
+
+/*
+Connects to the neighbour, or waits for it to connect, depending on which one has the lower address
+*/
+func (b *BGP) connect(p *bgpPeer) *l4.TcpConnection {
+	localAddr := b.getLocalAddress(p.config.Address)
+	b.lock.Lock()
+	retryTime := b.retryTime
+	b.lock.Unlock()
+
+	if localAddr == nil || bytes.Compare(localAddr, p.config.Address) > 0 {
+		select {
+		case conn := <-p.incoming:
+			return conn
+		case <-time.After(retryTime):
+			return nil
+		}
+	}
+
+	binding := b.bindAnyPort(localAddr)
+	if binding == nil {
+		time.Sleep(retryTime)
+		return nil
+	}
+	conn := binding.Connect(p.config.Address, BgpPort)
+	if conn == nil {
+		log.Printf("BGP: Could not connect to %v: %v", p.config.Address, binding.GetError())
+		time.Sleep(retryTime)
+	}
+	return conn
+}
+
+func (b *BGP) runSession(p *bgpPeer, conn *l4.TcpConnection) {
+	b.lock.Lock()
+	holdTime := b.holdTime
+	p.state = bgpStateOpenSent
+	b.lock.Unlock()
+
+	open := make([]byte, bgpOpenLength)
+	open[0] = bgpVersion
+	binary.BigEndian.PutUint16(open[1:3], b.as)
+	binary.BigEndian.PutUint32(open[3:7], uint32(holdTime/time.Millisecond))
+	copy(open[7:11], b.routerId)
+	sendBgpMessage(conn, bgpOpen, open)
+
+	var buffer []byte
+	lastReceived := time.Now()
+	lastKeepalive := time.Now()
+	for b.isRunning() && conn.IsConnected() {
+		for {
+			c := conn.Recv()
+			if c == nil {
+				break
+			}
+			buffer = append(buffer, *c)
+		}
+
+		//Handle the complete messages
+		for len(buffer) >= bgpHeaderLength && int(binary.BigEndian.Uint16(buffer[0:2])) <= len(buffer) {
+			length := int(binary.BigEndian.Uint16(buffer[0:2]))
+			if length < bgpHeaderLength {
+				return
+			}
+			msgType, body := buffer[2], buffer[bgpHeaderLength:length]
+			buffer = buffer[length:]
+			lastReceived = time.Now()
+
+			switch msgType {
+			case bgpOpen:
+				if len(body) < bgpOpenLength || binary.BigEndian.Uint16(body[1:3]) != p.config.As {
+					log.Printf("BGP: AS %d: Neighbour %v is not in AS %d. Closing.", b.as, p.config.Address, p.config.As)
+					sendBgpMessage(conn, bgpNotification, []byte{bgpErrorOpen})
+					return
+				}
+				if offered := time.Duration(binary.BigEndian.Uint32(body[3:7])) * time.Millisecond; offered < holdTime {
+					holdTime = offered
+				}
+
+				b.lock.Lock()
+				p.state = bgpStateEstablished
+				b.lock.Unlock()
+				log.Printf("BGP: AS %d: Session with %v is established", b.as, p.config.Address)
+			case bgpUpdate:
+				if !b.handleUpdate(p, body) {
+					log.Printf("BGP: AS %d: Got a malformed UPDATE from %v. Closing.", b.as, p.config.Address)
+					sendBgpMessage(conn, bgpNotification, []byte{bgpErrorUpdate})
+					return
+				}
+			case bgpNotification:
+				log.Printf("BGP: AS %d: Neighbour %v closed the session", b.as, p.config.Address)
+				return
+			}
+		}
+
+		if time.Since(lastReceived) > holdTime {
+			log.Printf("BGP: AS %d: Hold time expired for %v", b.as, p.config.Address)
+			sendBgpMessage(conn, bgpNotification, []byte{bgpErrorHoldTimer})
+			return
+		}
+		if time.Since(lastKeepalive) > holdTime/3 {
+			sendBgpMessage(conn, bgpKeepalive, nil)
+			lastKeepalive = time.Now()
+		}
+		b.sendUpdates(p, conn)
+
+		time.Sleep(bgpSendInterval)
+	}
+
+	if !b.isRunning() {
+		sendBgpMessage(conn, bgpNotification, []byte{bgpErrorCease})
+	}
+}
+
+/*
+Returns false if the UPDATE is malformed, in which case nothing it carries is used
+*/
+func (b *BGP) handleUpdate(p *bgpPeer, body []byte) bool {
+	withdrawn, path, nlri, valid := decodeBgpUpdate(body)
+	if !valid {
+		return false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if p.state != bgpStateEstablished {
+		return true
+	}
+	for _, prefix := range withdrawn {
+		delete(p.received, cidrKey(prefix))
+	}
+
+	for _, prefix := range nlri {
+		key := cidrKey(prefix)
+		delete(p.received, key)
+
+		received := path.copy()
+		received.Prefix = prefix
+		received.From = p.config.Address
+		received.Ebgp = p.config.As != b.as
+		if received.Ebgp {
+			received.LocalPref = BgpLocalPref
+		}
+
+		//A path which went through this AS already would make a loop
+		if containsAs(received.AsPath, b.as) {
+			continue
+		}
+		if p.config.Import != nil && !p.config.Import(received) {
+			continue
+		}
+		p.received[key] = received
+	}
+
+	b.selectBestPaths()
+	return true
+}
+
+/*
+Sends the changes between what the neighbour should have and what it was sent
+*/
+func (b *BGP) sendUpdates(p *bgpPeer, conn *l4.TcpConnection) {
+	localAddr := b.getLocalAddress(p.config.Address)
+
+	b.lock.Lock()
+	if p.state != bgpStateEstablished {
+		b.lock.Unlock()
+		return
+	}
+
+	ebgp := p.config.As != b.as
+	wanted := map[string]*BgpPath{}
+	for key, path := range b.best {
+		//Never send a path back where it came from, and iBGP paths are not passed on to iBGP neighbours
+		if bytes.Equal(path.From, p.config.Address) || (!ebgp && path.From != nil && !path.Ebgp) {
+			continue
+		}
+
+		exported := path.copy()
+		exported.NextHop = localAddr
+		if ebgp {
+			exported.AsPath = append([]uint16{b.as}, exported.AsPath...)
+			exported.LocalPref = 0
+		}
+		if p.config.Export != nil && !p.config.Export(exported) {
+			continue
+		}
+		wanted[key] = exported
+	}
+
+	var withdrawn []*protocol.CIDR
+	for key := range p.advertised {
+		if _, found := wanted[key]; !found {
+			withdrawn = append(withdrawn, keyToCidr(key))
+			delete(p.advertised, key)
+		}
+	}
+	var updates [][]byte
+	if len(withdrawn) > 0 {
+		updates = append(updates, encodeBgpUpdate(withdrawn, nil))
+	}
+	for key, path := range wanted {
+		encoded := string(encodeBgpUpdate(nil, path))
+		if p.advertised[key] != encoded {
+			p.advertised[key] = encoded
+			updates = append(updates, []byte(encoded))
+		}
+	}
+	b.lock.Unlock()
+
+	for _, u := range updates {
+		sendBgpMessage(conn, bgpUpdate, u)
+	}
+}
+
+/*
+Picks the best path for every prefix and updates the routing table. Expects the lock to be held.
+*/
+func (b *BGP) selectBestPaths() {
+	keys := map[string]bool{}
+	for key := range b.networks {
+		keys[key] = true
+	}
+	for _, p := range b.peers {
+		for key := range p.received {
+			keys[key] = true
+		}
+	}
+
+	best := map[string]*BgpPath{}
+	for key := range keys {
+		var chosen *BgpPath
+		for _, path := range b.candidates(key) {
+			if chosen == nil || isBetterPath(path, chosen) {
+				chosen = path
+			}
+		}
+		best[key] = chosen
+	}
+	b.best = best
+
+	if !b.running {
+		return
+	}
+
+	//Routes learnt from the neighbours go in the table
+	for key, route := range b.installed {
+		if path, found := best[key]; !found || path.From == nil {
+			b.table.RemoveRoute(route)
+			delete(b.installed, key)
+		}
+	}
+	for key, path := range best {
+		if path.From == nil {
+			continue
+		}
+
+		route := b.createRoute(path)
+		existing, found := b.installed[key]
+		if found && (route == nil || existing.Distance != route.Distance) {
+			b.table.RemoveRoute(existing)
+			delete(b.installed, key)
+		}
+		if route == nil {
+			continue
+		}
+		if !found || existing.Interface != route.Interface || !bytes.Equal(existing.Gateway, route.Gateway) {
+			b.table.ReplaceRoute(route)
+			b.installed[key] = route
+		}
+	}
+}
+
+/*
+Expects the lock to be held
+*/
+func (b *BGP) candidates(key string) []*BgpPath {
+	var paths []*BgpPath
+	if prefix, found := b.networks[key]; found {
+		paths = append(paths, &BgpPath{Prefix: prefix, LocalPref: BgpLocalPref})
+	}
+	for _, p := range b.peers {
+		if path, found := p.received[key]; found {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+/*
+The next hop may be a few hops away for iBGP paths, so the route goes to the gateway for the next hop. Returns nil if the
+next hop cannot be reached. Expects the lock to be held.
+*/
+func (b *BGP) createRoute(path *BgpPath) *l3.Route {
+	nextHopRoute, err := b.table.Lookup(path.NextHop)
+	if err != nil || nextHopRoute.Distance == DistanceEbgp || nextHopRoute.Distance == DistanceIbgp {
+		return nil
+	}
+
+	gateway := nextHopRoute.Gateway
+	if gateway == nil {
+		gateway = path.NextHop
+	}
+	distance := DistanceIbgp
+	if path.Ebgp {
+		distance = DistanceEbgp
+	}
+	return &l3.Route{
+		Cidr:      path.Prefix,
+		Gateway:   gateway,
+		Interface: nextHopRoute.Interface,
+		Metric:    len(path.AsPath),
+		Distance:  distance,
+	}
+}
+
+/*
+Returns the address of the interface the neighbour is reached through
+*/
+func (b *BGP) getLocalAddress(neighbor []byte) []byte {
+	route, err := b.table.Lookup(neighbor)
+	if err != nil {
+		return nil
+	}
+	return b.ip.GetAddressForInterface(route.Interface)
+}
+
+func (b *BGP) bindAnyPort(localAddr []byte) *l4.TcpBinding {
+	for i := 0; i < 10; i++ {
+		port := uint16(bgpConnectMin + rand.Intn(65536-bgpConnectMin))
+		if !b.tcp.IsPortInUse(port) {
+			return b.tcp.Bind(localAddr, port, protocol.IP)
+		}
+	}
+	return nil
+}
+
+func isBetterPath(a *BgpPath, b *BgpPath) bool {
+	if (a.From == nil) != (b.From == nil) {
+		return a.From == nil
+	}
+	if a.LocalPref != b.LocalPref {
+		return a.LocalPref > b.LocalPref
+	}
+	if len(a.AsPath) != len(b.AsPath) {
+		return len(a.AsPath) < len(b.AsPath)
+	}
+	if a.Ebgp != b.Ebgp {
+		return a.Ebgp
+	}
+	return bytes.Compare(a.From, b.From) < 0
+}
+
+func containsAs(asPath []uint16, as uint16) bool {
+	for _, a := range asPath {
+		if a == as {
+			return true
+		}
+	}
+	return false
+}
+
+func sortPaths(paths []*BgpPath) {
+	sort.Slice(paths, func(i, j int) bool {
+		return cidrKey(paths[i].Prefix) < cidrKey(paths[j].Prefix)
+	})
+}
+
+func keyToCidr(key string) *protocol.CIDR {
+	return &protocol.CIDR{Address: []byte(key[0:4]), Mask: int(key[4])}
+}
+
+func sendBgpMessage(conn *l4.TcpConnection, msgType byte, body []byte) {
+	header := make([]byte, bgpHeaderLength)
+	binary.BigEndian.PutUint16(header[0:2], uint16(bgpHeaderLength+len(body)))
+	header[2] = msgType
+	for _, c := range append(header, body...) {
+		conn.Send(c)
+	}
+}
+
+func encodeBgpUpdate(withdrawn []*protocol.CIDR, path *BgpPath) []byte {
+	m := make([]byte, 2)
+	binary.BigEndian.PutUint16(m, uint16(len(withdrawn)))
+	for _, prefix := range withdrawn {
+		m = append(m, encodeBgpPrefix(prefix)...)
+	}
+
+	attributes := make([]byte, 9)
+	var nlri []*protocol.CIDR
+	if path != nil {
+		binary.BigEndian.PutUint32(attributes[0:4], uint32(path.LocalPref))
+		copy(attributes[4:8], path.NextHop)
+		attributes[8] = byte(len(path.AsPath))
+		for _, as := range path.AsPath {
+			attributes = append(attributes, byte(as>>8), byte(as))
+		}
+		nlri = append(nlri, path.Prefix)
+	}
+	m = append(m, attributes...)
+
+	count := make([]byte, 2)
+	binary.BigEndian.PutUint16(count, uint16(len(nlri)))
+	m = append(m, count...)
+	for _, prefix := range nlri {
+		m = append(m, encodeBgpPrefix(prefix)...)
+	}
+	return m
+}
+
+/*
+Returns the withdrawn prefixes, the attributes of the path, and the prefixes the path is for. The last value is false if
+a prefix is invalid, in which case the whole UPDATE has to be dropped.
+*/
+func decodeBgpUpdate(m []byte) ([]*protocol.CIDR, *BgpPath, []*protocol.CIDR, bool) {
+	if len(m) < 2 {
+		return nil, nil, nil, true
+	}
+
+	var withdrawn []*protocol.CIDR
+	count := int(binary.BigEndian.Uint16(m[0:2]))
+	offset := 2
+	for i := 0; i < count && offset+bgpPrefixLength <= len(m); i++ {
+		prefix := decodeBgpPrefix(m[offset : offset+bgpPrefixLength])
+		if prefix == nil {
+			return nil, nil, nil, false
+		}
+		withdrawn = append(withdrawn, prefix)
+		offset += bgpPrefixLength
+	}
+	if offset+9 > len(m) {
+		return withdrawn, nil, nil, true
+	}
+
+	path := &BgpPath{
+		LocalPref: int(binary.BigEndian.Uint32(m[offset : offset+4])),
+		NextHop:   append([]byte{}, m[offset+4:offset+8]...),
+	}
+	asPathLength := int(m[offset+8])
+	offset += 9
+	for i := 0; i < asPathLength && offset+2 <= len(m); i++ {
+		path.AsPath = append(path.AsPath, binary.BigEndian.Uint16(m[offset:offset+2]))
+		offset += 2
+	}
+	if offset+2 > len(m) {
+		return withdrawn, path, nil, true
+	}
+
+	var nlri []*protocol.CIDR
+	count = int(binary.BigEndian.Uint16(m[offset : offset+2]))
+	offset += 2
+	for i := 0; i < count && offset+bgpPrefixLength <= len(m); i++ {
+		prefix := decodeBgpPrefix(m[offset : offset+bgpPrefixLength])
+		if prefix == nil {
+			return nil, nil, nil, false
+		}
+		nlri = append(nlri, prefix)
+		offset += bgpPrefixLength
+	}
+	return withdrawn, path, nlri, true
+}
+
+func encodeBgpPrefix(prefix *protocol.CIDR) []byte {
+	return append([]byte{byte(prefix.Mask)}, prefix.Address...)
+}
+
+/*
+Returns nil if the mask is longer than the address
+*/
+func decodeBgpPrefix(b []byte) *protocol.CIDR {
+	if int(b[0]) > 8*(bgpPrefixLength-1) {
+		return nil
+	}
+	return &protocol.CIDR{Address: append([]byte{}, b[1:5]...), Mask: int(b[0])}
+}
+
+//Internal structs
+type bgpPeer struct {
+	config     *BgpNeighbor
+	state      int
+	incoming   chan *l4.TcpConnection
+	received   map[string]*BgpPath
+	advertised map[string]string
+}
+
+func (p *BgpPath) copy() *BgpPath {
+	copied := *p
+	copied.AsPath = append([]uint16{}, p.AsPath...)
+	return &copied
+}
@@ -0,0 +1,47 @@
+package routing
+
+import (
+	"bytes"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"testing"
+)
+
+func TestBgpMalformedUpdate(t *testing.T) {
+	table := l3.NewRoutingTable()
+	table.AddRoute(&l3.Route{Cidr: &protocol.CIDR{Address: []byte{10, 0, 0, 0}, Mask: 24}, Interface: 0, Distance: l3.DistanceConnected})
+
+	b := NewBGP(nil, nil, table, 100, []byte{1, 1, 1, 1})
+	b.running = true
+	p := &bgpPeer{
+		config:   &BgpNeighbor{Address: []byte{10, 0, 0, 2}, As: 200},
+		state:    bgpStateEstablished,
+		received: map[string]*BgpPath{},
+	}
+	b.peers[string(p.config.Address)] = p
+
+	good := &protocol.CIDR{Address: []byte{20, 0, 0, 0}, Mask: 16}
+	if !b.handleUpdate(p, encodeBgpUpdate(nil, &BgpPath{Prefix: good, NextHop: []byte{10, 0, 0, 2}, AsPath: []uint16{200}})) {
+		t.Fatalf("Expected a valid UPDATE to be accepted")
+	}
+
+	//A mask longer than the address drops the whole UPDATE, including the withdrawal which comes with it
+	for _, withdrawn := range [][]*protocol.CIDR{nil, {good}} {
+		bad := &protocol.CIDR{Address: []byte{30, 0, 0, 0}, Mask: 40}
+		update := encodeBgpUpdate(withdrawn, &BgpPath{Prefix: bad, NextHop: []byte{10, 0, 0, 2}, AsPath: []uint16{200}})
+		if b.handleUpdate(p, update) {
+			t.Errorf("Expected an UPDATE with a /40 prefix to be refused")
+		}
+	}
+	if b.handleUpdate(p, encodeBgpUpdate([]*protocol.CIDR{{Address: []byte{20, 0, 0, 0}, Mask: 33}}, nil)) {
+		t.Errorf("Expected an UPDATE withdrawing a /33 prefix to be refused")
+	}
+
+	if _, err := table.Lookup([]byte{30, 0, 0, 1}); err == nil {
+		t.Errorf("Expected no route for the invalid prefix")
+	}
+	route, err := table.Lookup([]byte{20, 0, 1, 1})
+	if err != nil || !bytes.Equal(route.Gateway, []byte{10, 0, 0, 2}) {
+		t.Errorf("Expected the route learnt before to be kept but got %v", route)
+	}
+}
@@ -0,0 +1,857 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+OSPF is a link state routing protocol. Instead of telling its neighbours which networks it can reach, every router tells
+all the routers which neighbours and networks it is directly connected to, and at what cost. This is its link state
+advertisement (LSA). Every router keeps the LSAs of all the routers in its link state database, so all of them have the
+same map of the network and each one finds the shortest paths from itself using Dijkstra's algorithm (SPF).
+
+Routers find their neighbours by broadcasting Hellos on every interface OSPF runs on. A Hello lists the neighbours the
+router has heard from, so when a router sees itself in the Hello of a neighbour, it knows they can talk both ways. They
+then exchange their databases, and both routers advertise the new link. A neighbour which is not heard from for the dead
+interval is taken out, and the link is advertised as gone.
+
+An LSA is flooded to all the neighbours, who flood it further unless they already have it. Each LSA has a sequence
+number which is incremented whenever the router originates it again, so that the routers can tell which one is newer.
+LSAs also have an age. A router originates its LSA again when it gets old, and an LSA which reaches the maximum age is
+taken out of the database. A router which stops flushes its LSA from the network by flooding it with the maximum age.
+
+This is a simpler OSPF. There is a single area, no designated router (every router on a network is adjacent to every
+other one), and the packets are broadcast instead of being sent to the OSPF multicast addresses. The intervals are in
+milliseconds, since simulations need short timers.
+
+Like RIP, OSPF runs on the interfaces having an address in one of the configured networks, and the configured networks
+are the ones it advertises as the stub networks of the router.
+
+Packet Format:
+
+Version		- 1 byte
+Type		- 1 byte
+Length		- 2 bytes
+Router ID	- 4 bytes
+Area ID		- 4 bytes
+Body		- No fixed length
+
+Hello Body:
+
+Network Mask	- 4 bytes
+Hello Interval	- 4 bytes
+Dead Interval	- 4 bytes
+Neighbors		- 4 bytes each
+
+Link State Update Body:
+
+Number of LSAs	- 4 bytes
+LSAs			- No fixed length
+
+LSA Format:
+
+Age					- 2 bytes, in seconds
+Advertising Router	- 4 bytes
+Sequence			- 4 bytes
+Number of Links		- 2 bytes
+Links				- 12 bytes each. Each is ID (4 bytes), Data (4 bytes), Type (1 byte), Zero (1 byte), Metric (2 bytes)
+
+A link to a router has the router ID as ID and the address of the interface as Data. A link to a stub network has the
+address of the network as ID and the mask as Data.
+*/
+const (
+	DistanceOspf   = 110
+	OspfLinkRouter = 1
+	OspfLinkStub   = 3
+)
+
+const (
+	ospfVersion         = 2
+	ospfHello           = 1
+	ospfLsUpdate        = 4
+	ospfHeaderLength    = 12
+	ospfHelloLength     = 12
+	ospfLsaHeaderLength = 12
+	ospfLinkLength      = 12
+	ospfDefaultCost     = 10
+	ospfHelloInterval   = 10 * time.Second
+	ospfDeadInterval    = 40 * time.Second
+	ospfLsRefreshTime   = 30 * time.Minute
+	ospfMaxAge          = 60 * time.Minute
+	ospfTTL             = 1
+)
+
+/*
+A link state advertisement, as found in the database
+*/
+type Lsa struct {
+	AdvertisingRouter []byte
+	Sequence          uint32
+	Age               time.Duration
+	Links             []*LsaLink
+}
+
+type LsaLink struct {
+	Type   int
+	Id     []byte
+	Data   []byte
+	Metric int
+}
+
+type OSPF struct {
+	identifier    []byte
+	routerId      []byte
+	ip            *l3.IP
+	table         *l3.RoutingTable
+	spfTable      *l3.RoutingTable
+	networks      []*protocol.CIDR
+	costs         map[int]int
+	interfaces    map[int]*ospfInterface
+	lsdb          map[string]*ospfLsa
+	installed     map[string]*l3.Route
+	sequence      uint32
+	originatedAt  time.Time
+	spfNeeded     bool
+	helloInterval time.Duration
+	deadInterval  time.Duration
+	refreshTime   time.Duration
+	maxAge        time.Duration
+	running       bool
+	lock          sync.Mutex
+}
+
+/*
+Constructor
+*/
+func NewOSPF(ip *l3.IP, table *l3.RoutingTable, routerId []byte, networks []*protocol.CIDR) *OSPF {
+	return &OSPF{
+		identifier:    protocol.OSPF,
+		routerId:      routerId,
+		ip:            ip,
+		table:         table,
+		spfTable:      l3.NewRoutingTable(),
+		networks:      networks,
+		costs:         map[int]int{},
+		interfaces:    map[int]*ospfInterface{},
+		lsdb:          map[string]*ospfLsa{},
+		installed:     map[string]*l3.Route{},
+		helloInterval: ospfHelloInterval,
+		deadInterval:  ospfDeadInterval,
+		refreshTime:   ospfLsRefreshTime,
+		maxAge:        ospfMaxAge,
+	}
+}
+
+/*
+Next 3 methods make this an implementation of Protocol
+*/
+func (o *OSPF) GetIdentifier() []byte {
+	return o.identifier
+}
+
+func (o *OSPF) SendUp(data []byte, metadata []byte, sender protocol.Protocol) {
+	if len(data) < ospfHeaderLength || data[0] != ospfVersion || len(metadata) < 9 {
+		log.Printf("OSPF: Got invalid packet. Dropping.")
+		return
+	}
+
+	o.lock.Lock()
+	intf, found := o.interfaces[int(metadata[8])]
+	if !o.running || !found || bytes.Equal(data[4:8], o.routerId) {
+		o.lock.Unlock()
+		return
+	}
+
+	var outgoing []*ospfPacket
+	switch data[1] {
+	case ospfHello:
+		outgoing = o.handleHello(intf, data[4:8], metadata[0:4], data[ospfHeaderLength:])
+	case ospfLsUpdate:
+		outgoing = o.handleLsUpdate(intf, data[ospfHeaderLength:])
+	}
+	o.lock.Unlock()
+
+	o.send(outgoing)
+}
+
+func (o *OSPF) SendDown(data []byte, destAddr []byte, metadata []byte, sender protocol.Protocol) {
+	//Not used. Packets are generated by OSPF itself.
+}
+
+/*
+Following methods make this an implementation of L4 Protocol
+*/
+func (o *OSPF) AddL3Protocol(l3Protocol protocol.L3Protocol) {
+	//Not used. OSPF is created for one IP.
+}
+
+/*
+Next 2 methods make this an implementation of RouteProvider, using the routes found by the last SPF run
+*/
+func (o *OSPF) GetGatewayForAddress(ipAddr []byte) []byte {
+	return o.getSpfTable().GetGatewayForAddress(ipAddr)
+}
+
+func (o *OSPF) GetInterfaceForAddress(ipAddr []byte) int {
+	return o.getSpfTable().GetInterfaceForAddress(ipAddr)
+}
+
+/*
+OSPF public API
+*/
+func (o *OSPF) Start() {
+	o.lock.Lock()
+	for intfNum, network := range interfacesInNetworks(o.ip, o.networks) {
+		o.interfaces[intfNum] = &ospfInterface{
+			intfNum:   intfNum,
+			network:   network,
+			neighbors: map[string]*ospfNeighbor{},
+		}
+		o.table.AddRoute(&l3.Route{Cidr: network, Interface: intfNum, Distance: l3.DistanceConnected})
+	}
+	o.running = true
+	outgoing := o.originate()
+	o.lock.Unlock()
+
+	o.send(outgoing)
+	go o.run()
+}
+
+/*
+Stopping flushes the LSA of this router from the network and takes the routes out of the table
+*/
+func (o *OSPF) Stop() {
+	o.lock.Lock()
+	o.running = false
+	var outgoing []*ospfPacket
+	if own, found := o.lsdb[string(o.routerId)]; found {
+		flushed := *own.lsa
+		flushed.Sequence++
+		flushed.Age = o.maxAge
+		outgoing = o.flood(&flushed, -1)
+	}
+
+	for key, route := range o.installed {
+		o.table.RemoveRoute(route)
+		delete(o.installed, key)
+	}
+	for intfNum, intf := range o.interfaces {
+		o.table.RemoveRoute(&l3.Route{Cidr: intf.network, Interface: intfNum, Distance: l3.DistanceConnected})
+	}
+	o.interfaces = map[int]*ospfInterface{}
+	o.lsdb = map[string]*ospfLsa{}
+	o.spfTable = l3.NewRoutingTable()
+	o.lock.Unlock()
+
+	o.send(outgoing)
+}
+
+/*
+Changes the timers. The defaults are too long for most simulations.
+*/
+func (o *OSPF) SetTimers(helloInterval time.Duration, deadInterval time.Duration, refreshTime time.Duration, maxAge time.Duration) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.helloInterval = helloInterval
+	o.deadInterval = deadInterval
+	o.refreshTime = refreshTime
+	o.maxAge = maxAge
+}
+
+/*
+Sets the cost of sending out of the interface. The default is 10.
+*/
+func (o *OSPF) SetCost(intfNum int, cost int) {
+	o.lock.Lock()
+	o.costs[intfNum] = cost
+	var outgoing []*ospfPacket
+	if o.running {
+		outgoing = o.originate()
+	}
+	o.lock.Unlock()
+
+	o.send(outgoing)
+}
+
+/*
+Returns a copy of the link state database, ordered by the advertising router
+*/
+func (o *OSPF) GetDatabase() []*Lsa {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	now := time.Now()
+	var database []*Lsa
+	for _, entry := range o.lsdb {
+		lsa := *entry.lsa
+		lsa.Age = entry.age(now)
+		database = append(database, &lsa)
+	}
+	sort.Slice(database, func(i, j int) bool {
+		return bytes.Compare(database[i].AdvertisingRouter, database[j].AdvertisingRouter) < 0
+	})
+	return database
+}
+
+/*
+Returns the IDs of the routers this router is adjacent to
+*/
+func (o *OSPF) GetNeighbors() [][]byte {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	var neighbors [][]byte
+	for _, intf := range o.interfaces {
+		for _, n := range intf.neighbors {
+			if n.twoWay {
+				neighbors = append(neighbors, n.routerId)
+			}
+		}
+	}
+	return neighbors
+}
+
+/*
+Returns the routes found by the last SPF run
+*/
+func (o *OSPF) GetRoutes() []*l3.Route {
+	return o.getSpfTable().GetRoutes()
+}
+
+/*
+Internal methods
+*/
+func (o *OSPF) getSpfTable() *l3.RoutingTable {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return o.spfTable
+}
+
+func (o *OSPF) isRunning() bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return o.running
+}
+
+func (o *OSPF) run() {
+	var nextHello time.Time
+	for o.isRunning() {
+		now := time.Now()
+		var outgoing []*ospfPacket
+
+		o.lock.Lock()
+		if now.After(nextHello) {
+			for _, intf := range o.interfaces {
+				outgoing = append(outgoing, o.createHello(intf))
+			}
+			nextHello = now.Add(o.helloInterval)
+		}
+		outgoing = append(outgoing, o.expire(now)...)
+		if o.spfNeeded {
+			o.runSpf()
+			o.spfNeeded = false
+		}
+		o.lock.Unlock()
+
+		o.send(outgoing)
+		time.Sleep(pollInterval)
+	}
+}
+
+/*
+Expects the lock to be held
+*/
+func (o *OSPF) handleHello(intf *ospfInterface, routerId []byte, srcAddr []byte, body []byte) []*ospfPacket {
+	if len(body) < ospfHelloLength {
+		return nil
+	}
+
+	//Routers only become neighbours if they agree on the network and the timers
+	if protocol.BytesToMask(body[0:4]) != intf.network.Mask ||
+		time.Duration(binary.BigEndian.Uint32(body[4:8]))*time.Millisecond != o.helloInterval ||
+		time.Duration(binary.BigEndian.Uint32(body[8:12]))*time.Millisecond != o.deadInterval {
+		log.Printf("OSPF: Hello from %v does not match the configuration of interface %d. Dropping.", routerId, intf.intfNum)
+		return nil
+	}
+
+	seesUs := false
+	for i := ospfHelloLength; i+4 <= len(body); i += 4 {
+		if bytes.Equal(body[i:i+4], o.routerId) {
+			seesUs = true
+		}
+	}
+
+	var outgoing []*ospfPacket
+	neighbor, found := intf.neighbors[string(routerId)]
+	if !found {
+		neighbor = &ospfNeighbor{routerId: append([]byte{}, routerId...)}
+		intf.neighbors[string(routerId)] = neighbor
+
+		//Answer right away so that the neighbour does not wait for the next Hello to see us
+		outgoing = append(outgoing, o.createHello(intf))
+	}
+	neighbor.address = append([]byte{}, srcAddr...)
+	neighbor.lastSeen = time.Now()
+
+	if seesUs != neighbor.twoWay {
+		neighbor.twoWay = seesUs
+		if seesUs {
+			log.Printf("OSPF: Router %v: Adjacency with %v is up", o.routerId, routerId)
+			outgoing = append(outgoing, o.createLsUpdate(intf.intfNum, o.getLsas()))
+		}
+		outgoing = append(outgoing, o.originate()...)
+	}
+
+	return outgoing
+}
+
+/*
+Expects the lock to be held
+*/
+func (o *OSPF) handleLsUpdate(intf *ospfInterface, body []byte) []*ospfPacket {
+	var outgoing []*ospfPacket
+	for _, lsa := range decodeLsas(body) {
+		key := string(lsa.AdvertisingRouter)
+		existing, found := o.lsdb[key]
+
+		//An older LSA is answered with the one in the database
+		if found && isNewerLsa(existing.lsa, lsa, existing.age(time.Now()), o.maxAge) {
+			outgoing = append(outgoing, o.createLsUpdate(intf.intfNum, []*Lsa{existing.current(time.Now())}))
+			continue
+		}
+		if found && !isNewerLsa(lsa, existing.lsa, lsa.Age, o.maxAge) {
+			continue
+		}
+
+		//Our own LSA from before a restart. Originate a newer one.
+		if bytes.Equal(lsa.AdvertisingRouter, o.routerId) {
+			if lsa.Sequence >= o.sequence {
+				o.sequence = lsa.Sequence
+			}
+			outgoing = append(outgoing, o.originate()...)
+			continue
+		}
+
+		if lsa.Age >= o.maxAge {
+			if found {
+				delete(o.lsdb, key)
+				o.spfNeeded = true
+				outgoing = append(outgoing, o.flood(lsa, intf.intfNum)...)
+			}
+			continue
+		}
+
+		o.lsdb[key] = &ospfLsa{lsa: lsa, installedAt: time.Now()}
+		o.spfNeeded = true
+		outgoing = append(outgoing, o.flood(lsa, intf.intfNum)...)
+	}
+
+	return outgoing
+}
+
+/*
+Takes out neighbours which went quiet and LSAs which got too old, and originates the LSA of this router again if it is
+getting old. Expects the lock to be held.
+*/
+func (o *OSPF) expire(now time.Time) []*ospfPacket {
+	changed := false
+	for _, intf := range o.interfaces {
+		for key, n := range intf.neighbors {
+			if now.Sub(n.lastSeen) > o.deadInterval {
+				log.Printf("OSPF: Router %v: Neighbour %v is down", o.routerId, n.routerId)
+				delete(intf.neighbors, key)
+				changed = changed || n.twoWay
+			}
+		}
+	}
+
+	for key, entry := range o.lsdb {
+		if key != string(o.routerId) && entry.age(now) >= o.maxAge {
+			delete(o.lsdb, key)
+			o.spfNeeded = true
+		}
+	}
+
+	if changed || now.Sub(o.originatedAt) > o.refreshTime {
+		return o.originate()
+	}
+	return nil
+}
+
+/*
+Creates a new LSA for this router and floods it. Expects the lock to be held.
+*/
+func (o *OSPF) originate() []*ospfPacket {
+	o.sequence++
+	lsa := &Lsa{
+		AdvertisingRouter: o.routerId,
+		Sequence:          o.sequence,
+	}
+
+	intfNums := make([]int, 0, len(o.interfaces))
+	for intfNum := range o.interfaces {
+		intfNums = append(intfNums, intfNum)
+	}
+	sort.Ints(intfNums)
+
+	for _, intfNum := range intfNums {
+		intf := o.interfaces[intfNum]
+		cost := o.getCost(intfNum)
+		lsa.Links = append(lsa.Links, &LsaLink{
+			Type:   OspfLinkStub,
+			Id:     intf.network.Address,
+			Data:   protocol.MaskToBytes(intf.network.Mask),
+			Metric: cost,
+		})
+		for _, n := range intf.neighbors {
+			if n.twoWay {
+				lsa.Links = append(lsa.Links, &LsaLink{
+					Type:   OspfLinkRouter,
+					Id:     n.routerId,
+					Data:   o.ip.GetAddressForInterface(intfNum),
+					Metric: cost,
+				})
+			}
+		}
+	}
+
+	o.lsdb[string(o.routerId)] = &ospfLsa{lsa: lsa, installedAt: time.Now()}
+	o.originatedAt = time.Now()
+	o.spfNeeded = true
+	return o.flood(lsa, -1)
+}
+
+/*
+Sends the LSA out of every interface except the one it came from. Expects the lock to be held.
+*/
+func (o *OSPF) flood(lsa *Lsa, except int) []*ospfPacket {
+	var outgoing []*ospfPacket
+	for intfNum := range o.interfaces {
+		if intfNum != except {
+			outgoing = append(outgoing, o.createLsUpdate(intfNum, []*Lsa{lsa}))
+		}
+	}
+	return outgoing
+}
+
+/*
+Finds the shortest path to every router, and through them to every network, and updates the routing tables. Expects the
+lock to be held.
+*/
+func (o *OSPF) runSpf() {
+	root := string(o.routerId)
+	dist := map[string]int{root: 0}
+	hops := map[string]*ospfHop{}
+	done := map[string]bool{}
+
+	for {
+		//Pick the closest router not done yet
+		current := ""
+		for id, d := range dist {
+			if !done[id] && (current == "" || d < dist[current]) {
+				current = id
+			}
+		}
+		if current == "" {
+			break
+		}
+		done[current] = true
+
+		entry, found := o.lsdb[current]
+		if !found {
+			continue
+		}
+		for _, link := range entry.lsa.Links {
+			next := string(link.Id)
+			if link.Type != OspfLinkRouter || done[next] || !o.hasLinkBack(next, current) {
+				continue
+			}
+
+			d := dist[current] + link.Metric
+			if existing, found := dist[next]; found && existing <= d {
+				continue
+			}
+
+			//The first hop is the neighbour itself, and the routers beyond are reached through the same neighbour
+			var hop *ospfHop
+			if current == root {
+				hop = o.hopToNeighbor(link)
+			} else {
+				hop = hops[current]
+			}
+			if hop == nil {
+				continue
+			}
+			dist[next] = d
+			hops[next] = hop
+		}
+	}
+
+	//The networks connected to this router are not routed through anyone
+	routes := map[string]*l3.Route{}
+	for id, d := range dist {
+		entry, found := o.lsdb[id]
+		if !found || id == root {
+			continue
+		}
+		for _, link := range entry.lsa.Links {
+			if link.Type != OspfLinkStub {
+				continue
+			}
+			cidr := &protocol.CIDR{Address: link.Id, Mask: protocol.BytesToMask(link.Data)}
+			key := cidrKey(cidr)
+			if o.isConnected(cidr) {
+				continue
+			}
+			if existing, found := routes[key]; found && existing.Metric <= d+link.Metric {
+				continue
+			}
+			routes[key] = &l3.Route{
+				Cidr:      cidr,
+				Gateway:   hops[id].gateway,
+				Interface: hops[id].intfNum,
+				Metric:    d + link.Metric,
+				Distance:  DistanceOspf,
+			}
+		}
+	}
+
+	//Update the routing table with what changed
+	for key, route := range o.installed {
+		if _, found := routes[key]; !found {
+			o.table.RemoveRoute(route)
+			delete(o.installed, key)
+		}
+	}
+	spfTable := l3.NewRoutingTable()
+	for key, route := range routes {
+		existing, found := o.installed[key]
+		if !found || existing.Metric != route.Metric || existing.Interface != route.Interface || !bytes.Equal(existing.Gateway, route.Gateway) {
+			o.table.ReplaceRoute(route)
+			o.installed[key] = route
+		}
+		spfTable.AddRoute(route)
+	}
+	for intfNum, intf := range o.interfaces {
+		spfTable.AddRoute(&l3.Route{Cidr: intf.network, Interface: intfNum, Distance: l3.DistanceConnected})
+	}
+	o.spfTable = spfTable
+}
+
+/*
+Expects the lock to be held
+*/
+func (o *OSPF) hasLinkBack(from string, to string) bool {
+	entry, found := o.lsdb[from]
+	if !found {
+		return false
+	}
+	for _, link := range entry.lsa.Links {
+		if link.Type == OspfLinkRouter && string(link.Id) == to {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Expects the lock to be held
+*/
+func (o *OSPF) hopToNeighbor(link *LsaLink) *ospfHop {
+	for intfNum, intf := range o.interfaces {
+		if !bytes.Equal(o.ip.GetAddressForInterface(intfNum), link.Data) {
+			continue
+		}
+		if n, found := intf.neighbors[string(link.Id)]; found && n.twoWay {
+			return &ospfHop{gateway: n.address, intfNum: intfNum}
+		}
+	}
+	return nil
+}
+
+/*
+Expects the lock to be held
+*/
+func (o *OSPF) isConnected(cidr *protocol.CIDR) bool {
+	for _, intf := range o.interfaces {
+		if intf.network.Mask == cidr.Mask && intf.network.Contains(cidr.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Expects the lock to be held
+*/
+func (o *OSPF) getCost(intfNum int) int {
+	cost, found := o.costs[intfNum]
+	if !found {
+		return ospfDefaultCost
+	}
+	return cost
+}
+
+/*
+Expects the lock to be held
+*/
+func (o *OSPF) getLsas() []*Lsa {
+	now := time.Now()
+	var lsas []*Lsa
+	for _, entry := range o.lsdb {
+		lsas = append(lsas, entry.current(now))
+	}
+	return lsas
+}
+
+/*
+Expects the lock to be held
+*/
+func (o *OSPF) createHello(intf *ospfInterface) *ospfPacket {
+	body := make([]byte, ospfHelloLength)
+	copy(body[0:4], protocol.MaskToBytes(intf.network.Mask))
+	binary.BigEndian.PutUint32(body[4:8], uint32(o.helloInterval/time.Millisecond))
+	binary.BigEndian.PutUint32(body[8:12], uint32(o.deadInterval/time.Millisecond))
+	for _, n := range intf.neighbors {
+		body = append(body, n.routerId...)
+	}
+	return &ospfPacket{intfNum: intf.intfNum, data: o.createPacket(ospfHello, body)}
+}
+
+/*
+Expects the lock to be held
+*/
+func (o *OSPF) createLsUpdate(intfNum int, lsas []*Lsa) *ospfPacket {
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, uint32(len(lsas)))
+	for _, lsa := range lsas {
+		body = append(body, encodeLsa(lsa)...)
+	}
+	return &ospfPacket{intfNum: intfNum, data: o.createPacket(ospfLsUpdate, body)}
+}
+
+func (o *OSPF) createPacket(packetType byte, body []byte) []byte {
+	packet := []byte{ospfVersion, packetType, 0, 0}
+	binary.BigEndian.PutUint16(packet[2:4], uint16(ospfHeaderLength+len(body)))
+	packet = append(packet, o.routerId...)
+	packet = append(packet, 0, 0, 0, 0)
+	return append(packet, body...)
+}
+
+/*
+Sends the packets. Must be called without the lock held.
+*/
+func (o *OSPF) send(packets []*ospfPacket) {
+	for _, p := range packets {
+		o.ip.SendDownOnInterface(p.intfNum, p.data, l3.BroadcastAddress, []byte{0, ospfTTL}, o)
+	}
+}
+
+/*
+The LSA with the higher sequence number is newer. For the same sequence number, the one being flushed is newer.
+*/
+func isNewerLsa(a *Lsa, b *Lsa, ageOfA time.Duration, maxAge time.Duration) bool {
+	if a.Sequence != b.Sequence {
+		return a.Sequence > b.Sequence
+	}
+	return ageOfA >= maxAge && b.Age < maxAge
+}
+
+func encodeLsa(lsa *Lsa) []byte {
+	b := make([]byte, ospfLsaHeaderLength)
+	binary.BigEndian.PutUint16(b[0:2], uint16((lsa.Age+time.Second-1)/time.Second))
+	copy(b[2:6], lsa.AdvertisingRouter)
+	binary.BigEndian.PutUint32(b[6:10], lsa.Sequence)
+	binary.BigEndian.PutUint16(b[10:12], uint16(len(lsa.Links)))
+	for _, link := range lsa.Links {
+		l := make([]byte, ospfLinkLength)
+		copy(l[0:4], link.Id)
+		copy(l[4:8], link.Data)
+		l[8] = byte(link.Type)
+		binary.BigEndian.PutUint16(l[10:12], uint16(link.Metric))
+		b = append(b, l...)
+	}
+	return b
+}
+
+func decodeLsas(body []byte) []*Lsa {
+	if len(body) < 4 {
+		return nil
+	}
+
+	var lsas []*Lsa
+	count := int(binary.BigEndian.Uint32(body[0:4]))
+	offset := 4
+	for i := 0; i < count && offset+ospfLsaHeaderLength <= len(body); i++ {
+		h := body[offset : offset+ospfLsaHeaderLength]
+		lsa := &Lsa{
+			Age:               time.Duration(binary.BigEndian.Uint16(h[0:2])) * time.Second,
+			AdvertisingRouter: append([]byte{}, h[2:6]...),
+			Sequence:          binary.BigEndian.Uint32(h[6:10]),
+		}
+		numLinks := int(binary.BigEndian.Uint16(h[10:12]))
+		offset += ospfLsaHeaderLength
+
+		for j := 0; j < numLinks && offset+ospfLinkLength <= len(body); j++ {
+			l := body[offset : offset+ospfLinkLength]
+			lsa.Links = append(lsa.Links, &LsaLink{
+				Type:   int(l[8]),
+				Id:     append([]byte{}, l[0:4]...),
+				Data:   append([]byte{}, l[4:8]...),
+				Metric: int(binary.BigEndian.Uint16(l[10:12])),
+			})
+			offset += ospfLinkLength
+		}
+		lsas = append(lsas, lsa)
+	}
+	return lsas
+}
+
+//Internal structs
+type ospfInterface struct {
+	intfNum   int
+	network   *protocol.CIDR
+	neighbors map[string]*ospfNeighbor
+}
+
+type ospfNeighbor struct {
+	routerId []byte
+	address  []byte
+	lastSeen time.Time
+	twoWay   bool
+}
+
+type ospfLsa struct {
+	lsa         *Lsa
+	installedAt time.Time
+}
+
+func (e *ospfLsa) age(now time.Time) time.Duration {
+	return e.lsa.Age + now.Sub(e.installedAt)
+}
+
+func (e *ospfLsa) current(now time.Time) *Lsa {
+	lsa := *e.lsa
+	lsa.Age = e.age(now)
+	return &lsa
+}
+
+type ospfHop struct {
+	gateway []byte
+	intfNum int
+}
+
+type ospfPacket struct {
+	intfNum int
+	data    []byte
+}
@@ -0,0 +1,679 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"netsim/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+PIM dense mode builds the distribution tree of a multicast group by flooding and pruning. The first packet from a source
+to a group is forwarded to every neighbouring router and every network with listeners, and the routers which find no one
+downstream that wants it send a Prune towards the source. Branches pruned this way stop getting the traffic of the source
+for the prune holdtime, after which the traffic is flooded again and has to be pruned again. When a listener shows up on
+a pruned branch, the router sends a Graft towards the source, which is acknowledged hop by hop, to get the traffic back
+without waiting for the prune to expire.
+
+A packet is only accepted from the interface the router would use to send to its source, which is found in the unicast
+routing table. This reverse path forwarding (RPF) check keeps packets from looping, and the router the interface leads to
+is the upstream neighbour the Prunes and Grafts of the source are sent to. Networks with listeners are found with IGMP,
+hence the router is made an IGMP querier.
+
+Routers find their neighbours by sending Hellos to all PIM routers (224.0.0.13) on every interface. When a router on a
+link with other routers prunes, the upstream router waits for a while before pruning the link, so that any other router
+which still wants the traffic can override the Prune by sending a Join. Asserts are not implemented, hence there must be
+only one router which can forward the traffic of a source onto a link.
+
+The forwarding state for a source and group is forgotten when no traffic is seen for the data timeout. Timers are sent in
+milliseconds, since simulations need short timers.
+
+Packet Format:
+
+Type		- 1 byte
+Checksum	- 1 byte
+Body		- No fixed length
+
+Hello Body:
+
+Holdtime	- 4 bytes, in milliseconds. The neighbour is forgotten if not heard from for this long.
+
+Join/Prune Body:
+
+Upstream Neighbor	- 4 bytes
+Holdtime			- 4 bytes
+Source				- 4 bytes
+Group				- 4 bytes
+Prune				- 1 byte, 1 for a Prune and 0 for a Join
+
+Graft and Graft Ack Body:
+
+Source		- 4 bytes
+Group		- 4 bytes
+*/
+const (
+	pimHello              = 0
+	pimJoinPrune          = 3
+	pimGraft              = 6
+	pimGraftAck           = 7
+	pimHeaderLength       = 2
+	pimJoinPruneLength    = 17
+	pimGraftLength        = 8
+	pimTTL                = 1
+	pimHelloInterval      = 30 * time.Second
+	pimHoldtimeFactor     = 3.5
+	pimPruneHoldtime      = 210 * time.Second
+	pimDataTimeout        = 210 * time.Second
+	pimPruneOverrideDelay = 3 * time.Second
+	pimPruneRetryInterval = 3 * time.Second
+	pimGraftRetryInterval = 3 * time.Second
+)
+
+var (
+	AllPimRoutersGroup = []byte{224, 0, 0, 13}
+)
+
+/*
+The forwarding state of a source and group, as found in the multicast forwarding table
+*/
+type MulticastRoute struct {
+	Source             []byte
+	Group              []byte
+	IncomingInterface  int
+	Upstream           []byte
+	OutgoingInterfaces []int
+	PrunedInterfaces   []int
+	UpstreamPruned     bool
+}
+
+type PIM struct {
+	identifier    []byte
+	ip            *l3.IP
+	igmp          *l3.IGMP
+	routeProvider protocol.RouteProvider
+	neighbors     map[int]map[string]time.Time
+	entries       map[string]*pimEntry
+	helloInterval time.Duration
+	pruneHoldtime time.Duration
+	running       bool
+	lock          sync.Mutex
+}
+
+/*
+Constructor
+*/
+func NewPIM(ip *l3.IP, igmp *l3.IGMP, routeProvider protocol.RouteProvider) *PIM {
+	return &PIM{
+		identifier:    protocol.PIM,
+		ip:            ip,
+		igmp:          igmp,
+		routeProvider: routeProvider,
+		neighbors:     map[int]map[string]time.Time{},
+		entries:       map[string]*pimEntry{},
+		helloInterval: pimHelloInterval,
+		pruneHoldtime: pimPruneHoldtime,
+	}
+}
+
+/*
+Next 3 methods make this an implementation of Protocol
+*/
+func (p *PIM) GetIdentifier() []byte {
+	return p.identifier
+}
+
+func (p *PIM) SendUp(data []byte, metadata []byte, sender protocol.Protocol) {
+	if len(data) < pimHeaderLength || len(metadata) < 9 {
+		log.Printf("PIM: Got invalid packet. Dropping.")
+		return
+	}
+
+	//The checksum covers the whole packet
+	packet := append([]byte{}, data...)
+	packet[1] = 0
+	if utils.CalculateChecksum(packet)[0] != data[1] {
+		log.Printf("PIM: Got corrupted packet. Dropping.")
+		return
+	}
+
+	srcAddr := metadata[0:4]
+	intfNum := int(metadata[8])
+	body := data[pimHeaderLength:]
+
+	p.lock.Lock()
+	if !p.running {
+		p.lock.Unlock()
+		return
+	}
+
+	var outgoing []*pimPacket
+	switch data[0] {
+	case pimHello:
+		outgoing = p.handleHello(intfNum, srcAddr, body)
+	case pimJoinPrune:
+		outgoing = p.handleJoinPrune(intfNum, body)
+	case pimGraft:
+		outgoing = p.handleGraft(intfNum, srcAddr, body)
+	case pimGraftAck:
+		p.handleGraftAck(body)
+	}
+	p.lock.Unlock()
+
+	p.send(outgoing)
+}
+
+func (p *PIM) SendDown(data []byte, destAddr []byte, metadata []byte, sender protocol.Protocol) {
+	//Not used. Packets are generated by PIM itself.
+}
+
+/*
+Following methods make this an implementation of L4 Protocol
+*/
+func (p *PIM) AddL3Protocol(l3Protocol protocol.L3Protocol) {
+	//Not used. PIM is created for one IP.
+}
+
+/*
+Next method makes this an implementation of MulticastRouter. The forwarding state is created by the first packet of a
+source, and the packets which fail the RPF check are dropped.
+*/
+func (p *PIM) GetOutgoingInterfaces(srcAddr []byte, group []byte, intfNum int) []int {
+	p.lock.Lock()
+	if !p.running {
+		p.lock.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	entry := p.getEntry(srcAddr, group)
+	if entry == nil || entry.incoming != intfNum {
+		p.lock.Unlock()
+		return nil
+	}
+	entry.expiresAt = now.Add(pimDataTimeout)
+
+	//No one downstream wants the traffic, hence tell the upstream router. The Prune is sent again if the traffic keeps
+	//coming, in case it got lost.
+	var outgoing []*pimPacket
+	intfNums := p.getOutgoingInterfaces(entry, now)
+	if len(intfNums) == 0 && entry.upstream != nil && (!entry.upstreamPruned || now.Sub(entry.prunedAt) > pimPruneRetryInterval) {
+		outgoing = append(outgoing, p.prune(entry, now))
+	}
+	p.lock.Unlock()
+
+	p.send(outgoing)
+	return intfNums
+}
+
+/*
+PIM public API
+*/
+func (p *PIM) Start() {
+	p.lock.Lock()
+	p.running = true
+	p.lock.Unlock()
+
+	//Networks with listeners are learnt by querying them
+	p.igmp.SetQuerier(true)
+	p.igmp.SetMembershipHandler(p.handleMembership)
+	for i := 0; i < p.ip.NumInterfaces(); i++ {
+		p.ip.JoinGroup(AllPimRoutersGroup, p.ip.GetAddressForInterface(i))
+	}
+
+	go p.run()
+}
+
+func (p *PIM) Stop() {
+	p.lock.Lock()
+	p.running = false
+	p.neighbors = map[int]map[string]time.Time{}
+	p.entries = map[string]*pimEntry{}
+	p.lock.Unlock()
+
+	p.igmp.SetMembershipHandler(nil)
+	for i := 0; i < p.ip.NumInterfaces(); i++ {
+		p.ip.LeaveGroup(AllPimRoutersGroup, p.ip.GetAddressForInterface(i))
+	}
+}
+
+/*
+Changes the timers. The defaults are too long for most simulations.
+*/
+func (p *PIM) SetTimers(helloInterval time.Duration, pruneHoldtime time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.helloInterval = helloInterval
+	p.pruneHoldtime = pruneHoldtime
+}
+
+/*
+Returns the addresses of the routers heard from on the interface
+*/
+func (p *PIM) GetNeighbors(intfNum int) [][]byte {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var neighbors [][]byte
+	for addr := range p.neighbors[intfNum] {
+		neighbors = append(neighbors, []byte(addr))
+	}
+	sort.Slice(neighbors, func(i, j int) bool {
+		return bytes.Compare(neighbors[i], neighbors[j]) < 0
+	})
+	return neighbors
+}
+
+/*
+Returns the multicast forwarding table, ordered by group and source
+*/
+func (p *PIM) GetForwardingTable() []*MulticastRoute {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	var routes []*MulticastRoute
+	for _, entry := range p.entries {
+		route := &MulticastRoute{
+			Source:             entry.source,
+			Group:              entry.group,
+			IncomingInterface:  entry.incoming,
+			Upstream:           entry.upstream,
+			OutgoingInterfaces: p.getOutgoingInterfaces(entry, now),
+			UpstreamPruned:     entry.upstreamPruned,
+		}
+		for intfNum, until := range entry.pruned {
+			if until.After(now) {
+				route.PrunedInterfaces = append(route.PrunedInterfaces, intfNum)
+			}
+		}
+		sort.Ints(route.PrunedInterfaces)
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if c := bytes.Compare(routes[i].Group, routes[j].Group); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(routes[i].Source, routes[j].Source) < 0
+	})
+	return routes
+}
+
+/*
+Internal methods
+*/
+func (p *PIM) isRunning() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.running
+}
+
+func (p *PIM) run() {
+	var nextHello time.Time
+	for p.isRunning() {
+		now := time.Now()
+		var outgoing []*pimPacket
+
+		p.lock.Lock()
+		if now.After(nextHello) {
+			for i := 0; i < p.ip.NumInterfaces(); i++ {
+				outgoing = append(outgoing, p.createHello(i))
+			}
+			nextHello = now.Add(p.helloInterval)
+		}
+		outgoing = append(outgoing, p.expire(now)...)
+		p.lock.Unlock()
+
+		p.send(outgoing)
+		time.Sleep(pollInterval)
+	}
+}
+
+/*
+Called by IGMP when a network gets its first listener for a group, or loses its last one
+*/
+func (p *PIM) handleMembership(intfNum int, group []byte, hasListeners bool) {
+	p.lock.Lock()
+	var outgoing []*pimPacket
+	now := time.Now()
+	for _, entry := range p.entries {
+		if bytes.Equal(entry.group, group) {
+			outgoing = append(outgoing, p.updateUpstream(entry, now)...)
+		}
+	}
+	p.lock.Unlock()
+
+	p.send(outgoing)
+}
+
+/*
+Expects the lock to be held
+*/
+func (p *PIM) handleHello(intfNum int, srcAddr []byte, body []byte) []*pimPacket {
+	if len(body) < 4 {
+		return nil
+	}
+
+	holdtime := time.Duration(binary.BigEndian.Uint32(body[0:4])) * time.Millisecond
+	if p.neighbors[intfNum] == nil {
+		p.neighbors[intfNum] = map[string]time.Time{}
+	}
+	_, found := p.neighbors[intfNum][string(srcAddr)]
+	p.neighbors[intfNum][string(srcAddr)] = time.Now().Add(holdtime)
+	if found {
+		return nil
+	}
+
+	//A new neighbour may want the traffic of the sources which have been pruned
+	log.Printf("PIM: Neighbour %v is up on interface %d", srcAddr, intfNum)
+	var outgoing []*pimPacket
+	for _, entry := range p.entries {
+		outgoing = append(outgoing, p.updateUpstream(entry, time.Now())...)
+	}
+	return outgoing
+}
+
+/*
+Expects the lock to be held
+*/
+func (p *PIM) handleJoinPrune(intfNum int, body []byte) []*pimPacket {
+	if len(body) < pimJoinPruneLength {
+		return nil
+	}
+
+	upstream := body[0:4]
+	holdtime := time.Duration(binary.BigEndian.Uint32(body[4:8])) * time.Millisecond
+	isPrune := body[16] == 1
+	entry, found := p.entries[pimEntryKey(body[8:12], body[12:16])]
+	if !found {
+		return nil
+	}
+
+	now := time.Now()
+
+	//Another router on the link prunes the source from the upstream router. Override it if we still want the traffic.
+	if !bytes.Equal(upstream, p.ip.GetAddressForInterface(intfNum)) {
+		if isPrune && entry.incoming == intfNum && bytes.Equal(entry.upstream, upstream) && len(p.getOutgoingInterfaces(entry, now)) > 0 {
+			return []*pimPacket{p.createJoinPrune(entry, false)}
+		}
+		return nil
+	}
+
+	if !isPrune {
+		delete(entry.pendingPrunes, intfNum)
+		delete(entry.pruned, intfNum)
+		return nil
+	}
+
+	//Other routers on the link get a chance to override the Prune
+	if len(p.neighbors[intfNum]) > 1 {
+		if _, pending := entry.pendingPrunes[intfNum]; !pending {
+			entry.pendingPrunes[intfNum] = &pimPendingPrune{at: now.Add(pimPruneOverrideDelay), holdtime: holdtime}
+		}
+		return nil
+	}
+
+	entry.pruned[intfNum] = now.Add(holdtime)
+	return p.updateUpstream(entry, now)
+}
+
+/*
+Expects the lock to be held
+*/
+func (p *PIM) handleGraft(intfNum int, srcAddr []byte, body []byte) []*pimPacket {
+	if len(body) < pimGraftLength {
+		return nil
+	}
+
+	//The Graft is always acknowledged, even if there is no state for it
+	outgoing := []*pimPacket{{
+		intfNum:  intfNum,
+		destAddr: append([]byte{}, srcAddr...),
+		data:     createPimPacket(pimGraftAck, body[0:pimGraftLength]),
+	}}
+
+	entry, found := p.entries[pimEntryKey(body[0:4], body[4:8])]
+	if !found {
+		return outgoing
+	}
+
+	log.Printf("PIM: Grafting interface %d for source %v group %v", intfNum, entry.source, entry.group)
+	delete(entry.pruned, intfNum)
+	delete(entry.pendingPrunes, intfNum)
+	return append(outgoing, p.updateUpstream(entry, time.Now())...)
+}
+
+/*
+Expects the lock to be held
+*/
+func (p *PIM) handleGraftAck(body []byte) {
+	if len(body) < pimGraftLength {
+		return
+	}
+
+	if entry, found := p.entries[pimEntryKey(body[0:4], body[4:8])]; found {
+		entry.graftRetryAt = time.Time{}
+	}
+}
+
+/*
+Applies the Prunes which were not overridden, lets the ones whose holdtime is over expire, resends the Grafts which were
+not acknowledged, and takes out the neighbours and forwarding state which went quiet. Expects the lock to be held.
+*/
+func (p *PIM) expire(now time.Time) []*pimPacket {
+	var outgoing []*pimPacket
+	for _, neighbors := range p.neighbors {
+		for addr, expiresAt := range neighbors {
+			if expiresAt.Before(now) {
+				log.Printf("PIM: Neighbour %v is down", []byte(addr))
+				delete(neighbors, addr)
+			}
+		}
+	}
+
+	for key, entry := range p.entries {
+		if entry.expiresAt.Before(now) {
+			delete(p.entries, key)
+			continue
+		}
+
+		changed := false
+		for intfNum, pending := range entry.pendingPrunes {
+			if pending.at.Before(now) {
+				entry.pruned[intfNum] = now.Add(pending.holdtime)
+				delete(entry.pendingPrunes, intfNum)
+				changed = true
+			}
+		}
+		for intfNum, until := range entry.pruned {
+			if until.Before(now) {
+				delete(entry.pruned, intfNum)
+			}
+		}
+
+		//The upstream router floods the traffic again once its Prune expires
+		if entry.upstreamPruned && now.Sub(entry.prunedAt) > p.pruneHoldtime {
+			entry.upstreamPruned = false
+		}
+
+		if changed {
+			outgoing = append(outgoing, p.updateUpstream(entry, now)...)
+		}
+		if !entry.graftRetryAt.IsZero() && entry.graftRetryAt.Before(now) {
+			outgoing = append(outgoing, p.graft(entry, now))
+		}
+	}
+	return outgoing
+}
+
+/*
+Returns the forwarding state of the source and group, creating it if needed. Returns nil if there is no route to the
+source. Expects the lock to be held.
+*/
+func (p *PIM) getEntry(srcAddr []byte, group []byte) *pimEntry {
+	key := pimEntryKey(srcAddr, group)
+	if entry, found := p.entries[key]; found {
+		return entry
+	}
+
+	incoming := p.routeProvider.GetInterfaceForAddress(srcAddr)
+	if incoming < 0 {
+		return nil
+	}
+
+	entry := &pimEntry{
+		source:        append([]byte{}, srcAddr...),
+		group:         append([]byte{}, group...),
+		incoming:      incoming,
+		upstream:      p.routeProvider.GetGatewayForAddress(srcAddr),
+		pruned:        map[int]time.Time{},
+		pendingPrunes: map[int]*pimPendingPrune{},
+		expiresAt:     time.Now().Add(pimDataTimeout),
+	}
+	p.entries[key] = entry
+	log.Printf("PIM: New source %v for group %v on interface %d", srcAddr, group, incoming)
+	return entry
+}
+
+/*
+The traffic is forwarded to the neighbouring routers which have not pruned it, and to the networks with listeners.
+Expects the lock to be held.
+*/
+func (p *PIM) getOutgoingInterfaces(entry *pimEntry, now time.Time) []int {
+	var intfNums []int
+	for i := 0; i < p.ip.NumInterfaces(); i++ {
+		if i == entry.incoming {
+			continue
+		}
+
+		until, isPruned := entry.pruned[i]
+		hasRouters := len(p.neighbors[i]) > 0 && (!isPruned || until.Before(now))
+		if hasRouters || p.igmp.HasListeners(i, entry.group) {
+			intfNums = append(intfNums, i)
+		}
+	}
+	return intfNums
+}
+
+/*
+Prunes the source from the upstream router when no one wants its traffic anymore, and grafts it back when someone does.
+Expects the lock to be held.
+*/
+func (p *PIM) updateUpstream(entry *pimEntry, now time.Time) []*pimPacket {
+	if entry.upstream == nil {
+		return nil
+	}
+
+	isWanted := len(p.getOutgoingInterfaces(entry, now)) > 0
+	if !isWanted && !entry.upstreamPruned {
+		return []*pimPacket{p.prune(entry, now)}
+	}
+	if isWanted && entry.upstreamPruned {
+		return []*pimPacket{p.graft(entry, now)}
+	}
+	return nil
+}
+
+/*
+Expects the lock to be held
+*/
+func (p *PIM) prune(entry *pimEntry, now time.Time) *pimPacket {
+	log.Printf("PIM: Pruning source %v group %v from %v", entry.source, entry.group, entry.upstream)
+	entry.upstreamPruned = true
+	entry.prunedAt = now
+	entry.graftRetryAt = time.Time{}
+	return p.createJoinPrune(entry, true)
+}
+
+/*
+Expects the lock to be held
+*/
+func (p *PIM) graft(entry *pimEntry, now time.Time) *pimPacket {
+	log.Printf("PIM: Grafting source %v group %v to %v", entry.source, entry.group, entry.upstream)
+	entry.upstreamPruned = false
+	entry.graftRetryAt = now.Add(pimGraftRetryInterval)
+
+	body := append(append([]byte{}, entry.source...), entry.group...)
+	return &pimPacket{intfNum: entry.incoming, destAddr: entry.upstream, data: createPimPacket(pimGraft, body)}
+}
+
+/*
+Expects the lock to be held
+*/
+func (p *PIM) createJoinPrune(entry *pimEntry, isPrune bool) *pimPacket {
+	body := make([]byte, pimJoinPruneLength)
+	copy(body[0:4], entry.upstream)
+	binary.BigEndian.PutUint32(body[4:8], uint32(p.pruneHoldtime/time.Millisecond))
+	copy(body[8:12], entry.source)
+	copy(body[12:16], entry.group)
+	if isPrune {
+		body[16] = 1
+	}
+	return &pimPacket{intfNum: entry.incoming, destAddr: AllPimRoutersGroup, data: createPimPacket(pimJoinPrune, body)}
+}
+
+/*
+Expects the lock to be held
+*/
+func (p *PIM) createHello(intfNum int) *pimPacket {
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, uint32(float64(p.helloInterval/time.Millisecond)*pimHoldtimeFactor))
+	return &pimPacket{intfNum: intfNum, destAddr: AllPimRoutersGroup, data: createPimPacket(pimHello, body)}
+}
+
+/*
+Sends the packets. Must be called without the lock held.
+*/
+func (p *PIM) send(packets []*pimPacket) {
+	for _, packet := range packets {
+		if p.ip.GetL2ProtocolForInterface(packet.intfNum) != nil {
+			p.ip.SendDownOnInterface(packet.intfNum, packet.data, packet.destAddr, []byte{0, pimTTL}, p)
+		}
+	}
+}
+
+func createPimPacket(packetType byte, body []byte) []byte {
+	packet := append([]byte{packetType, 0}, body...)
+	packet[1] = utils.CalculateChecksum(packet)[0]
+	return packet
+}
+
+func pimEntryKey(srcAddr []byte, group []byte) string {
+	return string(srcAddr) + string(group)
+}
+
+/*
+Forwarding state of a source and group
+*/
+type pimEntry struct {
+	source         []byte
+	group          []byte
+	incoming       int
+	upstream       []byte
+	pruned         map[int]time.Time
+	pendingPrunes  map[int]*pimPendingPrune
+	upstreamPruned bool
+	prunedAt       time.Time
+	graftRetryAt   time.Time
+	expiresAt      time.Time
+}
+
+/*
+A Prune received on a link with other routers, which is applied unless one of them overrides it in time
+*/
+type pimPendingPrune struct {
+	at       time.Time
+	holdtime time.Duration
+}
+
+type pimPacket struct {
+	intfNum  int
+	destAddr []byte
+	data     []byte
+}
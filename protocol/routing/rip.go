@@ -0,0 +1,492 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"netsim/protocol/l4"
+	"sync"
+	"time"
+)
+
+/*
+RIP is a distance vector routing protocol. Every router tells its neighbours about all the networks it can reach and how
+many hops away they are, and the neighbours pick the shortest path they hear of. Updates are sent every 30 seconds to
+the broadcast address of every interface RIP runs on. A route which is not heard of again for 180 seconds times out. It
+is then advertised as unreachable, with a metric of 16, for another 120 seconds before it is forgotten.
+
+Since a router only knows what its neighbours tell it, two routers can keep telling each other about a network which is
+gone, counting up the metric each time. This is limited by treating 16 as infinity, and made less likely by never
+advertising a route back on the interface it was learnt from, except as unreachable (split horizon with poisoned
+reverse), and by telling the neighbours about changes right away instead of waiting for the next update (triggered
+updates).
+
+RIP runs on the interfaces having an address in one of the configured networks, and the configured networks are the
+ones it advertises as directly connected, with a metric of 1.
+
+Message Format (RIPv2):
+
+Command		- 1 byte
+Version		- 1 byte
+Zero		- 2 bytes
+Entries		- 20 bytes each, up to 25
+	AFI			- 2 bytes
+	Route Tag	- 2 bytes
+	Address		- 4 bytes
+	Mask		- 4 bytes
+	Next Hop	- 4 bytes
+	Metric		- 4 bytes
+*/
+const (
+	RipPort     = 520
+	DistanceRip = 120
+)
+
+const (
+	ripRequest            = 1
+	ripResponse           = 2
+	ripVersion            = 2
+	ripAfiInet            = 2
+	ripHeaderLength       = 4
+	ripEntryLength        = 20
+	ripMaxEntries         = 25
+	ripInfinity           = 16
+	ripUpdateInterval     = 30 * time.Second
+	ripTimeout            = 180 * time.Second
+	ripGarbageCollectTime = 120 * time.Second
+)
+
+type RIP struct {
+	host           Host
+	ip             *l3.IP
+	table          *l3.RoutingTable
+	networks       []*protocol.CIDR
+	interfaces     map[int]*protocol.CIDR
+	binding        *l4.UdpBinding
+	routes         map[string]*ripRoute
+	updateInterval time.Duration
+	timeout        time.Duration
+	garbageTime    time.Duration
+	triggered      bool
+	running        bool
+	lock           sync.Mutex
+}
+
+/*
+Constructor
+*/
+func NewRIP(host Host, table *l3.RoutingTable, networks []*protocol.CIDR) *RIP {
+	return &RIP{
+		host:           host,
+		ip:             host.GetL3Protocol().(*l3.IP),
+		table:          table,
+		networks:       networks,
+		routes:         map[string]*ripRoute{},
+		updateInterval: ripUpdateInterval,
+		timeout:        ripTimeout,
+		garbageTime:    ripGarbageCollectTime,
+	}
+}
+
+/*
+RIP public API
+*/
+func (r *RIP) Start() {
+	r.binding = r.host.GetUDP().Bind([]byte{0, 0, 0, 0}, RipPort, protocol.IP)
+	if r.binding == nil {
+		return
+	}
+
+	//The configured networks are directly connected
+	r.interfaces = interfacesInNetworks(r.ip, r.networks)
+	r.lock.Lock()
+	for intfNum, network := range r.interfaces {
+		route := &ripRoute{cidr: network, intf: intfNum, metric: 1, connected: true}
+		r.routes[cidrKey(network)] = route
+		r.table.AddRoute(&l3.Route{Cidr: network, Interface: intfNum, Distance: l3.DistanceConnected})
+	}
+	r.lock.Unlock()
+
+	r.setRunning(true)
+	go r.run()
+}
+
+/*
+Stopping tells the neighbours that the routes through this router are gone, and takes the learnt routes out of the table
+*/
+func (r *RIP) Stop() {
+	r.setRunning(false)
+
+	r.lock.Lock()
+	for _, route := range r.routes {
+		route.metric = ripInfinity
+		route.changed = true
+	}
+	r.lock.Unlock()
+	r.sendUpdates(true)
+
+	r.lock.Lock()
+	for key, route := range r.routes {
+		if route.connected {
+			r.table.RemoveRoute(&l3.Route{Cidr: route.cidr, Interface: route.intf, Distance: l3.DistanceConnected})
+		} else {
+			r.uninstall(route)
+		}
+		delete(r.routes, key)
+	}
+	r.lock.Unlock()
+
+	if r.binding != nil {
+		r.binding.Close()
+	}
+}
+
+/*
+Changes the timers. The defaults are too long for most simulations.
+*/
+func (r *RIP) SetTimers(updateInterval time.Duration, timeout time.Duration, garbageTime time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.updateInterval = updateInterval
+	r.timeout = timeout
+	r.garbageTime = garbageTime
+}
+
+/*
+Returns the reachable routes known to RIP, including the directly connected networks
+*/
+func (r *RIP) GetRoutes() []*l3.Route {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var routes []*l3.Route
+	for _, route := range r.routes {
+		if route.metric < ripInfinity {
+			routes = append(routes, route.toRoute())
+		}
+	}
+	return routes
+}
+
+/*
+Internal methods
+*/
+func (r *RIP) setRunning(running bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.running = running
+}
+
+func (r *RIP) isRunning() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.running
+}
+
+func (r *RIP) run() {
+	//Ask the neighbours for their routes instead of waiting for their next update
+	for intfNum := range r.interfaces {
+		request := encodeRipMessage(ripRequest, []*ripEntry{{metric: ripInfinity}})
+		sendUdp(r.host.GetUDP(), request[0], l3.BroadcastAddress, RipPort, RipPort, intfNum)
+	}
+
+	var nextUpdate time.Time
+	for r.isRunning() {
+		data, srcAddr, srcPort, intfNum := r.binding.RecvFrom()
+		if data != nil {
+			r.handle(data, srcAddr, srcPort, intfNum)
+			continue
+		}
+
+		now := time.Now()
+		if now.After(nextUpdate) {
+			r.sendUpdates(false)
+			r.lock.Lock()
+			nextUpdate = now.Add(r.updateInterval)
+			r.lock.Unlock()
+		}
+
+		r.expire(now)
+		if r.isTriggered() {
+			r.sendUpdates(true)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func (r *RIP) handle(data []byte, srcAddr []byte, srcPort uint16, intfNum int) {
+	if _, found := r.interfaces[intfNum]; !found {
+		return
+	}
+	if len(data) < ripHeaderLength || data[1] != ripVersion {
+		log.Printf("RIP: Got invalid message. Dropping.")
+		return
+	}
+
+	entries := decodeRipEntries(data[ripHeaderLength:])
+	switch data[0] {
+	case ripRequest:
+		//A request for the whole table is answered directly to the router asking
+		if len(entries) == 1 && entries[0].afi == 0 && entries[0].metric == ripInfinity {
+			for _, m := range encodeRipMessage(ripResponse, r.entriesForInterface(intfNum, false)) {
+				sendUdp(r.host.GetUDP(), m, srcAddr, srcPort, RipPort, intfNum)
+			}
+		}
+	case ripResponse:
+		if srcPort != RipPort || bytes.Equal(srcAddr, r.ip.GetAddressForInterface(intfNum)) {
+			return
+		}
+		for _, e := range entries {
+			if e.afi == ripAfiInet {
+				r.learn(e, srcAddr, intfNum)
+			}
+		}
+	}
+}
+
+/*
+Updates the route to the network in the entry, if the neighbour offers a better path, or if it is the neighbour the
+current path goes through
+*/
+func (r *RIP) learn(e *ripEntry, srcAddr []byte, intfNum int) {
+	if e.metric < 1 || e.metric > ripInfinity {
+		return
+	}
+	metric := e.metric + 1
+	if metric > ripInfinity {
+		metric = ripInfinity
+	}
+	gateway := srcAddr
+	if !isUnspecifiedAddr(e.nextHop) && r.interfaces[intfNum].Contains(e.nextHop) {
+		gateway = e.nextHop
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	cidr := &protocol.CIDR{Address: e.address, Mask: e.mask}
+	existing, found := r.routes[cidrKey(cidr)]
+	switch {
+	case !found:
+		if metric == ripInfinity {
+			return
+		}
+		route := &ripRoute{cidr: cidr, nextHop: gateway, intf: intfNum, metric: metric, updatedAt: time.Now()}
+		r.routes[cidrKey(cidr)] = route
+		r.install(route)
+	case existing.connected:
+		return
+	case existing.intf == intfNum && bytes.Equal(existing.nextHop, gateway):
+		if metric == ripInfinity {
+			if existing.metric != ripInfinity {
+				r.invalidate(existing)
+			}
+			return
+		}
+		existing.updatedAt = time.Now()
+		if metric != existing.metric {
+			existing.metric = metric
+			existing.deletedAt = time.Time{}
+			r.install(existing)
+		}
+	case metric < existing.metric:
+		existing.nextHop = gateway
+		existing.intf = intfNum
+		existing.metric = metric
+		existing.updatedAt = time.Now()
+		existing.deletedAt = time.Time{}
+		r.install(existing)
+	}
+}
+
+/*
+Times out the routes not heard of for a while, and forgets the ones which have been unreachable for a while
+*/
+func (r *RIP) expire(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for key, route := range r.routes {
+		if route.connected {
+			continue
+		}
+		if route.deletedAt.IsZero() && now.Sub(route.updatedAt) > r.timeout {
+			log.Printf("RIP: Route to %v/%d timed out", route.cidr.Address, route.cidr.Mask)
+			r.invalidate(route)
+		} else if !route.deletedAt.IsZero() && now.Sub(route.deletedAt) > r.garbageTime {
+			delete(r.routes, key)
+		}
+	}
+}
+
+/*
+Expects the lock to be held
+*/
+func (r *RIP) install(route *ripRoute) {
+	r.table.ReplaceRoute(route.toRoute())
+	route.changed = true
+	r.triggered = true
+}
+
+/*
+Expects the lock to be held
+*/
+func (r *RIP) uninstall(route *ripRoute) {
+	r.table.RemoveRoute(route.toRoute())
+}
+
+/*
+Expects the lock to be held
+*/
+func (r *RIP) invalidate(route *ripRoute) {
+	r.uninstall(route)
+	route.metric = ripInfinity
+	route.deletedAt = time.Now()
+	route.changed = true
+	r.triggered = true
+}
+
+func (r *RIP) isTriggered() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.triggered
+}
+
+/*
+Sends the routes out of every interface. A triggered update has only the routes which changed since the last one.
+*/
+func (r *RIP) sendUpdates(triggered bool) {
+	for intfNum := range r.interfaces {
+		for _, m := range encodeRipMessage(ripResponse, r.entriesForInterface(intfNum, triggered)) {
+			sendUdp(r.host.GetUDP(), m, l3.BroadcastAddress, RipPort, RipPort, intfNum)
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.triggered = false
+	for _, route := range r.routes {
+		route.changed = false
+	}
+}
+
+/*
+Routes learnt on the interface are advertised back on it as unreachable, so that the neighbour never uses this router to
+reach them
+*/
+func (r *RIP) entriesForInterface(intfNum int, changedOnly bool) []*ripEntry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var entries []*ripEntry
+	for _, route := range r.routes {
+		if changedOnly && !route.changed {
+			continue
+		}
+
+		metric := route.metric
+		if !route.connected && route.intf == intfNum {
+			metric = ripInfinity
+		}
+		entries = append(entries, &ripEntry{
+			afi:     ripAfiInet,
+			address: route.cidr.Address,
+			mask:    route.cidr.Mask,
+			nextHop: []byte{0, 0, 0, 0},
+			metric:  metric,
+		})
+	}
+	return entries
+}
+
+/*
+Splits the entries in as many messages as needed
+*/
+func encodeRipMessage(command byte, entries []*ripEntry) [][]byte {
+	var messages [][]byte
+	for start := 0; start < len(entries); start += ripMaxEntries {
+		end := start + ripMaxEntries
+		if end > len(entries) {
+			end = len(entries)
+		}
+
+		m := []byte{command, ripVersion, 0, 0}
+		for _, e := range entries[start:end] {
+			m = append(m, e.encode()...)
+		}
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+func decodeRipEntries(data []byte) []*ripEntry {
+	var entries []*ripEntry
+	for i := 0; i+ripEntryLength <= len(data); i += ripEntryLength {
+		e := data[i : i+ripEntryLength]
+		entries = append(entries, &ripEntry{
+			afi:     binary.BigEndian.Uint16(e[0:2]),
+			address: append([]byte{}, e[4:8]...),
+			mask:    protocol.BytesToMask(e[8:12]),
+			nextHop: append([]byte{}, e[12:16]...),
+			metric:  int(binary.BigEndian.Uint32(e[16:20])),
+		})
+	}
+	return entries
+}
+
+func isUnspecifiedAddr(addr []byte) bool {
+	return bytes.Equal(addr, []byte{0, 0, 0, 0})
+}
+
+// Internal structs
+type ripRoute struct {
+	cidr      *protocol.CIDR
+	nextHop   []byte
+	intf      int
+	metric    int
+	connected bool
+	changed   bool
+	updatedAt time.Time
+	deletedAt time.Time
+}
+
+func (r *ripRoute) toRoute() *l3.Route {
+	distance := DistanceRip
+	if r.connected {
+		distance = l3.DistanceConnected
+	}
+	return &l3.Route{
+		Cidr:      r.cidr,
+		Gateway:   r.nextHop,
+		Interface: r.intf,
+		Metric:    r.metric,
+		Distance:  distance,
+	}
+}
+
+type ripEntry struct {
+	afi     uint16
+	address []byte
+	mask    int
+	nextHop []byte
+	metric  int
+}
+
+func (e *ripEntry) encode() []byte {
+	b := make([]byte, ripEntryLength)
+	binary.BigEndian.PutUint16(b[0:2], e.afi)
+	if e.address != nil {
+		copy(b[4:8], e.address)
+		copy(b[8:12], protocol.MaskToBytes(e.mask))
+		copy(b[12:16], e.nextHop)
+	}
+	binary.BigEndian.PutUint32(b[16:20], uint32(e.metric))
+	return b
+}
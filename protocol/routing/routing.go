@@ -0,0 +1,61 @@
+package routing
+
+import (
+	"encoding/binary"
+	"netsim/protocol"
+	"netsim/protocol/l3"
+	"netsim/protocol/l4"
+	"time"
+)
+
+/*
+Routing protocols run on routers and learn the routes to networks which are not directly connected by talking to the
+neighbouring routers. The routes they learn are put in the routing table of the router, with the administrative distance
+of the protocol, so that the table can pick between the routes learnt in different ways.
+*/
+const (
+	pollInterval = 20 * time.Millisecond
+)
+
+/*
+The device a routing protocol runs on
+*/
+type Host interface {
+	GetUDP() *l4.UDP
+	GetL3Protocol() protocol.L3Protocol
+}
+
+/*
+Internal methods
+*/
+func sendUdp(udp *l4.UDP, data []byte, destAddr []byte, destPort uint16, srcPort uint16, intfNum int) {
+	metadata := make([]byte, 4)
+	binary.BigEndian.PutUint16(metadata[0:2], destPort)
+	binary.BigEndian.PutUint16(metadata[2:4], srcPort)
+	metadata = append(metadata, protocol.IP...)
+	if intfNum >= 0 {
+		metadata = append(metadata, byte(intfNum))
+	}
+
+	udp.SendDown(data, destAddr, metadata, nil)
+}
+
+/*
+Returns the interfaces of the host which have an address in one of the networks, mapped to the network
+*/
+func interfacesInNetworks(ip *l3.IP, networks []*protocol.CIDR) map[int]*protocol.CIDR {
+	interfaces := map[int]*protocol.CIDR{}
+	for i := 0; i < ip.NumInterfaces(); i++ {
+		for _, n := range networks {
+			if n.Contains(ip.GetAddressForInterface(i)) {
+				interfaces[i] = n
+				break
+			}
+		}
+	}
+	return interfaces
+}
+
+func cidrKey(cidr *protocol.CIDR) string {
+	return string(cidr.Address) + string(rune(cidr.Mask))
+}
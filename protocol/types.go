@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"encoding/binary"
 	"netsim/hardware"
 )
 
@@ -38,6 +39,57 @@ type L4Protocol interface {
 	AddL3Protocol(L3Protocol)
 }
 
+/*
+Implemented by L3 protocols which let the sender choose the interface a packet leaves from. Needed when there is no
+route to use, like when a host without an address broadcasts to find one.
+*/
+type InterfaceSender interface {
+	SendDownOnInterface(intfNum int, data []byte, destAddr []byte, metadata []byte, sender Protocol)
+}
+
+/*
+Implemented by L3 protocols which can tell the sender of a packet that it could not be delivered. The data and metadata
+are the ones the L4 protocol got for the packet.
+*/
+type ErrorReporter interface {
+	ReportError(err error, data []byte, metadata []byte, sender Protocol)
+}
+
+/*
+Implemented by L4 protocols which want to know that a packet they sent could not be delivered. The data is the beginning
+of the packet as it was sent and the metadata has the source and destination addresses.
+*/
+type ErrorConsumer interface {
+	ConsumeError(err error, data []byte, metadata []byte)
+}
+
+/*
+Implemented by L3 protocols which know the largest packet that can reach a destination without being fragmented. L4
+protocols use it to size the packets they send, and report destinations to which packets of that size never arrive.
+*/
+type PathMTUProvider interface {
+	GetPathMTU(destAddr []byte) int
+	ReportBlackHole(destAddr []byte)
+}
+
+/*
+Implemented by L3 protocols which can receive packets sent to multicast groups. Groups are joined on the interface with
+the given address, or on the one the group is routed through if the address is nil. Every join has to be matched by a
+leave, since the interface stays in the group while anyone on the host wants it.
+*/
+type GroupMembership interface {
+	JoinGroup(group []byte, intfAddr []byte)
+	LeaveGroup(group []byte, intfAddr []byte)
+}
+
+/*
+Implemented by multicast routing protocols. Routers ask for the interfaces a packet sent by the source to the group has to
+be forwarded out of, given the interface it arrived on.
+*/
+type MulticastRouter interface {
+	GetOutgoingInterfaces(srcAddr []byte, group []byte, intfNum int) []int
+}
+
 type RouteProvider interface {
 	GetGatewayForAddress([]byte) []byte
 	GetInterfaceForAddress([]byte) int
@@ -47,7 +99,58 @@ type AddressResolver interface {
 	Resolve([]byte) []byte
 }
 
+/*
+A resolver which may need to ask the network. The callback is invoked once the address is resolved, or with nil if it
+cannot be resolved.
+*/
+type DynamicAddressResolver interface {
+	AddressResolver
+	Request(addr []byte, intfNum int, onResolved func([]byte))
+}
+
 type CIDR struct {
 	Address []byte
 	Mask    int
 }
+
+/*
+Tells whether the address is in the network. Addresses of another family are never in it.
+*/
+func (c *CIDR) Contains(addr []byte) bool {
+	if len(addr) != len(c.Address) || c.Mask < 0 || c.Mask > len(addr)*8 {
+		return false
+	}
+
+	for i := 0; i*8 < c.Mask; i++ {
+		mask := byte(0xff)
+		if bits := c.Mask - i*8; bits < 8 {
+			mask = byte(0xff << uint(8-bits))
+		}
+		if addr[i]&mask != c.Address[i]&mask {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Conversions between the length of an IPv4 mask and the mask itself, as carried by DHCP, RIP and OSPF
+*/
+func MaskToBytes(mask int) []byte {
+	m := uint32(0)
+	if mask > 0 {
+		m = ^uint32(0) << uint(32-mask)
+	}
+
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, m)
+	return b
+}
+
+func BytesToMask(b []byte) int {
+	mask := 0
+	for m := binary.BigEndian.Uint32(b); m&0x80000000 != 0; m <<= 1 {
+		mask++
+	}
+	return mask
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCidrContains(t *testing.T) {
+	tests := []struct {
+		cidr     *CIDR
+		addr     []byte
+		contains bool
+	}{
+		{&CIDR{Address: []byte{10, 1, 0, 0}, Mask: 16}, []byte{10, 1, 200, 3}, true},
+		{&CIDR{Address: []byte{10, 1, 0, 0}, Mask: 16}, []byte{10, 2, 0, 1}, false},
+		{&CIDR{Address: []byte{10, 1, 3, 64}, Mask: 27}, []byte{10, 1, 3, 95}, true},
+		{&CIDR{Address: []byte{10, 1, 3, 64}, Mask: 27}, []byte{10, 1, 3, 96}, false},
+		{&CIDR{Address: []byte{10, 1, 3, 77}, Mask: 32}, []byte{10, 1, 3, 77}, true},
+		{DefaultRouteCidr, []byte{8, 8, 8, 8}, true},
+		{DefaultRouteCidr, make([]byte, 16), false},
+		{&CIDR{Address: []byte{0xfd, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Mask: 64}, []byte{0xfd, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 9}, true},
+		{&CIDR{Address: []byte{10, 1, 3, 0}, Mask: 40}, []byte{10, 1, 3, 0}, false},
+	}
+
+	for _, test := range tests {
+		if test.cidr.Contains(test.addr) != test.contains {
+			t.Errorf("Expected %v/%d to contain %v to be %v", test.cidr.Address, test.cidr.Mask, test.addr, test.contains)
+		}
+	}
+
+	for _, mask := range []int{0, 1, 17, 24, 32} {
+		if BytesToMask(MaskToBytes(mask)) != mask {
+			t.Errorf("Expected mask /%d to survive the conversion", mask)
+		}
+	}
+	if !bytes.Equal(MaskToBytes(20), []byte{255, 255, 240, 0}) {
+		t.Errorf("Expected /20 to be 255.255.240.0 but got %v", MaskToBytes(20))
+	}
+}
@@ -15,3 +15,22 @@ func CalculateChecksum(data []byte) []byte {
 
 	return checksum
 }
+
+/*
+The checksum used by the protocols of the internet. It is the one's complement of the one's complement sum of the data
+taken as 16 bit words, hence a header which has its checksum filled in sums up to 0.
+*/
+func CalculateInternetChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+TokenBucket is a rate limiter. Tokens are added at a fixed rate per second up to the size of the bucket, and an event is
+allowed only if enough tokens are available for it.
+*/
+type TokenBucket struct {
+	rate       float64
+	size       float64
+	tokens     float64
+	lastRefill time.Time
+	lock       sync.Mutex
+}
+
+func NewTokenBucket(rate float64, size float64) *TokenBucket {
+	return &TokenBucket{
+		rate:       rate,
+		size:       size,
+		tokens:     size,
+		lastRefill: time.Now(),
+	}
+}
+
+func (t *TokenBucket) Take(tokens float64) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	t.tokens += now.Sub(t.lastRefill).Seconds() * t.rate
+	if t.tokens > t.size {
+		t.tokens = t.size
+	}
+	t.lastRefill = now
+
+	if t.tokens < tokens {
+		return false
+	}
+
+	t.tokens -= tokens
+	return true
+}